@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/go-redis/redis"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+Recent item changes of each user are kept in a Redis stream, to be replayed and tailed by clients.
+Unlike cache, the stream is not prefixed by the epoch, as it's not derived from Spanner and a new revision should see the same one.
+*/
+const (
+	activityMaxLen = 100
+	activityTTL    = seqKeyTTL
+)
+
+// Activity is a change with the id of the stream entry, which is given back to read the later ones
+type Activity struct {
+	ID     string
+	Change domain.ItemChanged
+}
+
+var activityIDRe = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+// ValidActivityID tells if id can be given to UserActivity, "0" is the oldest
+func ValidActivityID(id string) bool {
+	return activityIDRe.MatchString(id)
+}
+
+func activityKey(userID string) string {
+	return fmt.Sprintf("UserActivity_%s", userID)
+}
+
+// AppendActivity adds the change to the stream of the user, the stream is trimmed to about the last activityMaxLen entries
+func (c *Caching) AppendActivity(e domain.ItemChanged) error {
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	key := activityKey(e.UserID)
+	_, err = c.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(&redis.XAddArgs{
+			Stream:       key,
+			MaxLenApprox: activityMaxLen,
+			ID:           "*",
+			Values:       map[string]interface{}{"change": data},
+		})
+		pipe.Expire(key, activityTTL)
+		return nil
+	})
+	c.Health.Observe(err)
+	return err
+}
+
+/*
+UserActivity returns changes of the user after the id, without blocking.
+Polling it keeps no connection of the pool, which is shared with cache.
+*/
+func (c *Caching) UserActivity(userID, after string) ([]Activity, error) {
+	if !c.Health.Usable() {
+		return nil, errCacheDown
+	}
+	streams, err := c.RedisClient.XRead(&redis.XReadArgs{
+		Streams: []string{activityKey(userID), after},
+		Count:   activityMaxLen,
+		Block:   -1,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	c.Health.Observe(err)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []Activity{}
+	for _, stream := range streams {
+		for _, m := range stream.Messages {
+			data, _ := m.Values["change"].(string)
+			var e domain.ItemChanged
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return nil, fmt.Errorf("activity %s: %w", m.ID, err)
+			}
+			activities = append(activities, Activity{ID: m.ID, Change: e})
+		}
+	}
+	return activities, nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+/*
+APIKey identifies a client of the API by its name, like the one of a workshop attendee.
+The key is "<key_id>.<secret>", and only the sha256 of the secret is stored, it's shown just once when it's created.
+*/
+type APIKey struct {
+	ID        string     `json:"key_id"`
+	Name      string     `json:"name" validate:"required,max=64"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// what is cached for a key_id, the hash is enough to verify the secret without Spanner
+type cachedAPIKey struct {
+	Name       string `json:"name"`
+	SecretHash string `json:"secret_hash"`
+	Revoked    bool   `json:"revoked"`
+}
+
+func apiKeyCacheKey(keyID string) string {
+	return fmt.Sprintf("APIKey_%s", keyID)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey mints a key for the name, the returned key is the only place the secret is in plain
+func (d dbClient) CreateAPIKey(ctx context.Context, name string) (APIKey, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreateAPIKey")
+	defer span.End()
+
+	k := APIKey{ID: uuid.NewString(), Name: name}
+	if err := checkParams(k); err != nil {
+		return APIKey{}, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	resp, err := d.readWriteTransaction(ctx, "CreateAPIKey", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertMap("api_keys", map[string]interface{}{
+				"key_id":      k.ID,
+				"name":        k.Name,
+				"secret_hash": hashSecret(encoded),
+				"created_at":  spanner.CommitTimestamp,
+			}),
+		})
+	})
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	k.CreatedAt = resp.CommitTs
+	span.SetAttributes(attribute.String("apikey.id", k.ID))
+	return k, k.ID + "." + encoded, nil
+}
+
+// list keys in the order of creation, revoked ones are included
+func (d dbClient) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListAPIKeys")
+	defer span.End()
+
+	txn := d.Sc.Single()
+	defer txn.Close()
+	stmt := spanner.Statement{SQL: `SELECT key_id, name, created_at, revoked_at FROM api_keys ORDER BY created_at`}
+
+	keys := []APIKey{}
+	err := forEachRow(ctx, txn, "ListAPIKeys", stmt, func(row *spanner.Row) error {
+		var k APIKey
+		var revokedAt spanner.NullTime
+		if err := row.Columns(&k.ID, &k.Name, &k.CreatedAt, &revokedAt); err != nil {
+			return err
+		}
+		if revokedAt.Valid {
+			k.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	return keys, err
+}
+
+/*
+RevokeAPIKey makes the key invalid, NotFound if it doesn't exist.
+The row is kept to tell who had the key, and the cached entry is deleted if there's a cache, commands run without one, or it expires in seconds.
+*/
+func (d dbClient) RevokeAPIKey(ctx context.Context, keyID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RevokeAPIKey")
+	defer span.End()
+	span.SetAttributes(attribute.String("apikey.id", keyID))
+
+	_, err := d.readWriteTransaction(ctx, "RevokeAPIKey", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if _, err := txn.ReadRow(ctx, "api_keys", spanner.Key{keyID}, []string{"key_id"}); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.UpdateMap("api_keys", map[string]interface{}{
+				"key_id":     keyID,
+				"revoked_at": spanner.CommitTimestamp,
+			}),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if d.Cache == nil {
+		return nil
+	}
+	if err := d.Cache.Del(apiKeyCacheKey(keyID)); err != nil {
+		log.Println("RevokeAPIKey", keyID, err)
+	}
+	return nil
+}
+
+/*
+VerifyAPIKey returns the name of the key, ErrInvalidAPIKey if it's malformed, unknown, revoked or the secret doesn't match.
+The lookup is cached like UserItems, so a burst of requests with the same key doesn't go to Spanner each time.
+*/
+func (d dbClient) VerifyAPIKey(ctx context.Context, key string) (string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "VerifyAPIKey")
+	defer span.End()
+
+	keyID, secret, ok := strings.Cut(key, ".")
+	if !ok || secret == "" {
+		return "", ErrInvalidAPIKey
+	}
+	if err := validate.Var(keyID, "uuid4"); err != nil {
+		return "", ErrInvalidAPIKey
+	}
+	span.SetAttributes(attribute.String("apikey.id", keyID))
+
+	cached, err := d.apiKey(ctx, keyID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", ErrInvalidAPIKey
+	}
+	if err != nil {
+		return "", err
+	}
+	if cached.Revoked || subtle.ConstantTimeCompare([]byte(cached.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return "", ErrInvalidAPIKey
+	}
+	return cached.Name, nil
+}
+
+func (d dbClient) apiKey(ctx context.Context, keyID string) (cachedAPIKey, error) {
+	cacheKey := apiKeyCacheKey(keyID)
+	var cached cachedAPIKey
+
+	done := budget.Track(ctx, budget.Redis)
+	data, err := d.Cache.Get(cacheKey)
+	done()
+	if err == nil && json.Unmarshal([]byte(data), &cached) == nil {
+		countCacheLookup(ctx, "hit")
+		return cached, nil
+	}
+	countCacheLookup(ctx, "miss")
+
+	row, err := d.readRow(ctx, "api_keys", spanner.Key{keyID}, []string{"name", "secret_hash", "revoked_at"})
+	if err != nil {
+		return cached, err
+	}
+	var revokedAt spanner.NullTime
+	if err := row.Columns(&cached.Name, &cached.SecretHash, &revokedAt); err != nil {
+		return cached, err
+	}
+	cached.Revoked = revokedAt.Valid
+
+	// caching is best effort, errors are just logged
+	if data, err := json.Marshal(cached); err == nil {
+		defer budget.Track(ctx, budget.Redis)()
+		if err := d.Cache.Set(cacheKey, string(data)); err != nil {
+			log.Println("VerifyAPIKey", keyID, err)
+		}
+	}
+	return cached, nil
+}
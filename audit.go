@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+)
+
+// actions recorded in the audit of a user
+const (
+	AuditCreateUser = "create_user"
+	AuditUpdateUser = "update_user"
+	AuditAddItem    = "add_item"
+	AuditAddItems   = "add_items"
+	AuditRemoveItem = "remove_item"
+	AuditMergeUser  = "merge_user"
+)
+
+/*
+Actor is who makes the mutations of a request, recorded with them in the audit of the user.
+It's zero for mutations out of requests, like of commands.
+*/
+type Actor struct {
+	Caller    string
+	ActingAs  string
+	RequestID string
+}
+
+type actorKey struct{}
+
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+func actorFromContext(ctx context.Context) Actor {
+	a, _ := ctx.Value(actorKey{}).(Actor)
+	return a
+}
+
+/*
+AuditRecord is a mutation of a user, Before and After are json of what it changed, null for what didn't exist.
+Records are interleaved in the user, so they are deleted with the user as its other rows are, and a deletion of a user isn't in it.
+Wallets, grants and purchases have their own histories, the ledger and the tables of them.
+*/
+type AuditRecord struct {
+	AuditID   string          `json:"audit_id"`
+	Action    string          `json:"action"`
+	Caller    string          `json:"caller,omitempty"`
+	ActingAs  string          `json:"acting_as,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// an item in the audit, before or after a change of it
+type auditedItem struct {
+	ItemID   string `json:"item_id"`
+	Quantity int64  `json:"quantity"`
+}
+
+/*
+auditMutation is the record of the mutation by the actor of ctx, to be written in the same transaction as the mutation,
+so there is neither a record of what's not committed nor a mutation without its record.
+before or after is nil when there's nothing.
+*/
+func auditMutation(ctx context.Context, userID, action string, before, after interface{}) (*spanner.Mutation, error) {
+	payload := func(v interface{}) (spanner.NullString, error) {
+		if v == nil {
+			return spanner.NullString{}, nil
+		}
+		data, err := json.Marshal(v)
+		return spanner.NullString{StringVal: string(data), Valid: true}, err
+	}
+	b, err := payload(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := payload(after)
+	if err != nil {
+		return nil, err
+	}
+	actor := actorFromContext(ctx)
+	return spanner.InsertMap("user_audit", map[string]interface{}{
+		"user_id":    userID,
+		"audit_id":   uuid.NewString(),
+		"action":     action,
+		"caller":     actor.Caller,
+		"acting_as":  actor.ActingAs,
+		"request_id": actor.RequestID,
+		"before":     b,
+		"after":      a,
+		"created_at": spanner.CommitTimestamp,
+	}), nil
+}
+
+// the same as auditMutation, buffered in txn
+func bufferAudit(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, action string, before, after interface{}) error {
+	m, err := auditMutation(ctx, userID, action, before, after)
+	if err != nil {
+		return err
+	}
+	return txn.BufferWrite([]*spanner.Mutation{m})
+}
+
+// UserAudit lists mutations of the user from the newest, paginated in the same way as WalletLedger
+func (d dbClient) UserAudit(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]AuditRecord, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserAudit")
+	defer span.End()
+
+	limit = pageSize(limit)
+	at, auditID, err := decodeLedgerCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT audit_id, action, caller, acting_as, request_id, before, after, created_at FROM user_audit
+		  WHERE user_id = @userID AND (created_at < @at OR (created_at = @at AND audit_id < @auditID))
+		  ORDER BY created_at DESC, audit_id DESC LIMIT @limit`,
+		Params: map[string]interface{}{
+			"userID":  userID,
+			"at":      at,
+			"auditID": auditID,
+			"limit":   limit + 1,
+		},
+	}
+	records := make([]AuditRecord, 0, limit+1)
+	err = d.ForEachRow(ctx, "UserAudit", stmt, func(row *spanner.Row) error {
+		var r AuditRecord
+		var before, after spanner.NullString
+		if err := row.Columns(&r.AuditID, &r.Action, &r.Caller, &r.ActingAs, &r.RequestID, &before, &after, &r.CreatedAt); err != nil {
+			return err
+		}
+		r.Before, r.After = rawPayload(before), rawPayload(after)
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(records) <= limit {
+		return records, "", nil
+	}
+	records = records[:limit]
+	last := records[limit-1]
+	return records, encodeCursor(last.CreatedAt.Format(time.RFC3339Nano) + "/" + last.AuditID), nil
+}
+
+func rawPayload(s spanner.NullString) json.RawMessage {
+	if !s.Valid {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s.StringVal)
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+const MaxBatchItems = 100
+
+// result of an item in a batch, Error is empty if the item was added
+type ItemResult struct {
+	ItemID string `json:"item_id"`
+	Error  string `json:"error,omitempty"`
+}
+
+/*
+add items to the user in a single transaction, with BatchUpdate DML.
+Items which can't be added, unknown, already owned or duplicated in the request, are reported in the results
+and the others are still added. NotFound is returned if the user doesn't exist.
+*/
+func (d dbClient) AddItemsToUser(ctx context.Context, w io.Writer, u UserParams, itemIDs []string) ([]ItemResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AddItemsToUser")
+	defer span.End()
+	span.SetAttributes(attribute.Int("batch.size", len(itemIDs)))
+
+	if err := checkParams(u); err != nil {
+		return nil, err
+	}
+	if len(itemIDs) == 0 || len(itemIDs) > MaxBatchItems {
+		return nil, fmt.Errorf("%w: 1 to %d items can be added at once", domain.ErrInvalid, MaxBatchItems)
+	}
+	for _, itemID := range itemIDs {
+		if err := checkParams(ItemParams{ItemID: itemID}); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []ItemResult
+	var added []string
+	var lastSeq int64
+	resp, err := d.readWriteTransaction(ctx, "AddItemsToUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		results = make([]ItemResult, len(itemIDs))
+		added = added[:0]
+
+		// NotFound if the user doesn't exist
+		if _, err := txn.ReadRow(ctx, "users", spanner.Key{u.UserID}, []string{"user_id"}); err != nil {
+			return err
+		}
+		known, owned, err := d.batchItemStates(ctx, txn, u.UserID, itemIDs)
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		stmts := []spanner.Statement{}
+		t := time.Now()
+		for n, itemID := range itemIDs {
+			results[n].ItemID = itemID
+			switch {
+			case seen[itemID]:
+				results[n].Error = "duplicated in the request"
+			case !known[itemID]:
+				results[n].Error = "item is not found"
+			case owned[itemID]:
+				results[n].Error = "user already has the item"
+			default:
+				stmt, err := d.addItemStatement(u.UserID, itemID, t)
+				if err != nil {
+					return err
+				}
+				stmts = append(stmts, stmt)
+				added = append(added, itemID)
+			}
+			seen[itemID] = true
+		}
+		if len(stmts) == 0 {
+			return nil
+		}
+
+		if _, err := txn.BatchUpdateWithOptions(ctx, stmts, spanner.QueryOptions{RequestTag: "func=AddItemsToUser,env=dev,action=insert"}); err != nil {
+			return err
+		}
+		if d.EventSourced {
+			// the projector maintains item_count and sequences
+			return nil
+		}
+		if err := addItemCount(ctx, txn, u.UserID, int64(len(added))); err != nil {
+			return err
+		}
+		items := make([]auditedItem, len(added))
+		for n, itemID := range added {
+			items[n] = auditedItem{ItemID: itemID, Quantity: 1}
+		}
+		if err := bufferAudit(ctx, txn, u.UserID, AuditAddItems, nil, items); err != nil {
+			return err
+		}
+		if err := addCounter(ctx, txn, CounterItemsGranted, int64(len(added))); err != nil {
+			return err
+		}
+		if lastSeq, err = reserveUserSeqs(ctx, txn, u.UserID, int64(len(added))); err != nil {
+			return err
+		}
+		return d.stageChanges(txn, u.UserID, lastSeq, added, EventItemAdded)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("batch.added", len(added)))
+	if len(added) > 0 && !d.EventSourced {
+		d.invalidateUserItems(ctx, u.UserID, resp.CommitTs)
+		for n, itemID := range added {
+			d.emitChange(ctx, u.UserID, lastSeq-int64(len(added)-1-n), itemID, EventItemAdded)
+		}
+	}
+	return results, nil
+}
+
+// which of itemIDs are in the catalog, and which of them the user already has
+func (d dbClient) batchItemStates(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, itemIDs []string) (map[string]bool, map[string]bool, error) {
+	itemKeys := make([]spanner.Key, 0, len(itemIDs))
+	userItemKeys := make([]spanner.Key, 0, len(itemIDs))
+	for _, itemID := range itemIDs {
+		itemKeys = append(itemKeys, spanner.Key{itemID})
+		userItemKeys = append(userItemKeys, spanner.Key{userID, itemID})
+	}
+
+	known := map[string]bool{}
+	err := eachRow(ctx, "batchItems", func(ctx context.Context) *spanner.RowIterator {
+		return txn.Read(ctx, "items", spanner.KeySetFromKeys(itemKeys...), []string{"item_id"})
+	}, func(row *spanner.Row) error {
+		var itemID string
+		if err := row.Columns(&itemID); err != nil {
+			return err
+		}
+		known[itemID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owned := map[string]bool{}
+	err = eachRow(ctx, "batchUserItems", func(ctx context.Context) *spanner.RowIterator {
+		return txn.Read(ctx, "user_items", spanner.KeySetFromKeys(userItemKeys...), []string{"item_id"})
+	}, func(row *spanner.Row) error {
+		var itemID string
+		if err := row.Columns(&itemID); err != nil {
+			return err
+		}
+		owned[itemID] = true
+		return nil
+	})
+	return known, owned, err
+}
+
+type userItemParams struct {
+	UserID    string    `spanner:"userID"`
+	ItemID    string    `spanner:"itemID"`
+	Quantity  int64     `spanner:"quantity"`
+	Timestamp time.Time `spanner:"timestamp"`
+}
+
+type stackParams struct {
+	UserID   string `spanner:"userID"`
+	ItemID   string `spanner:"itemID"`
+	Quantity int64  `spanner:"quantity"`
+}
+
+type itemEventParams struct {
+	UserID    string `spanner:"userID"`
+	EventID   string `spanner:"eventID"`
+	ItemID    string `spanner:"itemID"`
+	EventType string `spanner:"eventType"`
+}
+
+var (
+	// updated_at is the commit timestamp for SyncUserItems
+	insertUserItem = newQuery[userItemParams](`INSERT user_items (user_id, item_id, quantity, created_at, updated_at)
+	  VALUES (@userID, @itemID, @quantity, @timestamp, PENDING_COMMIT_TIMESTAMP())`)
+	// adds to the quantity of an owned item in place, no row is updated if the user doesn't have it
+	stackUserItem = newQuery[stackParams](`UPDATE user_items SET quantity = quantity + @quantity, updated_at = PENDING_COMMIT_TIMESTAMP()
+	  WHERE user_id = @userID AND item_id = @itemID`)
+	insertItemEvent = newQuery[itemEventParams](`INSERT user_item_events (user_id, event_id, item_id, event_type, projected, created_at)
+	  VALUES (@userID, @eventID, @itemID, @eventType, false, PENDING_COMMIT_TIMESTAMP())`)
+)
+
+// insert into user_items, or append an event in event sourcing mode
+func (d dbClient) addItemStatement(userID, itemID string, t time.Time) (spanner.Statement, error) {
+	if !d.EventSourced {
+		return insertUserItem.Statement(userItemParams{UserID: userID, ItemID: itemID, Quantity: 1, Timestamp: t}), nil
+	}
+	eventID, err := uuid.NewRandom()
+	if err != nil {
+		return spanner.Statement{}, err
+	}
+	return insertItemEvent.Statement(itemEventParams{UserID: userID, EventID: eventID.String(), ItemID: itemID, EventType: EventItemAdded}), nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// ErrCircuitOpen is returned without calling Spanner while the breaker is open
+var ErrCircuitOpen = errors.New("spanner is unavailable, circuit is open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+/*
+Breaker is a circuit breaker in front of Spanner, in the same way as gobreaker.
+Consecutive failures up to Threshold open it, and calls fail fast with ErrCircuitOpen instead of waiting for the deadline.
+After Cooldown, one call at a time is let through as a probe, it closes the breaker if it succeeds, or opens it again.
+Calls slower than SlowCall are failures even if they succeed, so a hanging Spanner opens it too.
+Only errors of Spanner being unavailable are failures, not the ones of requests, like NotFound.
+Redis doesn't need another one, CacheHealth skips it while it's down in the same way.
+*/
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	SlowCall  time.Duration
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+	// time.Now if nil, replaced by tests
+	now func() time.Time
+}
+
+func NewBreaker(threshold int, cooldown, slowCall time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown, SlowCall: slowCall}
+}
+
+/*
+ParseBreaker reads "threshold,cooldown,slow call" like "5,10s,3s", the slow call can be omitted not to count slow ones.
+It's nil for "off", to call Spanner whatever happens.
+*/
+func ParseBreaker(config string) (*Breaker, error) {
+	if config == "off" {
+		return nil, nil
+	}
+	parts := strings.Split(config, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("breaker %q: has to be like \"5,10s,3s\"", config)
+	}
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil || threshold < 1 {
+		return nil, fmt.Errorf("breaker %q: threshold has to be a positive number", config)
+	}
+	cooldown, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("breaker %q: %w", config, err)
+	}
+	var slowCall time.Duration
+	if len(parts) == 3 {
+		if slowCall, err = time.ParseDuration(parts[2]); err != nil {
+			return nil, fmt.Errorf("breaker %q: %w", config, err)
+		}
+	}
+	return NewBreaker(threshold, cooldown, slowCall), nil
+}
+
+func (b *Breaker) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow tells if a call can be made, done has to be called with its result if it's allowed
+func (b *Breaker) Allow() (done func(error, time.Duration), err error) {
+	if b == nil {
+		return func(error, time.Duration) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := false
+	switch b.state {
+	case BreakerOpen:
+		if b.clock().Sub(b.openedAt) < b.Cooldown {
+			return nil, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return nil, ErrCircuitOpen
+		}
+		b.probing = true
+		probe = true
+	}
+	return func(err error, elapsed time.Duration) { b.observe(probe, err, elapsed) }, nil
+}
+
+func (b *Breaker) observe(probe bool, err error, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+
+	failed := isUnavailable(err) || (b.SlowCall > 0 && elapsed > b.SlowCall)
+	if !failed {
+		b.consecutive = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	b.consecutive++
+	if b.state == BreakerHalfOpen || b.consecutive >= b.Threshold {
+		b.openedAt = b.clock()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	if b.state != state {
+		log.Printf("spanner circuit changed from %s to %s\n", b.state, state)
+	}
+	b.state = state
+}
+
+// errors of Spanner itself, cancels of clients and errors of requests don't count
+func isUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch spanner.ErrCode(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// guard runs f if the breaker allows, and feeds its result to the breaker
+func (d dbClient) guard(f func() error) error {
+	done, err := d.Breaker.Allow()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = f()
+	done(err, time.Since(start))
+	return err
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package budget annotates spans with the latency budget of calls to dependencies.
+A call is given a share of the time left until the deadline of its context when it starts,
+like 0.5 of 60s for Spanner, and it's over budget if it takes longer than that.
+*/
+package budget
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dependencies, they are also the keys of Shares
+const (
+	Spanner = "spanner"
+	Redis   = "redis"
+	PubSub  = "pubsub"
+	NATS    = "nats"
+)
+
+// Shares of the remaining time each dependency may use, a dependency without its share has no budget
+type Shares map[string]float64
+
+var shares = Shares{}
+
+// Configure should be called once on startup
+func Configure(s Shares) {
+	shares = s
+}
+
+// ParseShares reads shares like "spanner=0.5,redis=0.1,pubsub=0.2", nothing has budget if it's empty
+func ParseShares(config string) (Shares, error) {
+	s := Shares{}
+	for _, pair := range strings.Split(config, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		dep, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("budget %q is not like dependency=share", pair)
+		}
+		share, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || share <= 0 || share > 1 {
+			return nil, fmt.Errorf("share of %q has to be in (0, 1]", dep)
+		}
+		s[strings.TrimSpace(dep)] = share
+	}
+	return s, nil
+}
+
+/*
+Track is called when a call to the dependency starts, and the returned func is called when it ends, like
+
+	done := budget.Track(ctx, budget.Redis)
+	data, err := d.Cache.Get(key)
+	done()
+
+The attributes are set to the span of ctx, prefixed by the dependency like "redis.deadline_remaining_ms".
+If the span calls the dependency more than once, the last call wins, except over_budget which stays true once it's set.
+Nothing is recorded if ctx has no deadline.
+*/
+func Track(ctx context.Context, dependency string) func() {
+	deadline, ok := ctx.Deadline()
+	span := trace.SpanFromContext(ctx)
+	if !ok || !span.IsRecording() {
+		return func() {}
+	}
+	start := time.Now()
+	remaining := deadline.Sub(start)
+	span.SetAttributes(attribute.Float64(dependency+".deadline_remaining_ms", milliseconds(remaining)))
+
+	share, ok := shares[dependency]
+	if !ok {
+		return func() {}
+	}
+	allowed := time.Duration(float64(remaining) * share)
+	span.SetAttributes(attribute.Float64(dependency+".budget_ms", milliseconds(allowed)))
+
+	return func() {
+		elapsed := time.Since(start)
+		if elapsed > allowed {
+			span.SetAttributes(
+				attribute.Bool(dependency+".over_budget", true),
+				attribute.Float64(dependency+".over_budget_ms", milliseconds(elapsed-allowed)),
+			)
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000000
+}
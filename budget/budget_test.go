@@ -0,0 +1,72 @@
+package budget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestParseShares(t *testing.T) {
+	s, err := ParseShares("spanner=0.5, redis=0.1,")
+	assert.Nil(t, err)
+	assert.Equal(t, Shares{Spanner: 0.5, Redis: 0.1}, s)
+
+	s, err = ParseShares("")
+	assert.Nil(t, err)
+	assert.Empty(t, s)
+
+	for _, config := range []string{"spanner", "spanner=0", "spanner=1.5", "spanner=half"} {
+		_, err := ParseShares(config)
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	Configure(Shares{Redis: 0.01})
+	defer Configure(Shares{})
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "UserItems")
+
+	// in budget, 10ms of 1s
+	Track(ctx, Redis)()
+	// over budget
+	done := Track(ctx, Redis)
+	time.Sleep(20 * time.Millisecond)
+	done()
+	// the last call in budget doesn't clear it
+	Track(ctx, Redis)()
+	// no share
+	Track(ctx, Spanner)()
+	span.End()
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range recorder.Ended()[0].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.InDelta(t, 1000, attrs["redis.deadline_remaining_ms"].AsFloat64(), 50)
+	assert.InDelta(t, 10, attrs["redis.budget_ms"].AsFloat64(), 1)
+	assert.True(t, attrs["redis.over_budget"].AsBool())
+	assert.Contains(t, attrs, attribute.Key("spanner.deadline_remaining_ms"))
+	assert.NotContains(t, attrs, attribute.Key("spanner.budget_ms"))
+	assert.NotContains(t, attrs, attribute.Key("spanner.over_budget"))
+}
+
+func TestTrackWithoutDeadline(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	ctx, span := tracer.Start(context.Background(), "UserItems")
+	Track(ctx, Spanner)()
+	span.End()
+	assert.Empty(t, recorder.Ended()[0].Attributes())
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+/*
+CacheEpoch prefixes cache keys, so a deploy changing the payload of cache starts with its own keys,
+and revisions of before and after don't read payloads of each other while both of them are serving.
+Empty Current means keys without prefix, as before epochs were introduced.
+
+Until PreviousUntil, a miss of the current epoch is read again from Previous and copied to the current one,
+which keeps the hit ratio through the deploy when payloads are compatible.
+Leave PreviousUntil zero when they are not.
+*/
+type CacheEpoch struct {
+	Current       string
+	Previous      string
+	PreviousUntil time.Time
+}
+
+func epochKey(epoch, key string) string {
+	if epoch == "" {
+		return key
+	}
+	return epoch + ":" + key
+}
+
+func (e CacheEpoch) key(key string) string {
+	return epochKey(e.Current, key)
+}
+
+// the key of the previous epoch, only while it's worth reading
+func (e CacheEpoch) previousKey(key string) (string, bool) {
+	if e.Previous == e.Current || !time.Now().Before(e.PreviousUntil) {
+		return "", false
+	}
+	return epochKey(e.Previous, key), true
+}
+
+// read the previous epoch after a miss, and carry the entry over to the current one
+func (c *Caching) getPrevious(key string) (string, error) {
+	prev, ok := c.Epoch.previousKey(key)
+	if !ok {
+		return "", redis.Nil
+	}
+	result, err := c.get(prev)
+	if err != nil {
+		return result, err
+	}
+	cacheEpochCarryovers.Inc()
+	if err := c.RedisClient.Set(c.Epoch.key(key), result, cacheTTL).Err(); err != nil {
+		log.Println("cache epoch", err)
+	}
+	return result, nil
+}
+
+// entries of the previous epoch can still be carried over, so they are deleted along with the current ones
+func (c *Caching) delPrevious(key string) error {
+	prev, ok := c.Epoch.previousKey(key)
+	if !ok {
+		return nil
+	}
+	return c.RedisClient.Del(prev).Err()
+}
+
+/*
+ParseCacheEpoch makes an epoch from config.
+current "K_REVISION" means the revision of Cloud Run, so every deploy starts with its own keys.
+grace is how long to read previous, like "10m" from now, previous is not read if it's empty.
+*/
+func ParseCacheEpoch(current, previous, grace, revision string) (CacheEpoch, error) {
+	if current == "K_REVISION" {
+		current = revision
+	}
+	e := CacheEpoch{Current: current, Previous: previous}
+	if grace == "" {
+		return e, nil
+	}
+	d, err := time.ParseDuration(grace)
+	if err != nil {
+		return e, err
+	}
+	e.PreviousUntil = time.Now().Add(d)
+	return e, nil
+}
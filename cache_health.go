@@ -0,0 +1,183 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type CacheState int
+
+const (
+	CacheHealthy CacheState = iota
+	CacheDegraded
+	CacheDown
+)
+
+func (s CacheState) String() string {
+	switch s {
+	case CacheHealthy:
+		return "healthy"
+	case CacheDegraded:
+		return "degraded"
+	default:
+		return "down"
+	}
+}
+
+const (
+	healthWindowSize    = 20
+	degradedErrorRatio  = 0.2
+	downConsecutiveErrs = 5
+
+	// weight of the latest call in the moving average of latency
+	latencyAlpha = 0.2
+	slowLatency  = 20 * time.Millisecond
+)
+
+/*
+CacheHealth keeps track of redis health as a small state machine.
+Every cache call and background ping is observed,
+error rate of the recent calls moves it to degraded,
+consecutive errors move it to down.
+While down, only background pings can bring it back.
+*/
+type CacheHealth struct {
+	mu          sync.Mutex
+	state       CacheState
+	window      [healthWindowSize]bool
+	pos         int
+	filled      int
+	consecutive int
+	latency     float64 // exponential moving average in nanoseconds
+}
+
+func NewCacheHealth() *CacheHealth {
+	return &CacheHealth{state: CacheHealthy}
+}
+
+func (h *CacheHealth) State() CacheState {
+	if h == nil {
+		return CacheHealthy
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// cache is worth to try unless it's down
+func (h *CacheHealth) Usable() bool {
+	return h.State() != CacheDown
+}
+
+func (h *CacheHealth) Observe(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.window[h.pos] = err != nil
+	h.pos = (h.pos + 1) % healthWindowSize
+	if h.filled < healthWindowSize {
+		h.filled++
+	}
+
+	if err != nil {
+		h.consecutive++
+	} else {
+		h.consecutive = 0
+	}
+
+	prev := h.state
+	switch {
+	case h.consecutive >= downConsecutiveErrs:
+		h.state = CacheDown
+	case prev == CacheDown && err == nil:
+		// recovered by ping, but not trusted until the window is clean
+		h.state = CacheDegraded
+		h.reset()
+	case h.errorRatio() > degradedErrorRatio:
+		h.state = CacheDegraded
+	case prev != CacheDown:
+		h.state = CacheHealthy
+	}
+
+	if prev != h.state {
+		log.Printf("cache state changed from %s to %s\n", prev, h.state)
+	}
+}
+
+func (h *CacheHealth) errorRatio() float64 {
+	if h.filled == 0 {
+		return 0
+	}
+	errs := 0
+	for i := 0; i < h.filled; i++ {
+		if h.window[i] {
+			errs++
+		}
+	}
+	return float64(errs) / float64(h.filled)
+}
+
+func (h *CacheHealth) reset() {
+	h.window = [healthWindowSize]bool{}
+	h.pos = 0
+	h.filled = 0
+	h.consecutive = 0
+}
+
+// ObserveLatency feeds the latency of a cache call, errors are observed separately by Observe
+func (h *CacheHealth) ObserveLatency(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.latency == 0 {
+		h.latency = float64(d)
+		return
+	}
+	h.latency = latencyAlpha*float64(d) + (1-latencyAlpha)*h.latency
+}
+
+// Slow tells the recent cache calls are slower than expected, even if they succeed
+func (h *CacheHealth) Slow() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Duration(h.latency) > slowLatency
+}
+
+// Watch pings periodically until ctx is done, so it can recover even if no request uses cache
+func (h *CacheHealth) Watch(ctx context.Context, ping func() error, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Observe(ping())
+		}
+	}
+}
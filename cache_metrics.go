@@ -0,0 +1,78 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+keyPrefix is the kind of a key, like UserItems of UserItems_<user id> and its pages, to label metrics by.
+Keys are of <kind>_<id>, and the epoch isn't a part of it, as metrics of a kind are compared across deploys.
+*/
+func keyPrefix(key string) string {
+	if i := strings.IndexByte(key, '_'); i > 0 {
+		return key[:i]
+	}
+	return "other"
+}
+
+// a call skipped while the cache is down took no time of it, so it's counted but not timed
+func observeCacheDuration(op, prefix string, start time.Time, err error) {
+	if errors.Is(err, errCacheDown) {
+		return
+	}
+	elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+	cacheDuration.WithLabelValues(op, prefix).Observe(elapsed)
+	cacheDurationHistogram.Record(context.Background(), elapsed, metric.WithAttributes(attribute.String("op", op), attribute.String("prefix", prefix)))
+}
+
+// a Get of the key by its result, miss tells the error is of a miss, which the backends tell apart by their own errors
+func observeCacheGet(key string, start time.Time, err error, miss bool) {
+	prefix := keyPrefix(key)
+	observeCacheDuration("get", prefix, start, err)
+	result := "hit"
+	switch {
+	case errors.Is(err, errCacheDown):
+		result = "down"
+	case miss:
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	cacheGets.WithLabelValues(prefix, result).Inc()
+}
+
+func observeCacheSet(key string, start time.Time, err error) {
+	prefix := keyPrefix(key)
+	observeCacheDuration("set", prefix, start, err)
+	switch {
+	case errors.Is(err, errCacheDown):
+		cacheSetFailures.WithLabelValues(prefix, "down").Inc()
+	case err != nil:
+		cacheSetFailures.WithLabelValues(prefix, "error").Inc()
+	}
+}
+
+func observeCacheDel(key string, start time.Time, err error) {
+	observeCacheDuration("del", keyPrefix(key), start, err)
+}
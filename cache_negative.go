@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+// cached UserItems of a user who doesn't exist, it's not json, so it's never taken for an inventory
+const userNotFoundEntry = "!notfound"
+
+// short, ids of unknown users may be of users just being created somewhere
+const userNotFoundTTL = 30 * time.Second
+
+// NotFound like the ones of Spanner, so callers handle both the same way
+var errUserNotFound = status.Error(codes.NotFound, "user is not found")
+
+// whether the user exists, to tell an unknown user from one without items
+func (d dbClient) userExists(ctx context.Context, userID string) (bool, error) {
+	_, err := d.readRow(ctx, "users", spanner.Key{userID}, []string{"user_id"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/*
+setUserNotFound caches that the user doesn't exist, so requests enumerating unknown ids don't reach Spanner every time.
+It's cached only by caches which can keep it for its own short ttl, the default one is too long for it.
+CreateUser drops it as it does the other entries.
+*/
+func (d dbClient) setUserNotFound(ctx context.Context, key string) {
+	setter, ok := d.Cache.(CacheTTLSetter)
+	if !ok {
+		return
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "setUserNotFound")
+	defer span.End()
+
+	defer budget.Track(ctx, budget.Redis)()
+	if err := setter.SetWithTTL(key, userNotFoundEntry, userNotFoundTTL); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/luascript"
+)
+
+func (c *Caching) CompareAndSwap(key string, old string, new string) (bool, error) {
+	if !c.Health.Usable() {
+		return false, errCacheDown
+	}
+	result, err := luascript.CompareAndSwap.Run(c.RedisClient, []string{c.Epoch.key(key)}, old, new, cacheTTL.Milliseconds()).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	c.Health.Observe(err)
+	if err != nil {
+		return false, err
+	}
+	return result == "OK", nil
+}
+
+const patchRetries = 3
+
+/*
+patchUserItems applies a single item change to the cached UserItems payload instead of requerying all of them,
+unless the cache strategy of the user is write-through or invalidate.
+If the entry is not cached, there is nothing to do, the next read fills it.
+If it can't be patched, or it keeps losing the race, the entry is invalidated instead of being left stale until it expires,
+a read replica lagging behind the primary looks like losing the race as well.
+committed is the commit timestamp of the change, see stampWrite.
+*/
+func (d dbClient) patchUserItems(ctx context.Context, userID, itemID string, added bool, committed time.Time) {
+
+	strategy := d.cacheStrategyOf(userID)
+	defer observeUpkeep(strategy, time.Now())
+	d.stampWrite(ctx, userID, committed)
+	if strategy == WriteThrough {
+		d.writeUserItems(ctx, userID)
+		return
+	}
+	forget(ctx, fmt.Sprintf("UserItems_%s", userID))
+
+	// a patched entry keeps the read timestamp of before the change, so it would never be fresh when it's validated
+	patcher, ok := d.Cache.(CachePatcher)
+	if !ok || d.ValidateCache || strategy == Invalidate {
+		d.dropUserItems(ctx, userID)
+		return
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "patchUserItems")
+	defer span.End()
+
+	key := fmt.Sprintf("UserItems_%s", userID)
+	var entry *domain.OwnedItem
+	for i := 0; i < patchRetries; i++ {
+		done := budget.Track(ctx, budget.Redis)
+		current, err := d.Cache.Get(key)
+		done()
+		if err != nil {
+			// not cached or cache is unavailable
+			return
+		}
+		if current == userNotFoundEntry {
+			d.dropUserItems(ctx, userID)
+			return
+		}
+		results, readAt, err := decodeUserItems(current)
+		if err != nil {
+			log.Println(err)
+			d.dropUserItems(ctx, userID)
+			return
+		}
+
+		patched := results.Without(itemID)
+		if added {
+			if entry == nil {
+				item, err := d.userItemEntry(ctx, userID, itemID)
+				if err != nil {
+					log.Println(err)
+					d.dropUserItems(ctx, userID)
+					return
+				}
+				entry = &item
+			}
+			patched = results.With(*entry)
+		}
+
+		data, err := encodeUserItems(patched, readAt)
+		if err != nil {
+			log.Println(err)
+			d.dropUserItems(ctx, userID)
+			return
+		}
+		done = budget.Track(ctx, budget.Redis)
+		swapped, err := patcher.CompareAndSwap(key, current, string(data))
+		done()
+		if err != nil {
+			log.Println(err)
+			d.dropUserItems(ctx, userID)
+			return
+		}
+		if swapped {
+			span.SetAttributes(attribute.Int("cache.patch_attempts", i+1))
+			return
+		}
+	}
+	span.SetAttributes(attribute.Int("cache.patch_attempts", patchRetries))
+	log.Println("UserItems", HashID(userID), "gave up patching cache")
+	d.dropUserItems(ctx, userID)
+}
+
+// the same shape of an element of UserItems, read after the change is committed for the quantity it has made
+func (d dbClient) userItemEntry(ctx context.Context, userID, itemID string) (domain.OwnedItem, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT users.name, items.item_name, user_items.quantity
+		  FROM user_items JOIN items ON items.item_id = user_items.item_id JOIN users ON users.user_id = user_items.user_id
+		  WHERE user_items.user_id = @user_id AND user_items.item_id = @item_id`,
+		Params: map[string]interface{}{
+			"user_id": userID,
+			"item_id": itemID,
+		},
+	}
+	found := false
+	var userName, itemName string
+	var quantity int64
+	err := d.ForEachRow(ctx, "userItemEntry", stmt, func(row *spanner.Row) error {
+		found = true
+		if err := row.Columns(&userName, &itemName, &quantity); err != nil {
+			return err
+		}
+		return errStopRows
+	})
+	if err != nil {
+		return domain.OwnedItem{}, err
+	}
+	if !found {
+		return domain.OwnedItem{}, fmt.Errorf("item %s of user %s is not found", itemID, HashID(userID))
+	}
+	return domain.NewOwnedItem(userName, itemName, itemID, quantity)
+}
+
+// drop the cached UserItems entirely, for changes which can't be patched, or write them through
+func (d dbClient) invalidateUserItems(ctx context.Context, userID string, committed time.Time) {
+	defer observeUpkeep(d.cacheStrategyOf(userID), time.Now())
+	d.stampWrite(ctx, userID, committed)
+	d.dropUserItems(ctx, userID)
+}
+
+// the same as invalidateUserItems after the write is stamped
+func (d dbClient) dropUserItems(ctx context.Context, userID string) {
+	if d.cacheStrategyOf(userID) == WriteThrough {
+		d.writeUserItems(ctx, userID)
+		return
+	}
+	forget(ctx, fmt.Sprintf("UserItems_%s", userID))
+	defer budget.Track(ctx, budget.Redis)()
+	if err := d.Cache.Del(fmt.Sprintf("UserItems_%s", userID)); err != nil {
+		log.Println("UserItems", HashID(userID), "could not invalidate cache", err)
+	}
+}
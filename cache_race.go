@@ -0,0 +1,121 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+const (
+	raceSourceCache   = "cache"
+	raceSourceSpanner = "spanner"
+)
+
+func cacheIsSlow(c Cacher) bool {
+	r, ok := c.(SlowReporter)
+	return ok && r.Slow()
+}
+
+type raceResult struct {
+	source string
+	items  domain.Inventory
+	readAt time.Time
+	err    error
+}
+
+// a cached entry which can't be proved fresh loses as a miss does
+var errNotFresh = errors.New("cache is not provably fresh")
+
+/*
+raceUserItems issues the cache GET and the Spanner query at the same time, and uses whichever returns first.
+A cache miss or error doesn't win, then the Spanner result is used and cached as usual.
+The Spanner query is cancelled when cache wins, but a redis call can't be cancelled,
+so its result is just discarded when Spanner wins.
+*/
+func (d dbClient) raceUserItems(ctx context.Context, key, userID string) (domain.Inventory, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "raceUserItems")
+	defer span.End()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered, so the loser doesn't block after we have returned
+	results := make(chan raceResult, 2)
+	go func() {
+		done := budget.Track(ctx, budget.Redis)
+		data, err := d.Cache.Get(key)
+		done()
+		if err != nil {
+			results <- raceResult{source: raceSourceCache, err: err}
+			return
+		}
+		if data == userNotFoundEntry {
+			results <- raceResult{source: raceSourceCache, err: errUserNotFound}
+			return
+		}
+		items, readAt, err := decodeUserItems(data)
+		if err == nil && d.ValidateCache && !d.provablyFresh(ctx, userID, readAt) {
+			err = errNotFresh
+		}
+		results <- raceResult{source: raceSourceCache, items: items, err: err}
+	}()
+	go func() {
+		items, readAt, err := d.queryUserItemsAt(ctx, userID, d.Staleness)
+		results <- raceResult{source: raceSourceSpanner, items: items, readAt: readAt, err: err}
+	}()
+
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == errUserNotFound {
+			// either of them knows the user doesn't exist
+			cacheRaceWins.WithLabelValues(r.source).Inc()
+			if r.source == raceSourceSpanner {
+				d.setUserNotFound(ctx, key)
+			}
+			return nil, r.err
+		}
+		if r.err != nil {
+			if r.source == raceSourceSpanner {
+				lastErr = r.err
+			}
+			continue
+		}
+		cacheRaceWins.WithLabelValues(r.source).Inc()
+		if r.source == raceSourceCache {
+			d.lookedUp(ctx, userID, "hit")
+		} else {
+			d.lookedUp(ctx, userID, "miss")
+		}
+		span.SetAttributes(attribute.String("race.winner", r.source))
+		if r.source == raceSourceSpanner {
+			d.setUserItems(ctx, key, r.items, r.readAt)
+		}
+		log.Println("UserItems", HashID(userID), "from", r.source, "by race")
+		return r.items, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// the switch of StandbyCache, it's kept in the standby without ttl
+const standbySwitchKey = "CacheReadStandby"
+
+/*
+StandbyCache writes to a primary redis and a warm standby one, and reads one of them, the primary unless it's switched over,
+so a maintenance of the primary, like the one of Memorystore, can be ridden out without a cold cache.
+Writes go to the one which is read first, and the copies to the other one are best effort, their failures make it behind, see Lag.
+The switch is kept in the standby, which is up while the primary is under maintenance, and every instance follows it by WatchStandby.
+*/
+type StandbyCache struct {
+	Primary *Caching
+	Standby *Caching
+
+	readingStandby atomic.Bool
+	mu             sync.Mutex
+	behindSince    time.Time
+}
+
+func NewStandbyCache(primary, standby *Caching) *StandbyCache {
+	return &StandbyCache{Primary: primary, Standby: standby}
+}
+
+// StandbyStatus is where reads go, and how the cache which isn't read is doing
+type StandbyStatus struct {
+	ReadingStandby bool `json:"reading_standby"`
+	// how long the cache which isn't read has been failing the copies of writes, 0 if it's in sync
+	LagSeconds  float64 `json:"lag_seconds"`
+	PrimaryKeys int64   `json:"primary_keys"`
+	StandbyKeys int64   `json:"standby_keys"`
+}
+
+// the one to read and write first, and the one to copy writes to
+func (c *StandbyCache) roles() (*Caching, *Caching) {
+	if c.readingStandby.Load() {
+		return c.Standby, c.Primary
+	}
+	return c.Primary, c.Standby
+}
+
+func (c *StandbyCache) copied(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		standbyCopies.WithLabelValues("error").Inc()
+		if c.behindSince.IsZero() {
+			c.behindSince = time.Now()
+		}
+		return
+	}
+	standbyCopies.WithLabelValues("ok").Inc()
+	c.behindSince = time.Time{}
+}
+
+/*
+Lag is how long the cache which isn't read has been failing the copies of writes, 0 once a copy succeeds again.
+Entries whose copies failed are missing from it until they are written again or expire.
+*/
+func (c *StandbyCache) Lag() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.behindSince.IsZero() {
+		return 0
+	}
+	return time.Since(c.behindSince)
+}
+
+func (c *StandbyCache) ReadingStandby() bool {
+	return c.readingStandby.Load()
+}
+
+func (c *StandbyCache) Get(key string) (string, error) {
+	read, _ := c.roles()
+	return read.Get(key)
+}
+
+func (c *StandbyCache) Set(key string, data string) error {
+	read, other := c.roles()
+	err := read.Set(key, data)
+	c.copied(other.Set(key, data))
+	return err
+}
+
+func (c *StandbyCache) SetWithTTL(key string, data string, ttl time.Duration) error {
+	read, other := c.roles()
+	err := read.SetWithTTL(key, data, ttl)
+	c.copied(other.SetWithTTL(key, data, ttl))
+	return err
+}
+
+func (c *StandbyCache) Del(key string) error {
+	read, other := c.roles()
+	err := read.Del(key)
+	c.copied(other.Del(key))
+	return err
+}
+
+// only the swap which won is copied, the other one is of a write which copies itself
+func (c *StandbyCache) CompareAndSwap(key string, old string, new string) (bool, error) {
+	read, other := c.roles()
+	swapped, err := read.CompareAndSwap(key, old, new)
+	if swapped {
+		c.copied(other.Set(key, new))
+	}
+	return swapped, err
+}
+
+func (c *StandbyCache) Slow() bool {
+	read, _ := c.roles()
+	return read.Slow()
+}
+
+// stamps are copied as entries are, otherwise entries of the standby couldn't be validated after switching over
+func (c *StandbyCache) StampWrite(key string, at time.Time) error {
+	read, other := c.roles()
+	err := read.StampWrite(key, at)
+	c.copied(other.StampWrite(key, at))
+	return err
+}
+
+func (c *StandbyCache) LastWrite(key string) (time.Time, bool, error) {
+	read, _ := c.roles()
+	return read.LastWrite(key)
+}
+
+// SwitchReads saves the switch in the standby, and follows it at once, other instances follow it by WatchStandby
+func (c *StandbyCache) SwitchReads(toStandby bool) error {
+	var err error
+	if toStandby {
+		err = c.Standby.RedisClient.Set(standbySwitchKey, "1", 0).Err()
+	} else {
+		err = c.Standby.RedisClient.Del(standbySwitchKey).Err()
+	}
+	if err != nil {
+		return err
+	}
+	c.follow(toStandby)
+	return nil
+}
+
+func (c *StandbyCache) follow(toStandby bool) {
+	if c.readingStandby.Swap(toStandby) != toStandby {
+		log.Printf("cache reads are switched over to the standby: %t\n", toStandby)
+	}
+}
+
+// Status counts keys of both, they are of the whole redis, keys of other apps sharing it as well
+func (c *StandbyCache) Status() (StandbyStatus, error) {
+	status := StandbyStatus{ReadingStandby: c.ReadingStandby(), LagSeconds: c.Lag().Seconds()}
+	var err error
+	if status.PrimaryKeys, err = c.Primary.size(); err != nil {
+		return status, err
+	}
+	status.StandbyKeys, err = c.Standby.size()
+	return status, err
+}
+
+/*
+WatchStandby follows the switch in the standby and samples the sizes of both every interval until ctx is done.
+The switch is left as it is while the standby can't be read.
+*/
+func (c *StandbyCache) WatchStandby(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		switch err := c.Standby.RedisClient.Get(standbySwitchKey).Err(); err {
+		case nil:
+			c.follow(true)
+		case redis.Nil:
+			c.follow(false)
+		default:
+			log.Println("could not read the switch of the standby", err)
+		}
+		for name, cache := range map[string]*Caching{"primary": c.Primary, "standby": c.Standby} {
+			if size, err := cache.size(); err == nil {
+				cacheKeys.WithLabelValues(name).Set(float64(size))
+			}
+		}
+	}
+}
+
+// keys of all the masters
+func (c *Caching) size() (int64, error) {
+	var mu sync.Mutex
+	var total int64
+	err := forEachMaster(c.RedisClient, func(node *redis.Client) error {
+		n, err := node.DbSize().Result()
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return err
+	})
+	return total, err
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+CacheStatus tells how UserItems of a request were looked up in the cache,
+hit, miss, negative or stale as in game_cache_lookups_total, so the API can answer it as a header.
+It's empty if the cache wasn't looked up, like reads by a staleness or a second read in the memo.
+*/
+type CacheStatus struct {
+	mu     sync.Mutex
+	result string
+}
+
+type cacheStatusKey struct{}
+
+// WithCacheStatus returns a context whose lookups of UserItems are recorded in the status
+func WithCacheStatus(ctx context.Context) (context.Context, *CacheStatus) {
+	status := &CacheStatus{}
+	return context.WithValue(ctx, cacheStatusKey{}, status), status
+}
+
+// String is the result of the last lookup
+func (s *CacheStatus) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+// count the lookup of user items by the strategy of the user, and record it in the status of ctx if there is
+func (d dbClient) lookedUp(ctx context.Context, userID, result string) {
+	strategyLookups.WithLabelValues(string(d.cacheStrategyOf(userID)), result).Inc()
+	recordLookup(ctx, result)
+}
+
+// count the lookup of user items, and record it in the status of ctx if there is
+func recordLookup(ctx context.Context, result string) {
+	countCacheLookup(ctx, result)
+	if s, ok := ctx.Value(cacheStatusKey{}).(*CacheStatus); ok {
+		s.mu.Lock()
+		s.result = result
+		s.mu.Unlock()
+	}
+}
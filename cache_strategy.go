@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+/*
+CacheStrategy is how cached UserItems keep up with mutations, they are read by cache-aside anyway.
+It's a choice to compare in the workshop:
+cache-aside patches or drops the entry and lets the next read fill it, a mutation costs little but the next read may miss,
+invalidate always drops it, which costs the least but the next read always misses,
+write-through queries the items again and writes them in the request of the mutation, which is slower but the next read hits.
+*/
+type CacheStrategy string
+
+const (
+	CacheAside   CacheStrategy = "cache-aside"
+	Invalidate   CacheStrategy = "invalidate"
+	WriteThrough CacheStrategy = "write-through"
+)
+
+// ParseCacheStrategy reads config, empty is cache-aside
+func ParseCacheStrategy(config string) (CacheStrategy, error) {
+	switch s := CacheStrategy(config); s {
+	case "":
+		return CacheAside, nil
+	case CacheAside, Invalidate, WriteThrough:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown cache strategy %q, it has to be %s, %s or %s", config, CacheAside, Invalidate, WriteThrough)
+}
+
+/*
+CacheRollout returns the strategy of the user, to roll a strategy out to a percentage of users and compare them live.
+It has to return the same strategy for a user, like by the hash of the user id, or its entries would be kept up by several of them.
+An empty strategy is CacheStrategy of the client.
+*/
+type CacheRollout func(userID string) CacheStrategy
+
+// the strategy the cached items of the user are kept up by
+func (d dbClient) cacheStrategyOf(userID string) CacheStrategy {
+	if d.CacheRollout != nil {
+		if s := d.CacheRollout(userID); s != "" {
+			return s
+		}
+	}
+	if d.CacheStrategy == "" {
+		return CacheAside
+	}
+	return d.CacheStrategy
+}
+
+// the upkeep after a mutation by the strategy, from start
+func observeUpkeep(strategy CacheStrategy, start time.Time) {
+	elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+	cacheUpkeepDuration.WithLabelValues(string(strategy)).Observe(elapsed)
+}
+
+// the fresh UserItems in cache after a mutation, it's dropped if they can't be queried
+func (d dbClient) writeUserItems(ctx context.Context, userID string) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "writeUserItems")
+	defer span.End()
+
+	key := fmt.Sprintf("UserItems_%s", userID)
+	forget(ctx, key)
+	// strong, not to miss the write it follows
+	results, readAt, err := d.queryUserItemsAt(ctx, userID, Staleness{})
+	if err != nil {
+		log.Println("UserItems", HashID(userID), "could not write through cache", err)
+		defer budget.Track(ctx, budget.Redis)()
+		if err := d.Cache.Del(key); err != nil {
+			log.Println("UserItems", HashID(userID), "could not invalidate cache", err)
+		}
+		return
+	}
+	d.setUserItems(ctx, key, results, readAt)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotSupported = errors.New("not supported by the remote cache")
+
+type lruEntry struct {
+	key     string
+	data    string
+	expires time.Time
+}
+
+// lru keeps up to size entries for ttl at most, the least recently used one is evicted first
+type lru struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	// time.Now if nil, replaced by tests
+	now func() time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (l *lru) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+	return l.now()
+}
+
+func (l *lru) get(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*lruEntry)
+	if !l.clock().Before(entry.expires) {
+		l.order.Remove(e)
+		delete(l.entries, key)
+		return "", false
+	}
+	l.order.MoveToFront(e)
+	return entry.data, true
+}
+
+// set keeps data for the shorter of ttl and the one of lru
+func (l *lru) set(key, data string, ttl time.Duration) {
+	if ttl <= 0 || ttl > l.ttl {
+		ttl = l.ttl
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires := l.clock().Add(ttl)
+	if e, ok := l.entries[key]; ok {
+		e.Value = &lruEntry{key: key, data: data, expires: expires}
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, data: data, expires: expires})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (l *lru) del(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+}
+
+/*
+TieredCache is a small LRU in process in front of a remote Cacher like Caching, for hot keys not to go over the network.
+Writes of this instance go through both, but the ones of other instances are seen after the ttl of the LRU at worst,
+so it has to be short, like a second, it's as stale as the remote would be in the cache-aside.
+The optional interfaces are passed to the remote, with errNotSupported if it doesn't have them.
+*/
+type TieredCache struct {
+	Remote Cacher
+	local  *lru
+}
+
+func NewTieredCache(remote Cacher, size int, ttl time.Duration) *TieredCache {
+	return &TieredCache{Remote: remote, local: newLRU(size, ttl)}
+}
+
+// ParseLocalCache reads "size,ttl" of the LRU like "1000,1s"
+func ParseLocalCache(config string) (int, time.Duration, error) {
+	sizeText, ttlText, ok := strings.Cut(config, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("local cache %q: has to be like \"1000,1s\"", config)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(sizeText))
+	if err != nil || size < 1 {
+		return 0, 0, fmt.Errorf("local cache %q: size has to be a positive number", config)
+	}
+	ttl, err := time.ParseDuration(strings.TrimSpace(ttlText))
+	if err != nil || ttl <= 0 {
+		return 0, 0, fmt.Errorf("local cache %q: ttl has to be a positive duration", config)
+	}
+	return size, ttl, nil
+}
+
+func (c *TieredCache) Get(key string) (string, error) {
+	if data, ok := c.local.get(key); ok {
+		localCacheLookups.WithLabelValues("hit").Inc()
+		return data, nil
+	}
+	localCacheLookups.WithLabelValues("miss").Inc()
+	data, err := c.Remote.Get(key)
+	if err != nil {
+		return data, err
+	}
+	c.local.set(key, data, c.local.ttl)
+	return data, nil
+}
+
+func (c *TieredCache) Set(key string, data string) error {
+	c.local.set(key, data, c.local.ttl)
+	return c.Remote.Set(key, data)
+}
+
+func (c *TieredCache) SetWithTTL(key string, data string, ttl time.Duration) error {
+	setter, ok := c.Remote.(CacheTTLSetter)
+	if !ok {
+		return errNotSupported
+	}
+	c.local.set(key, data, ttl)
+	return setter.SetWithTTL(key, data, ttl)
+}
+
+func (c *TieredCache) Del(key string) error {
+	c.local.del(key)
+	return c.Remote.Del(key)
+}
+
+// the local entry is dropped when it loses, it may have been the stale one which old was read from
+func (c *TieredCache) CompareAndSwap(key string, old string, new string) (bool, error) {
+	patcher, ok := c.Remote.(CachePatcher)
+	if !ok {
+		return false, errNotSupported
+	}
+	swapped, err := patcher.CompareAndSwap(key, old, new)
+	if swapped {
+		c.local.set(key, new, c.local.ttl)
+	} else {
+		c.local.del(key)
+	}
+	return swapped, err
+}
+
+func (c *TieredCache) Slow() bool {
+	reporter, ok := c.Remote.(SlowReporter)
+	return ok && reporter.Slow()
+}
+
+// stamps are never kept in process, they are what tells entries of the process are stale
+func (c *TieredCache) StampWrite(key string, at time.Time) error {
+	stamper, ok := c.Remote.(WriteStamper)
+	if !ok {
+		return errNotSupported
+	}
+	return stamper.StampWrite(key, at)
+}
+
+func (c *TieredCache) LastWrite(key string) (time.Time, bool, error) {
+	stamper, ok := c.Remote.(WriteStamper)
+	if !ok {
+		return time.Time{}, false, errNotSupported
+	}
+	return stamper.LastWrite(key)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/luascript"
+)
+
+/*
+stamps of the last writes outlive cached entries by far, so no stamp means no write since an entry was read,
+unless the entry is older than it.
+*/
+const writeStampTTL = time.Hour
+
+/*
+UserItems cached with the read timestamp of Spanner, only when ValidateCache is set.
+Entries of only items are of before it's set, and they are never taken as provably fresh.
+*/
+type validatedUserItems struct {
+	ReadAt time.Time        `json:"read_at"`
+	Items  domain.Inventory `json:"items"`
+}
+
+func encodeUserItems(items domain.Inventory, readAt time.Time) ([]byte, error) {
+	if readAt.IsZero() {
+		return json.Marshal(items)
+	}
+	return json.Marshal(validatedUserItems{ReadAt: readAt, Items: items})
+}
+
+// the items and when they were read, zero if it's not known
+func decodeUserItems(data string) (domain.Inventory, time.Time, error) {
+	if strings.HasPrefix(data, "{") {
+		entry := validatedUserItems{}
+		err := json.Unmarshal([]byte(data), &entry)
+		return singlesIfUnstacked(entry.Items), entry.ReadAt, err
+	}
+	items := domain.Inventory{}
+	err := json.Unmarshal([]byte(data), &items)
+	return singlesIfUnstacked(items), time.Time{}, err
+}
+
+// entries cached before items had quantities have none, and every item of them is one
+func singlesIfUnstacked(items domain.Inventory) domain.Inventory {
+	for n := range items {
+		if items[n].Quantity == 0 {
+			items[n].Quantity = 1
+		}
+	}
+	return items
+}
+
+func writeStampKey(userID string) string {
+	return fmt.Sprintf("UserItemsWrite_%s", userID)
+}
+
+/*
+stampWrite records the commit timestamp of a mutation of the user, before its cache is patched or dropped,
+so an entry filled by a read which raced with it is told to be stale, however late it's written.
+It's best effort as caching is, a lost stamp leaves the entry until its ttl as it's without validation.
+*/
+func (d dbClient) stampWrite(ctx context.Context, userID string, committed time.Time) {
+	stamper, ok := d.Cache.(WriteStamper)
+	if !d.ValidateCache || !ok {
+		return
+	}
+	if committed.IsZero() {
+		// not from a transaction, it's known to be before now at least
+		committed = time.Now()
+	}
+	defer budget.Track(ctx, budget.Redis)()
+	if err := stamper.StampWrite(writeStampKey(userID), committed); err != nil {
+		log.Println("UserItems", HashID(userID), "could not stamp the write", err)
+	}
+}
+
+/*
+provablyFresh tells whether the entry read at readAt has all the writes of the user,
+that is, the last write was committed at or before readAt, as commit timestamps of Spanner are ordered with reads.
+Without a stamp, it's fresh only if it's younger than stamps live. Errors of the cache are taken as stale.
+*/
+func (d dbClient) provablyFresh(ctx context.Context, userID string, readAt time.Time) bool {
+	stamper, ok := d.Cache.(WriteStamper)
+	if !ok || readAt.IsZero() {
+		return false
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ValidateCache")
+	defer span.End()
+
+	done := budget.Track(ctx, budget.Redis)
+	last, found, err := stamper.LastWrite(writeStampKey(userID))
+	done()
+	if err != nil {
+		log.Println("UserItems", HashID(userID), "could not validate cache", err)
+		return false
+	}
+	if !found {
+		return time.Since(readAt) < writeStampTTL
+	}
+	return !last.After(readAt)
+}
+
+// StampWrite keeps at in microseconds, as commit timestamps are, and numbers of Lua are exact only up to 2^53
+func (c *Caching) StampWrite(key string, at time.Time) error {
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err := luascript.SetMax.Run(c.RedisClient, []string{key}, at.UnixMicro(), writeStampTTL.Milliseconds()).Err()
+	c.Health.Observe(err)
+	return err
+}
+
+// LastWrite is read from the primary, replicas may not have the stamp of the write yet
+func (c *Caching) LastWrite(key string) (time.Time, bool, error) {
+	if !c.Health.Usable() {
+		return time.Time{}, false, errCacheDown
+	}
+	data, err := c.RedisClient.Get(key).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	c.Health.Observe(err)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	micros, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMicro(micros), true, nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+Item catalog, to manage items without writing SQL.
+Cached UserItems have item names in them, so a renamed item shows its old name until the entries expire.
+The catalog cache is invalidated after each change, see CatalogCache.
+*/
+
+// add an item to the catalog, AlreadyExists if the item_id is used
+func (d dbClient) CreateItem(ctx context.Context, w io.Writer, i domain.Item) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreateItem")
+	defer span.End()
+
+	now := time.Now()
+	err := d.apply(ctx, "CreateItem", []*spanner.Mutation{
+		spanner.InsertMap("items", map[string]interface{}{
+			"item_id":    i.ID,
+			"item_name":  i.Name,
+			"price":      i.Price,
+			"created_at": now,
+			"updated_at": now,
+		}),
+	})
+	d.invalidateCatalog(ctx, err)
+	return err
+}
+
+// get an item of the catalog, NotFound if it doesn't exist
+func (d dbClient) Item(ctx context.Context, w io.Writer, itemID string) (domain.Item, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Item")
+	defer span.End()
+
+	return d.item(ctx, itemID)
+}
+
+// list items in the order of item_id, paginated in the same way as ListUsers
+func (d dbClient) ListItems(ctx context.Context, w io.Writer, limit int, cursor string) ([]domain.Item, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListItems")
+	defer span.End()
+
+	limit = pageSize(limit)
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT item_id, item_name, price FROM items WHERE item_id > @after ORDER BY item_id LIMIT @limit`,
+		Params: map[string]interface{}{
+			"after": after,
+			"limit": limit + 1,
+		},
+	}
+	items := make([]domain.Item, 0, limit+1)
+	err = d.ForEachRow(ctx, "ListItems", stmt, func(row *spanner.Row) error {
+		var itemID, name string
+		var price int64
+		if err := row.Columns(&itemID, &name, &price); err != nil {
+			return err
+		}
+		i, err := domain.NewItem(itemID, name, price)
+		if err != nil {
+			return err
+		}
+		items = append(items, i)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+	return items, encodeCursor(items[limit-1].ID), nil
+}
+
+// change name and price of an item, NotFound if it doesn't exist
+func (d dbClient) UpdateItem(ctx context.Context, w io.Writer, i domain.Item) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UpdateItem")
+	defer span.End()
+
+	err := d.apply(ctx, "UpdateItem", []*spanner.Mutation{
+		spanner.UpdateMap("items", map[string]interface{}{
+			"item_id":    i.ID,
+			"item_name":  i.Name,
+			"price":      i.Price,
+			"updated_at": time.Now(),
+		}),
+	})
+	forget(ctx, "item_"+i.ID)
+	d.invalidateCatalog(ctx, err)
+	return err
+}
+
+/*
+delete an item from the catalog, NotFound if it doesn't exist.
+It fails with FailedPrecondition while any user has the item, by the foreign key of user_items.
+*/
+func (d dbClient) DeleteItem(ctx context.Context, w io.Writer, itemID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DeleteItem")
+	defer span.End()
+
+	_, err := d.readWriteTransaction(ctx, "DeleteItem", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// NotFound if the item doesn't exist
+		if _, err := txn.ReadRow(ctx, "items", spanner.Key{itemID}, []string{"item_id"}); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("items", spanner.Key{itemID})})
+	})
+	forget(ctx, "item_"+itemID)
+	d.invalidateCatalog(ctx, err)
+	return err
+}
+
+// only after the catalog is changed
+func (d dbClient) invalidateCatalog(ctx context.Context, err error) {
+	if d.Catalog != nil && err == nil {
+		d.Catalog.Invalidate(ctx)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+const catalogCacheKey = "Catalog"
+
+// the whole catalog at a time, Version is when it started to be loaded from Spanner
+type catalogSnapshot struct {
+	Version int64                  `json:"version"`
+	Items   map[string]domain.Item `json:"items"`
+}
+
+/*
+CatalogCache keeps the whole item catalog in process, it's small, hot and rarely changes.
+It's shared among instances as a single versioned blob in the Cacher, and a newer version wins over an older one.
+Loads from Spanner are done once at a time in process, and instances refresh at jittered times,
+so an expired blob doesn't make all of them hit Spanner at once.
+Item mutations of this instance invalidate it at once, other instances see them by the next refresh.
+*/
+type CatalogCache struct {
+	load  func(context.Context) (catalogSnapshot, error)
+	cache Cacher
+	ttl   time.Duration
+
+	group    singleflight.Group
+	mu       sync.RWMutex
+	snapshot catalogSnapshot
+}
+
+// NewCatalogCache returns the cache of the client's catalog, c can be nil to keep it only in process
+func NewCatalogCache(d dbClient, c Cacher, refresh time.Duration) *CatalogCache {
+	return &CatalogCache{load: d.loadCatalog, cache: c, ttl: refresh}
+}
+
+/*
+Refresh adopts the shared blob, or loads the catalog if it's expired.
+It's run by the scheduler of the api every refresh interval, which is the ttl of the blob, with jitter up to a tenth of it.
+*/
+func (cc *CatalogCache) Refresh(ctx context.Context) error {
+	return cc.refresh(ctx, false)
+}
+
+// Item looks up the item in process, false if it's not known yet
+func (cc *CatalogCache) Item(itemID string) (domain.Item, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	item, ok := cc.snapshot.Items[itemID]
+	return item, ok
+}
+
+/*
+Invalidate drops the shared blob and loads the catalog again, it's called after the catalog is changed.
+It waits for the load, so the change is seen by the next request to this instance.
+*/
+func (cc *CatalogCache) Invalidate(ctx context.Context) {
+	if err := cc.cache.Del(catalogCacheKey); err != nil {
+		log.Println("CatalogCache", err)
+	}
+	if err := cc.refresh(ctx, true); err != nil {
+		log.Println("CatalogCache", err)
+	}
+}
+
+// refresh adopts the shared blob if it's newer, or loads from Spanner if there isn't, or always if force
+func (cc *CatalogCache) refresh(ctx context.Context, force bool) error {
+	if !force && cc.cache != nil {
+		if data, err := cc.cache.Get(catalogCacheKey); err == nil {
+			var s catalogSnapshot
+			if err := json.Unmarshal([]byte(data), &s); err == nil {
+				cc.adopt(s)
+				return nil
+			}
+		}
+	}
+
+	// a forced one doesn't join a running load, which may have started before the change
+	if force {
+		return cc.loadAndShare(ctx)
+	}
+	// concurrent callers share the load
+	_, err, _ := cc.group.Do("load", func() (interface{}, error) {
+		return nil, cc.loadAndShare(ctx)
+	})
+	return err
+}
+
+func (cc *CatalogCache) loadAndShare(ctx context.Context) error {
+	s, err := cc.load(ctx)
+	if err != nil {
+		return err
+	}
+	cc.adopt(s)
+	cc.share(s)
+	return nil
+}
+
+// refreshLater is for lookups which miss an item, the refresh is shared with the ones running already
+func (cc *CatalogCache) refreshLater() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cc.refresh(ctx, false); err != nil {
+			log.Println("CatalogCache", err)
+		}
+	}()
+}
+
+func (cc *CatalogCache) adopt(s catalogSnapshot) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if s.Version > cc.snapshot.Version {
+		cc.snapshot = s
+	}
+}
+
+// caching is best effort, errors are just logged
+func (cc *CatalogCache) share(s catalogSnapshot) {
+	if cc.cache == nil {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Println("CatalogCache", err)
+		return
+	}
+	if setter, ok := cc.cache.(CacheTTLSetter); ok {
+		err = setter.SetWithTTL(catalogCacheKey, string(data), cc.ttl)
+	} else {
+		err = cc.cache.Set(catalogCacheKey, string(data))
+	}
+	if err != nil {
+		log.Println("CatalogCache", err)
+	}
+}
+
+// all items of the catalog, the version is taken before the query not to be newer than what it has read
+func (d dbClient) loadCatalog(ctx context.Context) (catalogSnapshot, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "loadCatalog")
+	defer span.End()
+	// the catalog is read whole by design, even in a request
+	ctx = WithRowLimit(ctx, 0)
+
+	s := catalogSnapshot{Version: time.Now().UnixNano(), Items: map[string]domain.Item{}}
+	stmt := spanner.Statement{SQL: `SELECT item_id, item_name, price FROM items`}
+	err := d.ForEachRow(ctx, "loadCatalog", stmt, func(row *spanner.Row) error {
+		var itemID, name string
+		var price int64
+		if err := row.Columns(&itemID, &name, &price); err != nil {
+			return err
+		}
+		i, err := domain.NewItem(itemID, name, price)
+		if err != nil {
+			return err
+		}
+		s.Items[itemID] = i
+		return nil
+	})
+	span.SetAttributes(attribute.Int("catalog.items", len(s.Items)))
+	return s, err
+}
+
+/*
+queryUserItemsByCatalog is queryUserItems without the join of items, item names are looked up in process.
+It returns false if an item is not in the catalog, like the one created by another instance just now,
+then the caller queries with the join, and the catalog is refreshed in background.
+*/
+func (d dbClient) queryUserItemsByCatalog(ctx context.Context, userID string, staleness Staleness) (domain.Inventory, time.Time, bool, error) {
+
+	stmt := spanner.Statement{
+		SQL: `select users.name,user_items.item_id,user_items.quantity
+		from user_items join users on users.user_id = user_items.user_id
+		where user_items.user_id = @user_id`,
+		Params: map[string]interface{}{
+			"user_id": userID,
+		},
+	}
+
+	results := make(domain.Inventory, 0, 100)
+	known := true
+	var readAt time.Time
+	err := d.retry(ctx, "UserItemsByCatalog", func(ctx context.Context) error {
+		results = results[:0]
+		known = true
+		// in a single use transaction, not by ForEachRow, for the bound and the read timestamp
+		txn := d.Sc.Single().WithTimestampBound(staleness.timestampBound())
+		defer txn.Close()
+		err := forEachRow(ctx, txn, "UserItemsByCatalog", stmt, func(row *spanner.Row) error {
+			var userName string
+			var itemID string
+			var quantity int64
+			if err := row.Columns(&userName, &itemID, &quantity); err != nil {
+				return err
+			}
+			catalogItem, ok := d.Catalog.Item(itemID)
+			if !ok {
+				known = false
+				return errStopRows
+			}
+			item, err := domain.NewOwnedItem(userName, catalogItem.Name, itemID, quantity)
+			if err != nil {
+				return err
+			}
+			results = append(results, item)
+			return nil
+		})
+		if err != nil || !known {
+			return err
+		}
+		readAt, err = txn.Timestamp()
+		return err
+	})
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	if !known {
+		catalogLookups.WithLabelValues("miss").Inc()
+		d.Catalog.refreshLater()
+		return nil, time.Time{}, false, nil
+	}
+	catalogLookups.WithLabelValues("hit").Inc()
+	return results, readAt, true, nil
+}
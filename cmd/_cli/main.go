@@ -18,6 +18,7 @@ import (
 var (
 	spannerString = os.Getenv("SPANNER_STRING")
 	redisHost     = os.Getenv("REDIS_HOST")
+	validRules    = os.Getenv("VALIDATION_RULES")
 )
 
 type Serving struct {
@@ -33,6 +34,10 @@ func main() {
 
 	ctx := context.Background()
 
+	if err := game.ConfigureValidation(validRules); err != nil {
+		log.Fatal(err)
+	}
+
 	rdb := redis.NewClient(&redis.Options{
 		Addr:        redisHost,
 		Password:    "",
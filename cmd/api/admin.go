@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+// an admin recalls the item from all users, the item stays in the catalog
+func (s Serving) revokeItem(w http.ResponseWriter, r *http.Request) {
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "revokeItem.root")
+	span.SetAttributes(attribute.String("server", "revokeItem"))
+	defer span.End()
+
+	report, err := s.Client.RevokeItem(ctx, w, itemID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Warn("item has been revoked", "item_id", itemID, "users", report.Users, "removed", report.Removed, "caller", internal.IdentityFromContext(ctx).Caller)
+	render.JSON(w, r, report)
+}
+
+func (s Serving) sloSummary(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, s.SLOTracker.Summary())
+}
+
+// live stats for the dashboard, updated every few seconds
+func (s Serving) stats(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, s.Stats.Summary())
+}
+
+func (s Serving) jobStatus(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, s.Scheduler.Status())
+}
+
+var (
+	standbyStatusDoc = internal.OpenAPIOperation{Summary: "Where cache reads go, and the lag and the sizes of the primary and the standby redis", Response: game.StandbyStatus{}}
+	switchStandbyDoc = internal.OpenAPIOperation{Summary: "Switch cache reads of all the instances over to the standby redis or back to the primary", Request: standbySwitch{}, Response: game.StandbyStatus{}}
+)
+
+type standbySwitch struct {
+	ReadingStandby bool `json:"reading_standby"`
+}
+
+// the sizes are of the whole redis, the status is answered without them if either can't be counted
+func (s Serving) standbyStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Standby.Status()
+	if err != nil {
+		logger.Warn("could not count keys of redis", "error", err.Error())
+	}
+	render.JSON(w, r, status)
+}
+
+// other instances follow the switch within the health interval of redis
+func (s Serving) switchStandby(w http.ResponseWriter, r *http.Request) {
+	var body standbySwitch
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Standby.SwitchReads(body.ReadingStandby); err != nil {
+		errorRender(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	logger.Info("cache reads are switched", "reading_standby", body.ReadingStandby, "caller", internal.IdentityFromContext(r.Context()).Caller)
+	s.standbyStatus(w, r)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+API keys are minted and revoked by admins, they are required for mutations only when API_KEYS is set.
+Mint them before setting it, or use "create-api-key" command for the first admin.
+*/
+
+type apiKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// the key is in the response of creation only, it's never shown again
+type apiKeyResponse struct {
+	game.APIKey
+	Key string `json:"key"`
+}
+
+func (s Serving) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body apiKeyRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	key, secret, err := s.APIKeys.CreateAPIKey(r.Context(), body.Name)
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("api key has been created", "key_id", key.ID, "name", key.Name, "caller", internal.IdentityFromContext(r.Context()).Caller)
+	render.JSON(w, r, apiKeyResponse{APIKey: key, Key: secret})
+}
+
+func (s Serving) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.APIKeys.ListAPIKeys(r.Context())
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, keys)
+}
+
+func (s Serving) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "key_id")
+	err := s.APIKeys.RevokeAPIKey(r.Context(), keyID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("api key has been revoked", "key_id", keyID, "caller", internal.IdentityFromContext(r.Context()).Caller)
+	render.JSON(w, r, map[string]string{})
+}
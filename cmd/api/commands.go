@@ -0,0 +1,323 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+/*
+One-shot commands run by the same binary instead of serving, like
+"./main rebuild-projection".
+They are useful as Cloud Run jobs or from Cloud Scheduler.
+*/
+func runCommand(ctx context.Context, args []string) error {
+
+	// against another environment, not the database of this one
+	switch args[0] {
+	case "replay":
+		return replayCommand(ctx, args[1:])
+	case "smoke":
+		return smokeCommand(ctx, args[1:])
+	}
+
+	deps, err := game.ParseDependencies(dependencies)
+	if err != nil {
+		return err
+	}
+	client, err := game.NewClient(ctx, spannerString, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Sc.Close()
+	client.Timeout = time.Duration(deps.Spanner.Timeout)
+
+	switch args[0] {
+	case "rebuild-projection":
+		n, err := client.RebuildUserItems(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Info("user_items has been rebuilt", "events", n)
+	case "recount-items":
+		// backfill users.item_count after the column is added
+		n, err := client.RecountItems(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Info("item_count has been recounted", "users", n)
+	case "reconcile-wallets":
+		drifts, err := client.ReconcileWallets(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range drifts {
+			logger.Warn("balance doesn't match the ledger", "user.id", game.HashID(d.UserID), "balance", d.Balance, "ledger_sum", d.LedgerSum)
+		}
+		if len(drifts) > 0 {
+			return fmt.Errorf("%d wallets don't match their ledger", len(drifts))
+		}
+		logger.Info("all wallets match their ledger")
+	case "export-user-items":
+		// newline delimited json to stdout, which can be loaded to BigQuery as it is
+		var mu sync.Mutex
+		enc := json.NewEncoder(os.Stdout)
+		n, err := client.ExportUserItems(ctx, 8, func(row game.UserItemRow) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return enc.Encode(row)
+		})
+		if err != nil {
+			return err
+		}
+		// stdout is for the rows, so report to stderr
+		log.Printf("%d rows of user_items has been exported\n", n)
+	case "rewrap-user-pii":
+		// run after rotating the key, rows are readable with both of the keys meanwhile
+		pii, closePII, err := newEnvelope(ctx)
+		if err != nil {
+			return err
+		}
+		defer closePII()
+		client.Envelope = pii
+		n, err := client.RewrapUserPII(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Info("user_pii has been rewrapped", "rows", n)
+	case "reset":
+		if len(args) < 2 || args[1] != "--confirm" {
+			return fmt.Errorf("reset deletes all game data of %s, run it with --confirm", databaseName())
+		}
+		var cache *game.Caching
+		if redisHost != "" {
+			redisConfig, err := game.ParseRedisConfig(redisMode, redisHost, redisMaster, redisPassword)
+			if err != nil {
+				return err
+			}
+			rdb := game.NewRedisClient(redisConfig, deps.Redis)
+			defer rdb.Close()
+			cache = &game.Caching{RedisClient: rdb}
+		}
+		var pubsubClient *pubsub.Client
+		if resetSubs != "" {
+			if pubsubClient, err = pubsub.NewClient(ctx, projectId); err != nil {
+				return err
+			}
+			defer pubsubClient.Close()
+		}
+		report, err := resetWorkshop(ctx, client, cache, pubsubClient)
+		if err != nil {
+			return err
+		}
+		logger.Info("workshop has been reset", "tables", report.Tables, "redis_keys", report.RedisKeys, "subscriptions", report.Subscriptions)
+	case "create-api-key":
+		// to mint the first key of an admin, whose name is in ADMIN_CALLERS
+		if len(args) < 2 {
+			return fmt.Errorf("name of the key is required")
+		}
+		key, secret, err := client.CreateAPIKey(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		// stdout is for the key, so report to stderr
+		log.Printf("api key %s has been created for %s, it's not shown again\n", key.ID, key.Name)
+		fmt.Println(secret)
+	case "revoke-api-key":
+		if len(args) < 2 {
+			return fmt.Errorf("key_id is required")
+		}
+		if err := client.RevokeAPIKey(ctx, args[1]); err != nil {
+			return err
+		}
+		logger.Info("api key has been revoked", "key_id", args[1])
+	case "archive-expired":
+		if archiveBucket == "" {
+			return fmt.Errorf("ARCHIVE_BUCKET is required")
+		}
+		return archiveExpired(ctx, client)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	return nil
+}
+
+type retentionClient interface {
+	ArchiveExpiredRows(context.Context, game.RetentionPolicy, time.Time, func(map[string]interface{}) error) (int64, error)
+	DeleteExpiredRows(context.Context, game.RetentionPolicy, time.Time) (int64, error)
+	AcquireLease(context.Context, string, string, time.Duration) error
+	ReleaseLease(context.Context, string, string) error
+}
+
+const (
+	archiveLease    = "archive-expired"
+	archiveLeaseTTL = 30 * time.Minute
+)
+
+/*
+archiveExpired writes rows older than RETENTION_DAYS to ARCHIVE_BUCKET as newline delimited json,
+then deletes them only if the object has been written successfully.
+It's scheduled on every instance, and the command can be run at the same time, so only the one which has the lease archives,
+and the others return without doing anything.
+*/
+func archiveExpired(ctx context.Context, client retentionClient) error {
+
+	holder := "archive-" + uuid.NewString()
+	err := client.AcquireLease(ctx, archiveLease, holder, archiveLeaseTTL)
+	if errors.Is(err, game.ErrLeaseHeld) {
+		logger.Info("archiving is running on another one", "error", err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := client.ReleaseLease(context.Background(), archiveLease, holder); err != nil {
+			logger.Warn("could not release the lease of archiving", "error", err.Error())
+		}
+	}()
+
+	days := 90
+	if retentionDays != "" {
+		var err error
+		if days, err = strconv.Atoi(retentionDays); err != nil {
+			return fmt.Errorf("RETENTION_DAYS: %w", err)
+		}
+	}
+
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcs.Close()
+
+	start := time.Now()
+	before := start.AddDate(0, 0, -days)
+	for _, p := range game.RetentionPolicies {
+		// extended table by table, each of them is archived well within the ttl
+		if err := client.AcquireLease(ctx, archiveLease, holder, archiveLeaseTTL); err != nil {
+			return err
+		}
+		tableStart := time.Now()
+		name := fmt.Sprintf("%s/%s/%s.ndjson", p.Table, before.Format("2006-01-02"), start.Format("20060102T150405"))
+		// cancelling the context aborts the upload
+		wctx, cancel := context.WithCancel(ctx)
+		w := gcs.Bucket(archiveBucket).Object(name).NewWriter(wctx)
+		w.ContentType = "application/x-ndjson"
+		enc := json.NewEncoder(w)
+
+		archived, err := client.ArchiveExpiredRows(ctx, p, before, func(row map[string]interface{}) error {
+			return enc.Encode(row)
+		})
+		if err != nil {
+			cancel()
+			return fmt.Errorf("%s: %w", p.Table, err)
+		}
+		// the object is committed by Close, not to leave empty objects if nothing is expired
+		if archived == 0 {
+			cancel()
+			logger.Info("nothing to archive", "table", p.Table)
+			continue
+		}
+		err = w.Close()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Table, err)
+		}
+
+		deleted, err := client.DeleteExpiredRows(ctx, p, before)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Table, err)
+		}
+		logger.Info("expired rows has been archived",
+			"table", p.Table,
+			"object", fmt.Sprintf("gs://%s/%s", archiveBucket, name),
+			"archived", archived,
+			"deleted", deleted,
+			"duration", time.Since(tableStart).String(),
+		)
+	}
+	logger.Info("archiving has been completed", "before", before, "duration", time.Since(start).String())
+
+	return nil
+}
+
+type jobClient interface {
+	retentionClient
+	SweepStaleSagas(context.Context, time.Time) (int64, error)
+}
+
+/*
+background jobs run in the server process, main adds the ones which depend on the config, like the projector and the outbox relay.
+Slots are more than the long running jobs, so the ones every second are not held back by the archive.
+*/
+func newScheduler(client jobClient) (*internal.Scheduler, error) {
+	scheduler := internal.NewScheduler(4)
+
+	err := scheduler.Add(internal.Job{
+		Name:     "saga-sweeper",
+		Schedule: "*/5 * * * *",
+		Priority: 10,
+		Jitter:   30 * time.Second,
+		Timeout:  time.Minute,
+		Run: func(ctx context.Context) error {
+			n, err := client.SweepStaleSagas(ctx, time.Now().Add(-10*time.Minute))
+			if n > 0 {
+				logger.Warn("stale sagas has been marked as failed", "sagas", n)
+			}
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if archiveBucket != "" {
+		schedule := retentionCron
+		if schedule == "" {
+			schedule = "0 3 * * *"
+		}
+		err := scheduler.Add(internal.Job{
+			Name:     "archive-expired",
+			Schedule: schedule,
+			Jitter:   10 * time.Minute,
+			Timeout:  time.Hour,
+			Run: func(ctx context.Context) error {
+				return archiveExpired(ctx, client)
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return scheduler, nil
+}
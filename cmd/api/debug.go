@@ -0,0 +1,91 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+var startedAt = time.Now()
+
+// runtimeStats is a summary of runtime.MemStats and the scheduler, /debug/vars has all of MemStats
+type runtimeStats struct {
+	Goroutines     int     `json:"goroutines"`
+	GOMAXPROCS     int     `json:"gomaxprocs"`
+	HeapAlloc      uint64  `json:"heap_alloc_bytes"`
+	HeapInuse      uint64  `json:"heap_inuse_bytes"`
+	HeapObjects    uint64  `json:"heap_objects"`
+	NextGC         uint64  `json:"next_gc_bytes"`
+	Sys            uint64  `json:"sys_bytes"`
+	NumGC          uint32  `json:"num_gc"`
+	LastGCPauseMS  float64 `json:"last_gc_pause_ms"`
+	GCCPUFraction  float64 `json:"gc_cpu_fraction"`
+	UptimeSeconds  float64 `json:"uptime_seconds"`
+	LastGCUnixNano uint64  `json:"last_gc_unix_nano"`
+}
+
+func readRuntimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtimeStats{
+		Goroutines:     runtime.NumGoroutine(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		HeapAlloc:      m.HeapAlloc,
+		HeapInuse:      m.HeapInuse,
+		HeapObjects:    m.HeapObjects,
+		NextGC:         m.NextGC,
+		Sys:            m.Sys,
+		NumGC:          m.NumGC,
+		LastGCPauseMS:  float64(m.PauseNs[(m.NumGC+255)%256]) / float64(time.Millisecond),
+		GCCPUFraction:  m.GCCPUFraction,
+		UptimeSeconds:  time.Since(startedAt).Seconds(),
+		LastGCUnixNano: m.LastGC,
+	}
+}
+
+/*
+newDebugHandler serves pprof, expvar and runtime stats for latency investigations, like during load tests, without redeploying.
+It's for DEBUG_PORT, apart from the API, as profiles are expensive and tell much about the instance,
+so the port shouldn't be exposed like the API, and it requires admin callers with authorize, nil for none.
+*/
+func newDebugHandler(authorize ...func(http.Handler) http.Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(authorize...)
+
+	r.HandleFunc("/debug/pprof/*", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.Handle("/debug/vars", expvar.Handler())
+
+	r.Get("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, readRuntimeStats())
+	})
+	// to tell garbage from leaks, the stats after the collection are answered
+	r.Post("/debug/gc", func(w http.ResponseWriter, r *http.Request) {
+		runtime.GC()
+		render.JSON(w, r, readRuntimeStats())
+	})
+	return r
+}
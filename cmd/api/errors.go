@@ -0,0 +1,166 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+// errorKind is what went wrong from the view of clients, whichever of Spanner, the data layer or domain the error came from
+type errorKind int
+
+const (
+	kindInternal errorKind = iota
+	kindNotFound
+	kindAlreadyExists
+	kindInvalidArgument
+	kindUnavailable
+)
+
+// kindOf classifies the error, it's internal unless it's known to be one of the others
+func kindOf(err error) errorKind {
+	switch {
+	case errors.Is(err, domain.ErrInvalid), errors.Is(err, game.ErrInvalidCursor):
+		return kindInvalidArgument
+	case errors.Is(err, game.ErrCircuitOpen):
+		return kindUnavailable
+	}
+	switch spanner.ErrCode(err) {
+	case codes.NotFound:
+		return kindNotFound
+	case codes.AlreadyExists:
+		return kindAlreadyExists
+	case codes.InvalidArgument, codes.OutOfRange:
+		return kindInvalidArgument
+	case codes.Unavailable:
+		return kindUnavailable
+	}
+	return kindInternal
+}
+
+func (k errorKind) httpStatus() int {
+	switch k {
+	case kindNotFound:
+		return http.StatusNotFound
+	case kindAlreadyExists:
+		return http.StatusConflict
+	case kindInvalidArgument:
+		return http.StatusBadRequest
+	case kindUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (k errorKind) grpcCode() codes.Code {
+	switch k {
+	case kindNotFound:
+		return codes.NotFound
+	case kindAlreadyExists:
+		return codes.AlreadyExists
+	case kindInvalidArgument:
+		return codes.InvalidArgument
+	case kindUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+/*
+errorRender answers the error as {"ERROR": text, "code": stable code, "message": localized text}.
+Handlers pass the status they know the error by, and those which don't know better than 500 leave it to the kind of the error,
+so a NotFound of Spanner is answered as 404 wherever it comes from.
+*/
+var errorRender = func(w http.ResponseWriter, r *http.Request, httpCode int, err error) {
+	var se *spanner.Error
+	if errors.As(err, &se) {
+		spannerErrors.WithLabelValues(se.Code.String()).Inc()
+		spannerErrorsCounter.Add(r.Context(), 1, metric.WithAttributes(attribute.String("code", se.Code.String())))
+	}
+	if httpCode == http.StatusInternalServerError {
+		httpCode = kindOf(err).httpStatus()
+	}
+	// not to pile up requests on Spanner while it's failing, whatever the handler thought of the error
+	if errors.Is(err, game.ErrCircuitOpen) {
+		httpCode = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+	}
+	// however the handler took it, as it's not a failure of the server but of the request being too large
+	var tooManyRows *game.ErrTooManyRows
+	if errors.As(err, &tooManyRows) {
+		httpCode = http.StatusRequestEntityTooLarge
+	}
+	logger.Error(err.Error(), "http code", httpCode)
+	code := errorCode(httpCode, err)
+	body := map[string]interface{}{"ERROR": err.Error(), "code": code}
+	if messages != nil {
+		data := struct{ Path, RequestID string }{r.URL.Path, middleware.GetReqID(r.Context())}
+		message, tag := messages.Localize(r.Header.Get("Accept-Language"), code, data)
+		body["message"] = message
+		w.Header().Set("Content-Language", tag.String())
+	}
+	render.Status(r, httpCode)
+	render.JSON(w, r, body)
+}
+
+// codes of errors are stable for clients to branch on, their texts for people are in internal/messages
+func errorCode(httpCode int, err error) string {
+	switch {
+	case errors.Is(err, game.ErrInvalidCursor):
+		return "invalid_cursor"
+	case errors.Is(err, game.ErrInsufficientBalance):
+		return "insufficient_balance"
+	case errors.Is(err, game.ErrIdempotencyKeyReused):
+		return "idempotency_key_reused"
+	case errors.As(err, new(*game.ErrTooManyRows)):
+		return "too_many_rows"
+	// a conflict of its own, clients creating something can tell it's there already from other conflicts
+	case httpCode == http.StatusConflict && kindOf(err) == kindAlreadyExists:
+		return "already_exists"
+	}
+	switch httpCode {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthenticated"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusPreconditionRequired:
+		return "precondition_required"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusNotImplemented:
+		return "not_implemented"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "internal"
+}
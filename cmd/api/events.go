@@ -0,0 +1,122 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+)
+
+const (
+	eventsPollInterval = 1 * time.Second
+	eventsHeartbeat    = 15 * time.Second
+	// the stream is ended before the request timeout, and EventSource reconnects with Last-Event-ID
+	eventsTimeoutMargin = 5 * time.Second
+	eventsRetry         = 1 * time.Second
+)
+
+/*
+streamUserEvents is the Server-Sent Events stream of item changes of the user, for clients that can't use WebSockets.
+It replays recent changes kept in Redis, or the ones after Last-Event-ID on reconnection, and tails new ones.
+The event name is the type of the change, like "item_added", and the data is domain.ItemChanged as json.
+*/
+func (s Serving) streamUserEvents(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "streamUserEvents.root")
+	span.SetAttributes(attribute.String("server", "streamUserEvents"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.Activity == nil {
+		errorRender(w, r, http.StatusNotImplemented, errors.New("event stream is not available"))
+		return
+	}
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = "0"
+	}
+	if !game.ValidActivityID(after) {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %q", after))
+		return
+	}
+
+	// the first read is before the response, so an error can still be told by the status
+	activities, err := s.Activity.UserActivity(userID, after)
+	if err != nil {
+		errorRender(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	var end <-chan time.Time
+	if deadline, ok := ctx.Deadline(); ok {
+		end = time.After(time.Until(deadline) - eventsTimeoutMargin)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// not to be buffered by proxies
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+	for {
+		for _, a := range activities {
+			data, err := json.Marshal(a.Change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", a.ID, a.Change.Type, data)
+			after = a.ID
+		}
+		if len(activities) > 0 || time.Since(lastWrite) > eventsHeartbeat {
+			if len(activities) == 0 {
+				fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-end:
+			return
+		case <-ticker.C:
+		}
+
+		activities, err = s.Activity.UserActivity(userID, after)
+		if err != nil {
+			// the client reconnects with the last id, after cache comes back
+			logger.Warn("event stream", "error", err.Error())
+			return
+		}
+	}
+}
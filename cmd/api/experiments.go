@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+// the experiment whose variants are cache strategies, see cacheRollout
+const cacheStrategyExperiment = "cache_strategy"
+
+/*
+cacheRollout rolls cache strategies out by the experiment cache_strategy, its variants are strategies and their weights are percentages,
+like [{"name":"cache_strategy","salt":"cs1","variants":[{"name":"cache-aside","weight":90},{"name":"write-through","weight":10}]}].
+A user keeps its strategy as long as the salt and the weights are kept, and it labels the cache metrics of the user.
+It's nil without the experiment, then every user is of CACHE_STRATEGY.
+*/
+func cacheRollout(experiments []internal.Experiment) (game.CacheRollout, error) {
+	for _, e := range experiments {
+		if e.Name != cacheStrategyExperiment {
+			continue
+		}
+		for _, v := range e.Variants {
+			if _, err := game.ParseCacheStrategy(v.Name); err != nil || v.Name == "" {
+				return nil, fmt.Errorf("variants of experiment %s have to be cache strategies, not %q", e.Name, v.Name)
+			}
+		}
+		e := e
+		return func(userID string) game.CacheStrategy {
+			return game.CacheStrategy(e.Assign(userID))
+		}, nil
+	}
+	return nil, nil
+}
+
+func (s Serving) getExperiments(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	_, span := otel.Tracer("main").Start(ctx, "getExperiments.root")
+	span.SetAttributes(attribute.String("server", "getExperiments"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	experiments := internal.ExperimentsFromContext(ctx)
+	if experiments == nil {
+		experiments = map[string]string{}
+	}
+	render.JSON(w, r, map[string]interface{}{"user_id": userID, "experiments": experiments})
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/render"
+	"github.com/graphql-go/graphql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors,omitempty"`
+}
+
+var errActingAsOther = errors.New("acting as another user than the requested one")
+
+/*
+newGraphQLSchema resolves users and their items by the same client as the HTTP API.
+Items of each user are read one by one, so a page of users costs a query per user unless they are cached.
+*/
+func newGraphQLSchema(client game.GameUserOperation) (graphql.Schema, error) {
+	ownedItem := graphql.NewObject(graphql.ObjectConfig{
+		Name: "OwnedItem",
+		Fields: graphql.Fields{
+			"itemId": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(domain.OwnedItem).ItemID, nil
+			}},
+			"itemName": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(domain.OwnedItem).ItemName, nil
+			}},
+		},
+	})
+
+	user := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(domain.User).ID, nil
+			}},
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(domain.User).Name, nil
+			}},
+			"items": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(ownedItem))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				items, err := client.UserItems(p.Context, io.Discard, p.Source.(domain.User).ID)
+				if err != nil {
+					return nil, err
+				}
+				return []domain.OwnedItem(items), nil
+			}},
+		},
+	})
+
+	userPage := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserPage",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(user))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(map[string]interface{})["users"], nil
+			}},
+			"nextCursor": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if next := p.Source.(map[string]interface{})["next_cursor"].(string); next != "" {
+					return next, nil
+				}
+				return nil, nil
+			}},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: user,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					userID := p.Args["id"].(string)
+					if identity := internal.IdentityFromContext(p.Context); identity.Impersonating() && identity.ActingAs != userID {
+						return nil, errActingAsOther
+					}
+					profile, err := client.UserProfile(p.Context, io.Discard, userID)
+					if spanner.ErrCode(err) == codes.NotFound {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					return profile.User, nil
+				},
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(userPage),
+				Args: graphql.FieldConfigArgument{
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+					"cursor": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if internal.IdentityFromContext(p.Context).Impersonating() {
+						return nil, errActingAsOther
+					}
+					limit, _ := p.Args["limit"].(int)
+					cursor, _ := p.Args["cursor"].(string)
+					users, next, err := client.ListUsers(p.Context, io.Discard, limit, cursor)
+					if err != nil {
+						return nil, err
+					}
+					return map[string]interface{}{"users": users, "next_cursor": next}, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// graphqlHandler takes a query by POST as json, or by GET as query params
+func graphqlHandler(schema graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := otel.Tracer("main").Start(r.Context(), "graphql.root")
+		span.SetAttributes(attribute.String("server", "graphql"))
+		defer span.End()
+
+		req := graphqlRequest{Query: r.URL.Query().Get("query"), OperationName: r.URL.Query().Get("operationName")}
+		if r.Method == http.MethodPost {
+			if err := render.DecodeJSON(r.Body, &req); err != nil {
+				errorRender(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		span.SetAttributes(attribute.String("graphql.operation", req.OperationName))
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        ctx,
+		})
+		for _, err := range result.Errors {
+			logger.Error(err.Error(), "graphql operation", req.OperationName)
+		}
+		// errors are in the body as GraphQL does, not in the status code
+		render.JSON(w, r, result)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/gamepb"
+)
+
+/*
+gRPC surface of the same operations as the HTTP API, served on GRPC_PORT.
+The deadline of a call is in its context, so it's propagated to Spanner and to the upstream services.
+*/
+type grpcServing struct {
+	gamepb.UnimplementedGameServer
+	Client game.GameUserOperation
+}
+
+/*
+how each method is authorized, as the route of HTTP of the same operation,
+so the rate limits and the checks of users are shared by both
+*/
+var grpcMethods = map[string]internal.GRPCMethod{
+	gamepb.Game_CreateUser_FullMethodName: {Method: http.MethodPost, Route: "/api/user"},
+	gamepb.Game_AddItemToUser_FullMethodName: {
+		Method: http.MethodPut,
+		Route:  "/api/user_id/{user_id}/{item_id}",
+		UserID: func(req interface{}) string { return req.(*gamepb.AddItemToUserRequest).GetUserId() },
+	},
+	gamepb.Game_UserItems_FullMethodName: {
+		Method: http.MethodGet,
+		Route:  "/api/user_id/{user_id}",
+		UserID: func(req interface{}) string { return req.(*gamepb.UserItemsRequest).GetUserId() },
+	},
+	healthpb.Health_Check_FullMethodName: {Public: true},
+}
+
+/*
+newGRPCServer also registers the standard health and reflection services, for load balancers and grpcurl.
+Health is SERVING for both the server and game.v1.Game, call Shutdown of it before stopping the server,
+so load balancers stop sending new calls while in-flight ones are drained.
+Calls are authenticated by the metadata as requests of /api are by the headers, and limited by the same limits.
+*/
+func newGRPCServer(client game.GameUserOperation, authorizer *internal.Authorizer, limiter *internal.RateLimiter) (*grpc.Server, *health.Server) {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		// rejected calls are not logged as errors, as requests rejected by the middlewares are not
+		internal.UnaryServerInterceptor(authorizer, limiter, grpcMethods),
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			// the same as the memo middleware of HTTP
+			resp, err := handler(game.WithMemo(ctx), req)
+			if err != nil {
+				logger.Error(err.Error(), "grpc method", info.FullMethod)
+			}
+			return resp, err
+		},
+	))
+	gamepb.RegisterGameServer(s, grpcServing{Client: client})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(gamepb.Game_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+	reflection.Register(s)
+	return s, healthServer
+}
+
+// map errors of the data layer to status codes, as errorRender does to http ones
+func grpcError(err error) error {
+	if kind := kindOf(err); kind != kindInternal {
+		return status.Error(kind.grpcCode(), err.Error())
+	}
+	if code := spanner.ErrCode(err); code != codes.Unknown {
+		return status.Error(code, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s grpcServing) CreateUser(ctx context.Context, req *gamepb.CreateUserRequest) (*gamepb.User, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grpc.CreateUser.root")
+	span.SetAttributes(attribute.String("server", "grpc.CreateUser"))
+	defer span.End()
+
+	userId, _ := uuid.NewRandom()
+	user, err := domain.NewUser(userId.String(), req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err := s.Client.CreateUser(ctx, io.Discard, game.UserParams{UserID: user.ID, UserName: user.Name}); err != nil {
+		return nil, grpcError(err)
+	}
+	return &gamepb.User{Id: user.ID, Name: user.Name}, nil
+}
+
+func (s grpcServing) AddItemToUser(ctx context.Context, req *gamepb.AddItemToUserRequest) (*gamepb.AddItemToUserResponse, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grpc.AddItemToUser.root")
+	span.SetAttributes(attribute.String("server", "grpc.AddItemToUser"), attribute.String("user.id", game.HashID(req.GetUserId())))
+	defer span.End()
+
+	err := s.Client.AddItemToUser(ctx, io.Discard, game.UserParams{UserID: req.GetUserId()}, game.ItemParams{ItemID: req.GetItemId()})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gamepb.AddItemToUserResponse{}, nil
+}
+
+func (s grpcServing) UserItems(ctx context.Context, req *gamepb.UserItemsRequest) (*gamepb.UserItemsResponse, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grpc.UserItems.root")
+	span.SetAttributes(attribute.String("server", "grpc.UserItems"), attribute.String("user.id", game.HashID(req.GetUserId())))
+	defer span.End()
+
+	items, err := s.Client.UserItems(ctx, io.Discard, req.GetUserId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &gamepb.UserItemsResponse{Items: make([]*gamepb.OwnedItem, 0, len(items))}
+	for _, item := range items {
+		res.Items = append(res.Items, &gamepb.OwnedItem{UserName: item.UserName, ItemName: item.ItemName, ItemId: item.ItemID, Quantity: item.Quantity})
+	}
+	return res, nil
+}
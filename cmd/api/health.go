@@ -0,0 +1,135 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/go-chi/render"
+)
+
+// how long a dependency is given to answer /readyz, a probe shouldn't hang on a dependency which hangs
+const readinessTimeout = 2 * time.Second
+
+/*
+readinessCheck is a dependency checked by /readyz.
+An optional one is reported but doesn't make the instance unready, like redis, which requests fall back from to Spanner.
+*/
+type readinessCheck struct {
+	Name     string
+	Optional bool
+	Check    func(context.Context) error
+}
+
+type dependencyStatus struct {
+	// "ok" or "down"
+	Status    string  `json:"status"`
+	Optional  bool    `json:"optional,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readiness struct {
+	// "ok", "degraded" while an optional dependency is down, or "unavailable" while a required one is
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+	// the health state requests look at, it can be down for a while after failures even if PING is answered
+	Redis string `json:"redis"`
+}
+
+// the topic is checked by its existence, as publishing fails once it's deleted
+func topicCheck(client *pubsub.Client, topicName string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		exists, err := client.Topic(topicName).Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("topic %s doesn't exist", topicName)
+		}
+		return nil
+	}
+}
+
+// run the check until the timeout, checks without a context like of redis are left behind when it's over
+func runCheck(ctx context.Context, c readinessCheck) dependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- c.Check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	status := dependencyStatus{Status: "ok", Optional: c.Optional, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		status.Status = "down"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+/*
+readyz checks the dependencies at once, and answers 503 while a required one is down,
+so a load balancer stops sending requests which would fail anyway.
+*/
+func (s Serving) readyz(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: "ok", Dependencies: map[string]dependencyStatus{}, Redis: s.CacheHealth.State().String()}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range s.Readiness {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			status := runCheck(r.Context(), c)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Dependencies[c.Name] = status
+		}(c)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, status := range result.Dependencies {
+		switch {
+		case status.Status == "ok":
+		case !status.Optional:
+			result.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		case result.Status == "ok":
+			result.Status = "degraded"
+		}
+	}
+	render.Status(r, code)
+	render.JSON(w, r, result)
+}
+
+// healthz is liveness, it doesn't look at dependencies, as restarting the instance doesn't fix them
+func (s Serving) healthz(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, map[string]string{"status": "ok"})
+}
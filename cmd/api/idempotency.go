@@ -0,0 +1,120 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+const (
+	// set on responses replayed to retries, not on the first one
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKey         = 255
+)
+
+/*
+idempotent makes retries of a mutation with the same Idempotency-Key get the response of the first one, instead of running it again.
+Keys are scoped by the caller, and a key used with another method, path or body is refused.
+Responses of server errors are not kept, so the retries of them run again, as they may not have changed anything.
+Requests without the header are served as usual.
+*/
+func (s Serving) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(internal.IdempotencyKeyHeader)
+		if s.Idempotency == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("%s is longer than %d", internal.IdempotencyKeyHeader, maxIdempotencyKey))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			errorRender(w, r, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		scoped := hashOf(internal.IdentityFromContext(ctx).Caller, key)
+		replay, err := s.Idempotency.ClaimIdempotencyKey(ctx, scoped, hashOf(r.Method, r.URL.Path, string(body)))
+		switch {
+		case errors.Is(err, game.ErrIdempotencyKeyReused):
+			errorRender(w, r, http.StatusUnprocessableEntity, err)
+			return
+		case errors.Is(err, game.ErrIdempotencyInFlight):
+			w.Header().Set("Retry-After", "1")
+			errorRender(w, r, http.StatusConflict, err)
+			return
+		case err != nil:
+			errorRender(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if replay != nil {
+			w.Header().Set("Content-Type", replay.ContentType)
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(replay.StatusCode)
+			w.Write(replay.Body)
+			return
+		}
+
+		var recorded bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&recorded)
+		next.ServeHTTP(ww, r)
+
+		// not to lose the result to the cancel of the client, who is the one to retry
+		ctx = context.WithoutCancel(ctx)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError {
+			if err := s.Idempotency.ReleaseIdempotencyKey(ctx, scoped); err != nil {
+				logger.Warn("could not release idempotency key", "error", err.Error())
+			}
+			return
+		}
+		resp := game.IdempotentResponse{StatusCode: status, ContentType: ww.Header().Get("Content-Type"), Body: recorded.Bytes()}
+		if err := s.Idempotency.CompleteIdempotencyKey(ctx, scoped, resp); err != nil {
+			// retries run it again after the lease, as if the response was lost
+			logger.Warn("could not complete idempotency key", "error", err.Error())
+		}
+	})
+}
+
+// hex sha256 of the parts, which are separated not to be confused with their concatenation
+func hashOf(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+)
+
+// larger datasets are split into requests, they have to be written in the timeout of a request
+const maxImportBody = 32 << 20
+
+/*
+importHandler is POST /admin/import, for admins only, the body is newline delimited json of game.ImportRecord.
+Every line is checked before anything is written, then the answer is newline delimited json as well,
+a line of game.ImportProgress as groups are written and the game.ImportReport at last.
+*/
+func (s Serving) importHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := game.ReadImportRecords(http.MaxBytesReader(w, r.Body, maxImportBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errorRender(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("import is up to %d bytes a request, split it", maxImportBody))
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(records) == 0 {
+		errorRender(w, r, http.StatusBadRequest, errors.New("nothing to import"))
+		return
+	}
+
+	// the status is sent before the writes, failures are told in the report
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	report, err := s.Importer.Import(r.Context(), records, func(p game.ImportProgress) {
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		logger.Warn("import has been interrupted", "error", err.Error())
+	}
+	logger.Info("records have been imported", "groups", report.Groups, "applied", report.Applied, "failed", report.Failed)
+	enc.Encode(report)
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ActAsHeader names the user an admin acts on behalf of
+const ActAsHeader = "X-Act-As"
+
+// APIKeyHeader carries the key minted by admins, see game.APIKey
+const APIKeyHeader = "X-API-Key"
+
+/*
+Identity of the request.
+Caller is the value of the auth header, which is expected to be set by the proxy in front of the API, like IAP,
+or the email of the token verified by AUTH_MODE, or the subject of the bearer token, or the name of the api key if it's given.
+Subject is the one of the verified bearer token, it's empty if JWT is not used or no token is given.
+APIKey is the name of the verified X-API-Key, it's empty if api keys are not used or no key is given.
+ActingAs is the user id of X-Act-As, only admins can set it.
+Claims are the ones of the verified token, of the proxy if AUTH_MODE is set, or of the bearer token otherwise.
+*/
+type Identity struct {
+	Caller   string
+	Subject  string
+	APIKey   string
+	ActingAs string
+	Claims   map[string]interface{}
+}
+
+func (i Identity) Impersonating() bool {
+	return i.ActingAs != ""
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity of the request, zero value if it's not authenticated
+func IdentityFromContext(ctx context.Context) Identity {
+	identity, _ := ctx.Value(identityKey{}).(Identity)
+	return identity
+}
+
+// AuditEntry of a request, Status is the one of HTTP, or the code of gRPC for calls of it
+type AuditEntry struct {
+	Time      time.Time
+	RequestID string
+	Caller    string
+	ActingAs  string
+	Method    string
+	Route     string
+	Status    int
+}
+
+// AuditLogger records actions that have to be traced back to the caller
+type AuditLogger interface {
+	Record(ctx context.Context, entry AuditEntry)
+}
+
+// SlogAudit writes audit entries as structured logs, to be routed to its own sink by the "audit" field
+type SlogAudit struct {
+	Logger *slog.Logger
+}
+
+func (a SlogAudit) Record(ctx context.Context, e AuditEntry) {
+	a.Logger.InfoContext(ctx, "audit",
+		"audit", true,
+		"request_id", e.RequestID,
+		"caller", e.Caller,
+		"acting_as", e.ActingAs,
+		"method", e.Method,
+		"route", e.Route,
+		"status", e.Status,
+		"time", e.Time.UTC().Format(time.RFC3339Nano),
+	)
+}
+
+// APIKeyVerifier returns the name of a valid key, or an error if it is not
+type APIKeyVerifier interface {
+	VerifyAPIKey(ctx context.Context, key string) (string, error)
+}
+
+/*
+Authorizer authenticates requests by the auth header, and lets admins impersonate users by X-Act-As.
+Every impersonated request is recorded to the audit logger with both identities.
+No auth is required if Header is empty, but impersonation still is for admins only.
+If JWT is set, a bearer token is verified if it's given, and its subject is the caller instead of the auth header.
+If APIKeys is set, X-API-Key is verified if it's given, and its name is the caller unless a bearer token is given.
+If Proxy is set, the token of IAP or the invoker is required on every request, and its email is the caller.
+It's not the subject, which is a user of the game, but a bearer token still can be given for it.
+*/
+type Authorizer struct {
+	Header  string
+	Admins  map[string]bool
+	Audit   AuditLogger
+	JWT     *JWTVerifier
+	APIKeys APIKeyVerifier
+	Proxy   *JWTVerifier
+}
+
+// NewAuthorizer takes admins as comma separated callers
+func NewAuthorizer(header, admins string, audit AuditLogger) *Authorizer {
+	a := &Authorizer{Header: header, Admins: map[string]bool{}, Audit: audit}
+	for _, admin := range strings.Split(admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			a.Admins[admin] = true
+		}
+	}
+	return a
+}
+
+func (a *Authorizer) IsAdmin(caller string) bool {
+	return caller != "" && a.Admins[caller]
+}
+
+/*
+authError rejects a request with the status of HTTP and the message of it,
+it's an error to be answered by both HTTP and gRPC.
+Challenge is WWW-Authenticate of the answer if it's not empty.
+*/
+type authError struct {
+	Status    int
+	Message   string
+	Challenge string
+}
+
+func (e *authError) Error() string {
+	return e.Message
+}
+
+func (e *authError) write(w http.ResponseWriter) {
+	if e.Challenge != "" {
+		w.Header().Set("WWW-Authenticate", e.Challenge)
+	}
+	http.Error(w, e.Message, e.Status)
+}
+
+// identify authenticates the headers of the request, method and route are only to be logged
+func (a *Authorizer) identify(ctx context.Context, header http.Header, method, route string) (Identity, *authError) {
+	identity := Identity{ActingAs: header.Get(ActAsHeader)}
+	if a.Proxy != nil {
+		claims, err := a.Proxy.ClaimsFromHeader(header)
+		if err != nil {
+			slog.Warn("invalid proxy token", "method", method, "route", route, "error", err.Error())
+			return identity, &authError{Status: http.StatusUnauthorized, Message: "Invalid or missing token of the proxy"}
+		}
+		identity.Claims = claims
+		identity.Caller = proxyCaller(claims)
+	}
+	if a.JWT != nil {
+		claims, err := a.JWT.ClaimsFromHeader(header)
+		if err != nil && !errors.Is(err, errNoToken) {
+			slog.Warn("invalid token", "method", method, "route", route, "error", err.Error())
+			return identity, &authError{Status: http.StatusUnauthorized, Message: "Invalid bearer token", Challenge: `Bearer error="invalid_token"`}
+		}
+		if err == nil {
+			identity.Subject, _ = claims.GetSubject()
+			// the caller authenticated by the proxy is kept, as admins are named by it
+			if a.Proxy == nil {
+				identity.Caller = identity.Subject
+				identity.Claims = claims
+			}
+		}
+	}
+	if key := header.Get(APIKeyHeader); a.APIKeys != nil && key != "" {
+		name, err := a.APIKeys.VerifyAPIKey(ctx, key)
+		if err != nil {
+			slog.Warn("invalid api key", "method", method, "route", route, "error", err.Error())
+			return identity, &authError{Status: http.StatusUnauthorized, Message: "Invalid API key"}
+		}
+		identity.APIKey = name
+		if identity.Caller == "" {
+			identity.Caller = name
+		}
+	}
+	if a.Header != "" && identity.Caller == "" {
+		identity.Caller = header.Get(a.Header)
+		if identity.Caller == "" {
+			slog.Warn("forbidden request", "method", method, "route", route)
+			return identity, &authError{Status: http.StatusForbidden, Message: "You're NOT permitted to enter here"}
+		}
+	}
+	if identity.Impersonating() && !a.IsAdmin(identity.Caller) {
+		return identity, &authError{Status: http.StatusForbidden, Message: "Only admins can act as another user"}
+	}
+	return identity, nil
+}
+
+// Authenticate is used as the middleware of routers which requires the auth header
+func (a *Authorizer) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, aerr := a.identify(r.Context(), r.Header, r.Method, RoutePattern(r))
+		if aerr != nil {
+			aerr.write(w)
+			return
+		}
+
+		r = r.WithContext(WithIdentity(r.Context(), identity))
+		if !identity.Impersonating() || a.Audit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		a.Audit.Record(r.Context(), AuditEntry{
+			Time:      time.Now(),
+			RequestID: middleware.GetReqID(r.Context()),
+			Caller:    identity.Caller,
+			ActingAs:  identity.ActingAs,
+			Method:    r.Method,
+			Route:     RoutePattern(r),
+			Status:    ww.Status(),
+		})
+	})
+}
+
+// email of the signed in user, or the subject of service accounts without the email scope
+func proxyCaller(claims map[string]interface{}) string {
+	if email, ok := claims["email"].(string); ok && email != "" {
+		return email
+	}
+	subject, _ := claims["sub"].(string)
+	return subject
+}
+
+/*
+RequireSubject rejects mutations without a verified bearer token, reads are still allowed without it.
+It's used after Authenticate, and does nothing if JWT is not used.
+*/
+func (a *Authorizer) RequireSubject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if aerr := a.requireSubject(IdentityFromContext(r.Context()), r.Method); aerr != nil {
+			aerr.write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Authorizer) requireSubject(identity Identity, method string) *authError {
+	if a.JWT != nil && isMutation(method) && identity.Subject == "" {
+		return &authError{Status: http.StatusUnauthorized, Message: "Bearer token is required to change anything", Challenge: "Bearer"}
+	}
+	return nil
+}
+
+/*
+RequireAPIKey rejects mutations without a verified api key or bearer token, reads are still allowed without them.
+It's used after Authenticate, and does nothing if api keys are not used.
+*/
+func (a *Authorizer) RequireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if aerr := a.requireAPIKey(IdentityFromContext(r.Context()), r.Method); aerr != nil {
+			aerr.write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Authorizer) requireAPIKey(identity Identity, method string) *authError {
+	if a.APIKeys != nil && isMutation(method) && identity.APIKey == "" && identity.Subject == "" {
+		return &authError{Status: http.StatusUnauthorized, Message: APIKeyHeader + " is required to change anything"}
+	}
+	return nil
+}
+
+// RequireAdmin rejects callers who are not admins, it's used after Authenticate
+func (a *Authorizer) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if aerr := a.requireAdmin(IdentityFromContext(r.Context())); aerr != nil {
+			aerr.write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Authorizer) requireAdmin(identity Identity) *authError {
+	if !a.IsAdmin(identity.Caller) {
+		return &authError{Status: http.StatusForbidden, Message: "Only admins can do it"}
+	}
+	return nil
+}
+
+/*
+CanModify tells if the identity may change the user.
+With JWT, the subject has to be the user, unless an admin acts as the user. Anyone can without JWT.
+*/
+func (a *Authorizer) CanModify(identity Identity, userID string) bool {
+	if identity.Impersonating() {
+		return identity.ActingAs == userID
+	}
+	if a.JWT == nil {
+		return true
+	}
+	return identity.Subject != "" && identity.Subject == userID
+}
+
+/*
+AuthorizeUser rejects impersonated requests to other users than X-Act-As,
+and mutations of other users than the subject of the token.
+It has to be used inline like NewExperimentMiddleware, to see the url param.
+*/
+func (a *Authorizer) AuthorizeUser(param string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if aerr := a.authorizeUser(IdentityFromContext(r.Context()), r.Method, chi.URLParam(r, param)); aerr != nil {
+				aerr.write(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a *Authorizer) authorizeUser(identity Identity, method, userID string) *authError {
+	if identity.Impersonating() && userID != identity.ActingAs {
+		return &authError{Status: http.StatusForbidden, Message: "Acting as another user than the requested one"}
+	}
+	if isMutation(method) && !a.CanModify(identity, userID) {
+		return &authError{Status: http.StatusForbidden, Message: "Token subject is not the requested user"}
+	}
+	return nil
+}
+
+func isMutation(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type auditRecorder struct {
+	entries []AuditEntry
+}
+
+func (a *auditRecorder) Record(ctx context.Context, entry AuditEntry) {
+	a.entries = append(a.entries, entry)
+}
+
+func TestAuthorizerActAs(t *testing.T) {
+	audit := &auditRecorder{}
+	a := NewAuthorizer("X-Caller", "admin@example.com, ops@example.com", audit)
+
+	r := chi.NewRouter()
+	r.Route("/api", func(t chi.Router) {
+		t.Use(a.Authenticate)
+		t.Get("/items", func(w http.ResponseWriter, r *http.Request) {})
+		t.Group(func(u chi.Router) {
+			u.Use(a.AuthorizeUser("user_id"))
+			u.Get("/user_id/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(IdentityFromContext(r.Context()).ActingAs))
+			})
+		})
+	})
+
+	cases := []struct {
+		name   string
+		caller string
+		actAs  string
+		path   string
+		status int
+	}{
+		{name: "no caller", path: "/api/items", status: http.StatusForbidden},
+		{name: "user", caller: "user@example.com", path: "/api/user_id/u1", status: http.StatusOK},
+		{name: "user acts as", caller: "user@example.com", actAs: "u1", path: "/api/user_id/u1", status: http.StatusForbidden},
+		{name: "admin acts as", caller: "admin@example.com", actAs: "u1", path: "/api/user_id/u1", status: http.StatusOK},
+		{name: "admin acts as another", caller: "ops@example.com", actAs: "u2", path: "/api/user_id/u1", status: http.StatusForbidden},
+		{name: "admin acts as without user", caller: "admin@example.com", actAs: "u1", path: "/api/items", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.caller != "" {
+			req.Header.Set("X-Caller", c.caller)
+		}
+		if c.actAs != "" {
+			req.Header.Set(ActAsHeader, c.actAs)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.name)
+	}
+
+	// every impersonated request by admins is audited, even if it's rejected
+	assert.Len(t, audit.entries, 3)
+	e := audit.entries[0]
+	e.Time = time.Time{}
+	assert.Equal(t, AuditEntry{Caller: "admin@example.com", ActingAs: "u1", Method: "GET", Route: "/api/user_id/{user_id}", Status: http.StatusOK}, e)
+	assert.Equal(t, "ops@example.com", audit.entries[1].Caller)
+	assert.Equal(t, http.StatusForbidden, audit.entries[1].Status)
+}
+
+func TestAuthorizerWithoutHeader(t *testing.T) {
+	a := NewAuthorizer("", "", nil)
+	assert.False(t, a.IsAdmin(""))
+
+	h := a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// nobody is admin, when callers are not identified
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	req.Header.Set(ActAsHeader, "u1")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	a := NewAuthorizer("X-Caller", "admin", nil)
+	h := a.Authenticate(a.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for caller, status := range map[string]int{"admin": http.StatusOK, "u1": http.StatusForbidden, "": http.StatusForbidden} {
+		req := httptest.NewRequest("POST", "/admin/reset", nil)
+		if caller != "" {
+			req.Header.Set("X-Caller", caller)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, caller)
+	}
+}
+
+type fakeAPIKeys map[string]string
+
+func (f fakeAPIKeys) VerifyAPIKey(ctx context.Context, key string) (string, error) {
+	if name, ok := f[key]; ok {
+		return name, nil
+	}
+	return "", errors.New("invalid api key")
+}
+
+func TestAuthorizerAPIKey(t *testing.T) {
+	a := NewAuthorizer("", "admin", nil)
+	a.APIKeys = fakeAPIKeys{"k1": "attendee", "k2": "admin"}
+
+	h := a.Authenticate(a.RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(IdentityFromContext(r.Context()).Caller))
+	})))
+	admin := a.Authenticate(a.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	cases := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		key     string
+		status  int
+		caller  string
+	}{
+		{name: "read without key", handler: h, method: "GET", status: http.StatusOK},
+		{name: "mutation without key", handler: h, method: "POST", status: http.StatusUnauthorized},
+		{name: "invalid key", handler: h, method: "GET", key: "unknown", status: http.StatusUnauthorized},
+		{name: "mutation with key", handler: h, method: "POST", key: "k1", status: http.StatusOK, caller: "attendee"},
+		{name: "key of non admin", handler: admin, method: "POST", key: "k1", status: http.StatusForbidden},
+		{name: "key of admin", handler: admin, method: "POST", key: "k2", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/api/items", nil)
+		if c.key != "" {
+			req.Header.Set(APIKeyHeader, c.key)
+		}
+		rec := httptest.NewRecorder()
+		c.handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.name)
+		if c.caller != "" {
+			assert.Equal(t, c.caller, rec.Body.String(), c.name)
+		}
+	}
+
+	// nothing is required without api keys
+	rec := httptest.NewRecorder()
+	NewAuthorizer("", "", nil).RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest("POST", "/api/items", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
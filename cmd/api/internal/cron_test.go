@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2023, 10, 16, 10, 7, 30, 0, time.UTC) // monday
+
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2023, 10, 16, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, 10, 16, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2023, 10, 17, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * 1-5", time.Date(2023, 10, 16, 13, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2023, 10, 22, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2023, 10, 16, 11, 0, 0, 0, time.UTC)},
+		{"@every 30s", base.Add(30 * time.Second)},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		assert.Nil(t, err, c.spec)
+		assert.Equal(t, c.next, s.Next(base), c.spec)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every -1s"} {
+		_, err := ParseSchedule(spec)
+		assert.NotNil(t, err, spec)
+	}
+
+	never, err := ParseSchedule("0 0 31 2 *")
+	assert.Nil(t, err)
+	assert.True(t, never.Next(base).IsZero())
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"sync"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+EventBus fans out item changes of users to subscribers in this process, like websocket clients.
+It's in-process only, a subscriber gets changes made through this instance, not the ones through other instances.
+Publish never blocks the mutation path, a subscriber which can't keep up is dropped by closing its channel,
+then it should subscribe again and read the current items, instead of missing changes silently.
+*/
+type EventBus struct {
+	mu     sync.Mutex
+	buffer int
+	subs   map[string]map[chan domain.ItemChanged]struct{}
+	closed bool
+}
+
+// NewEventBus takes the buffer size of each subscriber
+func NewEventBus(buffer int) *EventBus {
+	return &EventBus{buffer: buffer, subs: map[string]map[chan domain.ItemChanged]struct{}{}}
+}
+
+/*
+Subscribe returns changes of the user and the func to unsubscribe, which has to be called when the subscriber is done.
+The channel is closed when the subscriber is dropped or the bus is closed.
+*/
+func (b *EventBus) Subscribe(userID string) (<-chan domain.ItemChanged, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan domain.ItemChanged, b.buffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = map[chan domain.ItemChanged]struct{}{}
+	}
+	b.subs[userID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.drop(userID, ch)
+	}
+}
+
+func (b *EventBus) Publish(e domain.ItemChanged) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+			b.drop(e.UserID, ch)
+		}
+	}
+}
+
+// Subscribers counts subscribers of all users
+func (b *EventBus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, chs := range b.subs {
+		n += len(chs)
+	}
+	return n
+}
+
+// Close drops all subscribers, it's for graceful shutdown as hijacked connections are not closed by the server
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for userID, chs := range b.subs {
+		for ch := range chs {
+			b.drop(userID, ch)
+		}
+	}
+	b.closed = true
+}
+
+// it has to be called with the lock, and is safe to call twice
+func (b *EventBus) drop(userID string, ch chan domain.ItemChanged) {
+	chs := b.subs[userID]
+	if _, ok := chs[ch]; !ok {
+		return
+	}
+	delete(chs, ch)
+	close(ch)
+	if len(chs) == 0 {
+		delete(b.subs, userID)
+	}
+}
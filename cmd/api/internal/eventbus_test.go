@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(1)
+	mine, unsubscribe := b.Subscribe("u1")
+	others, _ := b.Subscribe("u2")
+	assert.Equal(t, 2, b.Subscribers())
+
+	added, _ := domain.NewItemChanged("u1", 1, "i1", domain.ItemAdded)
+	b.Publish(added)
+	assert.Equal(t, added, <-mine)
+	assert.Empty(t, others)
+
+	// a subscriber which can't keep up is dropped, not to block the mutation
+	b.Publish(added)
+	b.Publish(added)
+	assert.Equal(t, added, <-mine)
+	_, ok := <-mine
+	assert.False(t, ok)
+	assert.Equal(t, 1, b.Subscribers())
+
+	// safe to unsubscribe after it's dropped
+	unsubscribe()
+
+	b.Close()
+	_, ok = <-others
+	assert.False(t, ok)
+	late, _ := b.Subscribe("u1")
+	_, ok = <-late
+	assert.False(t, ok)
+	assert.Equal(t, 0, b.Subscribers())
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type Variant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+/*
+Experiment of A/B test.
+A user is always assigned to the same variant, by the hash of the salt and the user id.
+Changing the salt reshuffles users, so give a new experiment its own salt.
+*/
+type Experiment struct {
+	Name     string    `json:"name"`
+	Salt     string    `json:"salt"`
+	Variants []Variant `json:"variants"`
+}
+
+// ParseExperiments reads experiments as json array, no experiment is running if it's empty
+func ParseExperiments(config string) ([]Experiment, error) {
+	if config == "" {
+		return nil, nil
+	}
+	experiments := []Experiment{}
+	if err := json.Unmarshal([]byte(config), &experiments); err != nil {
+		return nil, err
+	}
+	for _, e := range experiments {
+		if e.totalWeight() <= 0 {
+			return nil, fmt.Errorf("experiment %q has no weighted variant", e.Name)
+		}
+	}
+	return experiments, nil
+}
+
+func (e Experiment) totalWeight() int {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	return total
+}
+
+// Assign returns the variant of the user
+func (e Experiment) Assign(userID string) string {
+	sum := sha256.Sum256([]byte(e.Salt + "/" + userID))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(e.totalWeight()))
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v.Name
+		}
+		bucket -= v.Weight
+	}
+	return ""
+}
+
+// Assignments returns experiment name to the variant of the user
+func Assignments(experiments []Experiment, userID string) map[string]string {
+	assignments := make(map[string]string, len(experiments))
+	for _, e := range experiments {
+		assignments[e.Name] = e.Assign(userID)
+	}
+	return assignments
+}
+
+type experimentsKey struct{}
+
+func WithExperiments(ctx context.Context, assignments map[string]string) context.Context {
+	return context.WithValue(ctx, experimentsKey{}, assignments)
+}
+
+// ExperimentsFromContext returns assignments of the user of the request, nil if there is none
+func ExperimentsFromContext(ctx context.Context) map[string]string {
+	assignments, _ := ctx.Value(experimentsKey{}).(map[string]string)
+	return assignments
+}
+
+// attributes are sorted by experiment name, to be stable
+func experimentAttributes(assignments map[string]string) []attribute.KeyValue {
+	names := make([]string, 0, len(assignments))
+	for name := range assignments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]attribute.KeyValue, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, attribute.String("experiment."+name, assignments[name]))
+	}
+	return attrs
+}
+
+/*
+NewExperimentMiddleware assigns the user of the url param to the experiments, and keeps them in the request context.
+It has to be used inline, like Router.With or Router.Group, since url params are parsed after middlewares of the router.
+Requests are counted by variant in addition to the request metrics by route pattern, which don't know about experiments.
+*/
+func NewExperimentMiddleware(experiments []Experiment, param string) func(next http.Handler) http.Handler {
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "experiment_request_duration_milliseconds",
+		Help:    "How long it took to process the request, partitioned by experiment, variant and status code.",
+		Buckets: DefaultLatencyBuckets,
+	},
+		[]string{"experiment", "variant", "code"},
+	)
+	prometheus.MustRegister(latency)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := chi.URLParam(r, param)
+			if len(experiments) == 0 || userID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			assignments := Assignments(experiments, userID)
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(WithExperiments(r.Context(), assignments)))
+
+			elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+			for name, variant := range assignments {
+				latency.WithLabelValues(name, variant, http.StatusText(ww.Status())).Observe(elapsed)
+			}
+		})
+	}
+}
+
+// ExperimentSpanProcessor tags every span started in a request with the variants of the user
+type ExperimentSpanProcessor struct{}
+
+func (ExperimentSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	if assignments := ExperimentsFromContext(parent); assignments != nil {
+		s.SetAttributes(experimentAttributes(assignments)...)
+	}
+}
+
+func (ExperimentSpanProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (ExperimentSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (ExperimentSpanProcessor) ForceFlush(context.Context) error { return nil }
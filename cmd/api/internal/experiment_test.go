@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExperimentAssign(t *testing.T) {
+	e := Experiment{
+		Name: "new_shop",
+		Salt: "2023-10",
+		Variants: []Variant{
+			{Name: "control", Weight: 80},
+			{Name: "treatment", Weight: 20},
+		},
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant := e.Assign(userID)
+		assert.Equal(t, variant, e.Assign(userID))
+		counts[variant]++
+	}
+	assert.InDelta(t, 8000, counts["control"], 300)
+	assert.InDelta(t, 2000, counts["treatment"], 300)
+
+	// another salt reshuffles users
+	other := e
+	other.Salt = "2023-11"
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		if e.Assign(userID) != other.Assign(userID) {
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 100)
+}
+
+func TestParseExperiments(t *testing.T) {
+	experiments, err := ParseExperiments("")
+	assert.Nil(t, err)
+	assert.Empty(t, experiments)
+
+	experiments, err = ParseExperiments(`[{"name":"new_shop","salt":"x","variants":[{"name":"a","weight":1},{"name":"b","weight":1}]}]`)
+	assert.Nil(t, err)
+	assert.Len(t, experiments, 1)
+	assert.Len(t, Assignments(experiments, "user-1"), 1)
+
+	_, err = ParseExperiments(`[{"name":"empty","salt":"x","variants":[]}]`)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+GRPCMethod authorizes a method of gRPC as the route of HTTP of the same operation.
+Method and Route are the ones of the route, like "PUT" and "/api/user_id/{user_id}/{item_id}",
+mutations are told by Method, and the rate limit of the route applies to the method too.
+UserID returns the user of the request, it's checked as AuthorizeUser does if it's set.
+Admin requires admin callers as RequireAdmin does, and Public skips everything, for health checks of load balancers.
+*/
+type GRPCMethod struct {
+	Method string
+	Route  string
+	UserID func(req interface{}) string
+	Admin  bool
+	Public bool
+}
+
+/*
+UnaryServerInterceptor authenticates calls by the metadata as Authenticate does,
+and authorizes and limits them as the route of each method, the rate limiter may be nil.
+With JWT, mutations require a bearer token in "authorization", and its subject has to be the user of the request, as RequireSubject and AuthorizeUser do.
+With api keys, "x-api-key" is verified if it's given, and mutations require it or a bearer token, as RequireAPIKey does.
+Methods not in the map are rejected, not to serve a new method before its authorization is decided.
+*/
+func UnaryServerInterceptor(a *Authorizer, l *RateLimiter, methods map[string]GRPCMethod) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		m, ok := methods[info.FullMethod]
+		if !ok {
+			return nil, status.Error(codes.PermissionDenied, "The method is not authorized over gRPC")
+		}
+		if m.Public {
+			return handler(ctx, req)
+		}
+
+		identity, aerr := a.identify(ctx, metadataHeader(ctx), m.Method, info.FullMethod)
+		if aerr != nil {
+			return nil, aerr.grpcStatus()
+		}
+		ctx = WithIdentity(ctx, identity)
+		var userID string
+		if m.UserID != nil {
+			userID = m.UserID(req)
+		}
+
+		resp, err := a.serveAuthorized(ctx, l, m, identity, userID, req, handler)
+		if identity.Impersonating() && a.Audit != nil {
+			a.Audit.Record(ctx, AuditEntry{
+				Time:      time.Now(),
+				RequestID: metadataHeader(ctx).Get("X-Request-Id"),
+				Caller:    identity.Caller,
+				ActingAs:  identity.ActingAs,
+				Method:    m.Method,
+				Route:     info.FullMethod,
+				Status:    int(status.Code(err)),
+			})
+		}
+		return resp, err
+	}
+}
+
+// serveAuthorized checks the call in the same order as the middlewares of the route
+func (a *Authorizer) serveAuthorized(ctx context.Context, l *RateLimiter, m GRPCMethod, identity Identity, userID string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	if aerr := a.requireSubject(identity, m.Method); aerr != nil {
+		return nil, aerr.grpcStatus()
+	}
+	if aerr := a.requireAPIKey(identity, m.Method); aerr != nil {
+		return nil, aerr.grpcStatus()
+	}
+	if limit, ok := l.limitOf(m.Method, m.Route); ok {
+		if allowed, wait := l.take(limitKey(limit, userID, identity, peerAddr(ctx)), limit); !allowed {
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfter(wait)))
+			return nil, status.Error(codes.ResourceExhausted, "Too many requests, retry later")
+		}
+	}
+	if m.Admin {
+		if aerr := a.requireAdmin(identity); aerr != nil {
+			return nil, aerr.grpcStatus()
+		}
+	}
+	if m.UserID != nil {
+		if aerr := a.authorizeUser(identity, m.Method, userID); aerr != nil {
+			return nil, aerr.grpcStatus()
+		}
+	}
+	return handler(ctx, req)
+}
+
+// metadata of the call as the header of HTTP, keys of metadata are lower case but Get of the header canonicalizes them
+func metadataHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func (e *authError) grpcStatus() error {
+	if e.Status == http.StatusUnauthorized {
+		return status.Error(codes.Unauthenticated, e.Message)
+	}
+	return status.Error(codes.PermissionDenied, e.Message)
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// the request of the test methods is the user id itself
+var testGRPCMethods = map[string]GRPCMethod{
+	"/test/Items":   {Method: "GET", Route: "/api/user_id/{user_id}", UserID: func(req interface{}) string { return req.(string) }},
+	"/test/AddItem": {Method: "PUT", Route: "/api/user_id/{user_id}/{item_id}", UserID: func(req interface{}) string { return req.(string) }},
+	"/test/Create":  {Method: "POST", Route: "/api/user"},
+	"/test/Reset":   {Method: "POST", Route: "/admin/reset", Admin: true},
+	"/test/Check":   {Public: true},
+}
+
+func callGRPC(interceptor grpc.UnaryServerInterceptor, method string, req interface{}, md ...string) (Identity, error) {
+	var identity Identity
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(md...))
+	_, err := interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		identity = IdentityFromContext(ctx)
+		return nil, nil
+	})
+	return identity, err
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	audit := &auditRecorder{}
+	a := NewAuthorizer("X-Caller", "admin@example.com", audit)
+	interceptor := UnaryServerInterceptor(a, nil, testGRPCMethods)
+
+	cases := []struct {
+		name   string
+		method string
+		req    interface{}
+		md     []string
+		code   codes.Code
+	}{
+		{name: "no caller", method: "/test/Items", req: "u1", code: codes.PermissionDenied},
+		{name: "user", method: "/test/Items", req: "u1", md: []string{"x-caller", "user@example.com"}, code: codes.OK},
+		{name: "user acts as", method: "/test/Items", req: "u1", md: []string{"x-caller", "user@example.com", "x-act-as", "u1"}, code: codes.PermissionDenied},
+		{name: "admin acts as", method: "/test/Items", req: "u1", md: []string{"x-caller", "admin@example.com", "x-act-as", "u1"}, code: codes.OK},
+		{name: "admin acts as another", method: "/test/Items", req: "u2", md: []string{"x-caller", "admin@example.com", "x-act-as", "u1"}, code: codes.PermissionDenied},
+		{name: "not admin", method: "/test/Reset", md: []string{"x-caller", "user@example.com"}, code: codes.PermissionDenied},
+		{name: "admin", method: "/test/Reset", md: []string{"x-caller", "admin@example.com"}, code: codes.OK},
+		{name: "public", method: "/test/Check", code: codes.OK},
+		{name: "unknown method", method: "/test/Unknown", md: []string{"x-caller", "admin@example.com"}, code: codes.PermissionDenied},
+	}
+	for _, c := range cases {
+		_, err := callGRPC(interceptor, c.method, c.req, c.md...)
+		assert.Equal(t, c.code, status.Code(err), c.name)
+	}
+
+	identity, err := callGRPC(interceptor, "/test/Items", "u1", "x-caller", "user@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Caller: "user@example.com"}, identity)
+
+	// impersonated calls are audited as requests are
+	assert.Len(t, audit.entries, 2)
+	e := audit.entries[0]
+	e.Time = time.Time{}
+	assert.Equal(t, AuditEntry{Caller: "admin@example.com", ActingAs: "u1", Method: "GET", Route: "/test/Items", Status: int(codes.OK)}, e)
+	assert.Equal(t, int(codes.PermissionDenied), audit.entries[1].Status)
+}
+
+func TestUnaryServerInterceptorRateLimit(t *testing.T) {
+	limit := RateLimit{Method: "GET", Route: "/api/user_id/{user_id}", Rate: 0.1, Burst: 1, Fallback: true}
+	// not registered, as NewRateLimiter is already called by TestRateLimiter, and nothing listens on the port of redis
+	l := &RateLimiter{
+		rdb:       redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond}),
+		limits:    map[string]RateLimit{limit.Method + " " + limit.Route: limit},
+		local:     newLocalBuckets(),
+		rejected:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rejected"}, []string{"method", "path"}),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "decisions"}, []string{"limiter", "decision"}),
+	}
+	interceptor := UnaryServerInterceptor(NewAuthorizer("", "", nil), l, testGRPCMethods)
+
+	// limited per user, as the route is
+	_, err := callGRPC(interceptor, "/test/Items", "u1")
+	assert.Nil(t, err)
+	_, err = callGRPC(interceptor, "/test/Items", "u1")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = callGRPC(interceptor, "/test/Items", "u2")
+	assert.Nil(t, err)
+}
+
+func TestUnaryServerInterceptorJWT(t *testing.T) {
+	v, sign := newTestVerifier(t)
+	a := NewAuthorizer("", "admin", nil)
+	a.JWT = v
+	interceptor := UnaryServerInterceptor(a, nil, testGRPCMethods)
+
+	cases := []struct {
+		name   string
+		method string
+		req    interface{}
+		token  string
+		actAs  string
+		code   codes.Code
+	}{
+		{name: "read without token", method: "/test/Items", req: "u1", code: codes.OK},
+		{name: "mutation without token", method: "/test/Create", code: codes.Unauthenticated},
+		{name: "invalid token", method: "/test/Items", req: "u1", token: "invalid", code: codes.Unauthenticated},
+		{name: "mutation with token", method: "/test/Create", token: sign(validClaims("u1")), code: codes.OK},
+		{name: "read of another user", method: "/test/Items", req: "u2", token: sign(validClaims("u1")), code: codes.OK},
+		{name: "mutation of the subject", method: "/test/AddItem", req: "u1", token: sign(validClaims("u1")), code: codes.OK},
+		{name: "mutation of another user", method: "/test/AddItem", req: "u2", token: sign(validClaims("u1")), code: codes.PermissionDenied},
+		{name: "mutation of the user without token", method: "/test/AddItem", req: "u1", code: codes.Unauthenticated},
+		{name: "admin acts as the user", method: "/test/AddItem", req: "u2", token: sign(validClaims("admin")), actAs: "u2", code: codes.OK},
+	}
+	for _, c := range cases {
+		md := []string{}
+		if c.token != "" {
+			md = append(md, "authorization", "Bearer "+c.token)
+		}
+		if c.actAs != "" {
+			md = append(md, "x-act-as", c.actAs)
+		}
+		_, err := callGRPC(interceptor, c.method, c.req, md...)
+		assert.Equal(t, c.code, status.Code(err), c.name)
+	}
+}
+
+func TestUnaryServerInterceptorAPIKey(t *testing.T) {
+	a := NewAuthorizer("", "admin", nil)
+	a.APIKeys = fakeAPIKeys{"k1": "attendee", "k2": "admin"}
+	interceptor := UnaryServerInterceptor(a, nil, testGRPCMethods)
+
+	cases := []struct {
+		name   string
+		method string
+		key    string
+		code   codes.Code
+		caller string
+	}{
+		{name: "read without key", method: "/test/Items", code: codes.OK},
+		{name: "mutation without key", method: "/test/Create", code: codes.Unauthenticated},
+		{name: "invalid key", method: "/test/Items", key: "unknown", code: codes.Unauthenticated},
+		{name: "mutation with key", method: "/test/Create", key: "k1", code: codes.OK, caller: "attendee"},
+		{name: "key of non admin", method: "/test/Reset", key: "k1", code: codes.PermissionDenied},
+		{name: "key of admin", method: "/test/Reset", key: "k2", code: codes.OK, caller: "admin"},
+	}
+	for _, c := range cases {
+		md := []string{}
+		if c.key != "" {
+			md = append(md, "x-api-key", c.key)
+		}
+		identity, err := callGRPC(interceptor, c.method, "u1", md...)
+		assert.Equal(t, c.code, status.Code(err), c.name)
+		if c.caller != "" {
+			assert.Equal(t, c.caller, identity.Caller, c.name)
+			assert.Equal(t, c.caller, identity.APIKey, c.name)
+		}
+	}
+}
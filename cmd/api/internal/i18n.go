@@ -0,0 +1,122 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed messages/*.json
+var messageFiles embed.FS
+
+// the language of messages when none of Accept-Language is in the catalogs, it has every code
+const defaultLanguage = "en"
+
+/*
+Messages are user-facing texts of error codes, one catalog per language in messages/<language>.json.
+Codes are for machines and never change, the texts are for people and can be reworded any time.
+A text is a text/template, which is executed with the data given by the caller.
+*/
+type Messages struct {
+	tags     []language.Tag
+	matcher  language.Matcher
+	catalogs map[language.Tag]map[string]*template.Template
+}
+
+// LoadMessages parses the embedded catalogs, every code of them has to be in the default language
+func LoadMessages() (*Messages, error) {
+	return loadMessages(messageFiles)
+}
+
+func loadMessages(files fs.FS) (*Messages, error) {
+	names, err := fs.Glob(files, "messages/*.json")
+	if err != nil {
+		return nil, err
+	}
+	m := &Messages{catalogs: map[language.Tag]map[string]*template.Template{}}
+	// the default language goes first, as the matcher falls back to the first tag
+	m.tags = []language.Tag{language.Make(defaultLanguage)}
+	for _, name := range names {
+		tag, err := language.Parse(strings.TrimSuffix(path.Base(name), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		texts := map[string]string{}
+		if err := json.Unmarshal(data, &texts); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		catalog := map[string]*template.Template{}
+		for code, text := range texts {
+			if catalog[code], err = template.New(code).Option("missingkey=zero").Parse(text); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		m.catalogs[tag] = catalog
+		if tag != m.tags[0] {
+			m.tags = append(m.tags, tag)
+		}
+	}
+
+	fallback, ok := m.catalogs[m.tags[0]]
+	if !ok {
+		return nil, fmt.Errorf("messages/%s.json is required", defaultLanguage)
+	}
+	for tag, catalog := range m.catalogs {
+		for code := range catalog {
+			if _, ok := fallback[code]; !ok {
+				return nil, fmt.Errorf("%s of %s is not in messages/%s.json", code, tag, defaultLanguage)
+			}
+		}
+	}
+	m.matcher = language.NewMatcher(m.tags)
+	return m, nil
+}
+
+/*
+Localize returns the text of code in the language negotiated by acceptLanguage, the value of Accept-Language header,
+and the language it's written in for Content-Language.
+A code which is not translated yet is in the default language, and an unknown code is empty.
+*/
+func (m *Messages) Localize(acceptLanguage, code string, data interface{}) (string, language.Tag) {
+	desired, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	_, index, _ := m.matcher.Match(desired...)
+	tag := m.tags[index]
+
+	t, ok := m.catalogs[tag][code]
+	if !ok {
+		tag = m.tags[0]
+		if t, ok = m.catalogs[tag][code]; !ok {
+			return "", tag
+		}
+	}
+	var text strings.Builder
+	if err := t.Execute(&text, data); err != nil {
+		return "", tag
+	}
+	return text.String(), tag
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalize(t *testing.T) {
+	m, err := LoadMessages()
+	assert.Nil(t, err)
+
+	data := map[string]string{"Path": "/api/items/x"}
+	text, tag := m.Localize("", "not_found", data)
+	assert.Equal(t, "Nothing was found at /api/items/x.", text)
+	assert.Equal(t, "en", tag.String())
+
+	// the preferred one of the supported languages, by q values
+	text, tag = m.Localize("fr;q=0.9, ja-JP;q=0.8, en;q=0.5", "not_found", data)
+	assert.Equal(t, "/api/items/x は見つかりませんでした。", text)
+	assert.Equal(t, "ja", tag.String())
+
+	_, tag = m.Localize("fr", "not_found", data)
+	assert.Equal(t, "en", tag.String())
+
+	text, _ = m.Localize("ja", "no_such_code", data)
+	assert.Empty(t, text)
+}
+
+func TestLoadMessages(t *testing.T) {
+	// every code has to be in the default language
+	_, err := loadMessages(fstest.MapFS{
+		"messages/en.json": {Data: []byte(`{"a": "A"}`)},
+		"messages/ja.json": {Data: []byte(`{"a": "あ", "b": "い"}`)},
+	})
+	assert.NotNil(t, err)
+
+	// a code not translated yet is in the default language
+	m, err := loadMessages(fstest.MapFS{
+		"messages/en.json": {Data: []byte(`{"a": "A", "b": "B"}`)},
+		"messages/ja.json": {Data: []byte(`{"a": "あ"}`)},
+	})
+	assert.Nil(t, err)
+	text, tag := m.Localize("ja", "b", nil)
+	assert.Equal(t, "B", text)
+	assert.Equal(t, "en", tag.String())
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	errNoToken      = errors.New("bearer token is required")
+	errNoExpiration = errors.New("token has no expiration")
+	errNoSubject    = errors.New("token has no subject")
+)
+
+// only asymmetric algorithms, keys of JWKS are public ones
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+const jwtLeeway = 30 * time.Second
+
+// keys and issuers of Google, tokens of IAP are signed by ES256 and ID tokens by RS256
+const (
+	IAPHeader    = "X-Goog-IAP-JWT-Assertion"
+	iapIssuer    = "https://cloud.google.com/iap"
+	iapJWKS      = "https://www.gstatic.com/iap/verify/public_key-jwk"
+	googleIssuer = "https://accounts.google.com"
+	googleJWKS   = "https://www.googleapis.com/oauth2/v3/certs"
+)
+
+/*
+JWTVerifier verifies bearer tokens of the issuer for the audience, they have to expire and have the subject.
+Keyfunc looks up the key of a token, like the one of keyfunc.JWKS.
+Header is where the token is instead of Authorization, like X-Goog-IAP-JWT-Assertion, it's not a bearer one.
+*/
+type JWTVerifier struct {
+	Issuer   string
+	Audience string
+	Keyfunc  jwt.Keyfunc
+	Header   string
+}
+
+/*
+NewJWKSVerifier fetches keys from the JWKS url, and refreshes them hourly or on an unknown kid until ctx is done.
+Both issuer and audience are required, tokens of the same JWKS for other services would be accepted otherwise.
+*/
+func NewJWKSVerifier(ctx context.Context, issuer, audience, jwksURL string) (*JWTVerifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("both issuer and audience are required to verify tokens")
+	}
+	jwks, err := keyfunc.Get(jwksURL, keyfunc.Options{
+		Ctx:               ctx,
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  5 * time.Minute,
+		RefreshTimeout:    10 * time.Second,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			slog.Warn("could not refresh JWKS", "url", jwksURL, "error", err.Error())
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("JWKS %s: %w", jwksURL, err)
+	}
+	return &JWTVerifier{Issuer: issuer, Audience: audience, Keyfunc: jwks.Keyfunc}, nil
+}
+
+/*
+NewIAPVerifier verifies the assertion of Cloud IAP, audience is like "/projects/NUMBER/global/backendServices/ID".
+The caller is the email of the user signed in to IAP.
+*/
+func NewIAPVerifier(ctx context.Context, audience string) (*JWTVerifier, error) {
+	v, err := NewJWKSVerifier(ctx, iapIssuer, audience, iapJWKS)
+	if err != nil {
+		return nil, err
+	}
+	v.Header = IAPHeader
+	return v, nil
+}
+
+/*
+NewIDTokenVerifier verifies Google ID tokens of invokers in Authorization, audience is the url of the service.
+It's for invokers calling through something that passes the token as it's signed.
+*/
+func NewIDTokenVerifier(ctx context.Context, audience string) (*JWTVerifier, error) {
+	return NewJWKSVerifier(ctx, googleIssuer, audience, googleJWKS)
+}
+
+// Verify returns the subject of the token
+func (v *JWTVerifier) Verify(token string) (string, error) {
+	claims, err := v.Claims(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.GetSubject()
+}
+
+// Claims verifies the token and returns all of its claims, the subject is always in them
+func (v *JWTVerifier) Claims(token string) (jwt.MapClaims, error) {
+	parsed, err := jwt.Parse(token, v.Keyfunc,
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithIssuer(v.Issuer),
+		jwt.WithAudience(v.Audience),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if exp, err := parsed.Claims.GetExpirationTime(); err != nil || exp == nil {
+		return nil, errNoExpiration
+	}
+	if subject, err := parsed.Claims.GetSubject(); err != nil || subject == "" {
+		return nil, errNoSubject
+	}
+	return parsed.Claims.(jwt.MapClaims), nil
+}
+
+// FromRequest verifies the token of the request and returns its subject, errNoToken is returned if it's not given
+func (v *JWTVerifier) FromRequest(r *http.Request) (string, error) {
+	claims, err := v.ClaimsFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.GetSubject()
+}
+
+// ClaimsFromRequest verifies the token of Header, or the bearer token of Authorization if Header is empty
+func (v *JWTVerifier) ClaimsFromRequest(r *http.Request) (jwt.MapClaims, error) {
+	return v.ClaimsFromHeader(r.Header)
+}
+
+// ClaimsFromHeader is the same as ClaimsFromRequest, for the metadata of gRPC as well
+func (v *JWTVerifier) ClaimsFromHeader(header http.Header) (jwt.MapClaims, error) {
+	if v.Header != "" {
+		token := strings.TrimSpace(header.Get(v.Header))
+		if token == "" {
+			return nil, errNoToken
+		}
+		return v.Claims(token)
+	}
+	scheme, token, ok := strings.Cut(header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errNoToken
+	}
+	return v.Claims(strings.TrimSpace(token))
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVerifier(t *testing.T) (*JWTVerifier, func(jwt.MapClaims) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &JWTVerifier{
+		Issuer:   "https://issuer.example.com",
+		Audience: "game-api",
+		Keyfunc:  func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil },
+	}
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return v, sign
+}
+
+func validClaims(sub string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "https://issuer.example.com",
+		"aud": "game-api",
+		"sub": sub,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	v, sign := newTestVerifier(t)
+
+	subject, err := v.Verify(sign(validClaims("u1")))
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", subject)
+
+	invalid := map[string]func(jwt.MapClaims){
+		"issuer":        func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" },
+		"audience":      func(c jwt.MapClaims) { c["aud"] = "other-api" },
+		"expired":       func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiration": func(c jwt.MapClaims) { delete(c, "exp") },
+		"no subject":    func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+	for name, modify := range invalid {
+		claims := validClaims("u1")
+		modify(claims)
+		_, err := v.Verify(sign(claims))
+		assert.NotNil(t, err, name)
+	}
+
+	// symmetric algorithms are not accepted, whatever the key is
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("u1")).SignedString([]byte("secret"))
+	_, err = v.Verify(hs)
+	assert.NotNil(t, err)
+
+	_, err = NewJWKSVerifier(context.Background(), "", "game-api", "https://issuer.example.com/jwks")
+	assert.NotNil(t, err)
+}
+
+func TestAuthorizerJWT(t *testing.T) {
+	v, sign := newTestVerifier(t)
+	a := NewAuthorizer("", "admin", nil)
+	a.JWT = v
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(IdentityFromContext(r.Context()).Subject))
+	}
+	r := chi.NewRouter()
+	r.Route("/api", func(t chi.Router) {
+		t.Use(a.Authenticate)
+		t.Use(a.RequireSubject)
+		t.Get("/items", ok)
+		t.Post("/items", ok)
+		t.Group(func(u chi.Router) {
+			u.Use(a.AuthorizeUser("user_id"))
+			u.Get("/user_id/{user_id}", ok)
+			u.Put("/user_id/{user_id}/{item_id}", ok)
+		})
+	})
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		actAs  string
+		status int
+	}{
+		{name: "read without token", method: "GET", path: "/api/items", status: http.StatusOK},
+		{name: "mutation without token", method: "POST", path: "/api/items", status: http.StatusUnauthorized},
+		{name: "invalid token", method: "GET", path: "/api/items", token: "invalid", status: http.StatusUnauthorized},
+		{name: "mutation with token", method: "POST", path: "/api/items", token: sign(validClaims("u1")), status: http.StatusOK},
+		{name: "read of another user", method: "GET", path: "/api/user_id/u2", token: sign(validClaims("u1")), status: http.StatusOK},
+		{name: "mutation of the subject", method: "PUT", path: "/api/user_id/u1/i1", token: sign(validClaims("u1")), status: http.StatusOK},
+		{name: "mutation of another user", method: "PUT", path: "/api/user_id/u2/i1", token: sign(validClaims("u1")), status: http.StatusForbidden},
+		{name: "admin acts as the user", method: "PUT", path: "/api/user_id/u2/i1", token: sign(validClaims("admin")), actAs: "u2", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.actAs != "" {
+			req.Header.Set(ActAsHeader, c.actAs)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.name)
+		if c.status == http.StatusUnauthorized {
+			assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer", c.name)
+		}
+	}
+
+	assert.True(t, a.CanModify(Identity{Subject: "u1"}, "u1"))
+	assert.False(t, a.CanModify(Identity{}, "u1"))
+	assert.True(t, NewAuthorizer("", "", nil).CanModify(Identity{}, "u1"))
+}
+
+func TestAuthorizerProxy(t *testing.T) {
+	v, sign := newTestVerifier(t)
+	v.Header = IAPHeader
+	a := NewAuthorizer("", "admin@example.com", nil)
+	a.Proxy = v
+
+	h := a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := IdentityFromContext(r.Context())
+		assert.Equal(t, "accounts.google.com:1", identity.Claims["sub"])
+		assert.Empty(t, identity.Subject)
+		w.Write([]byte(identity.Caller))
+	}))
+
+	withEmail := validClaims("accounts.google.com:1")
+	withEmail["email"] = "admin@example.com"
+	cases := []struct {
+		name   string
+		token  string
+		status int
+		caller string
+	}{
+		{name: "without token", status: http.StatusUnauthorized},
+		{name: "invalid token", token: "invalid", status: http.StatusUnauthorized},
+		{name: "email is the caller", token: sign(withEmail), status: http.StatusOK, caller: "admin@example.com"},
+		{name: "subject without email", token: sign(validClaims("accounts.google.com:1")), status: http.StatusOK, caller: "accounts.google.com:1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/api/items", nil)
+		if c.token != "" {
+			req.Header.Set(IAPHeader, c.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.name)
+		if c.caller != "" {
+			assert.Equal(t, c.caller, rec.Body.String(), c.name)
+		}
+	}
+
+	// not a bearer token
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(withEmail))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
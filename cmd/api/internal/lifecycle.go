@@ -0,0 +1,136 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// priorities of the usual subsystems, lower ones start first, and stop first
+const (
+	// telemetry starts first and is flushed at last, to see everything else
+	StartTelemetry = 0
+	StartClients   = 10
+	StartJobs      = 20
+	StartServers   = 30
+
+	// servers stop accepting and drain first, then background jobs, then the clients they used
+	StopServers   = 0
+	StopJobs      = 10
+	StopClients   = 20
+	StopTelemetry = 30
+)
+
+type hook struct {
+	name     string
+	priority int
+	seq      int
+	fn       func(context.Context) error
+}
+
+/*
+Lifecycle runs hooks registered by subsystems when the binary starts and stops, ordered by their priorities.
+Start hooks of the same priority run in the order they are registered, and stop hooks in the reverse order like defer,
+so a subsystem registered after another one is stopped before it.
+Stop runs all the stop hooks even if some of them fail, and it's safe to call it more than once,
+so it can be deferred right after the Lifecycle is created, for both early returns and the normal shutdown.
+*/
+type Lifecycle struct {
+	mu      sync.Mutex
+	starts  []hook
+	stops   []hook
+	seq     int
+	stopped bool
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+// OnStart registers f to run by Start
+func (l *Lifecycle) OnStart(name string, priority int, f func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.starts = append(l.starts, hook{name: name, priority: priority, seq: l.seq, fn: f})
+}
+
+// OnStop registers f to run by Stop, f is expected to return by the deadline of ctx
+func (l *Lifecycle) OnStop(name string, priority int, f func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.stops = append(l.stops, hook{name: name, priority: priority, seq: l.seq, fn: f})
+}
+
+// Start runs the start hooks, it stops at the first error, then the caller is expected to Stop
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	starts := append([]hook{}, l.starts...)
+	l.mu.Unlock()
+
+	sort.SliceStable(starts, func(i, j int) bool {
+		if starts[i].priority != starts[j].priority {
+			return starts[i].priority < starts[j].priority
+		}
+		return starts[i].seq < starts[j].seq
+	})
+	for _, h := range starts {
+		if err := h.fn(ctx); err != nil {
+			return fmt.Errorf("start %s: %w", h.name, err)
+		}
+	}
+	return nil
+}
+
+// Stop runs the stop hooks once, and returns the errors of all of them
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return nil
+	}
+	l.stopped = true
+	stops := append([]hook{}, l.stops...)
+	l.mu.Unlock()
+
+	sort.SliceStable(stops, func(i, j int) bool {
+		if stops[i].priority != stops[j].priority {
+			return stops[i].priority < stops[j].priority
+		}
+		return stops[i].seq > stops[j].seq
+	})
+	var errs []error
+	for _, h := range stops {
+		if err := h.fn(ctx); err != nil {
+			slog.Warn("could not stop", "hook", h.name, "error", err.Error())
+			errs = append(errs, fmt.Errorf("stop %s: %w", h.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Closer adapts Close of clients to a stop hook
+func Closer(close func() error) func(context.Context) error {
+	return func(context.Context) error {
+		return close()
+	}
+}
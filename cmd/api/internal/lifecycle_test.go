@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	l := NewLifecycle()
+
+	order := []string{}
+	record := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			order = append(order, name)
+			return err
+		}
+	}
+	l.OnStart("http", StartServers, record("start http", nil))
+	l.OnStart("spanner", StartClients, record("start spanner", nil))
+	l.OnStart("redis", StartClients, record("start redis", nil))
+	l.OnStart("scheduler", StartJobs, record("start scheduler", nil))
+	l.OnStop("tracer", StopTelemetry, record("stop tracer", nil))
+	l.OnStop("spanner", StopClients, record("stop spanner", errors.New("failed")))
+	l.OnStop("redis", StopClients, record("stop redis", nil))
+	l.OnStop("http", StopServers, record("stop http", nil))
+
+	assert.Nil(t, l.Start(ctx))
+	assert.Equal(t, []string{"start spanner", "start redis", "start scheduler", "start http"}, order)
+
+	// the same priority stops in reverse order, and a failure doesn't skip the others
+	order = order[:0]
+	err := l.Stop(ctx)
+	assert.ErrorContains(t, err, "stop spanner")
+	assert.Equal(t, []string{"stop http", "stop redis", "stop spanner", "stop tracer"}, order)
+
+	order = order[:0]
+	assert.Nil(t, l.Stop(ctx))
+	assert.Empty(t, order)
+
+	// start stops at the first error
+	l = NewLifecycle()
+	order = order[:0]
+	l.OnStart("listen", StartServers, record("start listen", errors.New("address in use")))
+	l.OnStart("after", StartServers, record("start after", nil))
+	assert.ErrorContains(t, l.Start(ctx), "start listen")
+	assert.Equal(t, []string{"start listen"}, order)
+}
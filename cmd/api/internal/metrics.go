@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	PatternReqsName    = "chi_pattern_requests_total"
+	PatternLatencyName = "chi_pattern_request_duration_milliseconds"
+)
+
+var DefaultLatencyBuckets = []float64{50, 100, 300, 1200, 5000}
+
+/*
+NewPatternMetrics is a middleware to count requests and observe latency by chi route pattern,
+like /api/user_id/{user_id} instead of the actual path, so ids don't become labels.
+It's compatible with chiprometheus.NewPatternMiddleware, which can't be used with chi/v5.
+*/
+func NewPatternMetrics(name string, buckets ...float64) func(next http.Handler) http.Handler {
+	reqs := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        PatternReqsName,
+			Help:        "How many HTTP requests processed, partitioned by status code, method and HTTP path (with patterns).",
+			ConstLabels: prometheus.Labels{"service": name},
+		},
+		[]string{"code", "method", "path"},
+	)
+	prometheus.MustRegister(reqs)
+
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        PatternLatencyName,
+		Help:        "How long it took to process the request, partitioned by status code, method and HTTP path (with patterns).",
+		ConstLabels: prometheus.Labels{"service": name},
+		Buckets:     buckets,
+	},
+		[]string{"code", "method", "path"},
+	)
+	prometheus.MustRegister(latency)
+	// the same as latency for OTLP, of the global meter provider, which is a no-op until it's set
+	duration, _ := otel.Meter("github.com/shin5ok/go-architecting-workshop/cmd/api/internal").Float64Histogram(
+		"http.server.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("How long it took to process the request, by method, route pattern and status code."),
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			routePattern := RoutePattern(r)
+			reqs.WithLabelValues(http.StatusText(ww.Status()), r.Method, routePattern).Inc()
+			elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+			latency.WithLabelValues(http.StatusText(ww.Status()), r.Method, routePattern).Observe(elapsed)
+			duration.Record(r.Context(), elapsed, metric.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", routePattern),
+				attribute.Int("http.status_code", ww.Status()),
+			))
+		})
+	}
+}
+
+// RoutePattern returns the matched route pattern, it's available after the request is routed
+func RoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return ""
+	}
+	return strings.Replace(strings.Join(rctx.RoutePatterns, ""), "/*/", "/", -1)
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPatternMetrics(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(NewPatternMetrics("test"))
+	r.Route("/api", func(t chi.Router) {
+		t.Get("/user_id/{user_id}", func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	for _, id := range []string{"a", "b"} {
+		req := httptest.NewRequest("GET", "/api/user_id/"+id, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, PatternReqsName)
+	assert.Nil(t, err)
+	// both requests are counted by the pattern, not by each path
+	assert.Equal(t, 1, count)
+}
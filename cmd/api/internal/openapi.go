@@ -0,0 +1,283 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/*
+OpenAPIOperation documents a route, which is keyed by method and path without url param patterns, like "GET /api/items/{item_id}".
+Request and Response are zero values of json bodies, their schemas are generated by reflection.
+Errors are always answered with the error envelope, {"ERROR": "error", "code": "stable code", "message": "localized text"}.
+*/
+type OpenAPIOperation struct {
+	Summary   string
+	Request   interface{}
+	Response  interface{}
+	Paginated bool // limit and cursor query params
+	// Idempotency-Key header, see IdempotencyKeyHeader
+	Idempotent bool
+}
+
+// IdempotencyKeyHeader lets clients retry a mutation without doing it twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var urlParam = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+/*
+NewOpenAPI generates OpenAPI 3 document of the routes.
+Routes which are not documented by ops are left out and returned, to be noticed when a route is added without its document.
+Other methods of a documented path routed by Router.Handle are not returned, since it routes every method.
+*/
+func NewOpenAPI(title, version string, routes chi.Routes, ops map[string]OpenAPIOperation) (map[string]interface{}, []string, error) {
+	s := schemas{components: map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"ERROR":   map[string]interface{}{"type": "string"},
+				"code":    map[string]interface{}{"type": "string"},
+				"message": map[string]interface{}{"type": "string"},
+			},
+			"required": []string{"ERROR"},
+		},
+	}}
+	paths := map[string]map[string]interface{}{}
+	documented := map[string]bool{}
+	skipped := []string{}
+	handled := map[string]bool{} // routed for CONNECT too, it's done only by Router.Handle
+
+	err := chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		route = strings.Replace(route, "/*/", "/", -1)
+		path := urlParam.ReplaceAllString(route, "{$1}")
+		key := method + " " + path
+		if method == http.MethodConnect {
+			handled[path] = true
+		}
+		op, ok := ops[key]
+		if !ok {
+			skipped = append(skipped, key)
+			return nil
+		}
+		documented[key] = true
+
+		params := []interface{}{}
+		for _, m := range urlParam.FindAllStringSubmatch(route, -1) {
+			schema := map[string]interface{}{"type": "string"}
+			if m[2] != "" {
+				schema["pattern"] = "^" + m[2] + "$"
+			}
+			params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": schema})
+		}
+		if op.Paginated {
+			params = append(params,
+				map[string]interface{}{"name": "limit", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+				map[string]interface{}{"name": "cursor", "in": "query", "schema": map[string]interface{}{"type": "string"}},
+			)
+		}
+		if op.Idempotent {
+			params = append(params, map[string]interface{}{"name": IdempotencyKeyHeader, "in": "header", "schema": map[string]interface{}{"type": "string", "maxLength": 255}})
+		}
+
+		ok200 := map[string]interface{}{"description": "OK"}
+		if op.Response != nil {
+			ok200["content"] = jsonContent(s.of(reflect.TypeOf(op.Response)))
+		}
+		operation := map[string]interface{}{
+			"summary": op.Summary,
+			"responses": map[string]interface{}{
+				"200": ok200,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/Error"}),
+				},
+			},
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(s.of(reflect.TypeOf(op.Request)))}
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key := range ops {
+		if !documented[key] {
+			return nil, nil, fmt.Errorf("%q is documented, but not routed", key)
+		}
+	}
+	undocumented := []string{}
+	for _, key := range skipped {
+		if _, path, _ := strings.Cut(key, " "); paths[path] == nil || !handled[path] {
+			undocumented = append(undocumented, key)
+		}
+	}
+	sort.Strings(undocumented)
+
+	return map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]interface{}{"title": title, "version": version},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": s.components},
+	}, undocumented, nil
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// schemas generates json schemas by the json tags, named structs are shared as components
+type schemas struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s schemas) of(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s.components[t.Name()]; !ok {
+			// placeholder first, for recursive types
+			s.components[t.Name()] = map[string]interface{}{}
+			s.components[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Int64 || t.Kind() == reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+func (s schemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	s.fields(t, properties, &required)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s schemas) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		// embedded structs are flattened by encoding/json, even if they are unexported
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.of(f.Type)
+		if isRequired(f, opts) {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// required if it's validated so, or it's always encoded unless the request is validated
+func isRequired(f reflect.StructField, opts string) bool {
+	validate, ok := f.Tag.Lookup("validate")
+	if ok {
+		return strings.Contains(","+validate+",", ",required,")
+	}
+	return !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer
+}
+
+func OpenAPIHandler(doc interface{}) http.HandlerFunc {
+	body, err := json.Marshal(doc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+var swaggerUI = template.Must(template.New("swagger").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Swagger UI</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: {{.}}, dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+
+// SwaggerUIHandler serves Swagger UI of the document at specURL, the assets are loaded from unpkg
+func SwaggerUIHandler(specURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		swaggerUI.Execute(w, specURL)
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type testUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type testProfile struct {
+	testUser
+	Email     string    `json:"email,omitempty" validate:"omitempty,email"`
+	Token     string    `json:"token" validate:"required"`
+	Note      *string   `json:"note"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func TestNewOpenAPI(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r := chi.NewRouter()
+	r.Handle("/metrics", http.HandlerFunc(noop))
+	r.Route("/api", func(t chi.Router) {
+		t.Get("/users", noop)
+		t.Patch("/user_id/{user_id:[a-z0-9-.]+}", noop)
+		t.Delete("/user_id/{user_id:[a-z0-9-.]+}", noop)
+	})
+
+	doc, undocumented, err := NewOpenAPI("myapp", "1.0", r, map[string]OpenAPIOperation{
+		"GET /metrics": {Summary: "metrics"},
+		"GET /api/users": {Summary: "users", Paginated: true, Response: struct {
+			Users []testUser `json:"users"`
+		}{}},
+		"PATCH /api/user_id/{user_id}": {Summary: "update", Idempotent: true, Request: testProfile{}, Response: testProfile{}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DELETE /api/user_id/{user_id}"}, undocumented)
+
+	body, err := json.Marshal(doc)
+	assert.Nil(t, err)
+	var got struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name   string
+				In     string
+				Schema map[string]interface{}
+			}
+			RequestBody map[string]interface{}
+			Responses   map[string]interface{}
+		}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{}
+				Required   []string
+			}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(body, &got))
+
+	assert.Len(t, got.Paths, 3)
+	assert.Len(t, got.Paths["/metrics"], 1)
+
+	users := got.Paths["/api/users"]["get"]
+	assert.Len(t, users.Parameters, 2)
+	assert.Equal(t, "cursor", users.Parameters[1].Name)
+	assert.Contains(t, users.Responses, "default")
+
+	update := got.Paths["/api/user_id/{user_id}"]["patch"]
+	assert.Equal(t, "user_id", update.Parameters[0].Name)
+	assert.Equal(t, "path", update.Parameters[0].In)
+	assert.Equal(t, "^[a-z0-9-.]+$", update.Parameters[0].Schema["pattern"])
+	assert.NotNil(t, update.RequestBody)
+	assert.Equal(t, IdempotencyKeyHeader, update.Parameters[1].Name)
+	assert.Equal(t, "header", update.Parameters[1].In)
+
+	profile := got.Components.Schemas["testProfile"]
+	assert.ElementsMatch(t, []string{"id", "name", "email", "token", "note", "created_at"}, keys(profile.Properties))
+	assert.ElementsMatch(t, []string{"id", "name", "token", "created_at"}, profile.Required)
+	assert.Equal(t, "date-time", profile.Properties["created_at"]["format"])
+	assert.Equal(t, []string{"ERROR"}, got.Components.Schemas["Error"].Required)
+
+	// documented routes have to exist
+	_, _, err = NewOpenAPI("myapp", "1.0", r, map[string]OpenAPIOperation{"GET /api/items": {}})
+	assert.NotNil(t, err)
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	OpenAPIHandler(map[string]string{"openapi": "3.0.3"})(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"openapi": "3.0.3"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	SwaggerUIHandler("/openapi.json")(rec, httptest.NewRequest("GET", "/swagger", nil))
+	assert.Contains(t, rec.Body.String(), `url: "/openapi.json"`)
+}
+
+func keys(m map[string]map[string]interface{}) []string {
+	ks := []string{}
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
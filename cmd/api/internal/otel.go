@@ -16,57 +16,19 @@ limitations under the License.
 package internal
 
 import (
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
-
 	"context"
 
-	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
-	gcppropagator "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"github.com/shin5ok/go-architecting-workshop/telemetry"
 )
 
-func NewTracer(projectId string) (*sdktrace.TracerProvider, error) {
-
-	exporter, err := texporter.New(texporter.WithProjectID(projectId))
-	if err != nil {
-		return nil, err
-	}
-
-	res, err := resource.New(
-		context.Background(),
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String("game-api"),
-			semconv.TelemetrySDKNameKey.String("opentelemetry"),
-			semconv.TelemetrySDKLanguageKey.String("go"),
-		),
-	)
-
-	if err != nil {
-		return nil, err
+// NewTracer is telemetry.NewTracer of the api, requests forced by Tracing are sampled anyway, and spans are tagged by experiments
+func NewTracer(ctx context.Context, config telemetry.Config) (*sdktrace.TracerProvider, error) {
+	sampler := config.Sampler
+	if sampler == nil {
+		sampler = sdktrace.AlwaysSample()
 	}
-
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithBatcher(exporter),
-	)
-
-	otel.SetTracerProvider(tp)
-
-	installPropagators()
-
-	return tp, nil
-}
-
-func installPropagators() {
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			gcppropagator.CloudTraceOneWayPropagator{},
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		))
+	config.Sampler = forcingSampler{base: sampler}
+	return telemetry.NewTracer(ctx, config, sdktrace.WithSpanProcessor(ExperimentSpanProcessor{}))
 }
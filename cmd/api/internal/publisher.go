@@ -0,0 +1,199 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+/*
+EventPublisher publishes events of the game to a broker.
+id is unique per event, brokers supporting deduplication use it.
+data is encoded as json, a type of the domain package is preferred to keep the shape stable for consumers.
+The context of the publish span is propagated with the event, so consumers can link their spans to it.
+*/
+type EventPublisher interface {
+	Publish(ctx context.Context, eventType string, id string, data interface{}) error
+	Close() error
+}
+
+/*
+ConfirmedPublisher is an EventPublisher which can wait for the broker to accept an event,
+for the outbox relay, which marks events published only when they are.
+Publish of Pub/Sub returns once the event is enqueued, and its failure in background is just logged.
+*/
+type ConfirmedPublisher interface {
+	EventPublisher
+	PublishConfirmed(ctx context.Context, eventType string, id string, data interface{}) error
+}
+
+// PubSubPublisher publishes events to a Pub/Sub topic, the event type, id and experiment variants are set as attributes
+type PubSubPublisher struct {
+	topic *pubsub.Topic
+}
+
+// messages are sent in batches by settings, which are of the Pub/Sub policy of the dependencies
+func NewPubSubPublisher(client *pubsub.Client, topicName string, settings pubsub.PublishSettings) *PubSubPublisher {
+	topic := client.Topic(topicName)
+	topic.PublishSettings = settings
+	return &PubSubPublisher{topic: topic}
+}
+
+// publish span is a producer one, linked from the span of the consumer
+func startPublishSpan(ctx context.Context, system, eventType, id string) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer("main").Start(ctx, "publish "+eventType, trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(
+		attribute.String("messaging.system", system),
+		attribute.String("event.type", eventType),
+		attribute.String("event.id", id),
+	)
+	return ctx, span
+}
+
+func (p *PubSubPublisher) Publish(ctx context.Context, eventType string, id string, data interface{}) error {
+	ctx, span := startPublishSpan(ctx, "pubsub", eventType, id)
+	defer span.End()
+
+	res, err := p.enqueue(ctx, eventType, id, data)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if _, err := res.Get(context.Background()); err != nil {
+			log.Println("publish", eventType, id, err)
+		}
+	}()
+	return nil
+}
+
+// the same as Publish, but it returns after the message has been sent, with the error of sending it
+func (p *PubSubPublisher) PublishConfirmed(ctx context.Context, eventType string, id string, data interface{}) error {
+	ctx, span := startPublishSpan(ctx, "pubsub", eventType, id)
+	defer span.End()
+
+	res, err := p.enqueue(ctx, eventType, id, data)
+	if err != nil {
+		return err
+	}
+	_, err = res.Get(ctx)
+	return err
+}
+
+// enqueue the message in the current span, it's sent in a batch in background
+func (p *PubSubPublisher) enqueue(ctx context.Context, eventType string, id string, data interface{}) (*pubsub.PublishResult, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{
+		"event_type": eventType,
+		"event_id":   id,
+	}
+	for name, variant := range ExperimentsFromContext(ctx) {
+		attrs["experiment."+name] = variant
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
+	// only enqueueing is tracked, messages are sent in batches in background
+	done := budget.Track(ctx, budget.PubSub)
+	res := p.topic.Publish(ctx, &pubsub.Message{
+		Data:       jsonData,
+		Attributes: attrs,
+	})
+	done()
+	return res, nil
+}
+
+func (p *PubSubPublisher) Close() error {
+	p.topic.Stop()
+	return nil
+}
+
+/*
+NATSPublisher publishes events to NATS JetStream, as a lightweight alternative of Pub/Sub for off-cloud workshops.
+Each event type has its own subject under the stream, like "game.user_items_read",
+and JetStream drops duplicates by the message id within its duplicate window.
+Experiment variants are set as headers, like "Experiment-new_shop: treatment".
+*/
+type NATSPublisher struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	prefix string
+}
+
+func NewNATSPublisher(url string, stream string, prefix string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     stream,
+		Subjects: []string{prefix + ".>"},
+	})
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		conn.Close()
+		return nil, err
+	}
+
+	return &NATSPublisher{conn: conn, js: js, prefix: prefix}, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, eventType string, id string, data interface{}) error {
+	ctx, span := startPublishSpan(ctx, "nats", eventType, id)
+	defer span.End()
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.prefix + "." + eventType)
+	msg.Data = jsonData
+	for name, variant := range ExperimentsFromContext(ctx) {
+		msg.Header.Set("Experiment-"+name, variant)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(http.Header(msg.Header)))
+	defer budget.Track(ctx, budget.NATS)()
+	_, err = p.js.PublishMsg(msg, nats.MsgId(id), nats.Context(ctx))
+	return err
+}
+
+// Publish of JetStream waits for the ack of the stream already
+func (p *NATSPublisher) PublishConfirmed(ctx context.Context, eventType string, id string, data interface{}) error {
+	return p.Publish(ctx, eventType, id, data)
+}
+
+func (p *NATSPublisher) Close() error {
+	return p.conn.Drain()
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/shin5ok/go-architecting-workshop/luascript"
+)
+
+/*
+RateLimit of a route, per user or caller.
+Route is the pattern without regexps like "/api/user_id/{user_id}".
+Rate is how many requests are allowed per second in the long run, and Burst is how many at once.
+Fallback limits the route in process while redis is down, it's coarse as each instance allows the rate,
+but better than nothing for routes prone to abuse.
+*/
+type RateLimit struct {
+	Method   string  `json:"method"`
+	Route    string  `json:"route"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	Fallback bool    `json:"fallback,omitempty"`
+}
+
+// ParseRateLimits reads limits as json array, nothing is limited if it's empty
+func ParseRateLimits(config string) ([]RateLimit, error) {
+	if config == "" {
+		return nil, nil
+	}
+	limits := []RateLimit{}
+	if err := json.Unmarshal([]byte(config), &limits); err != nil {
+		return nil, err
+	}
+	for _, l := range limits {
+		if l.Rate <= 0 || l.Burst < 1 {
+			return nil, fmt.Errorf("rate limit of %s %s: rate has to be positive and burst at least 1", l.Method, l.Route)
+		}
+	}
+	return limits, nil
+}
+
+/*
+RateLimiter limits requests by token buckets in redis, so the limits are shared by all instances.
+It fails open, requests are allowed while redis is down, as it's to protect Spanner from a few noisy callers,
+except the routes with Fallback, which are limited by buckets in process instead.
+*/
+type RateLimiter struct {
+	rdb       redis.UniversalClient
+	limits    map[string]RateLimit
+	local     *localBuckets
+	rejected  *prometheus.CounterVec
+	decisions *prometheus.CounterVec
+}
+
+func NewRateLimiter(rdb redis.UniversalClient, limits []RateLimit) *RateLimiter {
+	rejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "How many requests were rejected by rate limits, partitioned by method and HTTP path (with patterns).",
+		},
+		[]string{"method", "path"},
+	)
+	decisions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_decisions_total",
+			Help: "How many requests were checked by rate limits, partitioned by the limiter, redis, memory or none while redis is down, and the decision.",
+		},
+		[]string{"limiter", "decision"},
+	)
+	prometheus.MustRegister(rejected, decisions)
+
+	l := &RateLimiter{rdb: rdb, limits: map[string]RateLimit{}, local: newLocalBuckets(), rejected: rejected, decisions: decisions}
+	for _, limit := range limits {
+		l.limits[limit.Method+" "+limit.Route] = limit
+	}
+	return l
+}
+
+// Allow takes a token of the key, and returns how long to wait for the next one if there isn't
+func (l *RateLimiter) Allow(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	result, err := luascript.TokenBucket.Run(l.rdb, []string{key}, limit.Rate, limit.Burst, now.UnixMilli()).Result()
+	if err != nil {
+		return true, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return true, 0, fmt.Errorf("unexpected result of the token bucket: %v", result)
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+/*
+Middleware limits requests of the routes in the limits, by the user of the url param,
+or by the api key, the caller or the client address if the route doesn't have the param.
+It has to be used inline like NewExperimentMiddleware, to see the url param and the route pattern.
+*/
+func (l *RateLimiter) Middleware(param string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := urlParam.ReplaceAllString(RoutePattern(r), "{$1}")
+			limit, ok := l.limitOf(r.Method, route)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowed, wait := l.take(rateLimitKey(r, param, limit), limit); !allowed {
+				w.Header().Set("Retry-After", retryAfter(wait))
+				http.Error(w, "Too many requests, retry later", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitOf returns the limit of the route, the limiter may be nil to limit nothing
+func (l *RateLimiter) limitOf(method, route string) (RateLimit, bool) {
+	if l == nil || len(l.limits) == 0 {
+		return RateLimit{}, false
+	}
+	limit, ok := l.limits[method+" "+route]
+	return limit, ok
+}
+
+// take checks the limit by redis, or in process while redis is down if the limit falls back, and counts the decision
+func (l *RateLimiter) take(key string, limit RateLimit) (bool, time.Duration) {
+	now := time.Now()
+	limiter := "redis"
+	allowed, wait, err := l.Allow(key, limit, now)
+	if err != nil {
+		limiter = "none"
+		if limit.Fallback {
+			limiter = "memory"
+			allowed, wait = l.local.allow(key, limit, now)
+		}
+		slog.Warn("rate limit is not checked by redis", "method", limit.Method, "route", limit.Route, "limiter", limiter, "error", err.Error())
+	}
+	decision := "allowed"
+	if !allowed {
+		decision = "rejected"
+	}
+	l.decisions.WithLabelValues(limiter, decision).Inc()
+	if !allowed {
+		l.rejected.WithLabelValues(limit.Method, limit.Route).Inc()
+	}
+	return allowed, wait
+}
+
+// seconds to wait rounded up, as Retry-After has no fraction
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// buckets of more keys than it are swept, not to grow while redis is down
+const maxLocalBuckets = 10000
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// localBuckets are the same token buckets as the script, in process
+type localBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+}
+
+func newLocalBuckets() *localBuckets {
+	return &localBuckets{buckets: map[string]*localBucket{}}
+}
+
+func (b *localBuckets) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= maxLocalBuckets {
+			b.sweep(now)
+		}
+		bucket = &localBucket{tokens: float64(limit.Burst), ts: now}
+		b.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+math.Max(0, now.Sub(bucket.ts).Seconds())*limit.Rate)
+	bucket.ts = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration(math.Ceil((1-bucket.tokens)*1000/limit.Rate)) * time.Millisecond
+}
+
+// drop buckets idle for a second or more, they start full again, which is a little loose for rates under 1 per second
+func (b *localBuckets) sweep(now time.Time) {
+	for key, bucket := range b.buckets {
+		if now.Sub(bucket.ts) >= time.Second {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+func rateLimitKey(r *http.Request, param string, limit RateLimit) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return limitKey(limit, chi.URLParam(r, param), IdentityFromContext(r.Context()), host)
+}
+
+/*
+braces are of hash tags in Redis Cluster, only the part in {} of a key is hashed,
+so keys of routes like /api/user_id/{user_id} would be all in a slot, "{user_id}" is written as ":user_id" instead
+*/
+var hashTagReplacer = strings.NewReplacer("{", ":", "}", "")
+
+// limitKey is by the user if it's given, or by the api key, the caller or the client address
+func limitKey(limit RateLimit, userID string, identity Identity, addr string) string {
+	var key string
+	switch {
+	case userID != "":
+		key = "user:" + userID
+	case identity.APIKey != "":
+		key = "apikey:" + identity.APIKey
+	case identity.Caller != "":
+		key = "caller:" + identity.Caller
+	default:
+		key = "addr:" + addr
+	}
+	return hashTagReplacer.Replace(fmt.Sprintf("RateLimit_%s %s_%s", limit.Method, limit.Route, key))
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("")
+	assert.Nil(t, err)
+	assert.Empty(t, limits)
+
+	limits, err = ParseRateLimits(`[{"method": "PUT", "route": "/api/user_id/{user_id}/{item_id}", "rate": 2, "burst": 5}]`)
+	assert.Nil(t, err)
+	assert.Equal(t, []RateLimit{{Method: "PUT", Route: "/api/user_id/{user_id}/{item_id}", Rate: 2, Burst: 5}}, limits)
+
+	_, err = ParseRateLimits(`[{"method": "GET", "route": "/api/items", "rate": 0, "burst": 5}]`)
+	assert.NotNil(t, err)
+}
+
+func TestLocalBuckets(t *testing.T) {
+	b := newLocalBuckets()
+	limit := RateLimit{Rate: 2, Burst: 2}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		allowed, _ := b.allow("k", limit, now)
+		assert.True(t, allowed)
+	}
+	allowed, wait := b.allow("k", limit, now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	allowed, _ = b.allow("other", limit, now)
+	assert.True(t, allowed)
+
+	allowed, _ = b.allow("k", limit, now.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+
+	b.sweep(now.Add(2 * time.Second))
+	assert.Empty(t, b.buckets)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limit := RateLimit{Method: "PUT", Route: "/api/user_id/{user_id}/{item_id}", Rate: 1, Burst: 2}
+	fallback := RateLimit{Method: "POST", Route: "/api/items", Rate: 0.1, Burst: 1, Fallback: true}
+	// nothing listens on the port, so redis is down
+	l := NewRateLimiter(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond}), []RateLimit{limit, fallback})
+
+	keys := []string{}
+	r := chi.NewRouter()
+	r.Route("/api", func(t chi.Router) {
+		t = t.With(l.Middleware("user_id"))
+		t.Get("/items", func(w http.ResponseWriter, r *http.Request) {})
+		t.Post("/items", func(w http.ResponseWriter, r *http.Request) {})
+		t.Put("/user_id/{user_id:[a-z0-9-.]+}/{item_id:[a-z0-9-.]+}", func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, rateLimitKey(r, "user_id", limit))
+		})
+	})
+
+	// fails open while redis is down
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/user_id/u1/i1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"RateLimit_PUT /api/user_id/:user_id/:item_id_user:u1"}, keys)
+
+	// not limited
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// limited in process while redis is down
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/api/items", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/api/items", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+
+	// callers without the param
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	req = req.WithContext(WithIdentity(req.Context(), Identity{Caller: "c1", APIKey: "attendee"}))
+	assert.Equal(t, "RateLimit_PUT /api/user_id/:user_id/:item_id_apikey:attendee", rateLimitKey(req, "user_id", limit))
+	req = httptest.NewRequest("GET", "/api/items", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "RateLimit_PUT /api/user_id/:user_id/:item_id_addr:192.0.2.1", rateLimitKey(req, "user_id", limit))
+
+	// no braces of hash tags, keys are spread over slots of a cluster
+	req = httptest.NewRequest("GET", "/api/items", nil)
+	req = req.WithContext(WithIdentity(req.Context(), Identity{Caller: "{c1}"}))
+	assert.Equal(t, "RateLimit_PUT /api/user_id/:user_id/:item_id_caller::c1", rateLimitKey(req, "user_id", limit))
+
+	// the bucket itself needs redis
+	l.rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DialTimeout: 100 * time.Millisecond})
+	if err := l.rdb.Ping().Err(); err != nil {
+		t.Skip("redis is not available", err)
+	}
+	key := "RateLimit_test_" + time.Now().Format(time.RFC3339Nano)
+	defer l.rdb.Del(key)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		allowed, _, err := l.Allow(key, limit, now)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, wait, err := l.Allow(key, limit, now)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	allowed, _, err = l.Allow(key, limit, now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
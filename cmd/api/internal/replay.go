@@ -0,0 +1,235 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+/*
+ReplayRecord is a captured request and how it was answered, captures are newline delimited json of them.
+It has only what's needed to send the request again, credentials and personal data are not kept, see NewReplayRecord.
+*/
+type ReplayRecord struct {
+	At         time.Time         `json:"at"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query,omitempty"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	Status     int               `json:"status"`
+	DurationMs float64           `json:"duration_ms"`
+}
+
+// headers which are kept, the others like Authorization, cookies and X-API-Key are dropped
+var replayHeaders = []string{"Content-Type", "Accept", "Accept-Language", "If-Match", "If-None-Match", IdempotencyKeyHeader}
+
+// fields of json bodies which are replaced by redactedValue at any depth
+var redactedFields = map[string]bool{
+	"email":          true,
+	"external_id":    true,
+	"receipt":        true,
+	"purchase_token": true,
+	"token":          true,
+	"secret":         true,
+	"password":       true,
+}
+
+const (
+	redactedValue = "REDACTED"
+	// larger bodies are not captured, they can't be replayed faithfully if they are cut
+	maxReplayBody = 64 << 10
+	// records kept in memory until they are written, more are dropped not to grow while the bucket is slow
+	maxPendingRecords = 10000
+)
+
+/*
+NewReplayRecord is the sanitized request, only the headers in replayHeaders are kept,
+and json bodies are kept without redactedFields, other bodies are dropped as they can't be sanitized.
+*/
+func NewReplayRecord(r *http.Request, body []byte) ReplayRecord {
+	rec := ReplayRecord{
+		At:     time.Now(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: map[string]string{},
+	}
+	for _, name := range replayHeaders {
+		if value := r.Header.Get(name); value != "" {
+			rec.Header[name] = value
+		}
+	}
+	if len(body) > 0 {
+		rec.Body = sanitizeBody(body)
+	}
+	return rec
+}
+
+func sanitizeBody(body []byte) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	sanitized, err := json.Marshal(redact(v))
+	if err != nil {
+		return nil
+	}
+	return sanitized
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if redactedFields[strings.ToLower(key)] {
+				v[key] = redactedValue
+				continue
+			}
+			v[key] = redact(value)
+		}
+	case []interface{}:
+		for n, value := range v {
+			v[n] = redact(value)
+		}
+	}
+	return v
+}
+
+// ParseCaptureRate reads the ratio of captured requests like "0.01", 0.01 if it's empty
+func ParseCaptureRate(config string) (float64, error) {
+	if config == "" {
+		return 0.01, nil
+	}
+	rate, err := strconv.ParseFloat(config, 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return 0, fmt.Errorf("capture rate has to be more than 0 and up to 1, not %q", config)
+	}
+	return rate, nil
+}
+
+/*
+TrafficCapture records sampled requests of the API as ReplayRecords and writes them in batches,
+so they can be sent again to another revision to compare them, see the replay command.
+Capturing is best effort, records are dropped rather than slowing the requests down.
+*/
+type TrafficCapture struct {
+	rate  float64
+	batch int
+	write func(context.Context, []ReplayRecord) error
+
+	mu      sync.Mutex
+	pending []ReplayRecord
+	dropped int
+}
+
+// NewTrafficCapture captures the rate of requests, and writes them by write every batch records or by Run
+func NewTrafficCapture(rate float64, batch int, write func(context.Context, []ReplayRecord) error) *TrafficCapture {
+	return &TrafficCapture{rate: rate, batch: batch, write: write}
+}
+
+// Middleware captures sampled requests, streams like websockets are not captured as they can't be replayed
+func (c *TrafficCapture) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c == nil || rand.Float64() >= c.rate || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+		// the handler reads the body as if nothing was read
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil || len(body) > maxReplayBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := NewReplayRecord(r, body)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		rec.DurationMs = float64(time.Since(rec.At).Nanoseconds()) / 1000000
+		rec.Status = ww.Status()
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		c.add(rec)
+	})
+}
+
+func (c *TrafficCapture) add(rec ReplayRecord) {
+	c.mu.Lock()
+	if len(c.pending) >= maxPendingRecords {
+		c.dropped++
+		c.mu.Unlock()
+		return
+	}
+	c.pending = append(c.pending, rec)
+	full := len(c.pending) >= c.batch
+	c.mu.Unlock()
+
+	if full {
+		// not in the request, which shouldn't wait for the bucket
+		go c.Flush(context.Background())
+	}
+}
+
+// Flush writes the pending records, they are dropped if they can't be written
+func (c *TrafficCapture) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	records, dropped := c.pending, c.dropped
+	c.pending, c.dropped = nil, 0
+	c.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("captured requests have been dropped", "records", dropped)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := c.write(ctx, records); err != nil {
+		return fmt.Errorf("could not write %d captured requests: %w", len(records), err)
+	}
+	return nil
+}
+
+// Run flushes every interval until ctx is done, pending records are left for the last Flush
+func (c *TrafficCapture) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				slog.Warn(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReplayRecord(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/api/user_id/u1/pii?x=1", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(APIKeyHeader, "key")
+	r.Header.Set("Content-Type", "application/json")
+	rec := NewReplayRecord(r, []byte(`{"email":"alice@example.com","items":[{"token":"t","id":"i1"}]}`))
+
+	assert.Equal(t, "/api/user_id/u1/pii", rec.Path)
+	assert.Equal(t, "x=1", rec.Query)
+	assert.Equal(t, map[string]string{"Content-Type": "application/json"}, rec.Header)
+	assert.JSONEq(t, `{"email":"REDACTED","items":[{"token":"REDACTED","id":"i1"}]}`, string(rec.Body))
+
+	// bodies which can't be sanitized are dropped
+	rec = NewReplayRecord(r, []byte("email=alice@example.com"))
+	assert.Nil(t, rec.Body)
+}
+
+func TestTrafficCapture(t *testing.T) {
+	var mu sync.Mutex
+	var written []ReplayRecord
+	c := NewTrafficCapture(1, 100, func(ctx context.Context, records []ReplayRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, records...)
+		return nil
+	})
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the handler reads the body as if it wasn't captured
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/user/alice", strings.NewReader(`{"name":"alice"}`)))
+	assert.Equal(t, `{"name":"alice"}`, w.Body.String())
+	// websockets are not captured
+	r := httptest.NewRequest("GET", "/api/user_id/u1/events", nil)
+	r.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Nil(t, c.Flush(context.Background()))
+	assert.Len(t, written, 1)
+	assert.Equal(t, http.StatusCreated, written[0].Status)
+	var body map[string]string
+	assert.Nil(t, json.Unmarshal(written[0].Body, &body))
+	assert.Equal(t, "alice", body["name"])
+
+	// nothing is captured by a nil capture
+	var none *TrafficCapture
+	w = httptest.NewRecorder()
+	none.Middleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	_, err := ParseCaptureRate("1.5")
+	assert.NotNil(t, err)
+	rate, err := ParseCaptureRate("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.01, rate)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type forcedSamplingKey struct{}
+
+// WithForcedSampling makes spans of the context sampled, whatever the sampler decides
+func WithForcedSampling(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forcedSamplingKey{}, true)
+}
+
+func samplingForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forcedSamplingKey{}).(bool)
+	return forced
+}
+
+// forcingSampler samples spans of contexts of WithForcedSampling, and leaves the others to the base
+type forcingSampler struct {
+	base sdktrace.Sampler
+}
+
+func (s forcingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if samplingForced(p.ParentContext) {
+		return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState()}
+	}
+	return s.base.ShouldSample(p)
+}
+
+func (s forcingSampler) Description() string {
+	return "Forcing{" + s.base.Description() + "}"
+}
+
+/*
+Tracing starts the server span of a request, which the sampler decides about once for the whole request,
+as the spans of handlers and the data layer are of its context.
+The trace of the caller propagated by the headers is continued, so parentbased_ samplers follow its decision.
+A request with the header, like X-Debug-Trace: 1, is sampled anyway for support investigations,
+and the header has to be the token if it's set, not to let anyone trace at full volume.
+The id of a sampled trace is answered by X-Trace-Id, to be looked up in the console.
+*/
+func Tracing(header, token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			if value := r.Header.Get(header); header != "" && value != "" && (token == "" || subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1) {
+				ctx = WithForcedSampling(ctx)
+			}
+			ctx, span := otel.Tracer("main").Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+			if span.SpanContext().IsSampled() {
+				w.Header().Set("X-Trace-Id", span.SpanContext().TraceID().String())
+			}
+			r = r.WithContext(ctx)
+			next.ServeHTTP(w, r)
+			// the pattern is known once the request is routed
+			span.SetName(r.Method + " " + RoutePattern(r))
+		})
+	}
+}
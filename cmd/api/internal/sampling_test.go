@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(forcingSampler{base: sdktrace.ParentBased(sdktrace.NeverSample())}), sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	r := chi.NewRouter()
+	r.Use(Tracing("X-Debug-Trace", "support"))
+	r.Get("/api/user_id/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := otel.Tracer("main").Start(r.Context(), "getUserItems.root")
+		span.End()
+	})
+
+	for _, c := range []struct {
+		headers map[string]string
+		sampled bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"X-Debug-Trace": "1"}, false},
+		{map[string]string{"X-Debug-Trace": "support"}, true},
+		// the decision of the caller is followed by parentbased_
+		{map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, true},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/user_id/a", nil)
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+		r.ServeHTTP(w, req)
+		assert.Equal(t, c.sampled, w.Header().Get("X-Trace-Id") != "", c.headers)
+	}
+
+	ended := spans.Ended()
+	// the span of the handler is of the trace of the request
+	assert.Len(t, ended, 4)
+	assert.Equal(t, "GET /api/user_id/{user_id}", ended[len(ended)-1].Name())
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", ended[len(ended)-1].SpanContext().TraceID().String())
+}
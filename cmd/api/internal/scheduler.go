@@ -0,0 +1,289 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+Job is a background task run by Scheduler.
+Higher Priority runs first when more jobs are due than free slots.
+A random delay up to Jitter is added to each run, not to hit Spanner at the same time from all instances.
+*/
+type Job struct {
+	Name     string
+	Schedule string
+	Priority int
+	Jitter   time.Duration
+	Timeout  time.Duration
+	Run      func(context.Context) error
+}
+
+type JobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Priority     int       `json:"priority"`
+	State        string    `json:"state"`
+	NextRun      time.Time `json:"next_run"`
+	LastStart    time.Time `json:"last_start,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	Skipped      int       `json:"skipped"`
+}
+
+const (
+	JobIdle    = "idle"
+	JobQueued  = "queued"
+	JobRunning = "running"
+)
+
+type jobEntry struct {
+	job      Job
+	schedule Schedule
+	seq      int
+	status   JobStatus
+}
+
+/*
+Scheduler runs jobs on their schedules in process, up to maxConcurrent at the same time.
+A job never overlaps itself, a run which comes while the previous one is still queued or running is skipped.
+*/
+type Scheduler struct {
+	maxConcurrent int
+	mu            sync.Mutex
+	entries       []*jobEntry
+	queue         []*jobEntry
+	running       int
+	enqueued      int
+	wake          chan struct{}
+	wg            sync.WaitGroup
+
+	runs     *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func NewScheduler(maxConcurrent int) *Scheduler {
+	runs := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "job_runs_total",
+			Help: "How many times background jobs ran, partitioned by job and result.",
+		},
+		[]string{"job", "result"},
+	)
+	duration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "job_duration_seconds",
+			Help:    "How long background jobs took, partitioned by job.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+		},
+		[]string{"job"},
+	)
+	prometheus.MustRegister(runs, duration)
+
+	return &Scheduler{
+		maxConcurrent: maxConcurrent,
+		wake:          make(chan struct{}, 1),
+		runs:          runs,
+		duration:      duration,
+	}
+}
+
+// Add registers a job, it has to be called before Run
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := ParseSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, &jobEntry{
+		job:      job,
+		schedule: schedule,
+		status:   JobStatus{Name: job.Name, Schedule: job.Schedule, Priority: job.Priority, State: JobIdle},
+	})
+	return nil
+}
+
+// Run dispatches jobs until ctx is done, and waits for running jobs to return
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	entries := append([]*jobEntry{}, s.entries...)
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		go s.tick(ctx, e)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-s.wake:
+			s.dispatch(ctx)
+		}
+	}
+}
+
+// tick enqueues the job every time it's due
+func (s *Scheduler) tick(ctx context.Context, e *jobEntry) {
+	for {
+		next := e.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Println("job", e.job.Name, "will never run")
+			return
+		}
+		if e.job.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(e.job.Jitter))))
+		}
+		s.mu.Lock()
+		e.status.NextRun = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.enqueue(e)
+		}
+	}
+}
+
+func (s *Scheduler) enqueue(e *jobEntry) {
+	s.mu.Lock()
+	if e.status.State != JobIdle {
+		e.status.Skipped++
+		s.mu.Unlock()
+		s.runs.WithLabelValues(e.job.Name, "skipped").Inc()
+		return
+	}
+	e.status.State = JobQueued
+	s.enqueued++
+	e.seq = s.enqueued
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start queued jobs by priority, and by arrival among the same priority, while slots are free
+func (s *Scheduler) dispatch(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sort.SliceStable(s.queue, func(i, j int) bool {
+		if s.queue[i].job.Priority != s.queue[j].job.Priority {
+			return s.queue[i].job.Priority > s.queue[j].job.Priority
+		}
+		return s.queue[i].seq < s.queue[j].seq
+	})
+	for s.running < s.maxConcurrent && len(s.queue) > 0 {
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		e.status.State = JobRunning
+		s.running++
+		s.wg.Add(1)
+		go s.run(ctx, e)
+	}
+}
+
+/*
+run traces each run as a root span, like a request, so what a job does to Spanner is seen in its own trace.
+Jobs are not retried, so the attempt is always 1, and job.run tells which run of the job it is.
+*/
+func (s *Scheduler) run(ctx context.Context, e *jobEntry) {
+	defer s.wg.Done()
+
+	s.mu.Lock()
+	runNumber := e.status.Runs + 1
+	s.mu.Unlock()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "job "+e.job.Name, trace.WithNewRoot())
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("job.name", e.job.Name),
+		attribute.Int("job.attempt", 1),
+		attribute.Int("job.run", runNumber),
+	)
+
+	if e.job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.job.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := e.job.Run(ctx)
+	elapsed := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		log.Println("job", e.job.Name, err)
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.String("job.outcome", result))
+	s.runs.WithLabelValues(e.job.Name, result).Inc()
+	s.duration.WithLabelValues(e.job.Name).Observe(elapsed.Seconds())
+
+	s.mu.Lock()
+	e.status.State = JobIdle
+	e.status.LastStart = start
+	e.status.LastDuration = elapsed.String()
+	e.status.LastError = ""
+	e.status.Runs++
+	if err != nil {
+		e.status.LastError = err.Error()
+		e.status.Failures++
+	}
+	s.running--
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]JobStatus, len(s.entries))
+	for i, e := range s.entries {
+		status[i] = e.status
+	}
+	return status
+}
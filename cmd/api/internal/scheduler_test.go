@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(1)
+
+	var mu sync.Mutex
+	order := []string{}
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	release := make(chan struct{})
+	blocker := func(context.Context) error {
+		<-release
+		return nil
+	}
+
+	// schedules far in the future, runs are enqueued by hand
+	assert.Nil(t, s.Add(Job{Name: "blocker", Schedule: "@every 1h", Run: blocker}))
+	assert.Nil(t, s.Add(Job{Name: "low", Schedule: "@every 1h", Priority: 0, Run: record("low")}))
+	assert.Nil(t, s.Add(Job{Name: "high", Schedule: "@every 1h", Priority: 10, Run: record("high")}))
+	assert.NotNil(t, s.Add(Job{Name: "broken", Schedule: "every hour"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	s.enqueue(s.entries[0])
+	assert.Eventually(t, func() bool { return s.Status()[0].State == JobRunning }, time.Second, time.Millisecond)
+
+	s.enqueue(s.entries[1])
+	s.enqueue(s.entries[2])
+	// already running
+	s.enqueue(s.entries[0])
+	assert.Equal(t, 1, s.Status()[0].Skipped)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"high", "low"}, order)
+
+	cancel()
+	<-done
+	for _, status := range s.Status() {
+		assert.Equal(t, JobIdle, status.State)
+		assert.Equal(t, 1, status.Runs)
+	}
+}
+
+func TestSchedulerTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	// not by NewScheduler, its metrics are registered once
+	s := &Scheduler{
+		maxConcurrent: 1,
+		wake:          make(chan struct{}, 1),
+		runs:          prometheus.NewCounterVec(prometheus.CounterOpts{Name: "runs"}, []string{"job", "result"}),
+		duration:      prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"job"}),
+	}
+	e := &jobEntry{job: Job{Name: "failing", Run: func(context.Context) error { return errors.New("failed") }}}
+
+	// a span of the caller is not the parent of the job
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	s.wg.Add(1)
+	s.run(ctx, e)
+	parent.End()
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	job := spans[0]
+	assert.Equal(t, "job failing", job.Name())
+	assert.False(t, job.Parent().IsValid())
+	assert.Equal(t, otelcodes.Error, job.Status().Code)
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range job.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "failing", attrs["job.name"].AsString())
+	assert.Equal(t, int64(1), attrs["job.run"].AsInt64())
+	assert.Equal(t, "failure", attrs["job.outcome"].AsString())
+}
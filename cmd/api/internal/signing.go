@@ -0,0 +1,249 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/go-chi/render"
+)
+
+// the detached JWS of the response body, verify it with the key of kid in /.well-known/jwks.json
+const SignatureHeader = "X-JWS-Signature"
+
+/*
+Signer signs responses by ES256, the private key never leaves it.
+KeyID is kid of the signatures, which clients look up in the JWKS.
+*/
+type Signer interface {
+	KeyID() string
+	// Sign returns the ES256 signature of the JWS signing input, r and s of 32 bytes each
+	Sign(context.Context, []byte) ([]byte, error)
+	PublicKey(context.Context) (*ecdsa.PublicKey, error)
+}
+
+/*
+LocalSigner keeps a P-256 key in process, for local development without KMS.
+It's generated at start, so clients have to fetch the JWKS again after restarts.
+*/
+type LocalSigner struct {
+	Key *ecdsa.PrivateKey
+	ID  string
+}
+
+func NewLocalSigner() (*LocalSigner, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalSigner{Key: key, ID: "local"}, nil
+}
+
+func (s *LocalSigner) KeyID() string {
+	return s.ID
+}
+
+func (s *LocalSigner) Sign(ctx context.Context, input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	r, ss, err := ecdsa.Sign(rand.Reader, s.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return es256Signature(r, ss), nil
+}
+
+func (s *LocalSigner) PublicKey(ctx context.Context) (*ecdsa.PublicKey, error) {
+	return &s.Key.PublicKey, nil
+}
+
+/*
+KMSSigner signs by an asymmetric key of Cloud KMS, whose algorithm is EC_SIGN_P256_SHA256.
+KeyVersion is the resource name of a version, not of a key, ending with /cryptoKeyVersions/<n>,
+as signatures of a version can be verified only by the public key of it. It's kid as well.
+*/
+type KMSSigner struct {
+	Client     *kms.KeyManagementClient
+	KeyVersion string
+}
+
+func NewKMSSigner(ctx context.Context, keyVersion string) (*KMSSigner, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &KMSSigner{Client: client, KeyVersion: keyVersion}, nil
+}
+
+func (s *KMSSigner) KeyID() string {
+	return s.KeyVersion
+}
+
+func (s *KMSSigner) Sign(ctx context.Context, input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	res, err := s.Client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{
+		Name:   s.KeyVersion,
+		Digest: &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// KMS answers in DER, JWS wants r and s as they are
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(res.Signature, &sig); err != nil {
+		return nil, err
+	}
+	return es256Signature(sig.R, sig.S), nil
+}
+
+func (s *KMSSigner) PublicKey(ctx context.Context) (*ecdsa.PublicKey, error) {
+	res, err := s.Client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: s.KeyVersion})
+	if err != nil {
+		return nil, err
+	}
+	return parseECPublicKey([]byte(res.Pem))
+}
+
+func (s *KMSSigner) Close() error {
+	return s.Client.Close()
+}
+
+func parseECPublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key is not in PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ec, ok := key.(*ecdsa.PublicKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		return nil, errors.New("public key is not of P-256")
+	}
+	return ec, nil
+}
+
+func es256Signature(r, s *big.Int) []byte {
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig
+}
+
+/*
+DetachedJWS signs payload as a JWS of RFC 7515 and returns it in the compact form without the payload, "header..signature".
+Verify it by putting base64url of the body between the dots.
+*/
+func DetachedJWS(ctx context.Context, signer Signer, payload []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": signer.KeyID()})
+	if err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	input := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := signer.Sign(ctx, []byte(input))
+	if err != nil {
+		return "", err
+	}
+	return encodedHeader + ".." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// the response is held until it's signed, as the signature goes in a header before the body
+type signingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *signingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+/*
+SignResponses signs bodies of the routes by signer in SignatureHeader, so clients can tell they are not tampered with on the way.
+Responses of the routes are buffered, use it for small json ones like wallets, not for streams.
+A response which can't be signed is answered with 500, rather than without its signature.
+*/
+func SignResponses(signer Signer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if signer == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &signingWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			jws, err := DetachedJWS(r.Context(), signer, sw.body.Bytes())
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not sign the response: %s", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(SignatureHeader, jws)
+			w.WriteHeader(sw.status)
+			w.Write(sw.body.Bytes())
+		})
+	}
+}
+
+// JWKSHandler serves the public key of signer as a JWKS, for clients to verify signatures
+func JWKSHandler(signer Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := signer.PublicKey(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		render.JSON(w, r, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"alg": "ES256",
+			"use": "sig",
+			"kid": signer.KeyID(),
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		}}})
+	}
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignResponses(t *testing.T) {
+	signer, err := NewLocalSigner()
+	assert.Nil(t, err)
+
+	h := SignResponses(signer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"balance":100}`))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `{"balance":100}`, rec.Body.String())
+
+	// verified by the key in the JWKS, with the body put back between the dots
+	parts := strings.Split(rec.Header().Get(SignatureHeader), ".")
+	assert.Len(t, parts, 3)
+	assert.Empty(t, parts[1])
+
+	rec = httptest.NewRecorder()
+	JWKSHandler(signer).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &jwks))
+	assert.Equal(t, "local", jwks.Keys[0]["kid"])
+	x, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["y"])
+	key := &ecdsa.PublicKey{Curve: signer.Key.Curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	verify := func(body string) bool {
+		digest := sha256.Sum256([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(body))))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		return ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	assert.True(t, verify(`{"balance":100}`))
+	assert.False(t, verify(`{"balance":999}`))
+
+	// no signer, no signature
+	rec = httptest.NewRecorder()
+	SignResponses(nil)(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, rec.Header().Get(SignatureHeader))
+}
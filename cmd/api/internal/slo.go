@@ -0,0 +1,249 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+SLO of a route.
+Availability is the ratio of non 5xx responses, like 0.999.
+LatencyTarget is the ratio of responses faster than LatencyMs, like 0.99,
+LatencyMs should be one of bucket boundaries of the latency histogram, or the next larger one is used.
+*/
+type SLO struct {
+	Method        string  `json:"method"`
+	Route         string  `json:"route"`
+	Availability  float64 `json:"availability"`
+	LatencyMs     float64 `json:"latency_ms"`
+	LatencyTarget float64 `json:"latency_target"`
+}
+
+var DefaultSLOs = []SLO{
+	{Method: "GET", Route: "/api/user_id/{user_id}", Availability: 0.999, LatencyMs: 300, LatencyTarget: 0.99},
+	{Method: "POST", Route: "/api/user/{user_name}", Availability: 0.999, LatencyMs: 1200, LatencyTarget: 0.99},
+	{Method: "PUT", Route: "/api/user_id/{user_id}/{item_id}", Availability: 0.999, LatencyMs: 1200, LatencyTarget: 0.99},
+}
+
+// ParseSLOs reads SLOs as json array, DefaultSLOs are used if it's empty
+func ParseSLOs(config string) ([]SLO, error) {
+	if config == "" {
+		return DefaultSLOs, nil
+	}
+	slos := []SLO{}
+	err := json.Unmarshal([]byte(config), &slos)
+	return slos, err
+}
+
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+type sloCounts struct {
+	Total  float64
+	Errors float64
+	Slow   float64
+}
+
+type sloSnapshot struct {
+	at     time.Time
+	counts []sloCounts
+}
+
+type SLOWindowStatus struct {
+	Requests             float64 `json:"requests"`
+	Availability         float64 `json:"availability"`
+	AvailabilityBurnRate float64 `json:"availability_burn_rate"`
+	LatencyGood          float64 `json:"latency_good"`
+	LatencyBurnRate      float64 `json:"latency_burn_rate"`
+}
+
+type SLOStatus struct {
+	SLO
+	Windows map[string]SLOWindowStatus `json:"windows"`
+}
+
+/*
+SLOTracker computes error budget burn rates from the request histogram by route pattern.
+It takes snapshots of the cumulative counts periodically and compares them with the one of a window ago.
+Burn rate 1 means the error budget is consumed just in the SLO period, 14.4 in 1h is a typical page.
+*/
+type SLOTracker struct {
+	slos      []SLO
+	gatherer  prometheus.Gatherer
+	burnRate  *prometheus.GaugeVec
+	mu        sync.Mutex
+	snapshots []sloSnapshot
+	status    []SLOStatus
+}
+
+func NewSLOTracker(slos []SLO, gatherer prometheus.Gatherer) *SLOTracker {
+	burnRate := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slo_error_budget_burn_rate",
+			Help: "Error budget burn rate per route, partitioned by sli and window.",
+		},
+		[]string{"method", "route", "sli", "window"},
+	)
+	prometheus.MustRegister(burnRate)
+	return &SLOTracker{slos: slos, gatherer: gatherer, burnRate: burnRate}
+}
+
+func (t *SLOTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := t.Collect(now); err != nil {
+				log.Println("slo", err)
+			}
+		}
+	}
+}
+
+// Collect takes a snapshot at now and updates burn rates
+func (t *SLOTracker) Collect(now time.Time) error {
+	counts, err := t.gather()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.snapshots = append(t.snapshots, sloSnapshot{at: now, counts: counts})
+	oldest := now.Add(-sloWindows[len(sloWindows)-1].duration)
+	// keep one snapshot older than the longest window as its base
+	for len(t.snapshots) > 2 && t.snapshots[1].at.Before(oldest) {
+		t.snapshots = t.snapshots[1:]
+	}
+
+	status := make([]SLOStatus, len(t.slos))
+	for i, slo := range t.slos {
+		status[i] = SLOStatus{SLO: slo, Windows: map[string]SLOWindowStatus{}}
+		for _, window := range sloWindows {
+			base := t.baseOf(now.Add(-window.duration))
+			ws := windowStatus(slo, base.counts[i], counts[i])
+			status[i].Windows[window.name] = ws
+			t.burnRate.WithLabelValues(slo.Method, slo.Route, "availability", window.name).Set(ws.AvailabilityBurnRate)
+			t.burnRate.WithLabelValues(slo.Method, slo.Route, "latency", window.name).Set(ws.LatencyBurnRate)
+		}
+	}
+	t.status = status
+	return nil
+}
+
+// the newest snapshot taken at or before since, or the oldest one if the history is shorter than the window
+func (t *SLOTracker) baseOf(since time.Time) sloSnapshot {
+	base := t.snapshots[0]
+	for _, s := range t.snapshots {
+		if s.at.After(since) {
+			break
+		}
+		base = s
+	}
+	return base
+}
+
+func windowStatus(slo SLO, base, current sloCounts) SLOWindowStatus {
+	total := current.Total - base.Total
+	ws := SLOWindowStatus{Requests: total, Availability: 1, LatencyGood: 1}
+	if total <= 0 {
+		return ws
+	}
+	errorRatio := (current.Errors - base.Errors) / total
+	slowRatio := (current.Slow - base.Slow) / total
+	ws.Availability = 1 - errorRatio
+	ws.LatencyGood = 1 - slowRatio
+	if slo.Availability < 1 {
+		ws.AvailabilityBurnRate = errorRatio / (1 - slo.Availability)
+	}
+	if slo.LatencyTarget < 1 {
+		ws.LatencyBurnRate = slowRatio / (1 - slo.LatencyTarget)
+	}
+	return ws
+}
+
+func (t *SLOTracker) gather() ([]sloCounts, error) {
+	families, err := t.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]sloCounts, len(t.slos))
+	for _, family := range families {
+		if family.GetName() != PatternLatencyName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			for i, slo := range t.slos {
+				if labels["method"] != slo.Method || labels["path"] != slo.Route {
+					continue
+				}
+				h := metric.GetHistogram()
+				total := float64(h.GetSampleCount())
+				counts[i].Total += total
+				if isServerError(labels["code"]) {
+					counts[i].Errors += total
+				}
+				fast := total
+				for _, b := range h.GetBucket() {
+					if b.GetUpperBound() >= slo.LatencyMs {
+						fast = float64(b.GetCumulativeCount())
+						break
+					}
+				}
+				counts[i].Slow += total - fast
+			}
+		}
+	}
+	return counts, nil
+}
+
+// status code is labeled as its text by the request metrics
+func isServerError(statusText string) bool {
+	for code := 500; code < 600; code++ {
+		if text := http.StatusText(code); text != "" && text == statusText {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SLOTracker) Summary() []SLOStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLOTracker(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    PatternLatencyName,
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"code", "method", "path"})
+	reg.MustRegister(latency)
+
+	slo := SLO{Method: "GET", Route: "/api/user_id/{user_id}", Availability: 0.99, LatencyMs: 300, LatencyTarget: 0.9}
+	tracker := NewSLOTracker([]SLO{slo}, reg)
+
+	now := time.Now()
+	assert.Nil(t, tracker.Collect(now))
+
+	ok := latency.WithLabelValues("OK", "GET", slo.Route)
+	for i := 0; i < 90; i++ {
+		ok.Observe(10)
+	}
+	for i := 0; i < 8; i++ {
+		ok.Observe(1000)
+	}
+	latency.WithLabelValues("Internal Server Error", "GET", slo.Route).Observe(10)
+	latency.WithLabelValues("Internal Server Error", "GET", slo.Route).Observe(10)
+	// other routes don't matter
+	latency.WithLabelValues("Internal Server Error", "GET", "/ping").Observe(10)
+
+	assert.Nil(t, tracker.Collect(now.Add(time.Minute)))
+
+	status := tracker.Summary()
+	assert.Len(t, status, 1)
+	w := status[0].Windows["5m"]
+	assert.Equal(t, float64(100), w.Requests)
+	assert.InDelta(t, 0.98, w.Availability, 0.0001)
+	assert.InDelta(t, 2.0, w.AvailabilityBurnRate, 0.0001)
+	assert.InDelta(t, 0.92, w.LatencyGood, 0.0001)
+	assert.InDelta(t, 0.8, w.LatencyBurnRate, 0.0001)
+}
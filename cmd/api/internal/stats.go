@@ -0,0 +1,235 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics read by StatsTracker besides the request latency, they are registered by the game package and main
+const (
+	CacheLookupsName  = "game_cache_lookups_total"
+	SpannerErrorsName = "game_spanner_errors_total"
+)
+
+var statsWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+}
+
+type statsCounts struct {
+	requests      float64
+	buckets       map[float64]float64 // cumulative count by upper bound
+	cacheHits     float64
+	cacheLookups  float64
+	spannerErrors map[string]float64 // by grpc code
+}
+
+type statsSnapshot struct {
+	at     time.Time
+	counts statsCounts
+}
+
+type StatsWindow struct {
+	Requests      float64            `json:"requests"`
+	RatePerSecond float64            `json:"rate_per_second"`
+	P50Ms         float64            `json:"p50_ms"`
+	P95Ms         float64            `json:"p95_ms"`
+	P99Ms         float64            `json:"p99_ms"`
+	CacheHitRatio float64            `json:"cache_hit_ratio"`
+	SpannerErrors map[string]float64 `json:"spanner_errors"`
+}
+
+type Stats struct {
+	At      time.Time              `json:"at"`
+	Windows map[string]StatsWindow `json:"windows"`
+}
+
+/*
+StatsTracker computes live stats for the dashboard from the default registry, without a Prometheus server.
+It works in the same way as SLOTracker, rolling windows are differences between snapshots.
+Percentiles are interpolated in the latency histogram buckets, so they are as coarse as the buckets.
+*/
+type StatsTracker struct {
+	gatherer  prometheus.Gatherer
+	mu        sync.Mutex
+	snapshots []statsSnapshot
+	stats     Stats
+}
+
+func NewStatsTracker(gatherer prometheus.Gatherer) *StatsTracker {
+	return &StatsTracker{gatherer: gatherer, stats: Stats{Windows: map[string]StatsWindow{}}}
+}
+
+func (t *StatsTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := t.Collect(now); err != nil {
+				log.Println("stats", err)
+			}
+		}
+	}
+}
+
+// Collect takes a snapshot at now and updates stats
+func (t *StatsTracker) Collect(now time.Time) error {
+	counts, err := t.gather()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.snapshots = append(t.snapshots, statsSnapshot{at: now, counts: counts})
+	oldest := now.Add(-statsWindows[len(statsWindows)-1].duration)
+	// keep one snapshot older than the longest window as its base
+	for len(t.snapshots) > 2 && t.snapshots[1].at.Before(oldest) {
+		t.snapshots = t.snapshots[1:]
+	}
+
+	stats := Stats{At: now, Windows: map[string]StatsWindow{}}
+	for _, window := range statsWindows {
+		base := t.baseOf(now.Add(-window.duration))
+		stats.Windows[window.name] = statsWindow(base, statsSnapshot{at: now, counts: counts})
+	}
+	t.stats = stats
+	return nil
+}
+
+// the newest snapshot taken at or before since, or the oldest one if the history is shorter than the window
+func (t *StatsTracker) baseOf(since time.Time) statsSnapshot {
+	base := t.snapshots[0]
+	for _, s := range t.snapshots {
+		if s.at.After(since) {
+			break
+		}
+		base = s
+	}
+	return base
+}
+
+func statsWindow(base, current statsSnapshot) StatsWindow {
+	ws := StatsWindow{SpannerErrors: map[string]float64{}}
+	ws.Requests = current.counts.requests - base.counts.requests
+	if elapsed := current.at.Sub(base.at).Seconds(); elapsed > 0 {
+		ws.RatePerSecond = ws.Requests / elapsed
+	}
+
+	bounds := make([]float64, 0, len(current.counts.buckets))
+	for bound := range current.counts.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	cumulative := make([]float64, len(bounds))
+	for i, bound := range bounds {
+		cumulative[i] = current.counts.buckets[bound] - base.counts.buckets[bound]
+	}
+	ws.P50Ms = quantile(0.5, bounds, cumulative, ws.Requests)
+	ws.P95Ms = quantile(0.95, bounds, cumulative, ws.Requests)
+	ws.P99Ms = quantile(0.99, bounds, cumulative, ws.Requests)
+
+	if lookups := current.counts.cacheLookups - base.counts.cacheLookups; lookups > 0 {
+		ws.CacheHitRatio = (current.counts.cacheHits - base.counts.cacheHits) / lookups
+	}
+	for code, n := range current.counts.spannerErrors {
+		if d := n - base.counts.spannerErrors[code]; d > 0 {
+			ws.SpannerErrors[code] = d
+		}
+	}
+	return ws
+}
+
+/*
+quantile estimates the q-quantile by linear interpolation in the bucket it falls in, like histogram_quantile of PromQL.
+Observations above the largest bound are reported as the largest bound.
+*/
+func quantile(q float64, bounds, cumulative []float64, total float64) float64 {
+	if total <= 0 || len(bounds) == 0 {
+		return 0
+	}
+	rank := q * total
+	lower, below := 0.0, 0.0
+	for i, bound := range bounds {
+		if cumulative[i] >= rank {
+			inBucket := cumulative[i] - below
+			if inBucket <= 0 {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-below)/inBucket
+		}
+		lower, below = bound, cumulative[i]
+	}
+	return bounds[len(bounds)-1]
+}
+
+func (t *StatsTracker) gather() (statsCounts, error) {
+	counts := statsCounts{buckets: map[float64]float64{}, spannerErrors: map[string]float64{}}
+	families, err := t.gatherer.Gather()
+	if err != nil {
+		return counts, err
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch family.GetName() {
+			case PatternLatencyName:
+				h := metric.GetHistogram()
+				counts.requests += float64(h.GetSampleCount())
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					counts.buckets[b.GetUpperBound()] += float64(b.GetCumulativeCount())
+				}
+			case CacheLookupsName:
+				n := metric.GetCounter().GetValue()
+				counts.cacheLookups += n
+				if labels["result"] == "hit" {
+					counts.cacheHits += n
+				}
+			case SpannerErrorsName:
+				counts.spannerErrors[labels["code"]] += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (t *StatsTracker) Summary() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
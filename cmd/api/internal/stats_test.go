@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsTracker(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    PatternLatencyName,
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"code", "method", "path"})
+	lookups := prometheus.NewCounterVec(prometheus.CounterOpts{Name: CacheLookupsName}, []string{"result"})
+	spannerErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: SpannerErrorsName}, []string{"code"})
+	reg.MustRegister(latency, lookups, spannerErrors)
+
+	tracker := NewStatsTracker(reg)
+	now := time.Now()
+	assert.Nil(t, tracker.Collect(now))
+
+	for i := 0; i < 100; i++ {
+		latency.WithLabelValues("OK", "GET", "/api/user_id/{user_id}").Observe(75)
+	}
+	for i := 0; i < 20; i++ {
+		latency.WithLabelValues("OK", "PUT", "/api/user_id/{user_id}/{item_id}").Observe(200)
+	}
+	lookups.WithLabelValues("hit").Add(3)
+	lookups.WithLabelValues("miss").Add(1)
+	spannerErrors.WithLabelValues("NotFound").Add(2)
+
+	assert.Nil(t, tracker.Collect(now.Add(time.Minute)))
+
+	w := tracker.Summary().Windows["1m"]
+	assert.Equal(t, float64(120), w.Requests)
+	assert.InDelta(t, 2.0, w.RatePerSecond, 0.0001)
+	// 60th of 100 in (50, 100]
+	assert.InDelta(t, 80, w.P50Ms, 0.0001)
+	// 114th, 14th of 20 in (100, 300]
+	assert.InDelta(t, 240, w.P95Ms, 0.0001)
+	assert.InDelta(t, 0.75, w.CacheHitRatio, 0.0001)
+	assert.Equal(t, map[string]float64{"NotFound": 2}, w.SpannerErrors)
+}
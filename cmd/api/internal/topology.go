@@ -0,0 +1,213 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/render"
+)
+
+// health of a dependency in the topology, the ones without a check are unknown
+const (
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+	HealthUnknown  = "unknown"
+)
+
+type TopologyNode struct {
+	ID string `json:"id"`
+	// like "spanner", "redis" or "pubsub_topic"
+	Kind string `json:"kind"`
+	// the database, addresses or the name of it
+	Target string `json:"target"`
+	Health string `json:"health"`
+}
+
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TopologyView is the topology at a time, with Mermaid of it for the diagram
+type TopologyView struct {
+	App     string            `json:"app"`
+	Nodes   []TopologyNode    `json:"nodes"`
+	Edges   []TopologyEdge    `json:"edges"`
+	Flags   map[string]string `json:"flags"`
+	Mermaid string            `json:"mermaid"`
+}
+
+type topologyNode struct {
+	TopologyNode
+	health func() string
+}
+
+/*
+Topology is what this instance is configured to depend on, as they are set up at start,
+so the workshop can see the architecture it's running instead of the one in slides.
+Health is checked when it's viewed, by the checks the dependencies already have, like the circuit breaker of Spanner.
+*/
+type Topology struct {
+	app   string
+	mu    sync.Mutex
+	nodes []topologyNode
+	edges []TopologyEdge
+	flags map[string]string
+}
+
+func NewTopology(app string) *Topology {
+	return &Topology{app: app, flags: map[string]string{}}
+}
+
+// Add adds a dependency used by from, or by the app if from is empty. health is unknown if it's nil
+func (t *Topology) Add(id, kind, target string, health func() string, from ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes = append(t.nodes, topologyNode{TopologyNode: TopologyNode{ID: id, Kind: kind, Target: target}, health: health})
+	if len(from) == 0 {
+		from = []string{t.app}
+	}
+	for _, f := range from {
+		t.edges = append(t.edges, TopologyEdge{From: f, To: id})
+	}
+}
+
+// Flag records a feature flag or a choice of config, which changes the paths between dependencies
+func (t *Topology) Flag(name, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flags[name] = value
+}
+
+func (t *Topology) View() TopologyView {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	view := TopologyView{
+		App:   t.app,
+		Nodes: []TopologyNode{{ID: t.app, Kind: "app", Target: t.app, Health: HealthHealthy}},
+		Edges: append([]TopologyEdge{}, t.edges...),
+		Flags: map[string]string{},
+	}
+	for _, n := range t.nodes {
+		node := n.TopologyNode
+		node.Health = HealthUnknown
+		if n.health != nil {
+			node.Health = n.health()
+		}
+		view.Nodes = append(view.Nodes, node)
+	}
+	for name, value := range t.flags {
+		view.Flags[name] = value
+	}
+	view.Mermaid = view.mermaid()
+	return view
+}
+
+var mermaidUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func mermaidID(id string) string {
+	return "n_" + mermaidUnsafe.ReplaceAllString(id, "_")
+}
+
+func mermaidLabel(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+// a flowchart colored by health, flags are in a note as they aren't dependencies
+func (v TopologyView) mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, n := range v.Nodes {
+		label := mermaidLabel(n.ID)
+		if n.Target != "" && n.Target != n.ID {
+			label += "<br/><small>" + mermaidLabel(n.Target) + "</small>"
+		}
+		fmt.Fprintf(&b, "  %s[\"%s\"]:::%s\n", mermaidID(n.ID), label, n.Health)
+	}
+	for _, e := range v.Edges {
+		fmt.Fprintf(&b, "  %s --> %s\n", mermaidID(e.From), mermaidID(e.To))
+	}
+	if len(v.Flags) > 0 {
+		names := make([]string, 0, len(v.Flags))
+		for name := range v.Flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		flags := make([]string, 0, len(names))
+		for _, name := range names {
+			flags = append(flags, mermaidLabel(name+"="+v.Flags[name]))
+		}
+		fmt.Fprintf(&b, "  flags[\"%s\"]:::flags\n", strings.Join(flags, "<br/>"))
+	}
+	b.WriteString("  classDef healthy fill:#d4edda,stroke:#28a745\n")
+	b.WriteString("  classDef degraded fill:#fff3cd,stroke:#ffc107\n")
+	b.WriteString("  classDef down fill:#f8d7da,stroke:#dc3545\n")
+	b.WriteString("  classDef unknown fill:#e2e3e5,stroke:#6c757d\n")
+	b.WriteString("  classDef flags fill:#ffffff,stroke:#6c757d,stroke-dasharray:4\n")
+	return b.String()
+}
+
+// TopologyHandler serves the view as json, or only Mermaid of it with ?format=mermaid
+func TopologyHandler(t *Topology) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := t.View()
+		if r.URL.Query().Get("format") == "mermaid" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(view.Mermaid))
+			return
+		}
+		render.JSON(w, r, view)
+	}
+}
+
+var topologyUI = template.Must(template.New("topology").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Topology</title>
+</head>
+<body>
+<div id="topology"></div>
+<script type="module">
+import mermaid from "https://unpkg.com/mermaid@10/dist/mermaid.esm.min.mjs";
+mermaid.initialize({startOnLoad: false});
+async function draw() {
+  const res = await fetch({{.}}, {credentials: "same-origin"});
+  const view = await res.json();
+  const {svg} = await mermaid.render("diagram", view.mermaid);
+  document.getElementById("topology").innerHTML = svg;
+}
+draw();
+setInterval(draw, 5000);
+</script>
+</body>
+</html>
+`))
+
+// TopologyUIHandler draws the topology at viewURL and redraws it every 5 seconds, Mermaid is loaded from unpkg
+func TopologyUIHandler(viewURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		topologyUI.Execute(w, viewURL)
+	}
+}
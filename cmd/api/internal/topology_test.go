@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopology(t *testing.T) {
+	redisHealth := HealthHealthy
+	topology := NewTopology("myapp")
+	topology.Add("spanner", "spanner", "projects/p/instances/i/databases/game", func() string { return HealthHealthy })
+	topology.Add("redis", "redis", "10.0.0.1:6379", func() string { return redisHealth })
+	topology.Add("topic", "pubsub_topic", "game", nil)
+	topology.Add("worker-sub", "pubsub_subscription", "game-worker", nil, "topic")
+	topology.Flag("CACHE_STRATEGY", "write-through")
+
+	// health is checked when it's viewed
+	redisHealth = HealthDown
+	view := topology.View()
+	assert.Len(t, view.Nodes, 5)
+	assert.Equal(t, TopologyNode{ID: "myapp", Kind: "app", Target: "myapp", Health: HealthHealthy}, view.Nodes[0])
+	assert.Equal(t, HealthDown, view.Nodes[2].Health)
+	assert.Equal(t, HealthUnknown, view.Nodes[3].Health)
+	assert.Contains(t, view.Edges, TopologyEdge{From: "topic", To: "worker-sub"})
+	assert.Contains(t, view.Edges, TopologyEdge{From: "myapp", To: "redis"})
+	assert.Contains(t, view.Mermaid, `n_worker_sub["worker-sub<br/><small>game-worker</small>"]:::unknown`)
+	assert.Contains(t, view.Mermaid, "n_topic --> n_worker_sub")
+	assert.Contains(t, view.Mermaid, "CACHE_STRATEGY=write-through")
+
+	rr := httptest.NewRecorder()
+	TopologyHandler(topology)(rr, httptest.NewRequest(http.MethodGet, "/admin/topology", nil))
+	var got TopologyView
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, view, got)
+
+	rr = httptest.NewRecorder()
+	TopologyHandler(topology)(rr, httptest.NewRequest(http.MethodGet, "/admin/topology?format=mermaid", nil))
+	assert.Equal(t, view.Mermaid, rr.Body.String())
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// cross origin requests are rejected by the default CheckOrigin of gorilla
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+/*
+UserEventsHandler streams item changes of the user in the url param as json text messages, one domain.ItemChanged per message.
+Clients should connect first and then read the current items, changes with seq older than the items read can be ignored.
+The connection is closed with 1013 (try again later) when the client can't keep up or the server is shutting down,
+the client should reconnect and read the items again, as some changes may be missed.
+Messages from the client are ignored except control frames.
+*/
+func UserEventsHandler(bus *EventBus, param string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, param)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// a response has been written by Upgrade
+			return
+		}
+		defer conn.Close()
+
+		events, unsubscribe := bus.Subscribe(userID)
+		defer unsubscribe()
+
+		// reading is required to handle pong and close frames
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			conn.SetReadLimit(512)
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			})
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if !ok {
+					conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resubscribe"))
+					return
+				}
+				if err := conn.WriteJSON(e); err != nil {
+					slog.Info("websocket write", "error", err.Error())
+					return
+				}
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserEventsHandler(t *testing.T) {
+	bus := NewEventBus(8)
+	r := chi.NewRouter()
+	r.Get("/ws/user/{user_id}", UserEventsHandler(bus, "user_id"))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/user/u1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// subscribed after the upgrade
+	assert.Eventually(t, func() bool { return bus.Subscribers() == 1 }, time.Second, 10*time.Millisecond)
+
+	other, _ := domain.NewItemChanged("u2", 1, "i1", domain.ItemAdded)
+	added, _ := domain.NewItemChanged("u1", 1, "i1", domain.ItemAdded)
+	removed, _ := domain.NewItemChanged("u1", 2, "i1", domain.ItemRemoved)
+	bus.Publish(other)
+	bus.Publish(added)
+	bus.Publish(removed)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []domain.ItemChanged{added, removed} {
+		var e domain.ItemChanged
+		assert.Nil(t, conn.ReadJSON(&e))
+		assert.Equal(t, expected, e)
+	}
+
+	// shutting down tells the client to reconnect
+	bus.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), err)
+
+	// unsubscribed when the client is gone
+	assert.Eventually(t, func() bool { return bus.Subscribers() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestUserEventsHandlerNotUpgraded(t *testing.T) {
+	r := chi.NewRouter()
+	r.Get("/ws/user/{user_id}", UserEventsHandler(NewEventBus(8), "user_id"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ws/user/u1", nil))
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+func (s Serving) listItems(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "listItems.root")
+	span.SetAttributes(attribute.String("server", "listItems"))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	items, next, err := s.Client.ListItems(ctx, w, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"items": items, "next_cursor": next})
+}
+
+// item_id is generated if it's not in the body
+func (s Serving) createItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "createItem.root")
+	span.SetAttributes(attribute.String("server", "createItem"))
+	defer span.End()
+
+	var body domain.Item
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if body.ID == "" {
+		itemID, _ := uuid.NewRandom()
+		body.ID = itemID.String()
+	}
+	item, err := domain.NewItem(body.ID, body.Name, body.Price)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.Client.CreateItem(ctx, w, item)
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		errorRender(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, item)
+}
+
+func (s Serving) getItem(w http.ResponseWriter, r *http.Request) {
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getItem.root")
+	span.SetAttributes(attribute.String("server", "getItem"))
+	defer span.End()
+
+	item, err := s.Client.Item(ctx, w, itemID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, item)
+}
+
+func (s Serving) updateItem(w http.ResponseWriter, r *http.Request) {
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "updateItem.root")
+	span.SetAttributes(attribute.String("server", "updateItem"))
+	defer span.End()
+
+	var body domain.Item
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	item, err := domain.NewItem(itemID, body.Name, body.Price)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.Client.UpdateItem(ctx, w, item)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, item)
+}
+
+// items owned by any user can't be deleted
+func (s Serving) deleteItem(w http.ResponseWriter, r *http.Request) {
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteItem.root")
+	span.SetAttributes(attribute.String("server", "deleteItem"))
+	defer span.End()
+
+	err := s.Client.DeleteItem(ctx, w, itemID)
+	switch spanner.ErrCode(err) {
+	case codes.NotFound:
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	case codes.FailedPrecondition:
+		errorRender(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]string{})
+}
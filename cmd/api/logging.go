@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+/*
+requestLogger logs responses as httplog.RequestLogger does, but by the route pattern instead of the path,
+with user ids of the url params hashed, as the path like /api/user_id/{user_id} has the raw user id.
+The entry is of httplog, so handlers still add to it by httplog.LogEntry,
+and a panic is logged by it as well by middleware.Recoverer used after it.
+*/
+func requestLogger(logger zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := &httplog.RequestLoggerEntry{Logger: logger.With().Fields(map[string]interface{}{
+				"httpRequest": map[string]interface{}{
+					"requestMethod": r.Method,
+					"requestID":     middleware.GetReqID(r.Context()),
+					"remoteIP":      r.RemoteAddr,
+					"proto":         r.Proto,
+				},
+			}).Logger()}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			defer func() {
+				// the route is known after the request is routed
+				entry.Logger = entry.Logger.With().Fields(routeLogFields(r)).Logger()
+				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(start), nil)
+			}()
+			next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+		})
+	}
+}
+
+// the route pattern, and the url params of user ids hashed by game.HashID
+func routeLogFields(r *http.Request) map[string]interface{} {
+	fields := map[string]interface{}{"route": internal.RoutePattern(r)}
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return fields
+	}
+	for n, key := range rctx.URLParams.Keys {
+		if strings.HasSuffix(key, "user_id") && n < len(rctx.URLParams.Values) {
+			fields[key] = game.HashID(rctx.URLParams.Values[n])
+		}
+	}
+	return fields
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+func (s Serving) getMailbox(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getMailbox.root")
+	span.SetAttributes(attribute.String("server", "getMailbox"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	mails, next, err := s.Client.Mailbox(ctx, w, userID, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"mails": mails, "next_cursor": next})
+}
+
+// mark the mail read, and claim its attachments if it has, acknowledging it again answers it as it is
+func (s Serving) ackMail(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	mailID := chi.URLParam(r, "mail_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ackMail.root")
+	span.SetAttributes(attribute.String("server", "ackMail"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	ack, err := s.Client.AckMail(ctx, w, userID, mailID)
+	switch {
+	case errors.Is(err, domain.ErrInvalid):
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	case spanner.ErrCode(err) == codes.NotFound:
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, game.ErrGrantIDReused), spanner.ErrCode(err) == codes.AlreadyExists:
+		errorRender(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, ack)
+}
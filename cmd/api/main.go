@@ -17,32 +17,45 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
 	"cloud.google.com/go/pubsub"
-	chiprometheus "github.com/766b/chi-prometheus"
+	"cloud.google.com/go/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog"
 	"github.com/go-chi/render"
 	"github.com/go-redis/redis"
-	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
 	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/budget"
 	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/envelope"
+	"github.com/shin5ok/go-architecting-workshop/fixtures"
+	"github.com/shin5ok/go-architecting-workshop/luascript"
+	"github.com/shin5ok/go-architecting-workshop/telemetry"
 )
 
 var (
@@ -50,27 +63,148 @@ var (
 	appVersion = "1.01"
 
 	spannerString = os.Getenv("SPANNER_STRING")
-	redisHost     = os.Getenv("REDIS_HOST")
-	redisPassword = os.Getenv("REDIS_PASSWORD") // Not required in many case
+	dbDriver      = os.Getenv("DB_DRIVER")          // "lite" for the in-memory repository without GCP, Spanner if empty, see game.NewLiteClient
+	liteFixtures  = os.Getenv("LITE_FIXTURES")      // comma separated fixture files loaded in lite mode, like "fixtures/workshop.yaml"
+	redisHost     = os.Getenv("REDIS_HOST")         // comma separated nodes of the cluster or Sentinels, with REDIS_MODE
+	redisMode     = os.Getenv("REDIS_MODE")         // "cluster" or "sentinel", a single host if empty
+	redisMaster   = os.Getenv("REDIS_MASTER_NAME")  // the master watched by Sentinels
+	redisPassword = os.Getenv("REDIS_PASSWORD")     // Not required in many case
+	redisReplicas = os.Getenv("REDIS_READ_HOSTS")   // comma separated addresses of read replicas, optional
+	redisStandby  = os.Getenv("REDIS_STANDBY_HOST") // the warm standby of the same REDIS_MODE, optional, see game.StandbyCache
+	cacheBackend  = os.Getenv("CACHE_BACKEND")      // "memcached" or redis if empty, activity and rate limits are on redis anyway
+	memcachedHost = os.Getenv("MEMCACHED_HOSTS")    // comma separated addresses of memcached, when CACHE_BACKEND=memcached
+	localCache    = os.Getenv("LOCAL_CACHE")        // "size,ttl" like "1000,1s" of the LRU in front of the cache, none if empty
 	servicePort   = os.Getenv("PORT")
 	projectId     = os.Getenv("GOOGLE_CLOUD_PROJECT")
 	rev           = os.Getenv("K_REVISION")
+	traceExporter = os.Getenv("TRACE_EXPORTER")              // "otlp", "none" or "cloudtrace", cloudtrace if empty, or none in lite mode
+	otlpEndpoint  = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") // base URL of the OTLP/HTTP receiver like "http://localhost:4318", with TRACE_EXPORTER=otlp
+	otlpHeaders   = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")  // comma separated headers to the receiver like "api-key=secret"
+	sampler       = os.Getenv("OTEL_TRACES_SAMPLER")         // "parentbased_traceidratio" or the others of telemetry.ParseSampler, always_on if empty
+	samplerArg    = os.Getenv("OTEL_TRACES_SAMPLER_ARG")     // the ratio of traceidratio like "0.1"
+	forceTrace    = os.Getenv("TRACE_FORCE_HEADER")          // requests with the header are sampled anyway, "X-Debug-Trace" if empty
+	forceToken    = os.Getenv("TRACE_FORCE_TOKEN")           // the value TRACE_FORCE_HEADER has to be if it's set, any if empty
+	metricsPush   = os.Getenv("METRICS_EXPORTER")            // "otlp" to push metrics of requests, Spanner and cache to OTEL_EXPORTER_OTLP_ENDPOINT as well
+	metricsEvery  = os.Getenv("OTEL_METRIC_EXPORT_INTERVAL") // milliseconds between pushes, 60000 if empty
+	idHashSalt    = os.Getenv("ID_HASH_SALT")
+	rawIDs        = os.Getenv("DEBUG_RAW_IDS") != ""    // disable hashing ids in telemetry, only for local
+	validateCache = os.Getenv("CACHE_VALIDATION") != "" // serve cached UserItems only if they are newer than the last write, on redis
+	eventSourcing = os.Getenv("EVENT_SOURCING") != ""
+	eventOutbox   = os.Getenv("EVENT_OUTBOX") != ""   // publish changes of items by the outbox relay, at least once, see game.OutboxEvent
+	raceCache     = os.Getenv("CACHE_RACE") != ""     // race cache and Spanner while redis is slow
+	cacheStrategy = os.Getenv("CACHE_STRATEGY")       // "write-through" or cache-aside if empty, see game.CacheStrategy
+	writeMode     = os.Getenv("WRITE_MODE")           // "mutation" or dml if empty, or by operation like "CreateUser=mutation", see game.WriteMode
+	staleness     = os.Getenv("USER_ITEMS_STALENESS") // "exact:10s" or "max:10s" for cache misses of UserItems, strong if empty, see game.Staleness
+	maxRows       = os.Getenv("MAX_ROWS_PER_QUERY")   // queries of a request fail beyond it, like "10000", unlimited if empty, see game.WithRowLimit
+	verifierName  = os.Getenv("RECEIPT_VERIFIER")     // "google_play" or stub if empty
+	schemaDrift   = os.Getenv("SCHEMA_DRIFT")         // "fail", "off" or warn if empty
+	sloConfig     = os.Getenv("SLO_CONFIG")           // json array of SLOs, see internal.SLO
+	abTestConfig  = os.Getenv("EXPERIMENTS")          // json array of experiments, see internal.Experiment
+	rateLimits    = os.Getenv("RATE_LIMITS")          // json array of limits per user, see internal.RateLimit
+	playPackage   = os.Getenv("PLAY_PACKAGE_NAME")
+	kmsKeyName    = os.Getenv("KMS_KEY_NAME")   // projects/*/locations/*/keyRings/*/cryptoKeys/*
+	piiLocalKeys  = os.Getenv("PII_LOCAL_KEYS") // comma separated base64 keys instead of KMS, only for local
+	archiveBucket = os.Getenv("ARCHIVE_BUCKET")
+	captureBucket = os.Getenv("CAPTURE_BUCKET")     // "bucket" or "bucket/prefix" to capture sampled requests for the replay command
+	captureRate   = os.Getenv("CAPTURE_RATE")       // ratio of captured requests like "0.01", see internal.ParseCaptureRate
+	retentionDays = os.Getenv("RETENTION_DAYS")     // 90 if empty
+	retentionCron = os.Getenv("RETENTION_SCHEDULE") // "0 3 * * *" if empty, only when ARCHIVE_BUCKET is set
+	cacheEpoch    = os.Getenv("CACHE_EPOCH")        // prefix of cache keys, "K_REVISION" for the revision
+	prevEpoch     = os.Getenv("CACHE_PREV_EPOCH")   // read on misses during CACHE_EPOCH_GRACE, see game.CacheEpoch
+	epochGrace    = os.Getenv("CACHE_EPOCH_GRACE")  // like "10m", previous epoch is not read if empty
+	latencyBudget = os.Getenv("LATENCY_BUDGET")     // like "spanner=0.5,redis=0.1,pubsub=0.2", see budget.Shares
+	catalogCache  = os.Getenv("CATALOG_CACHE")      // refresh interval like "1m" to look up item names in process, items are joined if empty
+	dependencies  = os.Getenv("DEPENDENCIES")       // json of timeouts and retries of Spanner, Redis and Pub/Sub, see game.Dependencies
+	spannerBreak  = os.Getenv("SPANNER_BREAKER")    // overrides spanner.breaker of DEPENDENCIES, see game.ParseBreaker
+	spannerRetry  = os.Getenv("SPANNER_RETRY")      // overrides spanner.retry of DEPENDENCIES, see game.ParseRetrier
+	validRules    = os.Getenv("VALIDATION_RULES")   // json like {"max_name_length":32,"name_chars":"alnum"}, see game.ConfigureValidation
 	logger        *slog.Logger
+	// texts of error codes in the language of the client, errors have only codes if nil
+	messages *internal.Messages
+)
+
+// Cloud Run waits 10 seconds after SIGTERM before SIGKILL
+const shutdownTimeout = 8 * time.Second
+
+// how items of the user were looked up in the cache, see game.CacheStatus
+const cacheStatusHeader = "X-Cache"
+
+var (
+	responseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of HTTP response bodies, partitioned by method and route pattern.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		},
+		[]string{"method", "path"},
+	)
+	spannerErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: internal.SpannerErrorsName,
+			Help: "How many requests failed with Spanner errors, partitioned by grpc code.",
+		},
+		[]string{"code"},
+	)
+	// the same as spannerErrors for OTLP, of the global meter provider, which is a no-op until it's set
+	spannerErrorsCounter, _ = otel.Meter("github.com/shin5ok/go-architecting-workshop/cmd/api").Int64Counter(
+		"game.spanner.errors",
+		metric.WithDescription("How many requests failed with Spanner errors, by grpc code."),
+	)
 )
 
 var (
 	topicName      = os.Getenv("TOPIC_NAME")
 	authHeaderName = os.Getenv("AUTH_HEADER")
-	pubsubClient   *pubsub.Client
+	adminCallers   = os.Getenv("ADMIN_CALLERS")   // comma separated values of AUTH_HEADER, which can use X-Act-As
+	publisherName  = os.Getenv("EVENT_PUBLISHER") // "nats", or Pub/Sub if TOPIC_NAME is set
+	natsURL        = os.Getenv("NATS_URL")
+	grpcPort       = os.Getenv("GRPC_PORT")        // gRPC is served on the second port only if it's set
+	debugPort      = os.Getenv("DEBUG_PORT")       // pprof, expvar and runtime stats are served on the port only if it's set, see newDebugHandler
+	debugAuth      = os.Getenv("DEBUG_AUTH") != "" // the debug port requires admin callers as /admin does
+	swaggerUI      = os.Getenv("SWAGGER_UI") != ""
+	jwksURL        = os.Getenv("JWKS_URL") // bearer tokens are verified only if it's set, with JWT_ISSUER and JWT_AUDIENCE
+	jwtIssuer      = os.Getenv("JWT_ISSUER")
+	jwtAudience    = os.Getenv("JWT_AUDIENCE")
+	allowReset     = os.Getenv("ALLOW_RESET") != ""   // /admin/reset is routed only if it's set, never set it in production
+	resetSubs      = os.Getenv("RESET_SUBSCRIPTIONS") // comma separated subscriptions to purge, like the worker's one and its dead letters
+	requireAPIKeys = os.Getenv("API_KEYS") != ""      // mutations require X-API-Key or a bearer token, keys are minted by admins
+	authMode       = os.Getenv("AUTH_MODE")           // "iap" or "id_token" to verify the token of the proxy or invoker, with AUTH_AUDIENCE
+	authAudience   = os.Getenv("AUTH_AUDIENCE")
+	signingKey     = os.Getenv("RESPONSE_SIGNING_KEY") // KMS key version to sign wallets and entitlements, or "local", unsigned if empty
 )
 
-type Serving struct {
-	Client game.GameUserOperation
+// what the API serves with, the Spanner client or the in-memory one of DB_DRIVER=lite
+type repository interface {
+	game.GameUserOperation
+	game.APIKeyStore
+	game.IdempotencyStore
+	game.Importer
 }
 
-type User struct {
-	Name string `json:"name"`
-	Id   string `json:"id"`
+type Serving struct {
+	Client      game.GameUserOperation
+	CacheHealth *game.CacheHealth
+	Verifier    game.ReceiptVerifier
+	Publisher   internal.EventPublisher
+	SLOTracker  *internal.SLOTracker
+	Stats       *internal.StatsTracker
+	Experiments []internal.Experiment
+	Scheduler   *internal.Scheduler
+	Authorizer  *internal.Authorizer
+	Events      *internal.EventBus
+	Activity    *game.Caching
+	APIKeys     game.APIKeyStore
+	RateLimiter *internal.RateLimiter
+	Topology    *internal.Topology
+	// Idempotency-Key is ignored if nil
+	Idempotency game.IdempotencyStore
+	Importer    game.Importer
+	// nil unless REDIS_STANDBY_HOST is set
+	Standby *game.StandbyCache
+	// nil unless ALLOW_RESET is set
+	Reset func(context.Context) (resetReport, error)
+	// dependencies checked by /readyz
+	Readiness []readinessCheck
 }
 
 func init() {
@@ -100,86 +234,923 @@ func init() {
 
 func main() {
 
+	// cancelled by SIGTERM from Cloud Run, or Ctrl-C on local
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// before the commands, so they take the same inputs as the API
+	if err := game.ConfigureValidation(validRules); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:]); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	/*
+		subsystems register their hooks as they are created, and lifecycle is stopped however main returns.
+		Teardown order matters, see the priorities of internal.Lifecycle:
+		stop accepting and wait for in-flight requests, then wait for background jobs,
+		then close clients in reverse order of their creation, and flush the tracer at last.
+	*/
+	lifecycle := internal.NewLifecycle()
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := lifecycle.Stop(ctx); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	defer shutdown()
+
 	logger.Info("Preparing to start with some options")
 
-	ctx := context.Background()
-	tp, err := internal.NewTracer(projectId)
+	if err := game.ConfigureIDHashing(idHashSalt, rawIDs); err != nil {
+		// revisions of Cloud Run are deployed ones, which must not leak ids by hashes anyone can make
+		if rev != "" {
+			logger.Error(err.Error())
+			return
+		}
+		logger.Warn(err.Error())
+	}
+
+	var err error
+	if messages, err = internal.LoadMessages(); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	shares, err := budget.ParseShares(latencyBudget)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
-	defer tp.Shutdown(ctx)
+	budget.Configure(shares)
 
-	profilerCfg := profiler.Config{
-		Service:           appName,
-		ServiceVersion:    appVersion,
-		ProjectID:         projectId,
-		EnableOCTelemetry: true,
+	deps, err := game.ParseDependencies(dependencies)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if spannerBreak != "" {
+		deps.Spanner.Breaker = spannerBreak
+	}
+	if spannerRetry != "" {
+		deps.Spanner.Retry = spannerRetry
 	}
 
-	if err := profiler.Start(profilerCfg); err != nil {
+	// lite mode runs without GCP, so spans are not exported unless they are sent to a collector by OTLP
+	if traceExporter == "" && dbDriver == "lite" {
+		traceExporter = telemetry.TraceNone
+	}
+	if traceExporter, err = telemetry.ParseTraceExporter(traceExporter); err != nil {
 		logger.Error(err.Error())
 		return
 	}
+	traceSampler, err := telemetry.ParseSampler(sampler, samplerArg)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	telemetryConfig := telemetry.Config{
+		TraceExporter:  traceExporter,
+		Sampler:        traceSampler,
+		ProjectID:      projectId,
+		OTLPEndpoint:   otlpEndpoint,
+		OTLPHeaders:    otlpHeaders,
+		ServiceName:    "game-api",
+		ServiceVersion: appVersion,
+		Revision:       rev,
+	}
+	tp, err := internal.NewTracer(ctx, telemetryConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	// the deadline of stopping may be used up by draining, so give it a fresh one to flush spans
+	lifecycle.OnStop("tracer", internal.StopTelemetry, func(context.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return tp.Shutdown(ctx)
+	})
+
+	if metricsPush == "otlp" {
+		interval, err := telemetry.ParseExportInterval(metricsEvery)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		mp, err := telemetry.NewMeter(ctx, telemetryConfig, interval)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		// the last push has what happened while draining, with a fresh deadline as spans have
+		lifecycle.OnStop("otlp metrics", internal.StopTelemetry, func(context.Context) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			return mp.Shutdown(ctx)
+		})
+	} else if metricsPush != "" {
+		logger.Error(fmt.Sprintf("unknown METRICS_EXPORTER %q, it has to be otlp or empty", metricsPush))
+		return
+	}
+
+	// profiles and Pub/Sub are off in lite mode as well
+	var pubsubClient *pubsub.Client
+	if dbDriver != "lite" {
+		profilerCfg := profiler.Config{
+			Service:           appName,
+			ServiceVersion:    appVersion,
+			ProjectID:         projectId,
+			EnableOCTelemetry: true,
+		}
+
+		if err := profiler.Start(profilerCfg); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		pubsubClient, err = pubsub.NewClient(ctx, projectId)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		lifecycle.OnStop("pubsub", internal.StopClients, internal.Closer(pubsubClient.Close))
+	}
+
+	var publisher internal.EventPublisher
+	switch {
+	case publisherName == "nats":
+		publisher, err = internal.NewNATSPublisher(natsURL, "GAME", "game")
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	case topicName != "":
+		if pubsubClient == nil {
+			logger.Error("TOPIC_NAME can't be used in lite mode, use EVENT_PUBLISHER=nats or leave it empty")
+			return
+		}
+		settings := pubsub.DefaultPublishSettings
+		settings.Timeout = time.Duration(deps.PubSub.PublishTimeout)
+		settings.DelayThreshold = time.Duration(deps.PubSub.DelayThreshold)
+		settings.CountThreshold = deps.PubSub.CountThreshold
+		publisher = internal.NewPubSubPublisher(pubsubClient, topicName, settings)
+	}
+	if publisher != nil {
+		lifecycle.OnStop("publisher", internal.StopClients, internal.Closer(publisher.Close))
+	}
 
-	pubsubClient, err := pubsub.NewClient(ctx, projectId)
+	// what this instance depends on, for /admin/topology
+	topology := internal.NewTopology(appName)
+	switch {
+	case publisherName == "nats":
+		topology.Add("nats", "nats", natsURL, nil)
+	case topicName != "":
+		topology.Add("topic", "pubsub_topic", topicName, nil)
+	}
+	for _, sub := range strings.Split(resetSubs, ",") {
+		if sub != "" && topicName != "" {
+			topology.Add(sub, "pubsub_subscription", sub, nil, "topic")
+		}
+	}
+
+	redisConfig, err := game.ParseRedisConfig(redisMode, redisHost, redisMaster, redisPassword)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
-	defer pubsubClient.Close()
+	rdb := game.NewRedisClient(redisConfig, deps.Redis)
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:        redisHost,
-		Password:    redisPassword,
-		DB:          0,
-		PoolSize:    10,
-		PoolTimeout: 30 * time.Second,
-		DialTimeout: 1 * time.Second,
+	var replicas []*redis.Client
+	for _, addr := range strings.Split(redisReplicas, ",") {
+		if addr == "" {
+			continue
+		}
+		replica := redis.NewClient(deps.Redis.Options(addr, redisPassword))
+		lifecycle.OnStop("redis replica "+addr, internal.StopClients, internal.Closer(replica.Close))
+		replicas = append(replicas, replica)
+	}
+
+	epoch, err := game.ParseCacheEpoch(cacheEpoch, prevEpoch, epochGrace, rev)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	c := game.Caching{RedisClient: rdb, Health: game.NewCacheHealth(), ReadReplicas: replicas, Epoch: epoch}
+	// Spanner is the only one required, events are published best effort
+	checks := []readinessCheck{{Name: "redis", Optional: true, Check: func(context.Context) error { return c.Ping() }}}
+	if topicName != "" && publisherName != "nats" {
+		checks = append(checks, readinessCheck{Name: "pubsub-topic", Optional: true, Check: topicCheck(pubsubClient, topicName)})
+	}
+	topology.Add("redis", "redis_"+string(redisConfig.Mode), strings.Join(redisConfig.Addrs, ","), func() string { return c.Health.State().String() })
+	for i, addr := range strings.Split(redisReplicas, ",") {
+		if addr != "" {
+			topology.Add(fmt.Sprintf("redis-replica-%d", i), "redis_replica", addr, nil)
+		}
+	}
+	lifecycle.OnStart("redis scripts", internal.StartJobs, func(ctx context.Context) error {
+		// scripts are loaded again by their first runs if it fails
+		if err := luascript.Load(rdb); err != nil {
+			logger.Warn("could not load redis scripts", "error", err.Error())
+		}
+		return nil
 	})
+	lifecycle.OnStart("redis health", internal.StartJobs, func(ctx context.Context) error {
+		go c.WatchHealth(ctx, time.Duration(deps.Redis.HealthInterval))
+		return nil
+	})
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "redis_health_state",
+			Help: "Redis health state, 0: healthy, 1: degraded, 2: down",
+		},
+		func() float64 { return float64(c.Health.State()) },
+	))
+
+	// the cache of the data layer, UserItems, the catalog and api keys
+	var cacher game.Cacher = &c
+	var standby *game.StandbyCache
+	if redisStandby != "" {
+		if cacheBackend != "" && cacheBackend != "redis" {
+			logger.Error("REDIS_STANDBY_HOST is only for the redis backend")
+			return
+		}
+		standbyConfig, err := game.ParseRedisConfig(redisMode, redisStandby, redisMaster, redisPassword)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		standbyRdb := game.NewRedisClient(standbyConfig, deps.Redis)
+		lifecycle.OnStop("redis standby", internal.StopClients, internal.Closer(standbyRdb.Close))
+		standby = game.NewStandbyCache(&c, &game.Caching{RedisClient: standbyRdb, Health: game.NewCacheHealth(), Epoch: epoch})
+		topology.Add("redis-standby", "redis_"+string(standbyConfig.Mode), strings.Join(standbyConfig.Addrs, ","), func() string { return standby.Standby.Health.State().String() })
+		lifecycle.OnStart("redis standby", internal.StartJobs, func(ctx context.Context) error {
+			go standby.Standby.WatchHealth(ctx, time.Duration(deps.Redis.HealthInterval))
+			go standby.WatchStandby(ctx, time.Duration(deps.Redis.HealthInterval))
+			return nil
+		})
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "redis_standby_lag_seconds",
+				Help: "How long the redis which isn't read has been failing the copies of writes, 0 if it's in sync.",
+			},
+			func() float64 { return standby.Lag().Seconds() },
+		))
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "redis_reading_standby",
+				Help: "1 while cache reads are switched over to the standby redis.",
+			},
+			func() float64 {
+				if standby.ReadingStandby() {
+					return 1
+				}
+				return 0
+			},
+		))
+		checks = append(checks, readinessCheck{Name: "redis-standby", Optional: true, Check: func(context.Context) error { return standby.Standby.Ping() }})
+		cacher = standby
+	}
+	switch cacheBackend {
+	case "", "redis":
+	case "memcached":
+		if memcachedHost == "" {
+			logger.Error("MEMCACHED_HOSTS is required for CACHE_BACKEND=memcached")
+			return
+		}
+		mc := game.NewMemcaching(strings.Split(memcachedHost, ","), epoch)
+		lifecycle.OnStart("memcached health", internal.StartJobs, func(ctx context.Context) error {
+			go mc.WatchHealth(ctx, 5*time.Second)
+			return nil
+		})
+		lifecycle.OnStop("memcached", internal.StopClients, internal.Closer(mc.Client.Close))
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "memcached_health_state",
+				Help: "Memcached health state, 0: healthy, 1: degraded, 2: down",
+			},
+			func() float64 { return float64(mc.Health.State()) },
+		))
+		topology.Add("memcached", "memcached", memcachedHost, func() string { return mc.Health.State().String() })
+		cacher = mc
+	default:
+		logger.Error(fmt.Sprintf("unknown CACHE_BACKEND %q", cacheBackend))
+		return
+	}
+
+	if localCache != "" {
+		size, ttl, err := game.ParseLocalCache(localCache)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		cacher = game.NewTieredCache(cacher, size, ttl)
+	}
+
+	lifecycle.OnStop("redis", internal.StopClients, internal.Closer(rdb.Close))
+
+	emitReceipt := func(ctx context.Context, receipt game.Receipt) error {
+		if publisher == nil {
+			logger.Info("receipt", "receipt_id", receipt.ReceiptID, "user", game.HashID(receipt.UserID))
+			return nil
+		}
+		return publisher.Publish(ctx, "receipt", receipt.ReceiptID, map[string]interface{}{"receipt": receipt, "rev": rev})
+	}
+
+	/*
+		changes go to websocket clients on this instance, to the activity stream in redis for SSE clients,
+		and to the broker for the others like the worker, unless the outbox relay publishes them
+	*/
+	events := internal.NewEventBus(16)
+	emitChange := func(ctx context.Context, e domain.ItemChanged) error {
+		events.Publish(e)
+		err := c.AppendActivity(e)
+		if publisher == nil || eventOutbox {
+			return err
+		}
+		return errors.Join(err, publisher.Publish(ctx, "user_items_changed", e.ID(), e))
+	}
+
+	pii, closePII, err := newEnvelope(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	lifecycle.OnStop("pii", internal.StopClients, internal.Closer(closePII))
+	if kmsKeyName != "" {
+		topology.Add("kms-pii", "kms", kmsKeyName, nil)
+	}
 
-	c := game.Caching{RedisClient: rdb}
+	rowLimit := 0
+	if maxRows != "" {
+		if rowLimit, err = strconv.Atoi(maxRows); err != nil || rowLimit < 0 {
+			logger.Error("MAX_ROWS_PER_QUERY has to be a number of rows", "value", maxRows)
+			return
+		}
+	}
 
-	client, err := game.NewClient(ctx, spannerString, &c)
+	experiments, err := internal.ParseExperiments(abTestConfig)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	defer client.Sc.Close()
-	defer rdb.Close()
+	flags := map[string]string{
+		"DB_DRIVER":           dbDriver,
+		"TRACE_EXPORTER":      traceExporter,
+		"METRICS_EXPORTER":    metricsPush,
+		"OTEL_TRACES_SAMPLER": traceSampler.Description(),
+		"REDIS_MODE":          string(redisConfig.Mode),
+		"CACHE_BACKEND":       cacheBackend,
+		"REDIS_STANDBY":       strconv.FormatBool(standby != nil),
+		"MAX_ROWS_PER_QUERY":  maxRows,
+		"LOCAL_CACHE":         localCache,
+		"DEPENDENCIES":        dependencies,
+	}
+
+	// the data layer, and what depends on its kind
+	var repo repository
+	var resetter resetClient
+	var scheduler *internal.Scheduler
+	switch dbDriver {
+	case "lite":
+		if eventOutbox {
+			logger.Error("EVENT_OUTBOX can't be used in lite mode, changes are staged in Spanner")
+			return
+		}
+		lite, err := game.NewLiteClient(cacher)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if liteFixtures != "" {
+			fixture, err := fixtures.ReadFiles(strings.Split(liteFixtures, ",")...)
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			if err := lite.Load(fixture); err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		}
+		lite.EmitReceipt = emitReceipt
+		lite.EmitChange = emitChange
+		lite.Envelope = pii
+		topology.Add("lite", "in_memory", "", nil)
+		flags["LITE_FIXTURES"] = liteFixtures
+		// jobs of the scheduler are of Spanner and the archive, there is none to run in lite mode
+		scheduler = internal.NewScheduler(2)
+		repo, resetter = lite, lite
+	case "", "spanner":
+		// the session pool is on /metrics, with sessions created along with the client
+		if err := game.EnableSpannerMetrics(); err != nil {
+			logger.Warn("could not enable metrics of the Spanner client", "error", err.Error())
+		}
+		client, err := game.NewClient(ctx, spannerString, cacher)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		lifecycle.OnStop("spanner", internal.StopClients, func(context.Context) error {
+			client.Sc.Close()
+			return nil
+		})
+
+		if schemaDrift != "off" {
+			version, drifts, err := client.CheckSchema(ctx)
+			if err != nil {
+				logger.Warn("could not check schema", "error", err.Error())
+			}
+			for _, drift := range drifts {
+				logger.Warn("schema drift", "expected", version, "drift", drift)
+			}
+			if len(drifts) > 0 && schemaDrift == "fail" {
+				logger.Error("refuse to start because of schema drift, apply schemas or set SCHEMA_DRIFT=warn")
+				return
+			}
+		}
+
+		client.EmitReceipt = emitReceipt
+		client.EmitChange = emitChange
+		client.Envelope = pii
+
+		client.RaceCache = raceCache
+		if client.CacheStrategy, err = game.ParseCacheStrategy(cacheStrategy); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if client.WriteModes, err = game.ParseWriteModes(writeMode); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if client.Staleness, err = game.ParseStaleness(staleness); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if validateCache {
+			// stamps of writes are kept by redis, and projected writes of events are not stamped
+			if cacheBackend == "memcached" || eventSourcing {
+				logger.Error("CACHE_VALIDATION can't be used with CACHE_BACKEND=memcached or EVENT_SOURCING")
+				return
+			}
+			client.ValidateCache = true
+		}
+
+		breaker, err := game.ParseBreaker(deps.Spanner.Breaker)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		client.Breaker = breaker
+		topology.Add("spanner", "spanner", spannerString, func() string {
+			switch breaker.State() {
+			case game.BreakerClosed:
+				return internal.HealthHealthy
+			case game.BreakerHalfOpen:
+				return internal.HealthDegraded
+			}
+			return internal.HealthDown
+		})
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "spanner_circuit_state",
+				Help: "Circuit breaker state of Spanner, 0: closed, 1: half-open, 2: open",
+			},
+			func() float64 { return float64(breaker.State()) },
+		))
+
+		if client.Retrier, err = game.ParseRetrier(deps.Spanner.Retry); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		client.Timeout = time.Duration(deps.Spanner.Timeout)
+
+		if scheduler, err = newScheduler(client); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		if catalogCache != "" {
+			refresh, err := time.ParseDuration(catalogCache)
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			// created before it's set, so the copy of client in it doesn't see itself
+			catalog := game.NewCatalogCache(client, cacher, refresh)
+			client.Catalog = catalog
+			// loaded before requests come, and refreshed by the scheduler
+			lifecycle.OnStart("catalog cache", internal.StartJobs, func(ctx context.Context) error {
+				if err := catalog.Refresh(ctx); err != nil {
+					logger.Warn("could not load the catalog", "error", err.Error())
+				}
+				return nil
+			})
+			err = scheduler.Add(internal.Job{
+				Name:     "catalog-refresh",
+				Schedule: "@every " + refresh.String(),
+				Priority: 5,
+				Jitter:   refresh / 10,
+				Timeout:  refresh,
+				Run:      catalog.Refresh,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		}
+
+		if eventSourcing {
+			client.EventSourced = true
+			err := scheduler.Add(internal.Job{
+				Name:     "projector",
+				Schedule: "@every 1s",
+				Priority: 20,
+				Timeout:  30 * time.Second,
+				Run: func(ctx context.Context) error {
+					_, err := client.ProjectPending(ctx)
+					return err
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		}
+
+		if eventOutbox {
+			// the relay marks changes published only when the broker has accepted them
+			confirmed, ok := publisher.(internal.ConfirmedPublisher)
+			if !ok || eventSourcing {
+				logger.Error("EVENT_OUTBOX requires TOPIC_NAME or EVENT_PUBLISHER=nats, and can't be used with EVENT_SOURCING")
+				return
+			}
+			client.Outbox = true
+			err := scheduler.Add(internal.Job{
+				Name:     "outbox-relay",
+				Schedule: "@every 1s",
+				Priority: 20,
+				Timeout:  30 * time.Second,
+				Run: func(ctx context.Context) error {
+					_, err := client.RelayPending(ctx, func(ctx context.Context, e game.OutboxEvent) error {
+						return confirmed.PublishConfirmed(ctx, e.Type, e.ID, e.Payload)
+					})
+					return err
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+		}
+
+		if client.CacheRollout, err = cacheRollout(experiments); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		for name, value := range map[string]string{
+			"CACHE_STRATEGY":       string(client.CacheStrategy),
+			"CACHE_RACE":           strconv.FormatBool(raceCache),
+			"CACHE_VALIDATION":     strconv.FormatBool(validateCache),
+			"WRITE_MODE":           client.WriteModes.String(),
+			"USER_ITEMS_STALENESS": client.Staleness.String(),
+			"CATALOG_CACHE":        catalogCache,
+			"EVENT_SOURCING":       strconv.FormatBool(eventSourcing),
+			"EVENT_OUTBOX":         strconv.FormatBool(eventOutbox),
+			"SPANNER_BREAKER":      deps.Spanner.Breaker,
+			"SPANNER_RETRY":        deps.Spanner.Retry,
+		} {
+			flags[name] = value
+		}
+		checks = append(checks, readinessCheck{Name: "spanner", Check: client.Ping})
+		repo, resetter = client, client
+	default:
+		logger.Error(fmt.Sprintf("unknown DB_DRIVER %q", dbDriver))
+		return
+	}
+
+	var verifier game.ReceiptVerifier = game.StubVerifier{}
+	if verifierName == "google_play" {
+		verifier, err = game.NewGooglePlayVerifier(ctx, playPackage)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+
+	slos, err := internal.ParseSLOs(sloConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	sloTracker := internal.NewSLOTracker(slos, prometheus.DefaultGatherer)
+	statsTracker := internal.NewStatsTracker(prometheus.DefaultGatherer)
+	lifecycle.OnStart("trackers", internal.StartJobs, func(ctx context.Context) error {
+		go sloTracker.Run(ctx, 15*time.Second)
+		go statsTracker.Run(ctx, 5*time.Second)
+		return nil
+	})
+
+	schedulerDone := make(chan struct{})
+	lifecycle.OnStart("scheduler", internal.StartJobs, func(ctx context.Context) error {
+		go func() {
+			scheduler.Run(ctx)
+			close(schedulerDone)
+		}()
+		// registered only when it's started, not to wait for the one which never runs
+		lifecycle.OnStop("scheduler", internal.StopJobs, func(ctx context.Context) error {
+			select {
+			case <-schedulerDone:
+				return nil
+			case <-ctx.Done():
+				return fmt.Errorf("background jobs are still running")
+			}
+		})
+		return nil
+	})
+
+	limits, err := internal.ParseRateLimits(rateLimits)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	var rateLimiter *internal.RateLimiter
+	if len(limits) > 0 {
+		rateLimiter = internal.NewRateLimiter(rdb, limits)
+	}
+
+	authorizer := internal.NewAuthorizer(authHeaderName, adminCallers, internal.SlogAudit{Logger: logger})
+	if jwksURL != "" {
+		authorizer.JWT, err = internal.NewJWKSVerifier(ctx, jwtIssuer, jwtAudience, jwksURL)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+	switch authMode {
+	case "":
+	case "iap":
+		authorizer.Proxy, err = internal.NewIAPVerifier(ctx, authAudience)
+	case "id_token":
+		// both are bearer tokens in Authorization
+		if jwksURL != "" {
+			err = fmt.Errorf("AUTH_MODE=id_token can't be used with JWKS_URL")
+			break
+		}
+		authorizer.Proxy, err = internal.NewIDTokenVerifier(ctx, authAudience)
+	default:
+		err = fmt.Errorf("unknown AUTH_MODE %q", authMode)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if requireAPIKeys {
+		authorizer.APIKeys = repo
+	}
+
+	if archiveBucket != "" {
+		topology.Add("archive", "gcs", archiveBucket, nil)
+	}
+	for name, value := range flags {
+		if value != "" {
+			topology.Flag(name, value)
+		}
+	}
+
+	// nil unless CAPTURE_BUCKET is set, its middleware passes requests through then
+	var capture *internal.TrafficCapture
+	if captureBucket != "" {
+		rate, err := internal.ParseCaptureRate(captureRate)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		gcs, err := storage.NewClient(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		lifecycle.OnStop("capture bucket", internal.StopClients, internal.Closer(gcs.Close))
+		capture = internal.NewTrafficCapture(rate, 500, newCaptureWriter(gcs, captureBucket))
+		lifecycle.OnStart("capture", internal.StartJobs, func(ctx context.Context) error {
+			go capture.Run(ctx, 30*time.Second)
+			return nil
+		})
+		// after the servers are drained, so the last requests are written
+		lifecycle.OnStop("capture", internal.StopJobs, capture.Flush)
+		topology.Add("capture", "gcs", captureBucket, nil)
+		topology.Flag("CAPTURE_RATE", strconv.FormatFloat(rate, 'f', -1, 64))
+	}
 
 	s := Serving{
-		Client: client,
+		Client:      repo,
+		CacheHealth: c.Health,
+		Verifier:    verifier,
+		SLOTracker:  sloTracker,
+		Stats:       statsTracker,
+		Publisher:   publisher,
+		Experiments: experiments,
+		Scheduler:   scheduler,
+		Authorizer:  authorizer,
+		Events:      events,
+		Activity:    &c,
+		APIKeys:     repo,
+		RateLimiter: rateLimiter,
+		Topology:    topology,
+		Idempotency: repo,
+		Importer:    repo,
+		Standby:     standby,
+		Readiness:   checks,
+	}
+	if allowReset {
+		s.Reset = func(ctx context.Context) (resetReport, error) {
+			return resetWorkshop(ctx, resetter, &c, pubsubClient)
+		}
+	}
+
+	var signer internal.Signer
+	switch signingKey {
+	case "":
+	case "local":
+		if signer, err = internal.NewLocalSigner(); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	default:
+		kmsSigner, err := internal.NewKMSSigner(ctx, signingKey)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		lifecycle.OnStop("signer", internal.StopClients, internal.Closer(kmsSigner.Close))
+		topology.Add("kms-signing", "kms", signingKey, nil)
+		signer = kmsSigner
 	}
+	signed := internal.SignResponses(signer)
 
-	oplog := httplog.LogEntry(context.Background())
 	/* jsonify logging */
 	httpLogger := httplog.NewLogger(appName, httplog.Options{JSON: true, LevelFieldName: "severity", Concise: true})
 
 	/* exporter for prometheus */
-	m := chiprometheus.NewMiddleware(appName)
+	/* labeled by route pattern, not to leak raw ids into metrics */
+	m := internal.NewPatternMetrics(appName)
 
 	r := chi.NewRouter()
 	// r.Use(middleware.Throttle(8))
 	r.Use(middleware.RequestID)
+	if forceTrace == "" {
+		forceTrace = "X-Debug-Trace"
+	}
+	r.Use(internal.Tracing(forceTrace, forceToken))
+	r.Use(requestLogger(httpLogger))
+	// after the logger, so a panic is logged in the entry of the request
 	r.Use(middleware.Recoverer)
-	r.Use(httplog.RequestLogger(httpLogger))
 	r.Use(middleware.Timeout(60 * time.Second))
+	r.Use(memo)
 
 	r.Use(m)
+	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(spannerErrors)
+	r.Use(measureResponseSize)
 	r.Handle("/metrics", promhttp.Handler())
 
 	r.Get("/ping", s.pingPong)
+	r.Get("/readyz", s.readyz)
+	r.Get("/healthz", s.healthz)
+	if signer != nil {
+		r.Get("/.well-known/jwks.json", internal.JWKSHandler(signer))
+		apiDocs["GET /.well-known/jwks.json"] = internal.OpenAPIOperation{Summary: "Public key to verify X-JWS-Signature of signed responses"}
+	}
 
 	r.Route("/api", func(t chi.Router) {
-		t.Use(headerAuth)
+		t.Use(capture.Middleware)
+		t.Use(limitRows(rowLimit))
+		t.Use(s.Authorizer.Authenticate)
+		t.Use(withActor)
+		t.Use(s.Authorizer.RequireSubject)
+		t.Use(s.Authorizer.RequireAPIKey)
+		// inline, so the limiter can see user_id and the route pattern
+		t = t.With(s.RateLimiter.Middleware("user_id"))
 		t.Get("/ping", s.pingPong)
-		t.Get("/user_id/{user_id:[a-z0-9-.]+}", s.getUserItems)
-		t.Post("/user/{user_name:[a-z0-9-.]+}", s.createUser)
-		t.Put("/user_id/{user_id:[a-z0-9-.]+}/{item_id:[a-z0-9-.]+}", s.addItemToUser)
+		t.Get("/users", s.listUsers)
+		t.With(s.idempotent).Post("/user", s.createUserByBody)
+		// the name in the path is kept for clients of before the body, it's restricted to what a path can have
+		t.With(s.idempotent).Post("/user/{user_name:[a-z0-9-.]+}", s.createUser)
+		t.Delete("/user/{user_id:[a-z0-9-.]+}", s.deleteUser)
+		t.Get("/items", s.listItems)
+		t.Get("/items/{item_id:[a-z0-9-.]+}", s.getItem)
+		// the catalog is of the game, not of a user, only admins change it
+		t.Group(func(u chi.Router) {
+			u.Use(s.Authorizer.RequireAdmin)
+			u.Post("/items", s.createItem)
+			u.Put("/items/{item_id:[a-z0-9-.]+}", s.updateItem)
+			u.Delete("/items/{item_id:[a-z0-9-.]+}", s.deleteItem)
+		})
+		t.Group(func(u chi.Router) {
+			// inline, so the middleware can see user_id
+			u.Use(s.Authorizer.AuthorizeUser("user_id"))
+			u.Use(internal.NewExperimentMiddleware(s.Experiments, "user_id"))
+			// what the user owns and pays, signed for clients to tell they are not tampered with
+			u.With(signed).Get("/user_id/{user_id:[a-z0-9-.]+}", s.getUserItems)
+			u.With(signed).Get("/user_id/{user_id:[a-z0-9-.]+}/sync", s.syncUserItems)
+			u.Patch("/user_id/{user_id:[a-z0-9-.]+}", s.updateUser)
+			u.With(s.idempotent).Put("/user_id/{user_id:[a-z0-9-.]+}/{item_id:[a-z0-9-.]+}", s.addItemToUser)
+			u.Delete("/user_id/{user_id:[a-z0-9-.]+}/{item_id:[a-z0-9-.]+}", s.removeItemFromUser)
+			u.Post("/user_id/{user_id:[a-z0-9-.]+}/items", s.addItemsToUser)
+			u.With(signed).Get("/user_id/{user_id:[a-z0-9-.]+}/items", s.getUserItemsPage)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/profile", s.getProfile)
+			u.With(signed).Get("/user_id/{user_id:[a-z0-9-.]+}/wallet", s.getWallet)
+			// currency is otherwise given only by grants and purchases, users can't mint it for themselves
+			u.With(s.Authorizer.RequireAdmin, signed).Put("/user_id/{user_id:[a-z0-9-.]+}/wallet/{amount:[0-9]+}", s.creditWallet)
+			u.With(signed).Get("/user_id/{user_id:[a-z0-9-.]+}/wallet/ledger", s.getWalletLedger)
+			u.With(signed).Post("/user_id/{user_id:[a-z0-9-.]+}/purchase/verify", s.verifyPurchase)
+			u.With(signed).Post("/user_id/{user_id:[a-z0-9-.]+}/purchase/{item_id:[a-z0-9-.]+}", s.purchaseItem)
+			// by subsystems giving rewards, which are admin callers, users can't grant themselves
+			u.With(s.Authorizer.RequireAdmin, signed).Post("/user_id/{user_id:[a-z0-9-.]+}/grant", s.grantToUser)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/pii", s.getUserPII)
+			u.Put("/user_id/{user_id:[a-z0-9-.]+}/pii", s.setUserPII)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/experiments", s.getExperiments)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/events", s.streamUserEvents)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/mailbox", s.getMailbox)
+			u.With(signed).Post("/user_id/{user_id:[a-z0-9-.]+}/mailbox/{mail_id:[a-z0-9-.]+}/ack", s.ackMail)
+			u.Get("/user_id/{user_id:[a-z0-9-.]+}/audit", s.getUserAudit)
+		})
 	})
 
+	r.Route("/admin", func(t chi.Router) {
+		t.Use(s.Authorizer.Authenticate)
+		t.Use(withActor)
+		t.Use(s.Authorizer.RequireSubject)
+		t.Get("/slo", s.sloSummary)
+		t.Get("/stats", s.stats)
+		t.Get("/jobs", s.jobStatus)
+		t.Group(func(u chi.Router) {
+			u.Use(s.Authorizer.RequireAdmin)
+			u.Get("/apikeys", s.listAPIKeys)
+			u.Post("/apikeys", s.createAPIKey)
+			u.Delete("/apikeys/{key_id:[a-z0-9-]+}", s.revokeAPIKey)
+			u.Post("/items/{item_id:[a-z0-9-.]+}/revoke", s.revokeItem)
+			u.Post("/import", s.importHandler)
+			u.Post("/users/merge", s.mergeUsers)
+			u.Get("/topology", internal.TopologyHandler(s.Topology))
+			u.Get("/topology/ui", internal.TopologyUIHandler("/admin/topology"))
+		})
+		if s.Standby != nil {
+			t.With(s.Authorizer.RequireAdmin).Get("/cache/standby", s.standbyStatus)
+			t.With(s.Authorizer.RequireAdmin).Put("/cache/standby", s.switchStandby)
+			apiDocs["GET /admin/cache/standby"] = standbyStatusDoc
+			apiDocs["PUT /admin/cache/standby"] = switchStandbyDoc
+		}
+		if s.Reset != nil {
+			t.With(s.Authorizer.RequireAdmin).Post("/reset", s.resetHandler)
+			// documented only when it's routed, as documents without routes are refused
+			apiDocs["POST /admin/reset"] = resetDoc
+		}
+	})
+
+	schema, err := newGraphQLSchema(s.Client)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	r.Group(func(t chi.Router) {
+		t.Use(limitRows(rowLimit))
+		t.Use(s.Authorizer.Authenticate)
+		t.Use(withActor)
+		t.Get("/graphql", graphqlHandler(schema))
+		t.Post("/graphql", graphqlHandler(schema))
+	})
+
+	/* generated after all the routes are added, so it doesn't document itself */
+	doc, undocumented, err := internal.NewOpenAPI(appName, appVersion, r, apiDocs)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if len(undocumented) > 0 {
+		logger.Warn("routes are not in the OpenAPI document", "routes", undocumented)
+	}
+	r.Get("/openapi.json", internal.OpenAPIHandler(doc))
+	if swaggerUI {
+		r.Get("/swagger", internal.SwaggerUIHandler("/openapi.json"))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws/", s.wsRouter(httpLogger))
+	mux.Handle("/", r)
+
 	user, err := user.Current()
 	if err != nil {
 		logger.Error(err.Error())
@@ -201,80 +1172,111 @@ func main() {
 		),
 	)
 
-	if err := http.ListenAndServe(":"+servicePort, r); err != nil {
-		oplog.Err(err)
-	}
-
-}
-
-var errorRender = func(w http.ResponseWriter, r *http.Request, httpCode int, err error) {
-	logger.Error(err.Error(), "http code", httpCode)
-	render.Status(r, httpCode)
-	render.JSON(w, r, map[string]interface{}{"ERROR": err.Error()})
-}
-
-func (s Serving) getUserItems(w http.ResponseWriter, r *http.Request) {
-
-	userID := chi.URLParam(r, "user_id")
-	ctx := r.Context()
-
-	ctx, span := otel.Tracer("main").Start(ctx, "getUserItems.root")
-	span.SetAttributes(attribute.String("server", "getUserItems"))
-	defer span.End()
-
-	/* sample log related to span id */
-	traceWithLog(ctx, span).Str("method", "ok").Send()
+	server := &http.Server{Addr: ":" + servicePort, Handler: mux}
+	// websocket connections are hijacked, so they are not closed by Shutdown
+	server.RegisterOnShutdown(events.Close)
+	lifecycle.OnStart("http", internal.StartServers, func(context.Context) error {
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error(err.Error())
+				stop()
+			}
+		}()
+		return nil
+	})
+	lifecycle.OnStop("http", internal.StopServers, func(ctx context.Context) error {
+		if err := server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("could not drain connections: %w", err)
+		}
+		return nil
+	})
 
-	results, err := s.Client.UserItems(ctx, w, userID)
-	if err != nil {
-		errorRender(w, r, http.StatusInternalServerError, err)
-		return
+	if grpcPort != "" {
+		grpcServer, grpcHealth := newGRPCServer(repo, s.Authorizer, s.RateLimiter)
+		lifecycle.OnStart("grpc", internal.StartServers, func(context.Context) error {
+			lis, err := net.Listen("tcp", ":"+grpcPort)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := grpcServer.Serve(lis); err != nil {
+					logger.Error(err.Error())
+					stop()
+				}
+			}()
+			return nil
+		})
+		lifecycle.OnStop("grpc", internal.StopServers, func(ctx context.Context) error {
+			grpcHealth.Shutdown()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcServer.Stop()
+			}
+			return nil
+		})
 	}
 
-	// publish log, just for test
-	if topicName != "" {
-		p := map[string]interface{}{"id": userID, "rev": rev}
-		internal.PublishLog(pubsubClient, topicName, p)
+	if debugPort != "" {
+		var authorize []func(http.Handler) http.Handler
+		if debugAuth {
+			authorize = append(authorize, s.Authorizer.Authenticate, s.Authorizer.RequireAdmin)
+		}
+		debugServer := &http.Server{Addr: ":" + debugPort, Handler: newDebugHandler(authorize...)}
+		lifecycle.OnStart("debug", internal.StartServers, func(context.Context) error {
+			lis, err := net.Listen("tcp", debugServer.Addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := debugServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Error(err.Error())
+				}
+			}()
+			return nil
+		})
+		// profiles being taken are not waited for, they take as long as 30s by default
+		lifecycle.OnStop("debug", internal.StopServers, internal.Closer(debugServer.Close))
 	}
 
-	render.JSON(w, r, results)
-}
-
-func (s Serving) createUser(w http.ResponseWriter, r *http.Request) {
-	userId, _ := uuid.NewRandom()
-	userName := chi.URLParam(r, "user_name")
-	ctx := r.Context()
-
-	ctx, span := otel.Tracer("main").Start(ctx, "createUser.root")
-	span.SetAttributes(attribute.String("server", "createUser"))
-	defer span.End()
-
-	err := s.Client.CreateUser(ctx, w, game.UserParams{UserID: userId.String(), UserName: userName})
-	if err != nil {
-		errorRender(w, r, http.StatusInternalServerError, err)
+	if err := lifecycle.Start(ctx); err != nil {
+		logger.Error(err.Error())
 		return
 	}
-	render.JSON(w, r, User{
-		Id:   userId.String(),
-		Name: userName,
-	})
-}
 
-func (s Serving) addItemToUser(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "user_id")
-	itemID := chi.URLParam(r, "item_id")
-	ctx := r.Context()
-
-	ctx, span := otel.Tracer("main").Start(ctx, "addItemToUser.root")
-	span.SetAttributes(attribute.String("server", "addItemToUser"))
-	defer span.End()
+	<-ctx.Done()
+	logger.Info("shutting down, draining connections")
+	shutdown()
+	logger.Info("server has been stopped")
+}
 
-	err := s.Client.AddItemToUser(ctx, w, game.UserParams{UserID: userID}, game.ItemParams{ItemID: itemID})
-	if err != nil {
-		errorRender(w, r, http.StatusInternalServerError, err)
-		return
+// envelope for sensitive fields by KMS_KEY_NAME or PII_LOCAL_KEYS, nil if neither is set
+func newEnvelope(ctx context.Context) (*envelope.Envelope, func() error, error) {
+	nop := func() error { return nil }
+	switch {
+	case kmsKeyName != "":
+		wrapper, err := envelope.NewKMSWrapper(ctx, kmsKeyName)
+		if err != nil {
+			return nil, nop, err
+		}
+		return &envelope.Envelope{Wrapper: wrapper}, wrapper.Close, nil
+	case piiLocalKeys != "":
+		wrapper := envelope.LocalWrapper{}
+		for _, encoded := range strings.Split(piiLocalKeys, ",") {
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, nop, fmt.Errorf("PII_LOCAL_KEYS: %w", err)
+			}
+			wrapper.Keys = append(wrapper.Keys, key)
+		}
+		return &envelope.Envelope{Wrapper: wrapper}, nop, nil
 	}
-	render.JSON(w, r, map[string]string{})
+	return nil, nop, nil
 }
 
 func (s Serving) pingPong(w http.ResponseWriter, r *http.Request) {
@@ -282,18 +1284,49 @@ func (s Serving) pingPong(w http.ResponseWriter, r *http.Request) {
 	render.PlainText(w, r, "Pong\n")
 }
 
-func headerAuth(next http.Handler) http.Handler {
+// lookups in a request are memoized, see game.WithMemo
+func memo(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if authHeaderName != "" {
-			auth := r.Header.Get(authHeaderName)
-			if auth == "" {
-				// w.WriteHeader(http.StatusForbidden)
-				log.Printf("Forbidden request info: %+v", r)
-				http.Error(w, "You're NOT permitted to enter here", http.StatusForbidden)
+		next.ServeHTTP(w, r.WithContext(game.WithMemo(r.Context())))
+	})
+}
+
+/*
+limitRows caps rows of each query in the request, so a huge result fails fast with 413 instead of being read into memory.
+It's for routes of users, admin ones may scan tables on purpose.
+*/
+func limitRows(limit int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limit <= 0 {
+				next.ServeHTTP(w, r)
 				return
 			}
-		}
-		next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(game.WithRowLimit(r.Context(), limit)))
+		})
+	}
+}
+
+// the identity of the request is recorded as the actor of the mutations it makes, in the audit of users
+func withActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := internal.IdentityFromContext(r.Context())
+		ctx := game.WithActor(r.Context(), game.Actor{
+			Caller:    identity.Caller,
+			ActingAs:  identity.ActingAs,
+			RequestID: middleware.GetReqID(r.Context()),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// record body size per route, to see when a response is getting too big to be cached, and on the server span to find the big ones
+func measureResponseSize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		responseSize.WithLabelValues(r.Method, internal.RoutePattern(r)).Observe(float64(ww.BytesWritten()))
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("http.response.size", ww.BytesWritten()))
 	})
 }
 
@@ -15,14 +15,24 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-redis/redis"
+	"github.com/rs/zerolog"
 	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
 	"github.com/shin5ok/go-architecting-workshop/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -45,6 +55,10 @@ func (c *dummyCaching) Set(key string, data string) error {
 	return nil
 }
 
+func (c *dummyCaching) Del(key string) error {
+	return nil
+}
+
 var _ game.Cacher = (*dummyCaching)(nil)
 
 func init() {
@@ -138,12 +152,31 @@ func TestCreateUser(t *testing.T) {
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
 	}
-	var u User
+	var u domain.User
 	json.Unmarshal(rr.Body.Bytes(), &u)
-	userTestID = u.Id
+	userTestID = u.ID
 
 }
 
+func TestCreateUserByBody(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"name":"Alice Smith"}`: http.StatusOK,
+		`{"name":""}`:            http.StatusBadRequest,
+		`{}`:                     http.StatusBadRequest,
+		`"alice"`:                http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("POST", "/api/user", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.createUserByBody).ServeHTTP(rr, req)
+		assert.Equal(t, want, rr.Code, body)
+		if want == http.StatusOK {
+			var u domain.User
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &u))
+			assert.Equal(t, "Alice Smith", u.Name)
+		}
+	}
+}
+
 // This test depends on Test_createUser
 func TestAddItemUser(t *testing.T) {
 
@@ -187,6 +220,191 @@ func TestGetUserItems(t *testing.T) {
 	}
 }
 
+// This test depends on TestAddItemUser
+func TestGraphQLUserItems(t *testing.T) {
+
+	schema, err := newGraphQLSchema(fakeServing.Client)
+	assert.Nil(t, err)
+
+	body := fmt.Sprintf(`{"query": "query($id: ID!) { user(id: $id) { id items { itemId } } }", "variables": {"id": %q}}`, userTestID)
+	req, err := http.NewRequest("POST", "/graphql", strings.NewReader(body))
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	graphqlHandler(schema).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res struct {
+		Data struct {
+			User struct {
+				ID    string
+				Items []struct{ ItemID string }
+			}
+		}
+		Errors []interface{}
+	}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, userTestID, res.Data.User.ID)
+	assert.Contains(t, res.Data.User.Items, struct{ ItemID string }{ItemID: itemTestID})
+}
+
+// in memory, the one of Spanner is tested in the game package
+type memoryIdempotency struct {
+	fingerprints map[string]string
+	responses    map[string]game.IdempotentResponse
+}
+
+func (m memoryIdempotency) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (*game.IdempotentResponse, error) {
+	if stored, ok := m.fingerprints[key]; ok && stored != fingerprint {
+		return nil, game.ErrIdempotencyKeyReused
+	}
+	m.fingerprints[key] = fingerprint
+	if resp, ok := m.responses[key]; ok {
+		return &resp, nil
+	}
+	return nil, nil
+}
+
+func (m memoryIdempotency) CompleteIdempotencyKey(ctx context.Context, key string, resp game.IdempotentResponse) error {
+	m.responses[key] = resp
+	return nil
+}
+
+func (m memoryIdempotency) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	delete(m.fingerprints, key)
+	return nil
+}
+
+func TestIdempotent(t *testing.T) {
+	calls := 0
+	s := Serving{Idempotency: memoryIdempotency{map[string]string{}, map[string]game.IdempotentResponse{}}}
+	handler := s.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"calls":%d}`, calls)
+	}))
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/user_id/1/2", nil)
+		req.Header.Set("Idempotency-Key", "retry-me")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := request()
+	assert.Equal(t, `{"calls":1}`, first.Body.String())
+	assert.Empty(t, first.Header().Get(idempotencyReplayedHeader))
+
+	retried := request()
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, `{"calls":1}`, retried.Body.String())
+	assert.Equal(t, "application/json", retried.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retried.Header().Get(idempotencyReplayedHeader))
+
+	// the same key for another request is refused
+	req := httptest.NewRequest("PUT", "/api/user_id/1/3", nil)
+	req.Header.Set("Idempotency-Key", "retry-me")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// without the key, it's run every time
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/user_id/1/2", nil))
+	assert.Equal(t, 2, calls)
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	req := httptest.NewRequest("PATCH", "/api/user_id/1", nil)
+	_, err := ifMatchVersion(req)
+	assert.ErrorIs(t, err, errNoIfMatch)
+
+	for etag, want := range map[string]int64{`"3"`: 3, `W/"3"`: 3, "*": game.AnyVersion} {
+		req.Header.Set("If-Match", etag)
+		version, err := ifMatchVersion(req)
+		assert.Nil(t, err)
+		assert.Equal(t, want, version)
+	}
+
+	req.Header.Set("If-Match", `"abc"`)
+	_, err = ifMatchVersion(req)
+	assert.NotNil(t, err)
+	assert.Equal(t, `"3"`, profileETag(domain.Profile{Version: 3}))
+}
+
+func TestReplayRecords(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// credentials are of the target, not of the capture
+		if r.Header.Get("Authorization") != "Bearer target" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/items" && r.URL.Query().Get("limit") == "5" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	now := time.Now()
+	records := []internal.ReplayRecord{
+		{At: now, Method: "GET", Path: "/api/items", Query: "limit=5", Status: http.StatusOK, DurationMs: 10},
+		{At: now.Add(time.Millisecond), Method: "PUT", Path: "/api/user_id/u1/i1", Status: http.StatusOK, DurationMs: 30},
+	}
+	header := http.Header{"Authorization": {"Bearer target"}}
+	report := replayRecords(context.Background(), target.Client(), target.URL, header, records, 2, 1)
+	assert.Equal(t, 2, report.Requests)
+	assert.Equal(t, 0, report.Failed)
+	assert.Equal(t, 1, report.StatusMismatches)
+	assert.Equal(t, map[string]int{"PUT 200->500": 1}, report.Mismatches)
+	assert.Equal(t, float64(30), report.CapturedP95Ms)
+
+	assert.Equal(t, float64(2), percentile([]float64{3, 1, 2}, 0.5))
+	assert.Equal(t, float64(0), percentile(nil, 0.5))
+}
+
+func TestSmoke(t *testing.T) {
+	var reads int
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer smoke" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/api/user/smoke-"):
+			json.NewEncoder(w).Encode(domain.User{ID: "u1", Name: "smoke"})
+		case r.Method == "GET" && r.URL.Path == "/api/items":
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []domain.Item{{ID: itemTestID}}})
+		case r.Method == "PUT" && r.URL.Path == "/api/user_id/u1/"+itemTestID:
+			w.Write([]byte("{}"))
+		case r.Method == "GET" && r.URL.Path == "/api/user_id/u1":
+			reads++
+			w.Header().Set(cacheStatusHeader, map[bool]string{true: "miss", false: "hit"}[reads == 1])
+			json.NewEncoder(w).Encode(domain.Inventory{{ItemID: itemTestID}})
+		case r.Method == "DELETE" && r.URL.Path == "/api/user/u1":
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	target := httptest.NewServer(api)
+	defer target.Close()
+
+	s := smoke{client: target.Client(), base: target.URL, header: http.Header{"Authorization": {"Bearer smoke"}}}
+	assert.Nil(t, s.run(context.Background(), "", nil))
+	assert.Equal(t, 2, reads)
+
+	// the second read doesn't hit the cache
+	reads = -1
+	err := s.run(context.Background(), itemTestID, nil)
+	assert.ErrorContains(t, err, "read items 2")
+
+	s.header = nil
+	assert.ErrorContains(t, s.run(context.Background(), "", nil), "create user")
+}
+
 func TestCleaning(t *testing.T) {
 	t.Cleanup(
 		func() {
@@ -202,3 +420,157 @@ func TestCleaning(t *testing.T) {
 		},
 	)
 }
+
+func TestCacheRollout(t *testing.T) {
+	rollout, err := cacheRollout(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, rollout)
+
+	experiments, err := internal.ParseExperiments(`[{"name":"cache_strategy","salt":"cs1","variants":[{"name":"cache-aside","weight":90},{"name":"write-through","weight":10}]}]`)
+	assert.Nil(t, err)
+	rollout, err = cacheRollout(experiments)
+	assert.Nil(t, err)
+	counts := map[game.CacheStrategy]int{}
+	for n := 0; n < 1000; n++ {
+		userID := fmt.Sprintf("user-%d", n)
+		assert.Equal(t, rollout(userID), rollout(userID))
+		counts[rollout(userID)]++
+	}
+	assert.Len(t, counts, 2)
+	assert.Greater(t, counts[game.CacheAside], counts[game.WriteThrough])
+
+	experiments[0].Variants[1].Name = "write-back"
+	_, err = cacheRollout(experiments)
+	assert.NotNil(t, err)
+}
+
+func TestErrorRender(t *testing.T) {
+	for _, c := range []struct {
+		httpCode int
+		err      error
+		status   int
+		code     string
+	}{
+		{http.StatusInternalServerError, fmt.Errorf("user: %w", status.Error(codes.NotFound, "user is not found")), http.StatusNotFound, "not_found"},
+		{http.StatusInternalServerError, status.Error(codes.AlreadyExists, "row exists"), http.StatusConflict, "already_exists"},
+		{http.StatusInternalServerError, fmt.Errorf("%w: name is empty", domain.ErrInvalid), http.StatusBadRequest, "invalid_request"},
+		{http.StatusInternalServerError, game.ErrCircuitOpen, http.StatusServiceUnavailable, "unavailable"},
+		{http.StatusInternalServerError, errors.New("broken"), http.StatusInternalServerError, "internal"},
+		// the handler knows better than the kind
+		{http.StatusConflict, errors.New("version mismatch"), http.StatusConflict, "conflict"},
+	} {
+		w := httptest.NewRecorder()
+		errorRender(w, httptest.NewRequest(http.MethodGet, "/api/ping", nil), c.httpCode, c.err)
+		assert.Equal(t, c.status, w.Code, c.err.Error())
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, c.code, body["code"], c.err.Error())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	down := func(context.Context) error { return errors.New("connection refused") }
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ok := func(context.Context) error { return nil }
+
+	for _, c := range []struct {
+		checks []readinessCheck
+		code   int
+		status string
+	}{
+		{[]readinessCheck{{Name: "spanner", Check: ok}, {Name: "redis", Optional: true, Check: ok}}, http.StatusOK, "ok"},
+		{[]readinessCheck{{Name: "spanner", Check: ok}, {Name: "redis", Optional: true, Check: down}}, http.StatusOK, "degraded"},
+		{[]readinessCheck{{Name: "spanner", Check: hang}, {Name: "redis", Optional: true, Check: down}}, http.StatusServiceUnavailable, "unavailable"},
+	} {
+		s := Serving{CacheHealth: game.NewCacheHealth(), Readiness: c.checks}
+		w := httptest.NewRecorder()
+		s.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, c.code, w.Code)
+		var body readiness
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, c.status, body.Status)
+		assert.Len(t, body.Dependencies, len(c.checks))
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	newDebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/runtime", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats runtimeStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Greater(t, stats.Goroutines, 0)
+	assert.Greater(t, stats.HeapAlloc, uint64(0))
+
+	w = httptest.NewRecorder()
+	newDebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "memstats")
+
+	a := internal.NewAuthorizer("X-Caller", "admin", nil)
+	debug := newDebugHandler(a.Authenticate, a.RequireAdmin)
+	for caller, code := range map[string]int{"": http.StatusForbidden, "player": http.StatusForbidden, "admin": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		r.Header.Set("X-Caller", caller)
+		debug.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, caller)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf strings.Builder
+	r := chi.NewRouter()
+	r.Use(requestLogger(zerolog.New(&buf)))
+	r.Use(middleware.Recoverer)
+	r.Route("/api", func(t chi.Router) {
+		t.Get("/user_id/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		t.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	})
+
+	userID := "6ff4a2bf-8d4c-4b38-9a3a-7e4b1d8d1b53"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user_id/"+userID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(buf.String()), &entry))
+	assert.Equal(t, "/api/user_id/{user_id}", entry["route"])
+	assert.Equal(t, game.HashID(userID), entry["user_id"])
+	assert.NotContains(t, buf.String(), userID)
+
+	// a panic is recovered once, and logged in the entry of the request
+	buf.Reset()
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	entry = nil
+	assert.Nil(t, json.Unmarshal([]byte(buf.String()), &entry))
+	assert.Equal(t, "boom", entry["panic"])
+	assert.Equal(t, "/api/panic", entry["route"])
+}
+
+func TestMeasureResponseSize(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+
+	r := chi.NewRouter()
+	r.Use(measureResponseSize)
+	r.Get("/api/items", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]\n"))
+	})
+	ctx, span := tracer.Start(context.Background(), "GET")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/items", nil).WithContext(ctx))
+	span.End()
+
+	ended := spans.Ended()
+	assert.Len(t, ended, 1)
+	assert.Contains(t, ended[0].Attributes(), attribute.Int("http.response.size", 3))
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+// the policy is for items both users have, sum if empty, see game.MergePolicy
+type mergeRequest struct {
+	SourceUserID string `json:"source_user_id"`
+	TargetUserID string `json:"target_user_id"`
+	Policy       string `json:"policy"`
+}
+
+var mergeDoc = internal.OpenAPIOperation{
+	Summary: "Merge a user into another, like linking a guest account, and delete the source, policy is sum, max, keep_target or fail",
+	Request: mergeRequest{}, Response: game.MergeReport{},
+}
+
+/*
+mergeUsers is POST /admin/users/merge, for admins only.
+Besides the item changes of the target, the merge is published as a users_merged event,
+so consumers keeping their own state of users, like analytics, can move it to the target as well.
+*/
+func (s Serving) mergeUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "mergeUsers.root")
+	span.SetAttributes(attribute.String("server", "mergeUsers"))
+	defer span.End()
+
+	var body mergeRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	policy, err := game.ParseMergePolicy(body.Policy)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// NotFound, AlreadyExists of the fail policy and ErrInvalid are left to their kinds
+	report, err := s.Client.MergeUsers(ctx, w, body.SourceUserID, body.TargetUserID, policy)
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if report.Merged {
+		logger.Warn("users have been merged", "source", game.HashID(report.SourceUserID), "target", game.HashID(report.TargetUserID),
+			"policy", report.Policy, "items", len(report.Items), "caller", internal.IdentityFromContext(ctx).Caller)
+		// best effort as the other events are, the merge has been committed anyway
+		if s.Publisher != nil {
+			if err := s.Publisher.Publish(ctx, "users_merged", report.SourceUserID, report); err != nil {
+				logger.Warn("could not publish the merge", "error", err.Error())
+			}
+		}
+	}
+	render.JSON(w, r, report)
+}
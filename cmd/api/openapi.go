@@ -0,0 +1,123 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+type empty struct{}
+
+/*
+Documents of the routes for /openapi.json, bodies have to be the same types as the handlers render.
+A route which is not here is left out of the document, and it's warned at start.
+*/
+var apiDocs = map[string]internal.OpenAPIOperation{
+	"GET /ping":     {Summary: "Answers Pong as plain text"},
+	"GET /api/ping": {Summary: "Answers Pong as plain text, with the auth header"},
+	"GET /metrics":  {Summary: "Prometheus metrics"},
+	"GET /readyz":   {Summary: "Readiness of the instance by checking its dependencies now, 503 while a required one is down", Response: readiness{}},
+	"GET /healthz":  {Summary: "Liveness of the process, dependencies are not checked", Response: map[string]string{}},
+
+	"GET /api/users": {Summary: "List users", Paginated: true, Response: struct {
+		Users      []domain.User `json:"users"`
+		NextCursor string        `json:"next_cursor"`
+	}{}},
+	"POST /api/user":               {Summary: "Create a user of the name in the body, by the validation rules of the deployment", Idempotent: true, Request: createUserRequest{}, Response: domain.User{}},
+	"POST /api/user/{user_name}":   {Summary: "Create a user, the name is only of [a-z0-9-.], POST /api/user takes any name", Idempotent: true, Response: domain.User{}},
+	"DELETE /api/user/{user_id}":   {Summary: "Delete a user", Response: empty{}},
+	"GET /api/user_id/{user_id}":   {Summary: "Items owned by the user, ?staleness=exact:10s or max:10s reads Spanner by the bound instead of the cache", Response: domain.Inventory{}},
+	"PATCH /api/user_id/{user_id}": {Summary: "Update the user, If-Match has to be the ETag of its profile", Request: game.UserPatch{}, Response: domain.Profile{}},
+	"GET /api/user_id/{user_id}/sync": {
+		Summary:  "Items added and removed since the synced_at of the last sync, all the items without since",
+		Response: game.SyncDelta{},
+	},
+
+	"PUT /api/user_id/{user_id}/{item_id}":    {Summary: "Add an item to the user, ?quantity=n adds n of it, owned items stack", Idempotent: true, Response: empty{}},
+	"DELETE /api/user_id/{user_id}/{item_id}": {Summary: "Remove an item from the user", Response: empty{}},
+	"POST /api/user_id/{user_id}/items": {Summary: "Add items to the user in a transaction", Request: []string{}, Response: struct {
+		Results []game.ItemResult `json:"results"`
+	}{}},
+	"GET /api/user_id/{user_id}/items": {Summary: "Items owned by the user in the order of item_id", Paginated: true, Response: struct {
+		Items      domain.Inventory `json:"items"`
+		NextCursor string           `json:"next_cursor"`
+	}{}},
+	"GET /api/user_id/{user_id}/profile":         {Summary: "Profile of the user", Response: domain.Profile{}},
+	"GET /api/user_id/{user_id}/wallet":          {Summary: "Wallet balance of the user", Response: domain.Wallet{}},
+	"PUT /api/user_id/{user_id}/wallet/{amount}": {Summary: "Credit the wallet, only by admin callers", Response: domain.Wallet{}},
+	"GET /api/user_id/{user_id}/wallet/ledger": {Summary: "Wallet changes, newest first", Paginated: true, Response: struct {
+		Entries    []domain.LedgerEntry `json:"entries"`
+		NextCursor string               `json:"next_cursor"`
+	}{}},
+	"POST /api/user_id/{user_id}/purchase/verify": {Summary: "Grant an item purchased in the store", Request: game.StoreReceipt{}, Response: struct {
+		ReceiptID string `json:"receipt_id"`
+		ItemID    string `json:"item_id"`
+		Granted   bool   `json:"granted"`
+	}{}},
+	"POST /api/user_id/{user_id}/purchase/{item_id}": {Summary: "Purchase an item with the wallet", Response: game.Receipt{}},
+	"GET /api/user_id/{user_id}/pii":                 {Summary: "Personal information of the user", Response: game.UserPII{}},
+	"PUT /api/user_id/{user_id}/pii":                 {Summary: "Set personal information of the user", Request: game.UserPII{}, Response: empty{}},
+	"POST /api/user_id/{user_id}/grant": {
+		Summary: "Give items, currency and XP at once or nothing, only by admin callers, idempotent by grant_id",
+		Request: domain.Grant{}, Response: game.GrantResult{},
+	},
+	"GET /api/user_id/{user_id}/experiments": {Summary: "Variants of the experiments assigned to the user", Response: struct {
+		UserID      string            `json:"user_id"`
+		Experiments map[string]string `json:"experiments"`
+	}{}},
+	"GET /api/user_id/{user_id}/events": {Summary: "Server-Sent Events of item changes, replayed after Last-Event-ID, each data is the response", Response: domain.ItemChanged{}},
+	"GET /api/user_id/{user_id}/mailbox": {Summary: "Gifts, rewards and system messages to the user, newest first", Paginated: true, Response: struct {
+		Mails      []domain.Mail `json:"mails"`
+		NextCursor string        `json:"next_cursor"`
+	}{}},
+	"POST /api/user_id/{user_id}/mailbox/{mail_id}/ack": {Summary: "Mark the mail read, and claim its attachments if it has", Response: game.MailAck{}},
+	"GET /api/user_id/{user_id}/audit": {Summary: "Creations, updates and item changes of the user with who made them, newest first", Paginated: true, Response: struct {
+		Records    []game.AuditRecord `json:"records"`
+		NextCursor string             `json:"next_cursor"`
+	}{}},
+
+	"GET /api/items": {Summary: "List items of the catalog", Paginated: true, Response: struct {
+		Items      []domain.Item `json:"items"`
+		NextCursor string        `json:"next_cursor"`
+	}{}},
+	"POST /api/items":             {Summary: "Create an item, only by admin callers", Request: domain.Item{}, Response: domain.Item{}},
+	"GET /api/items/{item_id}":    {Summary: "Get an item", Response: domain.Item{}},
+	"PUT /api/items/{item_id}":    {Summary: "Update an item, only by admin callers", Request: domain.Item{}, Response: domain.Item{}},
+	"DELETE /api/items/{item_id}": {Summary: "Delete an item, unless it's owned, only by admin callers", Response: empty{}},
+
+	"GET /graphql":  {Summary: "GraphQL query by the query and operationName params", Response: graphqlResponse{}},
+	"POST /graphql": {Summary: "GraphQL query of users and their items", Request: graphqlRequest{}, Response: graphqlResponse{}},
+
+	"GET /admin/slo":   {Summary: "Error budgets of the SLOs", Response: []internal.SLOStatus{}},
+	"GET /admin/stats": {Summary: "Request stats of the recent windows", Response: internal.Stats{}},
+	"GET /admin/jobs":  {Summary: "Status of the scheduled jobs", Response: []internal.JobStatus{}},
+
+	"GET /admin/apikeys":             {Summary: "List api keys, including revoked ones", Response: []game.APIKey{}},
+	"POST /admin/apikeys":            {Summary: "Mint an api key, the key is shown only in this response", Request: apiKeyRequest{}, Response: apiKeyResponse{}},
+	"DELETE /admin/apikeys/{key_id}": {Summary: "Revoke an api key", Response: empty{}},
+
+	"POST /admin/items/{item_id}/revoke": {Summary: "Remove a recalled item from all users", Response: game.RevokeReport{}},
+	"POST /admin/import": {
+		Summary: "Load users and their items from newline delimited json of the request, progress lines are streamed and the last line is the report",
+		Request: game.ImportRecord{}, Response: game.ImportReport{},
+	},
+	"POST /admin/users/merge": mergeDoc,
+
+	"GET /admin/topology":    {Summary: "Configured dependencies and their health, ?format=mermaid for the diagram", Response: internal.TopologyView{}},
+	"GET /admin/topology/ui": {Summary: "Diagram of the topology, redrawn every 5 seconds"},
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"google.golang.org/api/iterator"
+
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+/*
+newCaptureWriter writes captured requests to CAPTURE_BUCKET, which is "bucket" or "bucket/prefix",
+an object of newline delimited json a batch, under the revision so captures of revisions can be told apart.
+*/
+func newCaptureWriter(gcs *storage.Client, location string) func(context.Context, []internal.ReplayRecord) error {
+	bucket, prefix, _ := strings.Cut(location, "/")
+	revision := rev
+	if revision == "" {
+		revision = "local"
+	}
+	return func(ctx context.Context, records []internal.ReplayRecord) error {
+		name := path.Join(prefix, revision, fmt.Sprintf("%s-%s.ndjson", time.Now().UTC().Format("20060102T150405"), uuid.NewString()[:8]))
+		// cancelling the context aborts the upload
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		w := gcs.Bucket(bucket).Object(name).NewWriter(wctx)
+		w.ContentType = "application/x-ndjson"
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	}
+}
+
+// repeated -header flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("header has to be like \"Name: value\", not %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(v))
+	return nil
+}
+
+/*
+replayCommand sends captured requests again to another environment and reports how differently they were answered, like
+"./main replay -target https://game-xxx.a.run.app -header 'Authorization: Bearer ...' gs://bucket/prefix/revision".
+Credentials are not captured, so they are given by -header for the target.
+*/
+func replayCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := flags.String("target", "", "base url of the environment to send the requests to")
+	concurrency := flags.Int("concurrency", 4, "how many requests are sent at once")
+	speed := flags.Float64("speed", 0, "pace relative to the capture, 1 is as they were captured, 0 is as fast as possible")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "header added to every request like \"Authorization: Bearer ...\", it can be repeated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" || flags.NArg() != 1 || *concurrency < 1 || *speed < 0 {
+		return fmt.Errorf("usage: replay -target <url> [-concurrency n] [-speed x] [-header h]... <gs://bucket/prefix or file>")
+	}
+
+	records, err := loadReplayRecords(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no captured requests in %s", flags.Arg(0))
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	report := replayRecords(ctx, client, strings.TrimSuffix(*target, "/"), http.Header(headers), records, *concurrency, *speed)
+	logger.Info("captured requests have been replayed",
+		"target", *target,
+		"requests", report.Requests,
+		"failed", report.Failed,
+		"status_mismatches", report.StatusMismatches,
+		"mismatches", report.Mismatches,
+		"captured_p50_ms", report.CapturedP50Ms,
+		"captured_p95_ms", report.CapturedP95Ms,
+		"replayed_p50_ms", report.ReplayedP50Ms,
+		"replayed_p95_ms", report.ReplayedP95Ms,
+	)
+	return ctx.Err()
+}
+
+// records of the objects under gs://bucket/prefix or of a local file, in the order they were captured
+func loadReplayRecords(ctx context.Context, location string) ([]internal.ReplayRecord, error) {
+	var records []internal.ReplayRecord
+	decode := func(r io.Reader, name string) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec internal.ReplayRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			records = append(records, rec)
+		}
+		return scanner.Err()
+	}
+
+	bucketPath, ok := strings.CutPrefix(location, "gs://")
+	if !ok {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := decode(f, location); err != nil {
+			return nil, err
+		}
+	} else {
+		gcs, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer gcs.Close()
+		bucket, prefix, _ := strings.Cut(bucketPath, "/")
+		objects := gcs.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := objects.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			r, err := gcs.Bucket(bucket).Object(attrs.Name).NewReader(ctx)
+			if err != nil {
+				return nil, err
+			}
+			err = decode(r, attrs.Name)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	return records, nil
+}
+
+type replayReport struct {
+	Requests int
+	// not answered at all, like refused connections or timeouts
+	Failed int
+	// answered with another status than the captured one
+	StatusMismatches int
+	// by "<method> <captured status>-><replayed status>"
+	Mismatches    map[string]int
+	CapturedP50Ms float64
+	CapturedP95Ms float64
+	ReplayedP50Ms float64
+	ReplayedP95Ms float64
+}
+
+// send the records to target in the order they were captured, at speed of the capture or as fast as possible if it's 0
+func replayRecords(ctx context.Context, client *http.Client, target string, header http.Header, records []internal.ReplayRecord, concurrency int, speed float64) replayReport {
+	report := replayReport{Mismatches: map[string]int{}}
+	var captured, replayed []float64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	start := time.Now()
+
+	for _, rec := range records {
+		if speed > 0 {
+			wait := time.Duration(float64(rec.At.Sub(records[0].At))/speed) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(rec internal.ReplayRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status, elapsed, err := sendReplay(ctx, client, target, header, rec)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Requests++
+			if err != nil {
+				report.Failed++
+				return
+			}
+			captured = append(captured, rec.DurationMs)
+			replayed = append(replayed, elapsed)
+			if status != rec.Status {
+				report.StatusMismatches++
+				report.Mismatches[fmt.Sprintf("%s %d->%d", rec.Method, rec.Status, status)]++
+			}
+		}(rec)
+	}
+	wg.Wait()
+
+	report.CapturedP50Ms, report.CapturedP95Ms = percentile(captured, 0.5), percentile(captured, 0.95)
+	report.ReplayedP50Ms, report.ReplayedP95Ms = percentile(replayed, 0.5), percentile(replayed, 0.95)
+	return report
+}
+
+// the status and milliseconds of the answer to the record
+func sendReplay(ctx context.Context, client *http.Client, target string, header http.Header, rec internal.ReplayRecord) (int, float64, error) {
+	url := target + rec.Path
+	if rec.Query != "" {
+		url += "?" + rec.Query
+	}
+	req, err := http.NewRequestWithContext(ctx, rec.Method, url, bytes.NewReader(rec.Body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, value := range rec.Header {
+		req.Header.Set(name, value)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, float64(time.Since(start).Nanoseconds()) / 1000000, nil
+}
+
+// nearest rank percentile, 0 if there is nothing
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if n < 0 {
+		n = 0
+	}
+	return sorted[n]
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/go-chi/render"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+type resetClient interface {
+	ResetGameData(context.Context) (map[string]int64, error)
+}
+
+type resetReport struct {
+	Tables        map[string]int64 `json:"tables"`
+	RedisKeys     int64            `json:"redis_keys"`
+	Subscriptions []string         `json:"subscriptions"`
+}
+
+/*
+resetWorkshop tears down the state of a workshop run, so the next one starts clean.
+It truncates game tables, flushes keys of this app in redis, and purges messages of RESET_SUBSCRIPTIONS by seeking them to now.
+Load fixtures after it, like "make seed", to have the demo users again.
+*/
+func resetWorkshop(ctx context.Context, client resetClient, cache *game.Caching, pubsubClient *pubsub.Client) (resetReport, error) {
+	report := resetReport{Subscriptions: []string{}}
+
+	tables, err := client.ResetGameData(ctx)
+	report.Tables = tables
+	if err != nil {
+		return report, err
+	}
+
+	// cache is flushed after tables, not to be filled again by requests in between
+	if cache != nil {
+		if report.RedisKeys, err = cache.FlushGameKeys(); err != nil {
+			return report, fmt.Errorf("redis: %w", err)
+		}
+	}
+
+	for _, name := range strings.Split(resetSubs, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if pubsubClient == nil {
+			return report, errors.New("pubsub client is required to purge subscriptions")
+		}
+		if err := pubsubClient.Subscription(name).SeekToTime(ctx, time.Now()); err != nil {
+			return report, fmt.Errorf("subscription %s: %w", name, err)
+		}
+		report.Subscriptions = append(report.Subscriptions, name)
+	}
+	return report, nil
+}
+
+// the last part of SPANNER_STRING, or "lite" in lite mode, which has to be given to confirm resetting it
+func databaseName() string {
+	if dbDriver == "lite" {
+		return "lite"
+	}
+	return path.Base(spannerString)
+}
+
+var resetDoc = internal.OpenAPIOperation{Summary: "Truncate game tables, flush redis and purge subscriptions, with ?confirm=<database>", Response: resetReport{}}
+
+/*
+resetHandler is POST /admin/reset?confirm=<database>, for admins only.
+The database name is required to confirm, not to reset another environment by mistake.
+*/
+func (s Serving) resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("confirm") != databaseName() {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("confirm with the database name, like ?confirm=%s", databaseName()))
+		return
+	}
+	report, err := s.Reset(r.Context())
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Warn("workshop has been reset", "tables", report.Tables, "redis_keys", report.RedisKeys, "subscriptions", report.Subscriptions)
+	render.JSON(w, r, report)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/google/uuid"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+smokeCommand exercises the critical path of a running deployment, and fails at the first step which doesn't work, like
+"./main smoke -base-url https://game-xxx.a.run.app -header 'Authorization: Bearer ...' -subscription smoke".
+It's for post-deploy hooks, the user it creates is deleted at the end.
+The change event is verified only with -subscription, a pull subscription of TOPIC_NAME only for smoke tests,
+as every message read from it is acked.
+*/
+func smokeCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("smoke", flag.ContinueOnError)
+	baseURL := flags.String("base-url", "", "base url of the deployment to verify")
+	itemID := flags.String("item", "", "item added to the user, the first one of /api/items if empty")
+	subscription := flags.String("subscription", "", "pull subscription of the topic of the deployment, the change event is not verified if empty")
+	project := flags.String("project", projectId, "project of the subscription")
+	timeout := flags.Duration("timeout", 60*time.Second, "how long all the steps can take")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "header added to every request like \"Authorization: Bearer ...\", it can be repeated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *baseURL == "" || flags.NArg() != 0 || *timeout <= 0 {
+		return fmt.Errorf("usage: smoke -base-url <url> [-item id] [-subscription name] [-timeout d] [-header h]...")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	var sub *pubsub.Subscription
+	if *subscription != "" {
+		pubsubClient, err := pubsub.NewClient(ctx, *project)
+		if err != nil {
+			return err
+		}
+		defer pubsubClient.Close()
+		sub = pubsubClient.Subscription(*subscription)
+	}
+
+	s := smoke{
+		client: &http.Client{Timeout: 10 * time.Second},
+		base:   strings.TrimSuffix(*baseURL, "/"),
+		header: http.Header(headers),
+	}
+	if err := s.run(ctx, *itemID, sub); err != nil {
+		return fmt.Errorf("smoke test of %s has failed: %w", *baseURL, err)
+	}
+	logger.Info("smoke test has passed", "base_url", *baseURL)
+	return nil
+}
+
+type smoke struct {
+	client *http.Client
+	base   string
+	header http.Header
+}
+
+// the steps in the order users take them, sub is nil not to verify the change event
+func (s smoke) run(ctx context.Context, itemID string, sub *pubsub.Subscription) error {
+	var user domain.User
+	err := s.step("create user", func() error {
+		_, err := s.do(ctx, http.MethodPost, "/api/user/smoke-"+uuid.NewString()[:8], &user)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// best effort, a user left behind doesn't fail the deployment
+	defer func() {
+		if _, err := s.do(context.WithoutCancel(ctx), http.MethodDelete, "/api/user/"+user.ID, nil); err != nil {
+			logger.Warn("smoke user couldn't be deleted", "user.id", game.HashID(user.ID), "error", err.Error())
+		}
+	}()
+
+	if itemID == "" {
+		err := s.step("list items", func() error {
+			var page struct {
+				Items []domain.Item `json:"items"`
+			}
+			if _, err := s.do(ctx, http.MethodGet, "/api/items?limit=1", &page); err != nil {
+				return err
+			}
+			if len(page.Items) == 0 {
+				return fmt.Errorf("no items to add, give one by -item")
+			}
+			itemID = page.Items[0].ID
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.step("add item", func() error {
+		_, err := s.do(ctx, http.MethodPut, fmt.Sprintf("/api/user_id/%s/%s", user.ID, itemID), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the first read fills the cache, unless it's written through, so the second one has to hit it
+	for n, want := range []string{"", "hit"} {
+		err := s.step(fmt.Sprintf("read items %d", n+1), func() error {
+			var items domain.Inventory
+			header, err := s.do(ctx, http.MethodGet, "/api/user_id/"+user.ID, &items)
+			if err != nil {
+				return err
+			}
+			if !ownsItem(items, itemID) {
+				return fmt.Errorf("item %s is not in the items of the user", itemID)
+			}
+			status := header.Get(cacheStatusHeader)
+			if status == "" || (want != "" && status != want) {
+				return fmt.Errorf("%s header is %q, not %q", cacheStatusHeader, status, want)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if sub == nil {
+		logger.Info("smoke step is skipped without -subscription", "step", "receive event")
+		return nil
+	}
+	return s.step("receive event", func() error {
+		return receiveItemChanged(ctx, sub, user.ID, itemID)
+	})
+}
+
+func (s smoke) step(name string, f func() error) error {
+	start := time.Now()
+	if err := f(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	logger.Info("smoke step has passed", "step", name, "elapsed_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// send the request and decode the json response to out if it's not nil, anything but 200 is an error
+func (s smoke) do(ctx context.Context, method, path string, out interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s is answered with %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return resp.Header, nil
+}
+
+func ownsItem(items domain.Inventory, itemID string) bool {
+	for _, item := range items {
+		if item.ItemID == itemID {
+			return true
+		}
+	}
+	return false
+}
+
+// wait for user_items_changed of the item added to the user, until ctx is done
+func receiveItemChanged(ctx context.Context, sub *pubsub.Subscription, userID, itemID string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var received atomic.Bool
+	err := sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		m.Ack()
+		if m.Attributes["event_type"] != "user_items_changed" {
+			return
+		}
+		var e domain.ItemChanged
+		if err := json.Unmarshal(m.Data, &e); err != nil {
+			return
+		}
+		if e.UserID == userID && e.ItemID == itemID && e.Type == domain.ItemAdded {
+			received.Store(true)
+			cancel()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !received.Load() {
+		return fmt.Errorf("user_items_changed of the item hasn't been received from %s", sub.ID())
+	}
+	return nil
+}
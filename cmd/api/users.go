@@ -0,0 +1,511 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+func (s Serving) getUserItems(w http.ResponseWriter, r *http.Request) {
+
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUserItems.root")
+	span.SetAttributes(attribute.String("server", "getUserItems"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	/* sample log related to span id */
+	traceWithLog(ctx, span).Str("method", "ok").Send()
+
+	// like ?staleness=max:10s, to compare the bounds without the cache
+	if config := r.URL.Query().Get("staleness"); config != "" {
+		staleness, err := game.ParseStaleness(config)
+		if err != nil {
+			errorRender(w, r, http.StatusBadRequest, err)
+			return
+		}
+		ctx = game.WithStaleness(ctx, staleness)
+	}
+
+	ctx, cacheStatus := game.WithCacheStatus(ctx)
+	results, err := s.Client.UserItems(ctx, w, userID)
+	// like "hit" or "miss", not set when the cache isn't looked up
+	if status := cacheStatus.String(); status != "" {
+		w.Header().Set(cacheStatusHeader, status)
+	}
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	span.SetAttributes(attribute.Int("result.item_count", len(results)))
+
+	// publish log, just for test
+	if s.Publisher != nil {
+		p := map[string]interface{}{"id": userID, "rev": rev}
+		eventID, _ := uuid.NewRandom()
+		if err := s.Publisher.Publish(ctx, "user_items_read", eventID.String(), p); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+
+	render.JSON(w, r, results)
+}
+
+// the same as getUserItems, a page of them by limit and cursor query params, for users owning many items
+func (s Serving) getUserItemsPage(w http.ResponseWriter, r *http.Request) {
+
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUserItemsPage.root")
+	span.SetAttributes(attribute.String("server", "getUserItemsPage"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cacheStatus := game.WithCacheStatus(ctx)
+	items, next, err := s.Client.UserItemsPage(ctx, w, userID, limit, r.URL.Query().Get("cursor"))
+	if status := cacheStatus.String(); status != "" {
+		w.Header().Set(cacheStatusHeader, status)
+	}
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"items": items, "next_cursor": next})
+}
+
+// the body of POST /api/user
+type createUserRequest struct {
+	Name string `json:"name"`
+}
+
+// create a user of the name in the body, which can be any name the validation rules allow, unlike the one in the path
+func (s Serving) createUserByBody(w http.ResponseWriter, r *http.Request) {
+	var body createUserRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	s.newUser(w, r, body.Name)
+}
+
+func (s Serving) createUser(w http.ResponseWriter, r *http.Request) {
+	s.newUser(w, r, chi.URLParam(r, "user_name"))
+}
+
+func (s Serving) newUser(w http.ResponseWriter, r *http.Request, userName string) {
+	userId, _ := uuid.NewRandom()
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "createUser.root")
+	span.SetAttributes(attribute.String("server", "createUser"))
+	defer span.End()
+
+	user, err := domain.NewUser(userId.String(), userName)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.Client.CreateUser(ctx, w, game.UserParams{UserID: user.ID, UserName: user.Name})
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, user)
+}
+
+func (s Serving) listUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "listUsers.root")
+	span.SetAttributes(attribute.String("server", "listUsers"))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	users, next, err := s.Client.ListUsers(ctx, w, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"users": users, "next_cursor": next})
+}
+
+// limit query param of list APIs, 0 means the default
+func pageLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	return limit, nil
+}
+
+func (s Serving) updateUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "updateUser.root")
+	span.SetAttributes(attribute.String("server", "updateUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	// the ETag of the profile the client has read, not to overwrite changes it hasn't seen
+	version, err := ifMatchVersion(r)
+	if errors.Is(err, errNoIfMatch) {
+		errorRender(w, r, http.StatusPreconditionRequired, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	var patch game.UserPatch
+	if err := render.DecodeJSON(r.Body, &patch); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	profile, err := s.Client.UpdateUser(ctx, w, userID, version, patch)
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, game.ErrVersionConflict) {
+		errorRender(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("ETag", profileETag(profile))
+	render.JSON(w, r, profile)
+}
+
+var errNoIfMatch = errors.New("If-Match is required, with the ETag of the profile")
+
+// the version in If-Match, AnyVersion for "*"
+func ifMatchVersion(r *http.Request) (int64, error) {
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch etag {
+	case "":
+		return 0, errNoIfMatch
+	case "*":
+		return game.AnyVersion, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), 10, 64)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("If-Match %s is not an ETag of a profile", etag)
+	}
+	return version, nil
+}
+
+func profileETag(profile domain.Profile) string {
+	return strconv.Quote(strconv.FormatInt(profile.Version, 10))
+}
+
+func (s Serving) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteUser.root")
+	span.SetAttributes(attribute.String("server", "deleteUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	// it's out of the user routes, which are authorized by AuthorizeUser
+	if !s.Authorizer.CanModify(internal.IdentityFromContext(ctx), userID) {
+		errorRender(w, r, http.StatusForbidden, errors.New("token subject is not the user to delete"))
+		return
+	}
+
+	err := s.Client.DeleteUser(ctx, w, game.UserParams{UserID: userID})
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]string{})
+}
+
+func (s Serving) addItemToUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "addItemToUser.root")
+	span.SetAttributes(attribute.String("server", "addItemToUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	// how many of the item to add, one if it's not given
+	var quantity int64
+	if v := r.URL.Query().Get("quantity"); v != "" {
+		var err error
+		if quantity, err = strconv.ParseInt(v, 10, 64); err != nil || quantity <= 0 {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("quantity must be a positive integer"))
+			return
+		}
+	}
+
+	err := s.Client.AddItemToUser(ctx, w, game.UserParams{UserID: userID}, game.ItemParams{ItemID: itemID, Quantity: quantity})
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]string{})
+}
+
+// body is a json array of item ids, the response has the result of each of them
+func (s Serving) addItemsToUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "addItemsToUser.root")
+	span.SetAttributes(attribute.String("server", "addItemsToUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	var itemIDs []string
+	if err := render.DecodeJSON(r.Body, &itemIDs); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := s.Client.AddItemsToUser(ctx, w, game.UserParams{UserID: userID}, itemIDs)
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"results": results})
+}
+
+func (s Serving) removeItemFromUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "removeItemFromUser.root")
+	span.SetAttributes(attribute.String("server", "removeItemFromUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	err := s.Client.RemoveItemFromUser(ctx, w, game.UserParams{UserID: userID}, game.ItemParams{ItemID: itemID})
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]string{})
+}
+
+func (s Serving) getProfile(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getProfile.root")
+	span.SetAttributes(attribute.String("server", "getProfile"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	profile, err := s.Client.UserProfile(ctx, w, userID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("ETag", profileETag(profile))
+	render.JSON(w, r, profile)
+}
+
+// since is synced_at of the last response, in RFC 3339
+func (s Serving) syncUserItems(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "syncUserItems.root")
+	span.SetAttributes(attribute.String("server", "syncUserItems"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("since has to be a timestamp in RFC 3339: %w", err))
+			return
+		}
+	}
+
+	delta, err := s.Client.SyncUserItems(ctx, w, userID, since)
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, delta)
+}
+
+func (s Serving) getUserAudit(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUserAudit.root")
+	span.SetAttributes(attribute.String("server", "getUserAudit"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	records, next, err := s.Client.UserAudit(ctx, w, userID, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"records": records, "next_cursor": next})
+}
+
+func (s Serving) getUserPII(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUserPII.root")
+	span.SetAttributes(attribute.String("server", "getUserPII"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	pii, err := s.Client.UserPII(ctx, w, userID)
+	if spanner.ErrCode(err) == codes.NotFound {
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, game.ErrEncryptionDisabled) {
+		errorRender(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, pii)
+}
+
+func (s Serving) setUserPII(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "setUserPII.root")
+	span.SetAttributes(attribute.String("server", "setUserPII"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	var pii game.UserPII
+	if err := render.DecodeJSON(r.Body, &pii); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err := s.Client.SetUserPII(ctx, w, userID, pii)
+	if errors.Is(err, game.ErrEncryptionDisabled) {
+		errorRender(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]string{})
+}
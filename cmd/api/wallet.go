@@ -0,0 +1,194 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+func (s Serving) getWallet(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getWallet.root")
+	span.SetAttributes(attribute.String("server", "getWallet"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	wallet, err := s.Client.WalletBalance(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, wallet)
+}
+
+func (s Serving) creditWallet(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	amount, err := strconv.ParseInt(chi.URLParam(r, "amount"), 10, 64)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "creditWallet.root")
+	span.SetAttributes(attribute.String("server", "creditWallet"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	// the request id is recorded in the ledger, to trace an entry back to the request log
+	wallet, err := s.Client.CreditWallet(ctx, w, userID, amount, domain.LedgerCredit, middleware.GetReqID(ctx))
+	if errors.Is(err, domain.ErrInvalid) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, wallet)
+}
+
+func (s Serving) getWalletLedger(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getWalletLedger.root")
+	span.SetAttributes(attribute.String("server", "getWalletLedger"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, next, err := s.Client.WalletLedger(ctx, w, userID, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, game.ErrInvalidCursor) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"entries": entries, "next_cursor": next})
+}
+
+func (s Serving) purchaseItem(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "purchaseItem.root")
+	span.SetAttributes(attribute.String("server", "purchaseItem"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	receipt, err := s.Client.PurchaseItem(ctx, w, game.UserParams{UserID: userID}, game.ItemParams{ItemID: itemID})
+	if errors.Is(err, game.ErrInsufficientBalance) {
+		errorRender(w, r, http.StatusPaymentRequired, err)
+		return
+	}
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, receipt)
+}
+
+// body is a grant, see domain.Grant, a retry with the same grant_id gives nothing and answers granted false
+func (s Serving) grantToUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grantToUser.root")
+	span.SetAttributes(attribute.String("server", "grantToUser"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	var body domain.Grant
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	grant, err := domain.NewGrant(body.GrantID, body.Source, body.ItemIDs, body.Currency, body.XP)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := s.Client.GrantToUser(ctx, w, userID, grant)
+	switch {
+	case errors.Is(err, domain.ErrInvalid):
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	case spanner.ErrCode(err) == codes.NotFound:
+		errorRender(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, game.ErrGrantIDReused), spanner.ErrCode(err) == codes.AlreadyExists:
+		errorRender(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, result)
+}
+
+func (s Serving) verifyPurchase(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "verifyPurchase.root")
+	span.SetAttributes(attribute.String("server", "verifyPurchase"), attribute.String("user.id", game.HashID(userID)))
+	defer span.End()
+
+	var receipt game.StoreReceipt
+	if err := render.DecodeJSON(r.Body, &receipt); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	purchase, err := s.Verifier.Verify(ctx, receipt)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	granted, err := s.Client.RecordPurchase(ctx, w, game.UserParams{UserID: userID}, purchase)
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{
+		"receipt_id": purchase.ReceiptID,
+		"item_id":    purchase.ItemID,
+		"granted":    granted,
+	})
+}
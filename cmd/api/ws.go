@@ -0,0 +1,43 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+
+	internal "github.com/shin5ok/go-architecting-workshop/cmd/api/internal"
+)
+
+/*
+wsRouter routes websocket apart from the API, as its timeout and response metrics don't fit long-lived connections.
+It's not in the OpenAPI document either.
+*/
+func (s Serving) wsRouter(httpLogger zerolog.Logger) http.Handler {
+	ws := chi.NewRouter()
+	ws.Use(middleware.RequestID)
+	ws.Use(requestLogger(httpLogger))
+	ws.Use(middleware.Recoverer)
+	ws.Use(s.Authorizer.Authenticate)
+	ws.Group(func(u chi.Router) {
+		u.Use(s.Authorizer.AuthorizeUser("user_id"))
+		u.Get("/ws/user/{user_id:[a-z0-9-.]+}", internal.UserEventsHandler(s.Events, "user_id"))
+	})
+	return ws
+}
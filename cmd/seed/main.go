@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Seed loads yaml fixtures into the database of SPANNER_STRING, like
+
+	go run ./cmd/seed fixtures/workshop.yaml
+
+Files are merged in the order of args. It's idempotent, so it's also the step to reset the workshop data.
+*/
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"cloud.google.com/go/spanner"
+
+	"github.com/shin5ok/go-architecting-workshop/fixtures"
+)
+
+var (
+	spannerString = os.Getenv("SPANNER_STRING")
+	logger        = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+)
+
+func main() {
+	files := os.Args[1:]
+	if len(files) == 0 {
+		files = []string{"fixtures/workshop.yaml"}
+	}
+
+	// check fixtures before connecting, not to wait for Spanner to report a typo
+	f, err := fixtures.ReadFiles(files...)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	client, err := spanner.NewClient(ctx, spannerString)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	if err := fixtures.Load(ctx, client, f); err != nil {
+		logger.Error(err.Error())
+		client.Close()
+		os.Exit(1)
+	}
+	logger.Info("fixtures are loaded",
+		"files", files,
+		"items", len(f.Items),
+		"users", len(f.Users),
+		"user_items", len(f.UserItems),
+		"wallets", len(f.Wallets),
+	)
+}
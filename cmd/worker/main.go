@@ -0,0 +1,277 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Worker consumes events published by the api from a Pub/Sub subscription,
+and applies them with the inbox table, so redelivered messages are not applied twice.
+Each message is traced as a root span linked to the span which published it, as they can be far apart in time.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+
+	game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/telemetry"
+)
+
+var (
+	spannerString    = os.Getenv("SPANNER_STRING")
+	projectId        = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	subscriptionName = os.Getenv("SUBSCRIPTION_NAME")
+	redisHost        = os.Getenv("REDIS_HOST")        // optional, to apply cache invalidation events
+	redisMode        = os.Getenv("REDIS_MODE")        // "cluster" or "sentinel", the same as the api
+	redisMaster      = os.Getenv("REDIS_MASTER_NAME") // the master watched by Sentinels
+	redisPassword    = os.Getenv("REDIS_PASSWORD")
+	redisStandby     = os.Getenv("REDIS_STANDBY_HOST") // the same as the api, invalidations are applied to it as well
+	cacheEpoch       = os.Getenv("CACHE_EPOCH")        // the same as the api, invalidations miss otherwise
+	dependencies     = os.Getenv("DEPENDENCIES")       // the same as the api, see game.Dependencies
+	traceExporter    = os.Getenv("TRACE_EXPORTER")     // the same as the api, see telemetry.ParseTraceExporter
+	otlpEndpoint     = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	otlpHeaders      = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	sampler          = os.Getenv("OTEL_TRACES_SAMPLER") // the same as the api, see telemetry.ParseSampler
+	samplerArg       = os.Getenv("OTEL_TRACES_SAMPLER_ARG")
+	rev              = os.Getenv("K_REVISION")
+	idHashSalt       = os.Getenv("ID_HASH_SALT") // the same as the api, to tell the same users in logs of both
+	rawIDs           = os.Getenv("DEBUG_RAW_IDS") != ""
+	logger           = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+)
+
+func main() {
+
+	// Receive returns after outstanding messages are handled when ctx is cancelled
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if err := game.ConfigureIDHashing(idHashSalt, rawIDs); err != nil {
+		// the same as the api, deployed ones must not run without it
+		if rev != "" {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Warn(err.Error())
+	}
+
+	tp, err := newTracer(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	// ctx is already done when it's called, so give it a fresh one to flush spans
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		tp.Shutdown(ctx)
+	}()
+
+	deps, err := game.ParseDependencies(dependencies)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	client, err := game.NewClient(ctx, spannerString, nil)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	defer client.Sc.Close()
+	client.Timeout = time.Duration(deps.Spanner.Timeout)
+
+	pubsubClient, err := pubsub.NewClient(ctx, projectId)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	defer pubsubClient.Close()
+
+	var caches []*game.Caching
+	for _, host := range []string{redisHost, redisStandby} {
+		if host == "" {
+			continue
+		}
+		redisConfig, err := game.ParseRedisConfig(redisMode, host, redisMaster, redisPassword)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		rdb := game.NewRedisClient(redisConfig, deps.Redis)
+		defer rdb.Close()
+		// the revision of the worker is not the one of the api, so the epoch has to be given explicitly
+		caches = append(caches, &game.Caching{RedisClient: rdb, Epoch: game.CacheEpoch{Current: cacheEpoch}})
+	}
+
+	sub := pubsubClient.Subscription(subscriptionName)
+	logger.Info("Starting to receive events", "subscription", subscriptionName)
+
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		eventID := m.Attributes["event_id"]
+		eventType := m.Attributes["event_type"]
+		if eventID == "" {
+			// published before event ids were introduced
+			eventID = m.ID
+		}
+
+		ctx, span := startConsumeSpan(ctx, m, eventType, eventID)
+		defer span.End()
+
+		if eventType == "user_items_changed" && len(caches) > 0 {
+			var e domain.ItemChanged
+			if err := json.Unmarshal(m.Data, &e); err != nil {
+				logger.Error(err.Error(), "event_id", eventID)
+			} else {
+				for _, cache := range caches {
+					if ok, err := cache.InvalidateUserItems(e); err != nil {
+						logger.Warn(err.Error(), "event_id", eventID)
+					} else if !ok {
+						logger.Info("stale change event, ignored", "event_id", eventID)
+					}
+				}
+			}
+		}
+
+		if eventType == game.MailEventType {
+			if err := depositMail(ctx, client, eventID, m.Data); err != nil {
+				logger.Error(err.Error(), "event_id", eventID)
+				span.RecordError(err)
+				span.SetStatus(otelcodes.Error, err.Error())
+				span.SetAttributes(attribute.String("job.outcome", "nack"))
+				m.Nack()
+				return
+			}
+		}
+
+		applied, err := client.RecordEventAnalytics(ctx, eventID, eventType, m.Data)
+		if err != nil {
+			logger.Error(err.Error(), "event_id", eventID)
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+			span.SetAttributes(attribute.String("job.outcome", "nack"))
+			m.Nack()
+			return
+		}
+		if !applied {
+			logger.Info("duplicated event, skipped", "event_id", eventID)
+			span.SetAttributes(attribute.String("job.outcome", "duplicated"))
+		} else {
+			span.SetAttributes(attribute.String("job.outcome", "ack"))
+		}
+		m.Ack()
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+/*
+depositMail puts the mail of the event into the mailbox of the user, the event id is the mail id unless it's given.
+Mails which are broken or of unknown users are logged and dropped, as redelivering them doesn't fix them,
+so the error is only of the ones which can be retried.
+*/
+func depositMail(ctx context.Context, client mailDepositor, eventID string, data []byte) error {
+	var body domain.Mail
+	if err := json.Unmarshal(data, &body); err != nil {
+		logger.Error("broken mail, dropped", "event_id", eventID, "error", err.Error())
+		return nil
+	}
+	if body.MailID == "" {
+		body.MailID = eventID
+	}
+	mail, err := domain.NewMail(body.UserID, body.MailID, body.Kind, body.Subject, body.Body, body.ItemIDs, body.Currency, body.XP)
+	if err != nil {
+		logger.Error("broken mail, dropped", "event_id", eventID, "error", err.Error())
+		return nil
+	}
+	deposited, err := client.DepositMail(ctx, mail)
+	if spanner.ErrCode(err) == codes.NotFound {
+		logger.Warn("mail to an unknown user, dropped", "event_id", eventID, "user.id", game.HashID(mail.UserID))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !deposited {
+		logger.Info("mail is deposited already", "event_id", eventID)
+	}
+	return nil
+}
+
+type mailDepositor interface {
+	DepositMail(context.Context, domain.Mail) (bool, error)
+}
+
+/*
+startConsumeSpan starts the root span of a message, linked to the publish span of the api.
+The attempt is known only when the subscription has a dead letter policy, it's 0 otherwise.
+*/
+func startConsumeSpan(ctx context.Context, m *pubsub.Message, eventType, eventID string) (context.Context, trace.Span) {
+	published := otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(m.Attributes))
+	attempt := 0
+	if m.DeliveryAttempt != nil {
+		attempt = *m.DeliveryAttempt
+	}
+	return otel.Tracer("worker").Start(ctx, "process "+eventType,
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.LinkFromContext(published)),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "pubsub"),
+			attribute.String("messaging.message_id", m.ID),
+			attribute.String("job.name", eventType),
+			attribute.Int("job.attempt", attempt),
+			attribute.String("event.id", eventID),
+		),
+	)
+}
+
+// by the same config as the api's, but in the name of the worker
+func newTracer(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter, err := telemetry.ParseTraceExporter(traceExporter)
+	if err != nil {
+		return nil, err
+	}
+	traceSampler, err := telemetry.ParseSampler(sampler, samplerArg)
+	if err != nil {
+		return nil, err
+	}
+	return telemetry.NewTracer(ctx, telemetry.Config{
+		TraceExporter: exporter,
+		Sampler:       traceSampler,
+		ProjectID:     projectId,
+		OTLPEndpoint:  otlpEndpoint,
+		OTLPHeaders:   otlpHeaders,
+		ServiceName:   "game-worker",
+		Revision:      rev,
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+/*
+readWriteTransaction runs f in a read-write transaction tagged by name, with commit stats returned.
+The mutation count and how long it took to commit are recorded as metrics and attributes of the current span,
+to show what bulk operations cost. The duration includes retries of aborted transactions, which are counted, and the ones by the Retrier.
+*/
+func (d dbClient) readWriteTransaction(ctx context.Context, name string, f func(context.Context, *spanner.ReadWriteTransaction) error) (spanner.CommitResponse, error) {
+	start := time.Now()
+	done := budget.Track(ctx, budget.Spanner)
+	var resp spanner.CommitResponse
+	err := d.retry(ctx, name, func(ctx context.Context) (err error) {
+		// the client runs f again when an attempt is aborted, so attempts beyond the first one were aborted
+		attempts := 0
+		resp, err = d.Sc.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			attempts++
+			return f(ctx, txn)
+		}, spanner.TransactionOptions{
+			TransactionTag: fmt.Sprintf("func=%s,env=dev", name),
+			CommitOptions:  spanner.CommitOptions{ReturnCommitStats: true},
+		})
+		if attempts > 1 {
+			spannerAborts.WithLabelValues(name).Add(float64(attempts - 1))
+		}
+		return err
+	})
+	done()
+	if err != nil {
+		return resp, err
+	}
+
+	elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+	commitDuration.WithLabelValues(name).Observe(elapsed)
+	commitDurationHistogram.Record(ctx, elapsed, metric.WithAttributes(attribute.String("txn", name)))
+	attrs := []attribute.KeyValue{attribute.Float64("spanner.commit.duration_ms", elapsed)}
+	// the emulator doesn't return commit stats
+	if resp.CommitStats != nil {
+		mutations := resp.CommitStats.GetMutationCount()
+		commitMutations.WithLabelValues(name).Observe(float64(mutations))
+		attrs = append(attrs, attribute.Int64("spanner.commit.mutations", mutations))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+	return resp, nil
+}
+
+// the same as Client.Apply, with commit stats
+func (d dbClient) apply(ctx context.Context, name string, ms []*spanner.Mutation) error {
+	_, err := d.readWriteTransaction(ctx, name, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return txn.BufferWrite(ms)
+	})
+	return err
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+counters are split into CounterShards rows of the same name, and a write goes to one of them at random,
+so a counter incremented by every request doesn't make a single row hot, like users.item_count would be if it were global.
+The value is the sum of the shards, it's as consistent as the read, but costs a scan of CounterShards rows.
+*/
+const CounterShards = 16
+
+// CounterItemsGranted counts items granted to any user, by adding, batches, purchases or projections of events
+const CounterItemsGranted = "items_granted"
+
+// EventCounter is the name of the counter of events of the type recorded by RecordEventAnalytics
+func EventCounter(eventType string) string {
+	return "events_" + eventType
+}
+
+// addCounter adds delta to a shard of the counter in the transaction, the shard is created if it's not there yet
+func addCounter(ctx context.Context, txn *spanner.ReadWriteTransaction, name string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	shard := rand.Int63n(CounterShards)
+	var count int64
+	row, err := txn.ReadRow(ctx, "counters", spanner.Key{name, shard}, []string{"count"})
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+	case err != nil:
+		return err
+	default:
+		if err := row.Columns(&count); err != nil {
+			return err
+		}
+	}
+	return txn.BufferWrite([]*spanner.Mutation{
+		spanner.InsertOrUpdateMap("counters", map[string]interface{}{
+			"name":       name,
+			"shard":      shard,
+			"count":      count + delta,
+			"updated_at": spanner.CommitTimestamp,
+		}),
+	})
+}
+
+// AddCounter adds delta to the counter in its own transaction, for the ones not bound to other writes
+func (d dbClient) AddCounter(ctx context.Context, name string, delta int64) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AddCounter")
+	defer span.End()
+	span.SetAttributes(attribute.String("counter.name", name))
+
+	if name == "" || len(name) > 128 {
+		return fmt.Errorf("%w: name of a counter has to be 1 to 128 characters", domain.ErrInvalid)
+	}
+	_, err := d.readWriteTransaction(ctx, "AddCounter", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return addCounter(ctx, txn, name, delta)
+	})
+	return err
+}
+
+// Counter sums the shards of the counter, 0 if it's never been added
+func (d dbClient) Counter(ctx context.Context, name string) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Counter")
+	defer span.End()
+	span.SetAttributes(attribute.String("counter.name", name))
+
+	stmt := spanner.Statement{
+		SQL:    `SELECT IFNULL(SUM(count), 0) FROM counters WHERE name = @name`,
+		Params: map[string]interface{}{"name": name},
+	}
+	var total int64
+	err := d.ForEachRow(ctx, "Counter", stmt, func(row *spanner.Row) error {
+		return row.Columns(&total)
+	})
+	return total, err
+}
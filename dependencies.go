@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+/*
+Dependencies is how long calls to Spanner, Redis and Pub/Sub wait and how they are retried, in one place for all the wrappers.
+It's read by ParseDependencies from json like
+{"spanner":{"timeout":"5s","retry":"3/50ms/1s"},"redis":{"read_timeout":"200ms"},"pubsub":{"publish_timeout":"10s"}},
+fields which are not set are of DefaultDependencies.
+*/
+type Dependencies struct {
+	Spanner SpannerPolicy `json:"spanner"`
+	Redis   RedisPolicy   `json:"redis"`
+	PubSub  PubSubPolicy  `json:"pubsub"`
+}
+
+type SpannerPolicy struct {
+	// deadline of each attempt of a call, only the one of the request if zero
+	Timeout Duration `json:"timeout"`
+	// see ParseRetrier, "off" to call once
+	Retry string `json:"retry"`
+	// see ParseBreaker, "off" to call whatever happens
+	Breaker string `json:"breaker"`
+}
+
+type RedisPolicy struct {
+	PoolSize     int      `json:"pool_size"`
+	PoolTimeout  Duration `json:"pool_timeout"`
+	DialTimeout  Duration `json:"dial_timeout"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	// retries of a command by the client, with backoff between min and max
+	MaxRetries      int      `json:"max_retries"`
+	MinRetryBackoff Duration `json:"min_retry_backoff"`
+	MaxRetryBackoff Duration `json:"max_retry_backoff"`
+	// interval of pings which tell the health of the cache, see CacheHealth
+	HealthInterval Duration `json:"health_interval"`
+}
+
+type PubSubPolicy struct {
+	// how long a message is retried to be published before it fails
+	PublishTimeout Duration `json:"publish_timeout"`
+	// messages are sent in a batch when it has CountThreshold of them, or after DelayThreshold
+	DelayThreshold Duration `json:"delay_threshold"`
+	CountThreshold int      `json:"count_threshold"`
+}
+
+/*
+DefaultDependencies are what the wrappers used before they were configurable.
+Redis is a cache, its commands are not retried but fall back to Spanner, see Caching.
+*/
+var DefaultDependencies = Dependencies{
+	Spanner: SpannerPolicy{
+		Retry:   "3/50ms/1s",
+		Breaker: "5,10s,3s",
+	},
+	Redis: RedisPolicy{
+		PoolSize:        10,
+		PoolTimeout:     Duration(30 * time.Second),
+		DialTimeout:     Duration(1 * time.Second),
+		ReadTimeout:     Duration(3 * time.Second),
+		WriteTimeout:    Duration(3 * time.Second),
+		MaxRetries:      0,
+		MinRetryBackoff: Duration(8 * time.Millisecond),
+		MaxRetryBackoff: Duration(512 * time.Millisecond),
+		HealthInterval:  Duration(5 * time.Second),
+	},
+	PubSub: PubSubPolicy{
+		PublishTimeout: Duration(60 * time.Second),
+		DelayThreshold: Duration(10 * time.Millisecond),
+		CountThreshold: 100,
+	},
+}
+
+// ParseDependencies reads config as json over DefaultDependencies, it's them if empty
+func ParseDependencies(config string) (Dependencies, error) {
+	deps := DefaultDependencies
+	if config == "" {
+		return deps, nil
+	}
+	if err := json.Unmarshal([]byte(config), &deps); err != nil {
+		return Dependencies{}, fmt.Errorf("dependencies: %w", err)
+	}
+	return deps, deps.Validate()
+}
+
+// Validate checks the policies can be used, retry and breaker of Spanner are parsed as they will be
+func (deps Dependencies) Validate() error {
+	if _, err := ParseRetrier(deps.Spanner.Retry); err != nil {
+		return fmt.Errorf("spanner: %w", err)
+	}
+	if _, err := ParseBreaker(deps.Spanner.Breaker); err != nil {
+		return fmt.Errorf("spanner: %w", err)
+	}
+	for name, d := range map[string]Duration{
+		"spanner.timeout":         deps.Spanner.Timeout,
+		"redis.pool_timeout":      deps.Redis.PoolTimeout,
+		"redis.dial_timeout":      deps.Redis.DialTimeout,
+		"redis.read_timeout":      deps.Redis.ReadTimeout,
+		"redis.write_timeout":     deps.Redis.WriteTimeout,
+		"redis.min_retry_backoff": deps.Redis.MinRetryBackoff,
+		"redis.max_retry_backoff": deps.Redis.MaxRetryBackoff,
+		"pubsub.delay_threshold":  deps.PubSub.DelayThreshold,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	if deps.Redis.PoolSize < 1 || deps.Redis.HealthInterval <= 0 {
+		return fmt.Errorf("redis: pool_size and health_interval have to be positive")
+	}
+	if deps.Redis.MaxRetries < 0 {
+		return fmt.Errorf("redis: max_retries can't be negative")
+	}
+	if deps.PubSub.PublishTimeout <= 0 || deps.PubSub.CountThreshold < 1 {
+		return fmt.Errorf("pubsub: publish_timeout and count_threshold have to be positive")
+	}
+	return nil
+}
+
+// Options of a client of a single redis at addr, like a read replica
+func (p RedisPolicy) Options(addr, password string) *redis.Options {
+	return &redis.Options{
+		Addr:            addr,
+		Password:        password,
+		DB:              0,
+		PoolSize:        p.PoolSize,
+		PoolTimeout:     time.Duration(p.PoolTimeout),
+		DialTimeout:     time.Duration(p.DialTimeout),
+		ReadTimeout:     time.Duration(p.ReadTimeout),
+		WriteTimeout:    time.Duration(p.WriteTimeout),
+		MaxRetries:      p.MaxRetries,
+		MinRetryBackoff: time.Duration(p.MinRetryBackoff),
+		MaxRetryBackoff: time.Duration(p.MaxRetryBackoff),
+	}
+}
+
+// Duration is time.Duration written like "1s" in json
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration has to be a string like \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+/*
+Package domain has types of the game shared by handlers, repositories and events.
+Values are made by constructors which check invariants, so a value of these types can be trusted
+without validating it again wherever it's passed.
+*/
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalid is wrapped by every error of broken invariants, callers can treat it as a bad request
+	ErrInvalid             = errors.New("invalid")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
+
+const maxIDLength = 36
+
+func invalid(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, a...))
+}
+
+func checkID(kind, id string) error {
+	if id == "" {
+		return invalid("%s id is required", kind)
+	}
+	if len(id) > maxIDLength {
+		return invalid("%s id is longer than %d", kind, maxIDLength)
+	}
+	// Spanner rejects it, and json replaces it
+	if !utf8.ValidString(id) {
+		return invalid("%s id is not valid UTF-8", kind)
+	}
+	return nil
+}
+
+func checkName(kind, name string, maxLength int) error {
+	if name == "" {
+		return invalid("%s name is required", kind)
+	}
+	if len(name) > maxLength {
+		return invalid("%s name is longer than %d", kind, maxLength)
+	}
+	if !utf8.ValidString(name) {
+		return invalid("%s name is not valid UTF-8", kind)
+	}
+	return nil
+}
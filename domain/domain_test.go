@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUser(t *testing.T) {
+	u, err := NewUser("a1b2", "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, User{ID: "a1b2", Name: "alice"}, u)
+
+	_, err = NewUser("", "alice")
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewUser(strings.Repeat("x", 37), "alice")
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewUser("a1b2", "")
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestNameRules(t *testing.T) {
+	defer func(rules NameRules) { nameRules = rules }(nameRules)
+
+	assert.Nil(t, CheckUserName("アリス"))
+	assert.NotNil(t, SetNameRules(NameRules{MaxLength: 1000}))
+	assert.NotNil(t, SetNameRules(NameRules{Chars: "emoji"}))
+
+	assert.Nil(t, SetNameRules(NameRules{MaxLength: 8, Chars: NameCharsASCII}))
+	assert.Nil(t, CheckUserName("alice"))
+	assert.True(t, errors.Is(CheckUserName("アリス"), ErrInvalid))
+	assert.True(t, errors.Is(CheckUserName("alice-and-bob"), ErrInvalid))
+
+	// zero fields are left as they are
+	assert.Nil(t, SetNameRules(NameRules{Chars: NameCharsAlnum}))
+	assert.Equal(t, 8, nameRules.MaxLength)
+	assert.True(t, errors.Is(CheckUserName("alice!"), ErrInvalid))
+
+	// names stored before are still read
+	_, err := NewUser("a1b2", "アリス!")
+	assert.Nil(t, err)
+}
+
+func TestNewItem(t *testing.T) {
+	i, err := NewItem("i1", "sword", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, Item{ID: "i1", Name: "sword", Price: 100}, i)
+
+	_, err = NewItem("i1", "", 100)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewItem("i1", strings.Repeat("x", 65), 100)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewItem("i1", "sword", -1)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestWallet(t *testing.T) {
+	_, err := NewWallet("a1b2", -1)
+	assert.True(t, errors.Is(err, ErrInvalid))
+
+	w, err := NewWallet("a1b2", 100)
+	assert.Nil(t, err)
+
+	w, err = w.Credit(50)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(150), w.Balance)
+
+	_, err = w.Debit(151)
+	assert.True(t, errors.Is(err, ErrInsufficientBalance))
+
+	w, err = w.Debit(150)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), w.Balance)
+
+	_, err = w.Credit(0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = w.Debit(-1)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestNewGrant(t *testing.T) {
+	g, err := NewGrant("quest-1", GrantQuest, []string{"i1", "i2"}, 100, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"i1", "i2"}, g.ItemIDs)
+
+	_, err = NewGrant("", GrantQuest, []string{"i1"}, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewGrant("quest-1", "lottery", []string{"i1"}, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewGrant("quest-1", GrantQuest, []string{"i1", "i1"}, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewGrant("quest-1", GrantQuest, nil, -1, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewGrant("quest-1", GrantQuest, nil, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestNewMail(t *testing.T) {
+	m, err := NewMail("a1b2", "m1", MailGift, "welcome", "", []string{"i1"}, 100, 0)
+	assert.Nil(t, err)
+	g, ok := m.Grant()
+	assert.True(t, ok)
+	assert.Equal(t, "mail-m1", g.GrantID)
+	assert.Equal(t, GrantMail, g.Source)
+
+	m, err = NewMail("a1b2", "m2", MailSystem, "maintenance", "tonight", nil, 0, 0)
+	assert.Nil(t, err)
+	_, ok = m.Grant()
+	assert.False(t, ok)
+
+	// a gift of nothing, a system mail with something, and an unknown kind
+	_, err = NewMail("a1b2", "m3", MailGift, "empty", "", nil, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewMail("a1b2", "m3", MailSystem, "coins", "", nil, 100, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewMail("a1b2", "m3", "letter", "hello", "", nil, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewMail("a1b2", "m3", MailSystem, "", "", nil, 0, 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestNewLedgerEntry(t *testing.T) {
+	now := time.Now()
+	e, err := NewLedgerEntry("a1b2", "e1", -100, 50, LedgerPurchase, "r1", now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-100), e.Amount)
+
+	_, err = NewLedgerEntry("a1b2", "e1", 0, 50, LedgerCredit, "", now)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewLedgerEntry("a1b2", "e1", 100, -1, LedgerCredit, "", now)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewLedgerEntry("a1b2", "e1", 100, 100, "", "", now)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestInventory(t *testing.T) {
+	inv := Inventory{}
+	inv = inv.With(OwnedItem{UserName: "alice", ItemName: "sword", ItemID: "i1"})
+	inv = inv.With(OwnedItem{UserName: "alice", ItemName: "shield", ItemID: "i2"})
+	inv = inv.With(OwnedItem{UserName: "alice", ItemName: "sword+1", ItemID: "i1"})
+	assert.Len(t, inv, 2)
+	assert.True(t, inv.Has("i1"))
+
+	inv = inv.Without("i1")
+	assert.Len(t, inv, 1)
+	assert.False(t, inv.Has("i1"))
+	assert.True(t, inv.Has("i2"))
+
+	item, err := NewOwnedItem("alice", "potion", "i3", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), item.Quantity)
+	_, err = NewOwnedItem("alice", "potion", "i3", 0)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestNewItemChanged(t *testing.T) {
+	e, err := NewItemChanged("a1b2", 3, "i1", ItemAdded)
+	assert.Nil(t, err)
+	assert.Equal(t, "a1b2-3", e.ID())
+
+	_, err = NewItemChanged("a1b2", 0, "i1", ItemAdded)
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = NewItemChanged("a1b2", 1, "i1", "item_sold")
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+import "fmt"
+
+const (
+	ItemAdded   = "item_added"
+	ItemRemoved = "item_removed"
+)
+
+/*
+ItemChanged tells that items of a user have been changed.
+Seq increases monotonically per user in the same transaction as the change,
+so consumers can ignore events older than the one they have already seen.
+*/
+type ItemChanged struct {
+	UserID string `json:"user_id"`
+	Seq    int64  `json:"seq"`
+	ItemID string `json:"item_id"`
+	Type   string `json:"type"`
+}
+
+func NewItemChanged(userID string, seq int64, itemID string, changeType string) (ItemChanged, error) {
+	if err := checkID("user", userID); err != nil {
+		return ItemChanged{}, err
+	}
+	if err := checkID("item", itemID); err != nil {
+		return ItemChanged{}, err
+	}
+	if seq <= 0 {
+		return ItemChanged{}, invalid("seq must be positive")
+	}
+	if changeType != ItemAdded && changeType != ItemRemoved {
+		return ItemChanged{}, invalid("unknown change type %q", changeType)
+	}
+	return ItemChanged{UserID: userID, Seq: seq, ItemID: itemID, Type: changeType}, nil
+}
+
+// unique per change, brokers can deduplicate with it
+func (e ItemChanged) ID() string {
+	return fmt.Sprintf("%s-%d", e.UserID, e.Seq)
+}
@@ -0,0 +1,153 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+/*
+Fuzz targets of the validators and the payloads cached or published as json.
+Run one like "go test -fuzz=FuzzNewUser ./domain/", failing inputs are saved under testdata/fuzz
+and they are run as regression tests by go test.
+*/
+
+func FuzzNewUser(f *testing.F) {
+	f.Add("d169f397-ba3f-413b-bc3c-a465576ef06e", "test-user")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, id, name string) {
+		u, err := NewUser(id, name)
+		if err != nil {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("error is not ErrInvalid: %v", err)
+			}
+			return
+		}
+		// a valid user is stored and cached as it is
+		data, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded User
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != u {
+			t.Fatalf("%+v is decoded as %+v", u, decoded)
+		}
+	})
+}
+
+func FuzzNewItem(f *testing.F) {
+	f.Add("d169f397-ba3f-413b-bc3c-a465576ef06e", "sword", int64(100))
+	f.Add("item", "", int64(-1))
+	f.Fuzz(func(t *testing.T, id, name string, price int64) {
+		item, err := NewItem(id, name, price)
+		if err != nil {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("error is not ErrInvalid: %v", err)
+			}
+			return
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Item
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != item {
+			t.Fatalf("%+v is decoded as %+v", item, decoded)
+		}
+	})
+}
+
+func FuzzWallet(f *testing.F) {
+	f.Add(int64(100), int64(30), true)
+	f.Add(int64(math.MaxInt64), int64(1), true)
+	f.Fuzz(func(t *testing.T, balance, amount int64, credit bool) {
+		w, err := NewWallet("user", balance)
+		if err != nil {
+			return
+		}
+		var changed Wallet
+		if credit {
+			changed, err = w.Credit(amount)
+		} else {
+			changed, err = w.Debit(amount)
+		}
+		if err != nil {
+			if changed != w {
+				t.Fatalf("wallet is changed on error: %v", err)
+			}
+			return
+		}
+		if changed.Balance < 0 {
+			t.Fatalf("balance %d is negative after %d to %d", changed.Balance, amount, balance)
+		}
+	})
+}
+
+// user items are cached as json, an entry written by another version or broken has to be rejected, not to crash
+func FuzzInventoryJSON(f *testing.F) {
+	f.Add([]byte(`[{"user_name":"test-user","item_name":"sword","item_id":"d169f397-ba3f-413b-bc3c-a465576ef06e"}]`), "d169f397-ba3f-413b-bc3c-a465576ef06e")
+	f.Add([]byte(`null`), "")
+	f.Add([]byte(`[{}]`), "")
+	f.Fuzz(func(t *testing.T, data []byte, itemID string) {
+		inv := Inventory{}
+		if err := json.Unmarshal(data, &inv); err != nil {
+			return
+		}
+		item, err := NewOwnedItem("test-user", "sword", itemID, 1)
+		if err != nil {
+			return
+		}
+		without := inv.Without(itemID)
+		if without.Has(itemID) {
+			t.Fatalf("%q is still in %+v", itemID, without)
+		}
+		with := inv.With(item)
+		if !with.Has(itemID) || len(with) != len(without)+1 {
+			t.Fatalf("%q is not added once to %+v", itemID, with)
+		}
+
+		// patched entries are written back, they have to be read as they are
+		patched, err := json.Marshal(with)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := Inventory{}
+		if err := json.Unmarshal(patched, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, with) {
+			t.Fatalf("%+v is decoded as %+v", with, decoded)
+		}
+	})
+}
+
+// events are published as json and consumed by the worker to invalidate cache
+func FuzzItemChangedJSON(f *testing.F) {
+	f.Add([]byte(`{"user_id":"u1","seq":1,"item_id":"i1","type":"item_added"}`))
+	f.Add([]byte(`{"seq":-1}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var e ItemChanged
+		if err := json.Unmarshal(data, &e); err != nil {
+			return
+		}
+		// consumers validate decoded events by the constructor
+		valid, err := NewItemChanged(e.UserID, e.Seq, e.ItemID, e.Type)
+		if err != nil {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("error is not ErrInvalid: %v", err)
+			}
+			return
+		}
+		if valid != e || valid.ID() == "" {
+			t.Fatalf("%+v is not the same as %+v", valid, e)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+import "unicode/utf8"
+
+// subsystems which give grants
+const (
+	GrantReward   = "reward"
+	GrantQuest    = "quest"
+	GrantPurchase = "purchase"
+	// claims of mails with attachments, see Mail
+	GrantMail = "mail"
+)
+
+const (
+	// the same as MaxBatchItems, a grant is a batch which isn't partially added
+	maxGrantItems = 100
+	// ids are decided by the subsystems, like a receipt id, so they may be longer than ours
+	maxGrantIDLength = 64
+)
+
+/*
+Grant is a bundle of items, currency and XP given to a user all or nothing.
+GrantID is decided by the subsystem which gives it, like "quest-<quest id>-<user id>",
+so the same grant is given once however many times it's retried.
+*/
+type Grant struct {
+	GrantID  string   `json:"grant_id"`
+	Source   string   `json:"source"`
+	ItemIDs  []string `json:"items,omitempty"`
+	Currency int64    `json:"currency,omitempty"`
+	XP       int64    `json:"xp,omitempty"`
+}
+
+func NewGrant(grantID, source string, itemIDs []string, currency, xp int64) (Grant, error) {
+	if grantID == "" {
+		return Grant{}, invalid("grant id is required")
+	}
+	if len(grantID) > maxGrantIDLength || !utf8.ValidString(grantID) {
+		return Grant{}, invalid("grant id is longer than %d or not valid UTF-8", maxGrantIDLength)
+	}
+	switch source {
+	case GrantReward, GrantQuest, GrantPurchase, GrantMail:
+	default:
+		return Grant{}, invalid("unknown source of grant %q", source)
+	}
+	if len(itemIDs) > maxGrantItems {
+		return Grant{}, invalid("up to %d items can be granted at once", maxGrantItems)
+	}
+	seen := map[string]bool{}
+	for _, itemID := range itemIDs {
+		if err := checkID("item", itemID); err != nil {
+			return Grant{}, err
+		}
+		if seen[itemID] {
+			return Grant{}, invalid("item %s is duplicated in the grant", itemID)
+		}
+		seen[itemID] = true
+	}
+	if currency < 0 || xp < 0 {
+		return Grant{}, invalid("currency and xp of grant can't be negative")
+	}
+	if len(itemIDs) == 0 && currency == 0 && xp == 0 {
+		return Grant{}, invalid("grant has nothing to give")
+	}
+	return Grant{GrantID: grantID, Source: source, ItemIDs: itemIDs, Currency: currency, XP: xp}, nil
+}
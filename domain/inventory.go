@@ -0,0 +1,44 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+// Inventory is items owned by a user, an item appears at most once
+type Inventory []OwnedItem
+
+// With returns a new inventory having item, it replaces the one of the same id
+func (inv Inventory) With(item OwnedItem) Inventory {
+	return append(inv.Without(item.ItemID), item)
+}
+
+// Without returns a new inventory without the item
+func (inv Inventory) Without(itemID string) Inventory {
+	result := make(Inventory, 0, len(inv)+1)
+	for _, item := range inv {
+		if item.ItemID != itemID {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (inv Inventory) Has(itemID string) bool {
+	for _, item := range inv {
+		if item.ItemID == itemID {
+			return true
+		}
+	}
+	return false
+}
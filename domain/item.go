@@ -0,0 +1,56 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+const maxItemNameLength = 64
+
+type Item struct {
+	ID    string `json:"item_id"`
+	Name  string `json:"item_name"`
+	Price int64  `json:"price"`
+}
+
+func NewItem(id, name string, price int64) (Item, error) {
+	if err := checkID("item", id); err != nil {
+		return Item{}, err
+	}
+	if err := checkName("item", name, maxItemNameLength); err != nil {
+		return Item{}, err
+	}
+	if price < 0 {
+		return Item{}, invalid("price of item %s is negative", id)
+	}
+	return Item{ID: id, Name: name, Price: price}, nil
+}
+
+// OwnedItem is an item owned by a user, the json is the same as the response of user items
+type OwnedItem struct {
+	UserName string `json:"user_name"`
+	ItemName string `json:"item_name"`
+	ItemID   string `json:"item_id"`
+	// how many of the item the user has, items stack instead of being owned twice
+	Quantity int64 `json:"quantity"`
+}
+
+func NewOwnedItem(userName, itemName, itemID string, quantity int64) (OwnedItem, error) {
+	if err := checkID("item", itemID); err != nil {
+		return OwnedItem{}, err
+	}
+	if quantity < 1 {
+		return OwnedItem{}, invalid("quantity of item %s is %d, not positive", itemID, quantity)
+	}
+	return OwnedItem{UserName: userName, ItemName: itemName, ItemID: itemID, Quantity: quantity}, nil
+}
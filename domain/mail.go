@@ -0,0 +1,96 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// kinds of mails
+const (
+	MailGift   = "gift"
+	MailReward = "reward"
+	MailSystem = "system"
+)
+
+const (
+	maxMailSubjectLength = 128
+	maxMailBodyLength    = 4096
+)
+
+/*
+Mail is an entry of the mailbox of a user, deposited by the worker from events directed to the user.
+Gifts and rewards have items, currency or XP attached, which are given when the mail is claimed,
+a system mail has nothing attached and is just read.
+*/
+type Mail struct {
+	UserID    string    `json:"user_id"`
+	MailID    string    `json:"mail_id"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body,omitempty"`
+	ItemIDs   []string  `json:"items,omitempty"`
+	Currency  int64     `json:"currency,omitempty"`
+	XP        int64     `json:"xp,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// nil until the mail is acknowledged, ClaimedAt stays nil for mails without attachments
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+}
+
+func NewMail(userID, mailID, kind, subject, body string, itemIDs []string, currency, xp int64) (Mail, error) {
+	if err := checkID("user", userID); err != nil {
+		return Mail{}, err
+	}
+	if err := checkID("mail", mailID); err != nil {
+		return Mail{}, err
+	}
+	if subject == "" || len(subject) > maxMailSubjectLength || !utf8.ValidString(subject) {
+		return Mail{}, invalid("subject of mail %s is empty, longer than %d or not valid UTF-8", mailID, maxMailSubjectLength)
+	}
+	if len(body) > maxMailBodyLength || !utf8.ValidString(body) {
+		return Mail{}, invalid("body of mail %s is longer than %d or not valid UTF-8", mailID, maxMailBodyLength)
+	}
+	m := Mail{UserID: userID, MailID: mailID, Kind: kind, Subject: subject, Body: body, ItemIDs: itemIDs, Currency: currency, XP: xp}
+	switch kind {
+	case MailGift, MailReward:
+		// the attachment is checked as the grant it is claimed by
+		if _, err := NewGrant(m.grantID(), GrantMail, itemIDs, currency, xp); err != nil {
+			return Mail{}, err
+		}
+	case MailSystem:
+		if len(itemIDs) > 0 || currency != 0 || xp != 0 {
+			return Mail{}, invalid("system mail %s can't have attachments", mailID)
+		}
+	default:
+		return Mail{}, invalid("unknown kind of mail %q", kind)
+	}
+	return m, nil
+}
+
+// Grant is what claiming the mail gives, false for mails without attachments
+func (m Mail) Grant() (Grant, bool) {
+	if m.Kind == MailSystem {
+		return Grant{}, false
+	}
+	return Grant{GrantID: m.grantID(), Source: GrantMail, ItemIDs: m.ItemIDs, Currency: m.Currency, XP: m.XP}, true
+}
+
+// mail ids have to be unique across users as grant ids do, like the ids of the events they are deposited from
+func (m Mail) grantID() string {
+	return "mail-" + m.MailID
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// characters allowed in user names
+const (
+	// any valid UTF-8, as it has always been
+	NameCharsAny = "any"
+	// no control or invisible characters
+	NameCharsPrintable = "printable"
+	// letters and digits of any language, with space, "-", "_" and "."
+	NameCharsAlnum = "alnum"
+	// printable ASCII, for platforms which can't show the others
+	NameCharsASCII = "ascii"
+)
+
+/*
+NameRules are the rules of user names which differ by deployment, like a shorter limit for a small screen.
+They are set once at start by SetNameRules, before any input is taken.
+*/
+type NameRules struct {
+	MaxLength int    `json:"max_name_length"`
+	Chars     string `json:"name_chars"`
+}
+
+var nameRules = NameRules{MaxLength: maxUserNameLength, Chars: NameCharsAny}
+
+// SetNameRules replaces the rules, zero fields are left as they are
+func SetNameRules(rules NameRules) error {
+	if rules.MaxLength < 0 || rules.MaxLength > maxUserNameLength {
+		return fmt.Errorf("max name length has to be 1 to %d, the size of the column", maxUserNameLength)
+	}
+	if rules.MaxLength == 0 {
+		rules.MaxLength = nameRules.MaxLength
+	}
+	switch rules.Chars {
+	case "":
+		rules.Chars = nameRules.Chars
+	case NameCharsAny, NameCharsPrintable, NameCharsAlnum, NameCharsASCII:
+	default:
+		return fmt.Errorf("unknown name chars %q", rules.Chars)
+	}
+	nameRules = rules
+	return nil
+}
+
+// CheckUserName checks the name by the rules, it's what NewUser checks
+func CheckUserName(name string) error {
+	if err := checkName("user", name, nameRules.MaxLength); err != nil {
+		return err
+	}
+	for _, r := range name {
+		if !allowedInName(r, nameRules.Chars) {
+			return invalid("user name has %q, which is not allowed", r)
+		}
+	}
+	return nil
+}
+
+func allowedInName(r rune, chars string) bool {
+	switch chars {
+	case NameCharsPrintable:
+		return unicode.IsPrint(r)
+	case NameCharsAlnum:
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || r == '-' || r == '_' || r == '.'
+	case NameCharsASCII:
+		return r >= 0x20 && r <= 0x7e
+	}
+	return true
+}
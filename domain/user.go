@@ -0,0 +1,61 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+const maxUserNameLength = 64
+
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func NewUser(id, name string) (User, error) {
+	if err := checkID("user", id); err != nil {
+		return User{}, err
+	}
+	if err := checkName("user", name, maxUserNameLength); err != nil {
+		return User{}, err
+	}
+	return User{ID: id, Name: name}, nil
+}
+
+/*
+Profile is a user with summaries of the user.
+Version is incremented by every change of the profile, to be given back as If-Match not to overwrite a change of another client.
+*/
+type Profile struct {
+	User
+	ItemCount int64 `json:"item_count"`
+	XP        int64 `json:"xp"`
+	Version   int64 `json:"version"`
+}
+
+func NewProfile(id, name string, itemCount, xp, version int64) (Profile, error) {
+	u, err := NewUser(id, name)
+	if err != nil {
+		return Profile{}, err
+	}
+	if itemCount < 0 {
+		return Profile{}, invalid("item count is negative")
+	}
+	if xp < 0 {
+		return Profile{}, invalid("xp is negative")
+	}
+	if version < 0 {
+		return Profile{}, invalid("version is negative")
+	}
+	return Profile{User: u, ItemCount: itemCount, XP: xp, Version: version}, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package domain
+
+import (
+	"math"
+	"time"
+)
+
+// Wallet of a user, the balance never gets negative
+type Wallet struct {
+	UserID  string `json:"user_id"`
+	Balance int64  `json:"balance"`
+}
+
+func NewWallet(userID string, balance int64) (Wallet, error) {
+	if err := checkID("user", userID); err != nil {
+		return Wallet{}, err
+	}
+	if balance < 0 {
+		return Wallet{}, invalid("balance is negative")
+	}
+	return Wallet{UserID: userID, Balance: balance}, nil
+}
+
+// Credit returns the wallet added amount, which must be positive
+func (w Wallet) Credit(amount int64) (Wallet, error) {
+	if amount <= 0 {
+		return w, invalid("amount to credit must be positive")
+	}
+	if amount > math.MaxInt64-w.Balance {
+		return w, invalid("balance overflows by the amount to credit")
+	}
+	w.Balance += amount
+	return w, nil
+}
+
+// Debit returns the wallet subtracted amount, which must be positive and not more than the balance
+func (w Wallet) Debit(amount int64) (Wallet, error) {
+	if amount <= 0 {
+		return w, invalid("amount to debit must be positive")
+	}
+	if amount > w.Balance {
+		return w, ErrInsufficientBalance
+	}
+	w.Balance -= amount
+	return w, nil
+}
+
+// reasons of ledger entries
+const (
+	LedgerCredit   = "credit"
+	LedgerPurchase = "purchase"
+	LedgerRefund   = "refund"
+	LedgerGrant    = "grant"
+	LedgerMerge    = "merge"
+)
+
+// LedgerEntry is an immutable record of a change of a wallet, Balance is the one after the change
+type LedgerEntry struct {
+	UserID      string    `json:"user_id"`
+	EntryID     string    `json:"entry_id"`
+	Amount      int64     `json:"amount"`
+	Balance     int64     `json:"balance"`
+	Reason      string    `json:"reason"`
+	ReferenceID string    `json:"reference_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func NewLedgerEntry(userID, entryID string, amount, balance int64, reason, referenceID string, createdAt time.Time) (LedgerEntry, error) {
+	if err := checkID("user", userID); err != nil {
+		return LedgerEntry{}, err
+	}
+	if err := checkID("ledger entry", entryID); err != nil {
+		return LedgerEntry{}, err
+	}
+	if amount == 0 {
+		return LedgerEntry{}, invalid("amount of ledger entry is zero")
+	}
+	if balance < 0 {
+		return LedgerEntry{}, invalid("balance is negative")
+	}
+	if reason == "" {
+		return LedgerEntry{}, invalid("reason of ledger entry is required")
+	}
+	return LedgerEntry{
+		UserID:      userID,
+		EntryID:     entryID,
+		Amount:      amount,
+		Balance:     balance,
+		Reason:      reason,
+		ReferenceID: referenceID,
+		CreatedAt:   createdAt,
+	}, nil
+}
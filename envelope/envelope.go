@@ -0,0 +1,214 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package envelope encrypts small fields like email with envelope encryption.
+Each value is encrypted by its own data key with AES-GCM,
+and the data key is wrapped by a key encryption key, which is Cloud KMS in production.
+*/
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// KeyWrapper wraps and unwraps data keys with a key encryption key
+type KeyWrapper interface {
+	Wrap(context.Context, []byte) ([]byte, error)
+	Unwrap(context.Context, []byte) ([]byte, error)
+}
+
+// Sealed is what is stored instead of the plain value
+type Sealed struct {
+	WrappedKey []byte `json:"k"`
+	Nonce      []byte `json:"n"`
+	Ciphertext []byte `json:"c"`
+}
+
+type Envelope struct {
+	Wrapper KeyWrapper
+}
+
+// Seal encrypts plaintext and returns it encoded as json, to be stored as a BYTES column
+func (e Envelope) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := encrypt(dek, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := e.Wrapper.Wrap(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Sealed{WrappedKey: wrapped, Nonce: nonce, Ciphertext: ciphertext})
+}
+
+// Open decrypts what Seal returned
+func (e Envelope) Open(ctx context.Context, sealed []byte) ([]byte, error) {
+	var s Sealed
+	if err := json.Unmarshal(sealed, &s); err != nil {
+		return nil, err
+	}
+
+	dek, err := e.Wrapper.Unwrap(ctx, s.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(dek, s.Nonce, s.Ciphertext)
+}
+
+/*
+Rewrap wraps the data key again with the current key encryption key,
+after the key is rotated, without touching the ciphertext.
+*/
+func (e Envelope) Rewrap(ctx context.Context, sealed []byte) ([]byte, error) {
+	var s Sealed
+	if err := json.Unmarshal(sealed, &s); err != nil {
+		return nil, err
+	}
+
+	dek, err := e.Wrapper.Unwrap(ctx, s.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if s.WrappedKey, err = e.Wrapper.Wrap(ctx, dek); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+func encrypt(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+/*
+KMSWrapper wraps data keys with Cloud KMS.
+KeyName is a crypto key, not a version, so Wrap always uses the primary version,
+and Unwrap works with any enabled version. That is how rotation works with Rewrap.
+*/
+type KMSWrapper struct {
+	Client  *kms.KeyManagementClient
+	KeyName string
+}
+
+func NewKMSWrapper(ctx context.Context, keyName string) (*KMSWrapper, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &KMSWrapper{Client: client, KeyName: keyName}, nil
+}
+
+func (w *KMSWrapper) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	res, err := w.Client.Encrypt(ctx, &kmspb.EncryptRequest{Name: w.KeyName, Plaintext: dek})
+	if err != nil {
+		return nil, err
+	}
+	return res.Ciphertext, nil
+}
+
+func (w *KMSWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	res, err := w.Client.Decrypt(ctx, &kmspb.DecryptRequest{Name: w.KeyName, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
+
+func (w *KMSWrapper) Close() error {
+	return w.Client.Close()
+}
+
+/*
+LocalWrapper wraps data keys with a static key, for local development without KMS.
+Keys holds the current key first and older keys after it, to be able to unwrap after rotation.
+*/
+type LocalWrapper struct {
+	Keys [][]byte
+}
+
+func (w LocalWrapper) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	if len(w.Keys) == 0 {
+		return nil, errors.New("no key")
+	}
+	nonce, ciphertext, err := encrypt(w.Keys[0], dek)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func (w LocalWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	for _, key := range w.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) < gcm.NonceSize() {
+			return nil, errors.New("invalid wrapped key")
+		}
+		if dek, err := gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil); err == nil {
+			return dek, nil
+		}
+	}
+	return nil, errors.New("no key can unwrap it")
+}
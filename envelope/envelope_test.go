@@ -0,0 +1,44 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	ctx := context.Background()
+	e := Envelope{Wrapper: LocalWrapper{Keys: [][]byte{bytes.Repeat([]byte{1}, 32)}}}
+
+	sealed, err := e.Seal(ctx, []byte("foo@example.com"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(sealed), "foo@example.com")
+
+	plain, err := e.Open(ctx, sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo@example.com", string(plain))
+}
+
+func TestRewrap(t *testing.T) {
+	ctx := context.Background()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	sealed, err := Envelope{Wrapper: LocalWrapper{Keys: [][]byte{oldKey}}}.Seal(ctx, []byte("external-id"))
+	assert.Nil(t, err)
+
+	// rotated, the old key is kept to unwrap
+	rotated := Envelope{Wrapper: LocalWrapper{Keys: [][]byte{newKey, oldKey}}}
+	rewrapped, err := rotated.Rewrap(ctx, sealed)
+	assert.Nil(t, err)
+
+	// the old key is retired
+	retired := Envelope{Wrapper: LocalWrapper{Keys: [][]byte{newKey}}}
+	_, err = retired.Open(ctx, sealed)
+	assert.NotNil(t, err)
+	plain, err := retired.Open(ctx, rewrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, "external-id", string(plain))
+}
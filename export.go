@@ -0,0 +1,84 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+type UserItemRow struct {
+	UserID    string    `json:"user_id"`
+	ItemID    string    `json:"item_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/*
+ExportUserItems reads the whole user_items table with partitioned query,
+each partition is executed in parallel up to maxParallel at the same timestamp.
+fn is called concurrently from multiple goroutines, so it has to be goroutine safe.
+It's for analytics reads like export or BigQuery load, not for serving requests.
+*/
+func (d dbClient) ExportUserItems(ctx context.Context, maxParallel int, fn func(UserItemRow) error) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ExportUserItems")
+	defer span.End()
+
+	txn, err := d.Sc.BatchReadOnlyTransaction(ctx, spanner.StrongRead())
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Close()
+
+	stmt := spanner.Statement{SQL: `SELECT user_id, item_id, created_at, updated_at FROM user_items`}
+	partitions, err := txn.PartitionQueryWithOptions(ctx, stmt, spanner.PartitionOptions{}, spanner.QueryOptions{RequestTag: "func=ExportUserItems,env=dev,action=query"})
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int("export.partitions", len(partitions)))
+
+	var count int64
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxParallel)
+	for _, p := range partitions {
+		p := p
+		g.Go(func() error {
+			open := func(ctx context.Context) *spanner.RowIterator { return txn.Execute(ctx, p) }
+			return eachRow(ctx, "ExportUserItems", open, func(row *spanner.Row) error {
+				var r UserItemRow
+				if err := row.Columns(&r.UserID, &r.ItemID, &r.CreatedAt, &r.UpdatedAt); err != nil {
+					return err
+				}
+				if err := fn(r); err != nil {
+					return err
+				}
+				atomic.AddInt64(&count, 1)
+				return nil
+			})
+		})
+	}
+
+	err = g.Wait()
+	span.SetAttributes(attribute.Int64("export.rows", count))
+	return count, err
+}
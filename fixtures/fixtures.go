@@ -0,0 +1,251 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package fixtures loads declarative yaml fixtures into Spanner, like
+
+	items:
+	  - item_id: d169f397-ba3f-413b-bc3c-a465576ef06e
+	    item_name: sword
+	    price: 100
+	users:
+	  - user_id: 1a2b3c4d-0000-4000-8000-000000000001
+	    name: alice
+	user_items:
+	  - user_id: 1a2b3c4d-0000-4000-8000-000000000001
+	    item_id: d169f397-ba3f-413b-bc3c-a465576ef06e
+	wallets:
+	  - user_id: 1a2b3c4d-0000-4000-8000-000000000001
+	    balance: 1000
+
+Rows are validated by the domain constructors, and the columns are checked against the embedded schemas,
+so a fixture fails before writing anything if the API would reject it or the schema has drifted.
+Loading is idempotent, rows are written by insert-or-update, so loading the same fixture again resets them.
+Rows which are not in the fixture are kept as they are, and nothing in the cache is touched.
+*/
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"gopkg.in/yaml.v3"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/schemas"
+)
+
+type User struct {
+	UserID string `yaml:"user_id"`
+	Name   string `yaml:"name"`
+}
+
+type Item struct {
+	ItemID   string `yaml:"item_id"`
+	ItemName string `yaml:"item_name"`
+	Price    int64  `yaml:"price"`
+}
+
+type UserItem struct {
+	UserID string `yaml:"user_id"`
+	ItemID string `yaml:"item_id"`
+}
+
+type Wallet struct {
+	UserID  string `yaml:"user_id"`
+	Balance int64  `yaml:"balance"`
+}
+
+// Fixture is written in the order of the fields, parents first for foreign keys and interleaving
+type Fixture struct {
+	Items     []Item     `yaml:"items"`
+	Users     []User     `yaml:"users"`
+	UserItems []UserItem `yaml:"user_items"`
+	Wallets   []Wallet   `yaml:"wallets"`
+}
+
+// Parse reads a fixture strictly, unknown tables and columns are errors not to be ignored silently
+func Parse(data []byte) (Fixture, error) {
+	var f Fixture
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return Fixture{}, fmt.Errorf("%w: %s", domain.ErrInvalid, err)
+	}
+	if err := f.validate(); err != nil {
+		return Fixture{}, err
+	}
+	return f, nil
+}
+
+// ReadFiles merges fixtures in the files, a row of a later file overrides the same key of an earlier one
+func ReadFiles(paths ...string) (Fixture, error) {
+	var merged Fixture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Fixture{}, err
+		}
+		f, err := Parse(data)
+		if err != nil {
+			return Fixture{}, fmt.Errorf("%s: %w", path, err)
+		}
+		merged.Items = append(merged.Items, f.Items...)
+		merged.Users = append(merged.Users, f.Users...)
+		merged.UserItems = append(merged.UserItems, f.UserItems...)
+		merged.Wallets = append(merged.Wallets, f.Wallets...)
+	}
+	return merged, nil
+}
+
+func (f Fixture) validate() error {
+	for _, i := range f.Items {
+		if _, err := domain.NewItem(i.ItemID, i.ItemName, i.Price); err != nil {
+			return err
+		}
+	}
+	for _, u := range f.Users {
+		if _, err := domain.NewUser(u.UserID, u.Name); err != nil {
+			return err
+		}
+	}
+	for _, ui := range f.UserItems {
+		// as the change adding the item, which has the same ids as user_items
+		if _, err := domain.NewItemChanged(ui.UserID, 1, ui.ItemID, domain.ItemAdded); err != nil {
+			return err
+		}
+	}
+	for _, w := range f.Wallets {
+		if _, err := domain.NewWallet(w.UserID, w.Balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mutations of the fixture, created_at and updated_at are set to now
+func (f Fixture) Mutations(now time.Time) ([]*spanner.Mutation, error) {
+	expected, err := schemas.Expected()
+	if err != nil {
+		return nil, err
+	}
+
+	mutations := []*spanner.Mutation{}
+	add := func(table string, columns []string, values []interface{}) error {
+		if err := checkColumns(expected, table, columns); err != nil {
+			return err
+		}
+		mutations = append(mutations, spanner.InsertOrUpdate(table, columns, values))
+		return nil
+	}
+
+	for _, i := range f.Items {
+		err := add("items",
+			[]string{"item_id", "item_name", "price", "created_at", "updated_at"},
+			[]interface{}{i.ItemID, i.ItemName, i.Price, now, now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// item_count is left to the default on insert, and recounted after loading
+	for _, u := range f.Users {
+		err := add("users",
+			[]string{"user_id", "name", "created_at", "updated_at"},
+			[]interface{}{u.UserID, u.Name, now, now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ui := range f.UserItems {
+		err := add("user_items",
+			[]string{"user_id", "item_id", "created_at", "updated_at"},
+			[]interface{}{ui.UserID, ui.ItemID, now, now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, w := range f.Wallets {
+		err := add("wallets",
+			[]string{"user_id", "balance", "created_at", "updated_at"},
+			[]interface{}{w.UserID, w.Balance, now, now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mutations, nil
+}
+
+func checkColumns(expected schemas.Schema, table string, columns []string) error {
+	t, ok := expected.Tables[table]
+	if !ok {
+		return fmt.Errorf("table %s is not in the schemas", table)
+	}
+	for _, c := range columns {
+		if _, ok := t.Columns[c]; !ok {
+			return fmt.Errorf("column %s.%s is not in the schemas", table, c)
+		}
+	}
+	return nil
+}
+
+/*
+Load writes the fixture in a transaction, then recounts item_count of the users whose items are in the fixture.
+They are not in a transaction together, as DML doesn't see mutations buffered in the same transaction,
+but loading again fixes item_count if it fails in between.
+A fixture has to be within the mutation limit of a commit, which is large enough for workshop data.
+*/
+func Load(ctx context.Context, client *spanner.Client, f Fixture) error {
+	mutations, err := f.Mutations(time.Now())
+	if err != nil {
+		return err
+	}
+	if len(mutations) == 0 {
+		return nil
+	}
+	if _, err := client.Apply(ctx, mutations); err != nil {
+		return err
+	}
+
+	userIDs := []string{}
+	seen := map[string]bool{}
+	for _, ui := range f.UserItems {
+		if !seen[ui.UserID] {
+			seen[ui.UserID] = true
+			userIDs = append(userIDs, ui.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	_, err = client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		stmt := spanner.Statement{
+			SQL: `UPDATE users SET item_count = (SELECT COUNT(*) FROM user_items WHERE user_items.user_id = users.user_id)
+			  WHERE user_id IN UNNEST(@userIDs)`,
+			Params: map[string]interface{}{
+				"userIDs": userIDs,
+			},
+		}
+		_, err := txn.UpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=fixtures.Load,env=dev,action=update"})
+		return err
+	})
+	return err
+}
@@ -0,0 +1,61 @@
+package fixtures
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/schemas"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFiles(t *testing.T) {
+	f, err := ReadFiles("workshop.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, f.Users, 3)
+	assert.Equal(t, User{UserID: "0b7a5e3c-1f2d-4c6e-9a8b-000000000001", Name: "alice"}, f.Users[0])
+	assert.Len(t, f.UserItems, 3)
+	assert.Equal(t, int64(10000), f.Wallets[1].Balance)
+
+	mutations, err := f.Mutations(time.Now())
+	assert.Nil(t, err)
+	assert.Len(t, mutations, 9)
+
+	_, err = ReadFiles("workshop.yaml", "missing.yaml")
+	assert.NotNil(t, err)
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown table":  "shops:\n  - shop_id: s1\n",
+		"unknown column": "users:\n  - user_id: u1\n    name: alice\n    age: 20\n",
+		"no name":        "users:\n  - user_id: u1\n",
+		"negative price": "items:\n  - item_id: i1\n    item_name: sword\n    price: -1\n",
+		"no item id":     "user_items:\n  - user_id: u1\n",
+		"negative":       "wallets:\n  - user_id: u1\n    balance: -1\n",
+		"not a list":     "users: alice\n",
+	}
+	for name, data := range cases {
+		_, err := Parse([]byte(data))
+		assert.True(t, errors.Is(err, domain.ErrInvalid), "%s: %v", name, err)
+	}
+
+	f, err := Parse(nil)
+	assert.Nil(t, err)
+	mutations, err := f.Mutations(time.Now())
+	assert.Nil(t, err)
+	assert.Empty(t, mutations)
+}
+
+func TestCheckColumns(t *testing.T) {
+	expected, err := schemas.Expected()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, checkColumns(expected, "wallets", []string{"user_id", "balance"}))
+	assert.NotNil(t, checkColumns(expected, "wallets", []string{"user_id", "amount"}))
+	assert.NotNil(t, checkColumns(expected, "shops", []string{"shop_id"}))
+}
@@ -0,0 +1,106 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+Fuzz targets of params and json bodies from clients, which have to be rejected as invalid rather than to fail in Spanner.
+They share the init of this package, so the emulator is required like the other tests.
+Failing inputs are saved under testdata/fuzz and they are run as regression tests by go test.
+*/
+
+// Spanner rejects strings which are not valid UTF-8, a cursor is decoded into a query param
+func FuzzDecodeCursor(f *testing.F) {
+	f.Add(encodeCursor("d169f397-ba3f-413b-bc3c-a465576ef06e"))
+	f.Add("")
+	f.Add("!!")
+	f.Add(encodeCursor("\xff"))
+	f.Fuzz(func(t *testing.T, cursor string) {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("error is not ErrInvalidCursor: %v", err)
+			}
+			return
+		}
+		if !utf8.ValidString(key) {
+			t.Fatalf("%q is decoded as invalid UTF-8 %q", cursor, key)
+		}
+		decoded, err := decodeCursor(encodeCursor(key))
+		if err != nil || decoded != key {
+			t.Fatalf("%q is decoded as %q, %v", key, decoded, err)
+		}
+	})
+}
+
+func FuzzDecodeLedgerCursor(f *testing.F) {
+	entry, _ := domain.NewLedgerEntry("user", "entry", 100, 100, domain.LedgerCredit, "", time.Date(2023, 10, 1, 0, 0, 0, 1, time.UTC))
+	f.Add(encodeLedgerCursor(entry))
+	f.Add(encodeCursor("2023-10-01T00:00:00Z"))
+	f.Add(encodeCursor("0000-01-01T00:00:00Z/entry"))
+	f.Add(encodeCursor("9999-12-31T23:59:59-23:59/entry"))
+	f.Add("")
+	f.Fuzz(func(t *testing.T, cursor string) {
+		at, entryID, err := decodeLedgerCursor(cursor)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("error is not ErrInvalidCursor: %v", err)
+			}
+			return
+		}
+		if at.Before(minTimestamp) || at.After(maxTimestamp) {
+			t.Fatalf("%q is decoded as %v, which Spanner can't compare", cursor, at)
+		}
+		if !utf8.ValidString(entryID) {
+			t.Fatalf("%q is decoded as invalid UTF-8 %q", cursor, entryID)
+		}
+	})
+}
+
+// the body of PUT /api/user_id/{user_id}/pii
+func FuzzUserPIIJSON(f *testing.F) {
+	f.Add([]byte(`{"email":"foo@example.com","external_id":"123"}`))
+	f.Add([]byte(`{"email":"foo"}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pii UserPII
+		if err := json.Unmarshal(data, &pii); err != nil {
+			return
+		}
+		if err := pii.validate(); err != nil && !errors.Is(err, domain.ErrInvalid) {
+			t.Fatalf("error is not ErrInvalid: %v", err)
+		}
+	})
+}
+
+// the body of POST /api/user_id/{user_id}/purchase/verify
+func FuzzStoreReceiptJSON(f *testing.F) {
+	f.Add([]byte(`{"store":"google_play","product_id":"d169f397-ba3f-413b-bc3c-a465576ef06e","token":"abc"}`))
+	f.Add([]byte(`{"product_id":""}`))
+	f.Add([]byte(`{"product_id":"item","token":"` + strings.Repeat("a", 200) + `"}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var receipt StoreReceipt
+		if err := json.Unmarshal(data, &receipt); err != nil {
+			return
+		}
+		purchase, err := StubVerifier{}.Verify(context.Background(), receipt)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidReceipt) {
+				t.Fatalf("error is not ErrInvalidReceipt: %v", err)
+			}
+			return
+		}
+		// purchases.receipt_id is STRING(128), and it's the reference id of wallet_ledger, STRING(64)
+		if utf8.RuneCountInString(purchase.ReceiptID) > 64 {
+			t.Fatalf("receipt id %q is too long to be stored", purchase.ReceiptID)
+		}
+	})
+}
@@ -17,50 +17,193 @@ package game
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"encoding/json"
+	"encoding/base64"
 
 	"cloud.google.com/go/spanner"
-	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis"
 	"go.opentelemetry.io/otel"
-	"google.golang.org/api/iterator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/envelope"
 )
 
 type UserParams struct {
 	UserID   string `validate:"required,max=36"`
-	UserName string
+	UserName string `validate:"omitempty,safe_name"`
+}
+
+// fields of a user to update, nil fields are left as they are
+type UserPatch struct {
+	Name *string `json:"name" validate:"omitempty,safe_name"`
 }
 
+// AnyVersion updates the user whatever version it is, like If-Match: *
+const AnyVersion int64 = -1
+
+// the profile was changed by another request since its version was read
+var ErrVersionConflict = errors.New("the user is changed since the version")
+
 type ItemParams struct {
-	ItemID string `validate:"required,max=36"`
+	ItemID string `validate:"required,itemid"`
+	// how many of the item AddItemToUser adds, 0 is one
+	Quantity int64 `validate:"omitempty,min=1,max=1000"`
+}
+
+func (i ItemParams) quantity() int64 {
+	if i.Quantity == 0 {
+		return 1
+	}
+	return i.Quantity
 }
 
 type dbClient struct {
 	Sc    *spanner.Client
 	Cache Cacher
+	// item mutations are appended as events and projected to user_items asynchronously
+	EventSourced bool
+	// called as the last step of purchase, receipts are just logged if nil
+	EmitReceipt func(context.Context, Receipt) error
+	// called after items of a user are changed, nothing is emitted if nil
+	EmitChange func(context.Context, domain.ItemChanged) error
+	// changes are staged in event_outbox in their transactions as well, for RelayPending to publish them, see stageChanges
+	Outbox bool
+	// encrypts sensitive fields, they can't be used if nil
+	Envelope *envelope.Envelope
+	// query cache and Spanner concurrently while cache is slow, see raceUserItems
+	RaceCache bool
+	// calls of requests fail fast while Spanner is unavailable, nothing is guarded if nil
+	Breaker *Breaker
+	// transient errors of Spanner are retried by it, calls are made once if nil
+	Retrier *Retrier
+	// item names of UserItems are looked up in it instead of joining items, if it's set
+	Catalog *CatalogCache
+	// how cached UserItems are updated by mutations, cache-aside if empty
+	CacheStrategy CacheStrategy
+	// strategies of users rolled out apart from CacheStrategy, all the users are of it if nil
+	CacheRollout CacheRollout
+	// cached UserItems are served only if they were read after the last write of the user, see provablyFresh
+	ValidateCache bool
+	// whether CreateUser and AddItemToUser write by DML or mutations, DML if zero, see WriteMode
+	WriteModes WriteModes
+	// timestamp bound of queries of UserItems on cache misses, strong if zero, see Staleness
+	Staleness Staleness
+	// deadline of each attempt of a Spanner call, see Dependencies
+	Timeout time.Duration
+	// concurrent misses of a user share one query, see loadUserItems, they don't if nil
+	misses *singleflight.Group
 }
 
 type Caching struct {
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient
+	Health      *CacheHealth
+	// reads go to them in round robin if any, and fall back to RedisClient on errors
+	ReadReplicas []*redis.Client
+	next         uint32
+	// prefix of keys, see CacheEpoch
+	Epoch CacheEpoch
 }
 
-func (c *Caching) Get(key string) (string, error) {
-	result, err := c.RedisClient.Get(key).Result()
+const cacheTTL = 2 * time.Second
+
+var errCacheDown = errors.New("cache is down, skipped")
+
+func (c *Caching) Get(key string) (result string, err error) {
+	start := time.Now()
+	defer func() { observeCacheGet(key, start, err, err == redis.Nil) }()
+	if !c.Health.Usable() {
+		return "", errCacheDown
+	}
+	result, err = c.get(c.Epoch.key(key))
+	if err == redis.Nil {
+		result, err = c.getPrevious(key)
+	}
+	c.Health.ObserveLatency(time.Since(start))
+	if err != redis.Nil {
+		c.Health.Observe(err)
+	}
 	return result, err
 }
 
-func (c *Caching) Set(key string, data string) error {
-	err := c.RedisClient.Set(key, data, 2*time.Second).Err()
+// a miss of replica is a miss, it's not worth asking the primary
+func (c *Caching) get(key string) (string, error) {
+	if len(c.ReadReplicas) > 0 {
+		replica := c.ReadReplicas[atomic.AddUint32(&c.next, 1)%uint32(len(c.ReadReplicas))]
+		result, err := replica.Get(key).Result()
+		if err == nil || err == redis.Nil {
+			return result, err
+		}
+		cacheReplicaFallbacks.Inc()
+		log.Println("replica", replica.Options().Addr, err)
+	}
+	return c.RedisClient.Get(key).Result()
+}
+
+func (c *Caching) Slow() bool {
+	return c.Health.Slow()
+}
+
+func (c *Caching) Set(key string, data string) (err error) {
+	start := time.Now()
+	defer func() { observeCacheSet(key, start, err) }()
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err = c.RedisClient.Set(c.Epoch.key(key), data, cacheTTL).Err()
+	c.Health.Observe(err)
+	return err
+}
+
+func (c *Caching) SetWithTTL(key string, data string, ttl time.Duration) (err error) {
+	start := time.Now()
+	defer func() { observeCacheSet(key, start, err) }()
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err = c.RedisClient.Set(c.Epoch.key(key), data, ttl).Err()
+	c.Health.Observe(err)
+	return err
+}
+
+func (c *Caching) Del(key string) (err error) {
+	start := time.Now()
+	defer func() { observeCacheDel(key, start, err) }()
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err = c.RedisClient.Del(c.Epoch.key(key)).Err()
+	if err == nil {
+		err = c.delPrevious(key)
+	}
+	c.Health.Observe(err)
 	return err
 }
 
+// WatchHealth pings redis in background to feed Health
+func (c *Caching) WatchHealth(ctx context.Context, interval time.Duration) {
+	if c.Health == nil {
+		return
+	}
+	c.Health.Watch(ctx, func() error { return c.RedisClient.Ping().Err() }, interval)
+}
+
+// Ping checks redis now, whatever Health thinks of it, for readiness
+func (c *Caching) Ping() error {
+	return c.RedisClient.Ping().Err()
+}
+
 // var _ Cacher = (*cache)(nil)
-var validate = validator.New(validator.WithRequiredStructEnabled())
 
 func NewClient(ctx context.Context, dbString string, c Cacher) (dbClient, error) {
 
@@ -70,23 +213,66 @@ func NewClient(ctx context.Context, dbString string, c Cacher) (dbClient, error)
 	}
 
 	return dbClient{
-		Sc:    client,
-		Cache: c,
+		Sc:     client,
+		Cache:  c,
+		misses: &singleflight.Group{},
 	}, nil
 }
 
+// Ping queries SELECT 1 without the breaker and retries, for readiness to see Spanner as it is now
+func (d dbClient) Ping(ctx context.Context) error {
+	iter := d.Sc.Single().QueryWithOptions(ctx, spanner.Statement{SQL: "SELECT 1"}, spanner.QueryOptions{RequestTag: "func=Ping,env=dev,action=query"})
+	defer iter.Stop()
+	_, err := iter.Next()
+	return err
+}
+
 // create a user
 func (d dbClient) CreateUser(ctx context.Context, w io.Writer, u UserParams) error {
 
 	ctx, span := otel.Tracer("main").Start(ctx, "CreateUser")
 	defer span.End()
 
-	if err := validate.Struct(u); err != nil {
+	if err := checkParams(u); err != nil {
 		return err
 	}
 
-	_, err := d.Sc.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		ctx, span = otel.Tracer("main").Start(ctx, "PreparingStatement")
+	mode := d.WriteModes.of("CreateUser")
+	start := time.Now()
+	var commitTs time.Time
+	var err error
+	if mode == WriteMutation {
+		// a blind write, so it's a single Apply without a statement before the commit
+		t := time.Now()
+		var audit *spanner.Mutation
+		audit, err = auditMutation(ctx, u.UserID, AuditCreateUser, nil, domain.User{ID: u.UserID, Name: u.UserName})
+		if err != nil {
+			return err
+		}
+		commitTs, err = d.applyMutations(ctx, "CreateUser", []*spanner.Mutation{
+			spanner.InsertMap("users", map[string]interface{}{
+				"user_id":    u.UserID,
+				"name":       u.UserName,
+				"created_at": t,
+				"updated_at": t,
+			}),
+			audit,
+		})
+	} else {
+		commitTs, err = d.createUserByDML(ctx, u)
+	}
+
+	// UserItems of the id may have been read and cached empty before it's created
+	if err == nil {
+		observeWrite(ctx, "CreateUser", mode, start)
+		d.invalidateUserItems(ctx, u.UserID, commitTs)
+	}
+	return err
+}
+
+func (d dbClient) createUserByDML(ctx context.Context, u UserParams) (time.Time, error) {
+	resp, err := d.readWriteTransaction(ctx, "CreateUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		ctx, span := otel.Tracer("main").Start(ctx, "PreparingStatement")
 		sqlToUsers := `INSERT users (user_id, name, created_at, updated_at)
 		  VALUES (@userID, @userName, @timestamp, @timestamp)`
 		t := time.Now().Format("2006-01-02 15:04:05")
@@ -108,14 +294,185 @@ func (d dbClient) CreateUser(ctx context.Context, w io.Writer, u UserParams) err
 			return err
 		}
 
+		return bufferAudit(ctx, txn, u.UserID, AuditCreateUser, nil, domain.User{ID: u.UserID, Name: u.UserName})
+	})
+	return resp.CommitTs, err
+}
+
+// page size of list APIs
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+// a cursor is the last key of the previous page, it's encoded to be opaque to clients
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// the key to list after, empty cursor means from the beginning
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	// it's a query param, which Spanner rejects unless it's valid UTF-8
+	if err != nil || !utf8.ValidString(string(decoded)) {
+		return "", ErrInvalidCursor
+	}
+	return string(decoded), nil
+}
+
+/*
+list users in the order of user_id, from the one after cursor.
+cursor is opaque to clients, it's the last user_id of the previous page encoded,
+and next cursor is empty when there are no more users.
+*/
+func (d dbClient) ListUsers(ctx context.Context, w io.Writer, limit int, cursor string) ([]domain.User, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListUsers")
+	defer span.End()
+
+	limit = pageSize(limit)
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// one more than limit, to know whether the next page exists
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id, name FROM users WHERE user_id > @after ORDER BY user_id LIMIT @limit`,
+		Params: map[string]interface{}{
+			"after": after,
+			"limit": limit + 1,
+		},
+	}
+	users := make([]domain.User, 0, limit+1)
+	err = d.ForEachRow(ctx, "ListUsers", stmt, func(row *spanner.Row) error {
+		var userID, name string
+		if err := row.Columns(&userID, &name); err != nil {
+			return err
+		}
+		u, err := domain.NewUser(userID, name)
+		if err != nil {
+			return err
+		}
+		users = append(users, u)
 		return nil
-	}, spanner.TransactionOptions{TransactionTag: "func=CreateUser,env=dev"})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(users) <= limit {
+		return users, "", nil
+	}
+	users = users[:limit]
+	return users, encodeCursor(users[limit-1].ID), nil
+}
 
+/*
+delete a user and the items of the user,
+rows of other tables interleaved in users are deleted by cascade
+*/
+func (d dbClient) DeleteUser(ctx context.Context, w io.Writer, u UserParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DeleteUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+
+	resp, err := d.readWriteTransaction(ctx, "DeleteUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// NotFound if the user doesn't exist
+		if _, err := txn.ReadRow(ctx, "users", spanner.Key{u.UserID}, []string{"user_id"}); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Delete("user_items", spanner.Key{u.UserID}.AsPrefix()),
+			spanner.Delete("users", spanner.Key{u.UserID}),
+		})
+	})
+
+	if err == nil {
+		d.invalidateUserItems(ctx, u.UserID, resp.CommitTs)
+	}
 	return err
 }
 
 /*
-add item specified item_id to specific user
+update fields of the user in the patch and return the updated profile, NotFound if the user doesn't exist.
+It's updated only if the profile is still of the version, or ErrVersionConflict is returned, unless it's AnyVersion.
+Cached UserItems have the user name in them, so they are invalidated.
+*/
+func (d dbClient) UpdateUser(ctx context.Context, w io.Writer, userID string, version int64, patch UserPatch) (domain.Profile, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UpdateUser")
+	defer span.End()
+
+	if err := checkParams(patch); err != nil {
+		return domain.Profile{}, err
+	}
+
+	var profile domain.Profile
+	resp, err := d.readWriteTransaction(ctx, "UpdateUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"name", "item_count", "xp", "version"})
+		if err != nil {
+			return err
+		}
+		var name string
+		var itemCount, xp, current int64
+		if err := row.Columns(&name, &itemCount, &xp, &current); err != nil {
+			return err
+		}
+		if version != AnyVersion && version != current {
+			return ErrVersionConflict
+		}
+		before, err := domain.NewProfile(userID, name, itemCount, xp, current)
+		if err != nil {
+			return err
+		}
+		if patch.Name != nil {
+			name = *patch.Name
+		}
+		if profile, err = domain.NewProfile(userID, name, itemCount, xp, current+1); err != nil {
+			return err
+		}
+		if err := bufferAudit(ctx, txn, userID, AuditUpdateUser, before, profile); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.UpdateMap("users", map[string]interface{}{
+				"user_id":    userID,
+				"name":       profile.Name,
+				"version":    profile.Version,
+				"updated_at": time.Now(),
+			}),
+		})
+	})
+	if err != nil {
+		return domain.Profile{}, err
+	}
+
+	d.invalidateUserItems(ctx, userID, resp.CommitTs)
+	return profile, nil
+}
+
+/*
+add item specified item_id to specific user, or add to the quantity of it if the user has it already
 additionally show example how to use span of trace
 */
 func (d dbClient) AddItemToUser(ctx context.Context, w io.Writer, u UserParams, i ItemParams) error {
@@ -123,60 +480,250 @@ func (d dbClient) AddItemToUser(ctx context.Context, w io.Writer, u UserParams,
 	ctx, span := otel.Tracer("main").Start(ctx, "AddItemUser")
 	defer span.End()
 
-	if err := validate.Struct(u); err != nil {
+	if err := checkParams(u); err != nil {
+		return err
+	}
+	if err := checkParams(i); err != nil {
 		return err
 	}
 
-	_, err := d.Sc.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	if d.EventSourced {
+		// events are of an item, not of how many of it
+		if i.quantity() != 1 {
+			return fmt.Errorf("%w: quantity is not supported in event sourced mode", domain.ErrInvalid)
+		}
+		return d.appendItemEvent(ctx, u.UserID, i.ItemID, EventItemAdded)
+	}
 
-		sqlToUsers := `INSERT user_items (user_id, item_id, created_at, updated_at)
-		  VALUES (@userID, @itemID, @timestamp, @timestamp)`
-		t := time.Now().Format("2006-01-02 15:04:05")
-		params := map[string]interface{}{
-			"userID":    u.UserID,
-			"itemId":    i.ItemID,
-			"timestamp": t,
+	mode := d.WriteModes.of("AddItemToUser")
+	start := time.Now()
+	var resp spanner.CommitResponse
+	var seq int64
+	var err error
+	if mode == WriteMutation {
+		resp, seq, err = d.addItemByMutations(ctx, u.UserID, i.ItemID, i.quantity())
+	} else {
+		resp, seq, err = d.addItemByDML(ctx, u.UserID, i.ItemID, i.quantity())
+	}
+
+	if err == nil {
+		observeWrite(ctx, "AddItemToUser", mode, start)
+		d.patchUserItems(ctx, u.UserID, i.ItemID, true, resp.CommitTs)
+		d.emitChange(ctx, u.UserID, seq, i.ItemID, EventItemAdded)
+	}
+
+	return err
+}
+
+// AddItemToUser by DML, see stackItem
+func (d dbClient) addItemByDML(ctx context.Context, userID, itemID string, quantity int64) (spanner.CommitResponse, int64, error) {
+	var seq int64
+	resp, err := d.readWriteTransaction(ctx, "AddItemToUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) (err error) {
+		seq, err = d.stackItem(ctx, txn, userID, itemID, quantity)
+		return err
+	})
+	return resp, seq, err
+}
+
+/*
+add quantity of the item to the user in txn, and return the seq of the change.
+The owned item is stacked in place by an UPDATE, and only if the user doesn't have it, it's inserted,
+both in the transaction, so concurrent adds of the same item are serialized by the lock of the row instead of failing on the primary key.
+item_count is of distinct items, it's changed only by the insert.
+*/
+func (d dbClient) stackItem(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, itemID string, quantity int64) (int64, error) {
+	stacked, err := txn.Update(ctx, stackUserItem.Statement(stackParams{UserID: userID, ItemID: itemID, Quantity: quantity}))
+	if err != nil {
+		return 0, err
+	}
+	if stacked > 0 {
+		// the statement doesn't return the quantity, it's read back for the audit
+		row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"quantity"})
+		if err != nil {
+			return 0, err
 		}
-		stmtToUsers := spanner.Statement{
-			SQL:    sqlToUsers,
-			Params: params,
+		var after int64
+		if err := row.Columns(&after); err != nil {
+			return 0, err
 		}
+		before := auditedItem{ItemID: itemID, Quantity: after - quantity}
+		if err := bufferAudit(ctx, txn, userID, AuditAddItem, before, auditedItem{ItemID: itemID, Quantity: after}); err != nil {
+			return 0, err
+		}
+	} else {
+		stmtToUsers := insertUserItem.Statement(userItemParams{UserID: userID, ItemID: itemID, Quantity: quantity, Timestamp: time.Now()})
 		rowCountToUsers, err := txn.Update(ctx, stmtToUsers)
 		log.Printf("%d records has been updated\n", rowCountToUsers)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		return nil
-	}, spanner.TransactionOptions{TransactionTag: "func=AddItemToUser,env=dev"})
+		if err := addItemCount(ctx, txn, userID, rowCountToUsers); err != nil {
+			return 0, err
+		}
+		if err := bufferAudit(ctx, txn, userID, AuditAddItem, nil, auditedItem{ItemID: itemID, Quantity: quantity}); err != nil {
+			return 0, err
+		}
+	}
+	if err := addCounter(ctx, txn, CounterItemsGranted, quantity); err != nil {
+		return 0, err
+	}
+	seq, err := nextUserSeq(ctx, txn, userID)
+	if err != nil {
+		return 0, err
+	}
+	return seq, d.stageChanges(txn, userID, seq, []string{itemID}, EventItemAdded)
+}
 
-	return err
+// remove specified item_id from specific user, NotFound if the user doesn't have it
+func (d dbClient) RemoveItemFromUser(ctx context.Context, w io.Writer, u UserParams, i ItemParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RemoveItemFromUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+	if err := checkParams(i); err != nil {
+		return err
+	}
+
+	return d.removeItem(ctx, u.UserID, i.ItemID, true)
 }
 
-// get items the user has
-func (d dbClient) UserItems(ctx context.Context, w io.Writer, userID string) ([]map[string]interface{}, error) {
+// get items the user has, it's memoized in the request
+func (d dbClient) UserItems(ctx context.Context, w io.Writer, userID string) (domain.Inventory, error) {
+	key := fmt.Sprintf("UserItems_%s", userID)
+	if s, ok := stalenessFromContext(ctx); ok {
+		// not the cache, to see how long Spanner takes by the bound
+		return memoize(ctx, key+"@"+s.String(), func() (domain.Inventory, error) {
+			results, _, err := d.queryUserItemsAt(ctx, userID, s)
+			return results, err
+		})
+	}
+	return memoize(ctx, key, func() (domain.Inventory, error) {
+		return d.userItems(ctx, key, userID)
+	})
+}
+
+func (d dbClient) userItems(ctx context.Context, key, userID string) (domain.Inventory, error) {
+	if d.RaceCache && cacheIsSlow(d.Cache) {
+		return d.raceUserItems(ctx, key, userID)
+	}
 
 	ctx, span := otel.Tracer("main").Start(ctx, "GetCache")
-	key := fmt.Sprintf("UserItems_%s", userID)
+	done := budget.Track(ctx, budget.Redis)
 	data, err := d.Cache.Get(key)
+	done()
 	span.End()
 
 	if err != nil {
-		log.Println(key, "Error", err)
+		d.lookedUp(ctx, userID, "miss")
+		log.Println("UserItems", HashID(userID), "Error", err)
+	} else if data == userNotFoundEntry {
+		d.lookedUp(ctx, userID, "negative")
+		return nil, errUserNotFound
 	} else {
 		_, span := otel.Tracer("main").Start(ctx, "JsonUnmarshal")
-		results := []map[string]interface{}{}
-		err := json.Unmarshal([]byte(data), &results)
+		span.SetAttributes(attribute.Int("cache.payload_size", len(data)))
+		cachePayloadSize.WithLabelValues("get").Observe(float64(len(data)))
+		results, readAt, err := decodeUserItems(data)
+		span.End()
+		switch {
+		case err != nil:
+			// a corrupt entry, or of a format this revision can't read, is dropped and read again from Spanner
+			d.lookedUp(ctx, userID, "miss")
+			log.Println("UserItems", HashID(userID), "could not decode the cached entry", err)
+			if err := d.Cache.Del(key); err != nil {
+				log.Println("UserItems", HashID(userID), err)
+			}
+		case !d.ValidateCache || d.provablyFresh(ctx, userID, readAt):
+			d.lookedUp(ctx, userID, "hit")
+			log.Println("UserItems", HashID(userID), "from cache")
+			return results, nil
+		default:
+			d.lookedUp(ctx, userID, "stale")
+			log.Println("UserItems", HashID(userID), "cache is not provably fresh")
+		}
+	}
+
+	return d.loadUserItems(ctx, key, userID)
+}
+
+/*
+loadUserItems queries the items after a miss and caches them.
+When the entry of a hot user expires, concurrent misses of the user in process wait for the query of the first one
+and share its result, instead of all of them going to Spanner.
+The query doesn't see cancellation of the first request, as the others are waiting for it as well.
+*/
+func (d dbClient) loadUserItems(ctx context.Context, key, userID string) (domain.Inventory, error) {
+	load := func(ctx context.Context) (domain.Inventory, error) {
+		results, readAt, err := d.queryUserItemsAt(ctx, userID, d.Staleness)
+		if err == errUserNotFound {
+			d.setUserNotFound(ctx, key)
+		}
 		if err != nil {
-			log.Println(err)
+			return results, err
 		}
-		span.End()
-		log.Println(key, "from cache")
+		d.setUserItems(ctx, key, results, readAt)
 		return results, nil
 	}
+	if d.misses == nil {
+		return load(ctx)
+	}
+
+	leader := false
+	v, err, _ := d.misses.Do(userID, func() (interface{}, error) {
+		leader = true
+		return load(context.WithoutCancel(ctx))
+	})
+	if !leader {
+		cacheStampedesPrevented.Inc()
+	}
+	results, _ := v.(domain.Inventory)
+	return results, err
+}
+
+// the items of the user by a strong read, errUserNotFound if the user doesn't exist
+func (d dbClient) queryUserItems(ctx context.Context, userID string) (domain.Inventory, error) {
+	results, _, err := d.queryUserItemsAt(ctx, userID, Staleness{})
+	return results, err
+}
+
+/*
+the same as queryUserItems by the staleness, with the read timestamp of Spanner.
+Whether the user exists is read strongly, so a user created within the bound has no items instead of being unknown.
+*/
+func (d dbClient) queryUserItemsAt(ctx context.Context, userID string, staleness Staleness) (domain.Inventory, time.Time, error) {
+	start := time.Now()
+	results, readAt, err := d.queryInventory(ctx, userID, staleness)
+	if err == nil {
+		elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+		userItemsQueryDuration.WithLabelValues(staleness.mode()).Observe(elapsed)
+	}
+	if err != nil || len(results) > 0 {
+		return results, readAt, err
+	}
+	// nothing is joined for an unknown user as well as for a user without items
+	exists, err := d.userExists(ctx, userID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !exists {
+		return nil, time.Time{}, errUserNotFound
+	}
+	return results, readAt, nil
+}
+
+func (d dbClient) queryInventory(ctx context.Context, userID string, staleness Staleness) (domain.Inventory, time.Time, error) {
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("spanner.staleness", staleness.String()))
+	if d.Catalog != nil {
+		if results, readAt, ok, err := d.queryUserItemsByCatalog(ctx, userID, staleness); err != nil || ok {
+			return results, readAt, err
+		}
+	}
 
-	txn := d.Sc.ReadOnlyTransaction()
-	defer txn.Close()
-	sql := `select users.name,items.item_name,user_items.item_id
+	sql := `select users.name,items.item_name,user_items.item_id,user_items.quantity
 		from user_items join items on items.item_id = user_items.item_id join users on users.user_id = user_items.user_id
 		where user_items.user_id = @user_id`
 	stmt := spanner.Statement{
@@ -186,51 +733,65 @@ func (d dbClient) UserItems(ctx context.Context, w io.Writer, userID string) ([]
 		},
 	}
 
-	ctx, span = otel.Tracer("main").Start(ctx, "txnQuery")
-	iter := txn.QueryWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=UserItems,env=dev,action=query"})
-	defer iter.Stop()
-	span.End()
-
-	ctx, span = otel.Tracer("main").Start(ctx, "readResults")
-
 	baseItemSliceCap := 100
 
-	results := make([]map[string]interface{}, 0, baseItemSliceCap)
-	for {
-		row, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
+	results := make(domain.Inventory, 0, baseItemSliceCap)
+	var readAt time.Time
+	err := d.retry(ctx, "UserItems", func(ctx context.Context) error {
+		results = results[:0]
+		// single use for the bound, and for the read timestamp
+		txn := d.Sc.Single().WithTimestampBound(staleness.timestampBound())
+		defer txn.Close()
+		err := forEachRow(ctx, txn, "UserItems", stmt, func(row *spanner.Row) error {
+			var userName string
+			var itemNames string
+			var itemIds string
+			var quantity int64
+			if err := row.Columns(&userName, &itemNames, &itemIds, &quantity); err != nil {
+				return err
+			}
+
+			item, err := domain.NewOwnedItem(userName, itemNames, itemIds, quantity)
+			if err != nil {
+				return err
+			}
+			results = append(results, item)
+			return nil
+		})
 		if err != nil {
-			return results, err
-		}
-		var userName string
-		var itemNames string
-		var itemIds string
-		if err := row.Columns(&userName, &itemNames, &itemIds); err != nil {
-			return results, err
+			return err
 		}
+		readAt, err = txn.Timestamp()
+		return err
+	})
+	if err != nil {
+		return results, time.Time{}, err
+	}
+	return results, readAt, nil
+}
 
-		results = append(results,
-			map[string]interface{}{
-				"user_name": userName,
-				"item_name": itemNames,
-				"item_id":   itemIds,
-			})
+// caching is best effort, errors are just logged. readAt is kept with them only if ValidateCache is set
+func (d dbClient) setUserItems(ctx context.Context, key string, results domain.Inventory, readAt time.Time) {
 
-	}
-	span.End()
+	ctx, span := otel.Tracer("main").Start(ctx, "setResults")
+	defer span.End()
 
-	_, span = otel.Tracer("main").Start(ctx, "setResults")
-	jsonedResults, err := json.Marshal(results)
+	if !d.ValidateCache {
+		readAt = time.Time{}
+	}
+	jsonedResults, err := encodeUserItems(results, readAt)
 	if err != nil {
-		return results, err
+		log.Println(err)
+		return
 	}
+	span.SetAttributes(
+		attribute.Int("cache.payload_size", len(jsonedResults)),
+		attribute.Int("cache.item_count", len(results)),
+	)
+	cachePayloadSize.WithLabelValues("set").Observe(float64(len(jsonedResults)))
+	defer budget.Track(ctx, budget.Redis)()
 	err = d.Cache.Set(key, string(jsonedResults))
 	if err != nil {
 		log.Println(err)
 	}
-	span.End()
-
-	return results, nil
 }
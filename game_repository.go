@@ -3,15 +3,91 @@ package game
 import (
 	"context"
 	"io"
+	"time"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
 )
 
 type GameUserOperation interface {
 	CreateUser(context.Context, io.Writer, UserParams) error
+	DeleteUser(context.Context, io.Writer, UserParams) error
+	ListUsers(context.Context, io.Writer, int, string) ([]domain.User, string, error)
+	UpdateUser(context.Context, io.Writer, string, int64, UserPatch) (domain.Profile, error)
 	AddItemToUser(context.Context, io.Writer, UserParams, ItemParams) error
-	UserItems(context.Context, io.Writer, string) ([]map[string]interface{}, error)
+	RemoveItemFromUser(context.Context, io.Writer, UserParams, ItemParams) error
+	AddItemsToUser(context.Context, io.Writer, UserParams, []string) ([]ItemResult, error)
+	UserItems(context.Context, io.Writer, string) (domain.Inventory, error)
+	UserItemsPage(context.Context, io.Writer, string, int, string) (domain.Inventory, string, error)
+	SyncUserItems(context.Context, io.Writer, string, time.Time) (SyncDelta, error)
+	CreateItem(context.Context, io.Writer, domain.Item) error
+	Item(context.Context, io.Writer, string) (domain.Item, error)
+	ListItems(context.Context, io.Writer, int, string) ([]domain.Item, string, error)
+	UpdateItem(context.Context, io.Writer, domain.Item) error
+	DeleteItem(context.Context, io.Writer, string) error
+	RevokeItem(context.Context, io.Writer, string) (RevokeReport, error)
+	UserProfile(context.Context, io.Writer, string) (domain.Profile, error)
+	WalletBalance(context.Context, io.Writer, string) (domain.Wallet, error)
+	CreditWallet(context.Context, io.Writer, string, int64, string, string) (domain.Wallet, error)
+	WalletLedger(context.Context, io.Writer, string, int, string) ([]domain.LedgerEntry, string, error)
+	PurchaseItem(context.Context, io.Writer, UserParams, ItemParams) (Receipt, error)
+	RecordPurchase(context.Context, io.Writer, UserParams, VerifiedPurchase) (bool, error)
+	GrantToUser(context.Context, io.Writer, string, domain.Grant) (GrantResult, error)
+	Mailbox(context.Context, io.Writer, string, int, string) ([]domain.Mail, string, error)
+	AckMail(context.Context, io.Writer, string, string) (MailAck, error)
+	UserAudit(context.Context, io.Writer, string, int, string) ([]AuditRecord, string, error)
+	SetUserPII(context.Context, io.Writer, string, UserPII) error
+	UserPII(context.Context, io.Writer, string) (UserPII, error)
+	MergeUsers(context.Context, io.Writer, string, string, MergePolicy) (MergeReport, error)
+}
+
+// api keys are managed apart from the game, they're for access control of the API
+type APIKeyStore interface {
+	CreateAPIKey(context.Context, string) (APIKey, string, error)
+	ListAPIKeys(context.Context) ([]APIKey, error)
+	RevokeAPIKey(context.Context, string) error
+	VerifyAPIKey(context.Context, string) (string, error)
+}
+
+// bulk loads of datasets, see Import
+type Importer interface {
+	Import(context.Context, []ImportRecord, func(ImportProgress)) (ImportReport, error)
 }
 
+// keys of Idempotency-Key, see ClaimIdempotencyKey
+type IdempotencyStore interface {
+	ClaimIdempotencyKey(context.Context, string, string) (*IdempotentResponse, error)
+	CompleteIdempotencyKey(context.Context, string, IdempotentResponse) error
+	ReleaseIdempotencyKey(context.Context, string) error
+}
+
+// Del invalidates an entry after its source is changed, a missing key is not an error
 type Cacher interface {
 	Get(string) (string, error)
 	Set(string, string) error
+	Del(string) error
+}
+
+// optionally implemented by Cacher, to patch cached entries atomically
+type CachePatcher interface {
+	CompareAndSwap(key string, old string, new string) (bool, error)
+}
+
+// optionally implemented by Cacher, to keep an entry for other than the default ttl
+type CacheTTLSetter interface {
+	SetWithTTL(key string, data string, ttl time.Duration) error
+}
+
+// optionally implemented by Cacher, to validate cached entries by the last writes of their users, see ValidateCache
+type WriteStamper interface {
+	StampWrite(key string, at time.Time) error
+	LastWrite(key string) (time.Time, bool, error)
+}
+
+// optionally implemented by Cacher, to tell its latency is degraded
+type SlowReporter interface {
+	Slow() bool
+}
+
+type ReceiptVerifier interface {
+	Verify(context.Context, StoreReceipt) (VerifiedPurchase, error)
 }
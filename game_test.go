@@ -2,18 +2,33 @@ package game
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/spanner"
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	//game "github.com/shin5ok/go-architecting-workshop"
+	"github.com/shin5ok/go-architecting-workshop/domain"
 	"github.com/shin5ok/go-architecting-workshop/testutil"
 	"github.com/stretchr/testify/assert"
 )
@@ -47,6 +62,10 @@ func (c *dummyCaching) Set(key string, data string) error {
 	return nil
 }
 
+func (c *dummyCaching) Del(key string) error {
+	return nil
+}
+
 func init() {
 
 	log.Println("NO CLEANUP", noCleanup)
@@ -164,8 +183,1789 @@ func TestUserItems(t *testing.T) {
 
 	data := resultData[0]
 
-	assert.Equal(t, data["item_id"], itemTestID)
+	assert.Equal(t, data.ItemID, itemTestID)
+
+}
+
+// This test depends on TestAddItemUser
+func TestCatalogCache(t *testing.T) {
+	ctx := context.Background()
+
+	// loads running at the same time are shared, and an older version doesn't replace a newer one
+	loads := 0
+	release := make(chan struct{})
+	cc := &CatalogCache{ttl: time.Minute, load: func(context.Context) (catalogSnapshot, error) {
+		loads++
+		<-release
+		return catalogSnapshot{Version: int64(loads), Items: map[string]domain.Item{"i1": {ID: "i1", Name: "sword"}}}, nil
+	}}
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { done <- cc.refresh(ctx, false) }()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-done)
+	}
+	assert.Equal(t, 1, loads)
+	cc.adopt(catalogSnapshot{Version: 0})
+	item, ok := cc.Item("i1")
+	assert.True(t, ok)
+	assert.Equal(t, "sword", item.Name)
+
+	// a forced one always loads
+	cc.Invalidate(ctx)
+	assert.Equal(t, 2, loads)
+
+	// the same inventory as the one of the join, and from the catalog shared by redis
+	joined, err := testDbClient.queryUserItems(ctx, userTestID)
+	assert.Nil(t, err)
+	client := testDbClient
+	client.Catalog = NewCatalogCache(testDbClient, &Caching{RedisClient: testRdb}, time.Minute)
+	assert.Nil(t, client.Catalog.refresh(ctx, true))
+	byCatalog, _, ok, err := client.queryUserItemsByCatalog(ctx, userTestID, Staleness{})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, joined, byCatalog)
+
+	shared := NewCatalogCache(testDbClient, &Caching{RedisClient: testRdb}, time.Minute)
+	shared.load = func(context.Context) (catalogSnapshot, error) { return catalogSnapshot{}, errors.New("not loaded") }
+	assert.Nil(t, shared.refresh(ctx, false))
+	_, ok = shared.Item(itemTestID)
+	assert.True(t, ok)
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "deleted"}
+
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	assert.Nil(t, testDbClient.DeleteUser(ctx, io.Discard, u))
+
+	_, err := testDbClient.UserItems(ctx, io.Discard, u.UserID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+
+	err = testDbClient.DeleteUser(ctx, io.Discard, u)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestRemoveItemFromUser(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "removed"}
+
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	assert.Nil(t, testDbClient.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	resultData, err := testDbClient.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Empty(t, resultData)
+
+	profile, err := testDbClient.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), profile.ItemCount)
+
+	err = testDbClient.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID})
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestSyncUserItems(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "synced"}
+	i := ItemParams{ItemID: itemTestID}
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, i))
+
+	full, err := testDbClient.SyncUserItems(ctx, io.Discard, u.UserID, time.Time{})
+	assert.Nil(t, err)
+	assert.Len(t, full.Items, 1)
+	assert.Empty(t, full.Removed)
+
+	// nothing has changed since then
+	delta, err := testDbClient.SyncUserItems(ctx, io.Discard, u.UserID, full.SyncedAt)
+	assert.Nil(t, err)
+	assert.Empty(t, delta.Items)
+	assert.Empty(t, delta.Removed)
+
+	assert.Nil(t, testDbClient.RemoveItemFromUser(ctx, io.Discard, u, i))
+	removed, err := testDbClient.SyncUserItems(ctx, io.Discard, u.UserID, delta.SyncedAt)
+	assert.Nil(t, err)
+	assert.Empty(t, removed.Items)
+	assert.Equal(t, []string{itemTestID}, removed.Removed)
+
+	// added again, it's not removed any more for the ones synced before the removal
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, i))
+	added, err := testDbClient.SyncUserItems(ctx, io.Discard, u.UserID, delta.SyncedAt)
+	assert.Nil(t, err)
+	assert.Len(t, added.Items, 1)
+	assert.Empty(t, added.Removed)
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "before"}
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+
+	name := "after"
+	profile, err := testDbClient.UpdateUser(ctx, io.Discard, u.UserID, 0, UserPatch{Name: &name})
+	assert.Nil(t, err)
+	assert.Equal(t, name, profile.Name)
+	assert.Equal(t, int64(1), profile.Version)
+
+	// updated by another client since version 0 was read
+	_, err = testDbClient.UpdateUser(ctx, io.Discard, u.UserID, 0, UserPatch{Name: &name})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	profile, err = testDbClient.UpdateUser(ctx, io.Discard, u.UserID, AnyVersion, UserPatch{Name: &name})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), profile.Version)
+
+	empty := ""
+	_, err = testDbClient.UpdateUser(ctx, io.Discard, u.UserID, AnyVersion, UserPatch{Name: &empty})
+	assert.True(t, errors.Is(err, domain.ErrInvalid))
+
+	_, err = testDbClient.UpdateUser(ctx, io.Discard, "no-such-user", AnyVersion, UserPatch{Name: &name})
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestAddItemsToUser(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "batch"}
+	otherItemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	results, err := testDbClient.AddItemsToUser(ctx, io.Discard, u, []string{otherItemID, itemTestID, otherItemID, "no-such-item"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 4)
+	assert.Empty(t, results[0].Error)
+	assert.NotEmpty(t, results[1].Error)
+	assert.NotEmpty(t, results[2].Error)
+	assert.NotEmpty(t, results[3].Error)
+
+	profile, err := testDbClient.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), profile.ItemCount)
+
+	_, err = testDbClient.AddItemsToUser(ctx, io.Discard, UserParams{UserID: "no-such-user"}, []string{itemTestID})
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestGrantToUser(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "grant"}
+	otherItemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+
+	grant, err := domain.NewGrant("quest-"+u.UserID, domain.GrantQuest, []string{itemTestID}, 100, 50)
+	assert.Nil(t, err)
+	result, err := testDbClient.GrantToUser(ctx, io.Discard, u.UserID, grant)
+	assert.Nil(t, err)
+	assert.True(t, result.Granted)
+	assert.Equal(t, int64(100), result.Wallet.Balance)
+	assert.Equal(t, int64(50), result.XP)
+
+	// retried, nothing is given again
+	result, err = testDbClient.GrantToUser(ctx, io.Discard, u.UserID, grant)
+	assert.Nil(t, err)
+	assert.False(t, result.Granted)
+	assert.Equal(t, int64(100), result.Wallet.Balance)
+
+	// all or nothing, the owned item fails the others
+	grant, err = domain.NewGrant("reward-"+u.UserID, domain.GrantReward, []string{otherItemID, itemTestID}, 100, 50)
+	assert.Nil(t, err)
+	_, err = testDbClient.GrantToUser(ctx, io.Discard, u.UserID, grant)
+	assert.Equal(t, codes.AlreadyExists, spanner.ErrCode(err))
+
+	profile, err := testDbClient.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+	assert.Equal(t, int64(50), profile.XP)
+	wallet, err := testDbClient.WalletBalance(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), wallet.Balance)
+
+	_, err = testDbClient.GrantToUser(ctx, io.Discard, "no-such-user", grant)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestMergeUsers(t *testing.T) {
+	ctx := context.Background()
+	otherItemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+	source := UserParams{UserID: uuid.NewString(), UserName: "guest"}
+	target := UserParams{UserID: uuid.NewString(), UserName: "main"}
+	for _, u := range []UserParams{source, target} {
+		assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	}
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, source, ItemParams{ItemID: itemTestID, Quantity: 3}))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, source, ItemParams{ItemID: otherItemID}))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, target, ItemParams{ItemID: itemTestID, Quantity: 5}))
+	_, err := testDbClient.CreditWallet(ctx, io.Discard, source.UserID, 100, domain.LedgerCredit, "")
+	assert.Nil(t, err)
+
+	// nothing is merged by the fail policy
+	_, err = testDbClient.MergeUsers(ctx, io.Discard, source.UserID, target.UserID, MergeFail)
+	assert.Equal(t, codes.AlreadyExists, spanner.ErrCode(err))
+	_, err = testDbClient.MergeUsers(ctx, io.Discard, source.UserID, source.UserID, MergeSum)
+	assert.True(t, errors.Is(err, domain.ErrInvalid))
+
+	report, err := testDbClient.MergeUsers(ctx, io.Discard, source.UserID, target.UserID, MergeMax)
+	assert.Nil(t, err)
+	assert.True(t, report.Merged)
+	assert.Equal(t, []string{itemTestID}, report.Dropped)
+	assert.Equal(t, int64(100), report.Wallet.Balance)
+
+	items, err := testDbClient.UserItems(ctx, io.Discard, target.UserID)
+	assert.Nil(t, err)
+	quantities := map[string]int64{}
+	for _, item := range items {
+		quantities[item.ItemID] = item.Quantity
+	}
+	assert.Equal(t, map[string]int64{itemTestID: 5, otherItemID: 1}, quantities)
+	_, err = testDbClient.UserProfile(ctx, io.Discard, source.UserID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+
+	// retried, nothing is merged again
+	report, err = testDbClient.MergeUsers(ctx, io.Discard, source.UserID, target.UserID, MergeMax)
+	assert.Nil(t, err)
+	assert.False(t, report.Merged)
+}
+
+func TestRelayOutbox(t *testing.T) {
+	ctx := context.Background()
+	client := testDbClient
+	client.Outbox = true
+	u := UserParams{UserID: uuid.NewString(), UserName: "outbox"}
+	assert.Nil(t, client.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, client.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	assert.Nil(t, client.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	var changes []domain.ItemChanged
+	collect := func(ctx context.Context, e OutboxEvent) error {
+		var change domain.ItemChanged
+		if err := json.Unmarshal(e.Payload, &change); err != nil {
+			return err
+		}
+		assert.Equal(t, OutboxItemChanged, e.Type)
+		assert.Equal(t, change.ID(), e.ID)
+		if change.UserID == u.UserID {
+			changes = append(changes, change)
+		}
+		return nil
+	}
+	_, err := client.RelayOutbox(ctx, collect)
+	assert.Nil(t, err)
+	assert.Equal(t, []domain.ItemChanged{
+		{UserID: u.UserID, Seq: 1, ItemID: itemTestID, Type: EventItemAdded},
+		{UserID: u.UserID, Seq: 2, ItemID: itemTestID, Type: EventItemRemoved},
+	}, changes)
+
+	// published ones are not relayed again
+	changes = nil
+	_, err = client.RelayOutbox(ctx, collect)
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+
+	// the change is kept while the broker is down
+	assert.Nil(t, client.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	n, err := client.RelayOutbox(ctx, func(context.Context, OutboxEvent) error { return errors.New("broker is down") })
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	row, err := client.Sc.Single().ReadRow(ctx, "event_outbox", spanner.Key{u.UserID + "-3"}, []string{"attempts", "published_at"})
+	assert.Nil(t, err)
+	var attempts int64
+	var publishedAt spanner.NullTime
+	assert.Nil(t, row.Columns(&attempts, &publishedAt))
+	assert.Equal(t, int64(1), attempts)
+	assert.False(t, publishedAt.Valid)
+}
+
+func TestMailbox(t *testing.T) {
+	ctx := context.Background()
+	u := UserParams{UserID: uuid.NewString(), UserName: "mailbox"}
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+
+	gift, err := domain.NewMail(u.UserID, uuid.NewString(), domain.MailGift, "welcome", "", []string{itemTestID}, 100, 0)
+	assert.Nil(t, err)
+	notice, err := domain.NewMail(u.UserID, uuid.NewString(), domain.MailSystem, "maintenance", "tonight", nil, 0, 0)
+	assert.Nil(t, err)
+	for _, m := range []domain.Mail{gift, notice} {
+		deposited, err := testDbClient.DepositMail(ctx, m)
+		assert.Nil(t, err)
+		assert.True(t, deposited)
+	}
+	// redelivered
+	deposited, err := testDbClient.DepositMail(ctx, gift)
+	assert.Nil(t, err)
+	assert.False(t, deposited)
+
+	mails, next, err := testDbClient.Mailbox(ctx, io.Discard, u.UserID, 1, "")
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+	assert.NotEmpty(t, next)
+	mails, next, err = testDbClient.Mailbox(ctx, io.Discard, u.UserID, 1, next)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+	assert.Empty(t, next)
+
+	// claimed with the mail marked, and only once
+	ack, err := testDbClient.AckMail(ctx, io.Discard, u.UserID, gift.MailID)
+	assert.Nil(t, err)
+	assert.NotNil(t, ack.ReadAt)
+	assert.NotNil(t, ack.ClaimedAt)
+	assert.True(t, ack.Grant.Granted)
+	assert.Equal(t, int64(100), ack.Grant.Wallet.Balance)
+	ack, err = testDbClient.AckMail(ctx, io.Discard, u.UserID, gift.MailID)
+	assert.Nil(t, err)
+	assert.Nil(t, ack.Grant)
+	wallet, err := testDbClient.WalletBalance(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), wallet.Balance)
+
+	ack, err = testDbClient.AckMail(ctx, io.Discard, u.UserID, notice.MailID)
+	assert.Nil(t, err)
+	assert.NotNil(t, ack.ReadAt)
+	assert.Nil(t, ack.ClaimedAt)
+
+	_, err = testDbClient.AckMail(ctx, io.Discard, u.UserID, "no-such-mail")
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+	_, err = testDbClient.DepositMail(ctx, domain.Mail{UserID: uuid.NewString(), MailID: uuid.NewString(), Kind: domain.MailSystem, Subject: "lost"})
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestUserAudit(t *testing.T) {
+	ctx := WithActor(context.Background(), Actor{Caller: "admin@example.com", ActingAs: "someone", RequestID: "req-1"})
+	u := UserParams{UserID: uuid.NewString(), UserName: "audit"}
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+	i := ItemParams{ItemID: itemTestID}
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, i))
+	assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, i))
+	assert.Nil(t, testDbClient.RemoveItemFromUser(ctx, io.Discard, u, i))
+
+	records, next, err := testDbClient.UserAudit(ctx, io.Discard, u.UserID, 0, "")
+	assert.Nil(t, err)
+	assert.Empty(t, next)
+	assert.Len(t, records, 4)
+	// newest first
+	actions := []string{AuditRemoveItem, AuditAddItem, AuditAddItem, AuditCreateUser}
+	for n, r := range records {
+		assert.Equal(t, actions[n], r.Action)
+		assert.Equal(t, "admin@example.com", r.Caller)
+		assert.Equal(t, "someone", r.ActingAs)
+		assert.Equal(t, "req-1", r.RequestID)
+	}
+	assert.JSONEq(t, fmt.Sprintf(`{"item_id":%q,"quantity":2}`, itemTestID), string(records[0].Before))
+	assert.JSONEq(t, "null", string(records[0].After))
+	assert.JSONEq(t, fmt.Sprintf(`{"item_id":%q,"quantity":1}`, itemTestID), string(records[1].Before))
+	assert.JSONEq(t, "null", string(records[2].Before))
+	assert.JSONEq(t, "null", string(records[3].Before))
+
+	records, next, err = testDbClient.UserAudit(ctx, io.Discard, u.UserID, 3, "")
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	records, _, err = testDbClient.UserAudit(ctx, io.Discard, u.UserID, 3, next)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, AuditCreateUser, records[0].Action)
+}
+
+func TestWalletLedger(t *testing.T) {
+	ctx := context.Background()
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "ledger"}
+	assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+
+	_, err := testDbClient.CreditWallet(ctx, io.Discard, u.UserID, 300, domain.LedgerCredit, "r1")
+	assert.Nil(t, err)
+	wallet, err := testDbClient.CreditWallet(ctx, io.Discard, u.UserID, -100, domain.LedgerPurchase, "r2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), wallet.Balance)
+
+	entries, next, err := testDbClient.WalletLedger(ctx, io.Discard, u.UserID, 1, "")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, int64(-100), entries[0].Amount)
+	assert.NotEmpty(t, next)
+
+	entries, next, err = testDbClient.WalletLedger(ctx, io.Discard, u.UserID, 1, next)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, int64(300), entries[0].Amount)
+	assert.Empty(t, next)
+
+	drifts, err := testDbClient.ReconcileWallets(ctx)
+	assert.Nil(t, err)
+	for _, d := range drifts {
+		assert.NotEqual(t, u.UserID, d.UserID)
+	}
+}
+
+func TestRecordPurchase(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = mapCaching{}
+	u := UserParams{UserID: uuid.NewString(), UserName: "purchased"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	// stacked on the one owned, and a retried verification grants nothing
+	p := VerifiedPurchase{ReceiptID: uuid.NewString(), Store: "stub", ItemID: itemTestID}
+	for _, want := range []bool{true, false} {
+		granted, err := d.RecordPurchase(ctx, io.Discard, u, p)
+		assert.Nil(t, err)
+		assert.Equal(t, want, granted)
+	}
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, int64(2), items[0].Quantity)
+
+	records, _, err := d.UserAudit(ctx, io.Discard, u.UserID, 0, "")
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, AuditAddItem, records[0].Action)
+	assert.JSONEq(t, fmt.Sprintf(`{"item_id":%q,"quantity":1}`, itemTestID), string(records[0].Before))
+	assert.JSONEq(t, fmt.Sprintf(`{"item_id":%q,"quantity":2}`, itemTestID), string(records[0].After))
+}
+
+func TestPurchaseCompensation(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = mapCaching{}
+	d.EmitReceipt = func(context.Context, Receipt) error {
+		return errors.New("receipts are down")
+	}
+
+	for _, owned := range []int64{0, 2} {
+		u := UserParams{UserID: uuid.NewString(), UserName: "compensated"}
+		assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+		if owned > 0 {
+			assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID, Quantity: owned}))
+		}
+		_, err := d.CreditWallet(ctx, io.Discard, u.UserID, 6000, domain.LedgerCredit, "")
+		assert.Nil(t, err)
+
+		// the receipt fails after the item is granted, so both the grant and the debit are undone
+		_, err = d.PurchaseItem(ctx, io.Discard, u, ItemParams{ItemID: itemTestID})
+		assert.NotNil(t, err)
+
+		items, err := d.UserItems(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		if owned > 0 {
+			assert.Len(t, items, 1)
+			assert.Equal(t, owned, items[0].Quantity)
+		} else {
+			assert.Empty(t, items)
+		}
+		profile, err := d.UserProfile(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(items)), profile.ItemCount)
+		wallet, err := d.WalletBalance(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(6000), wallet.Balance)
+	}
+}
+
+func TestPurchaseGrantFailure(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = mapCaching{}
+
+	u := UserParams{UserID: uuid.NewString(), UserName: "grant failed"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	_, err := d.CreditWallet(ctx, io.Discard, u.UserID, 6000, domain.LedgerCredit, "")
+	assert.Nil(t, err)
+
+	// the wallet is debited, then granting fails, so only the debit is undone
+	receipt := Receipt{ReceiptID: uuid.NewString(), UserID: u.UserID, ItemID: itemTestID, Price: 5200}
+	steps := d.purchaseSteps(io.Discard, u, ItemParams{ItemID: itemTestID}, &receipt)
+	assert.Equal(t, "grantItem", steps[1].Name)
+	granting := errors.New("inventory is down")
+	steps[1].Do = func(context.Context) error {
+		return granting
+	}
+	sagaID, err := d.RunSaga(ctx, "purchase", u.UserID, steps)
+	assert.ErrorIs(t, err, granting)
+
+	row, err := d.readRow(ctx, "sagas", spanner.Key{sagaID}, []string{"state", "step"})
+	assert.Nil(t, err)
+	var state string
+	var step int64
+	assert.Nil(t, row.Columns(&state, &step))
+	assert.Equal(t, SagaCompensated, state)
+	assert.Equal(t, int64(1), step)
+
+	// the inventory is as it was, not revoked by the compensation of the step which failed
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, int64(1), items[0].Quantity)
+	profile, err := d.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+
+	wallet, err := d.WalletBalance(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6000), wallet.Balance)
+	entries, _, err := d.WalletLedger(ctx, io.Discard, u.UserID, 10, "")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, domain.LedgerRefund, entries[0].Reason)
+	assert.Equal(t, receipt.ReceiptID, entries[0].ReferenceID)
+	assert.Equal(t, int64(5200), entries[0].Amount)
+}
+
+func TestItemCatalog(t *testing.T) {
+	ctx := context.Background()
+	itemId, _ := uuid.NewUUID()
+	item, _ := domain.NewItem(itemId.String(), "test item", 100)
+
+	assert.Nil(t, testDbClient.CreateItem(ctx, io.Discard, item))
+	err := testDbClient.CreateItem(ctx, io.Discard, item)
+	assert.Equal(t, codes.AlreadyExists, spanner.ErrCode(err))
+
+	item.Price = 200
+	assert.Nil(t, testDbClient.UpdateItem(ctx, io.Discard, item))
+	got, err := testDbClient.Item(ctx, io.Discard, item.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, item, got)
+
+	items, _, err := testDbClient.ListItems(ctx, io.Discard, MaxPageSize, "")
+	assert.Nil(t, err)
+	assert.Contains(t, items, item)
+
+	assert.Nil(t, testDbClient.DeleteItem(ctx, io.Discard, item.ID))
+	_, err = testDbClient.Item(ctx, io.Discard, item.ID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+	err = testDbClient.DeleteItem(ctx, io.Discard, item.ID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestRevokeItem(t *testing.T) {
+	ctx := context.Background()
+	itemId, _ := uuid.NewUUID()
+	item, _ := domain.NewItem(itemId.String(), "recalled item", 100)
+	assert.Nil(t, testDbClient.CreateItem(ctx, io.Discard, item))
+
+	var users []UserParams
+	for n := 0; n < 2; n++ {
+		userId, _ := uuid.NewUUID()
+		u := UserParams{UserID: userId.String(), UserName: "revoked"}
+		assert.Nil(t, testDbClient.CreateUser(ctx, io.Discard, u))
+		assert.Nil(t, testDbClient.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: item.ID}))
+		users = append(users, u)
+	}
+
+	report, err := testDbClient.RevokeItem(ctx, io.Discard, item.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Users)
+	assert.Equal(t, int64(2), report.Removed)
+
+	for _, u := range users {
+		items, err := testDbClient.UserItems(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		assert.Empty(t, items)
+		profile, err := testDbClient.UserProfile(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), profile.ItemCount)
+	}
+
+	_, err = testDbClient.RevokeItem(ctx, io.Discard, "no-such-item")
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+}
+
+func TestProjection(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.EventSourced = true
+	drain := func() {
+		_, err := d.ProjectPending(ctx)
+		assert.Nil(t, err)
+	}
+	// read from user_items, not to see the cache which projectors don't patch
+	projected := func(userID string) (quantity int64, createdAt time.Time) {
+		row, err := d.readRow(ctx, "user_items", spanner.Key{userID, itemTestID}, []string{"quantity", "created_at"})
+		assert.Nil(t, err)
+		if row != nil {
+			assert.Nil(t, row.Columns(&quantity, &createdAt))
+		}
+		return quantity, createdAt
+	}
+
+	u := UserParams{UserID: uuid.NewString(), UserName: "projected"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	drain()
+	_, first := projected(u.UserID)
+
+	// stacked as DML mode does, and created_at is of the first one
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	assert.Nil(t, d.revokeItem(ctx, u.UserID, itemTestID, 1))
+	drain()
+	quantity, createdAt := projected(u.UserID)
+	assert.Equal(t, int64(2), quantity)
+	assert.Equal(t, first, createdAt)
+	profile, err := d.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+
+	// projectors stay away while a rebuild holds the lease
+	assert.Nil(t, d.AcquireLease(ctx, projectionLease, "rebuild-test", time.Minute))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	_, err = d.ProjectEvents(ctx)
+	assert.ErrorIs(t, err, ErrLeaseHeld)
+	// left to the rebuild
+	n, err := d.ProjectPending(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, d.AcquireLease(ctx, projectionLease, "another", time.Minute), ErrLeaseHeld)
+	assert.Nil(t, d.ReleaseLease(ctx, projectionLease, "rebuild-test"))
+	drain()
+	quantity, _ = projected(u.UserID)
+	assert.Equal(t, int64(3), quantity)
+}
+
+func TestFixtures(t *testing.T) {
+	ctx := context.Background()
+	alice := "0b7a5e3c-1f2d-4c6e-9a8b-000000000001"
+
+	// loaded twice, as the workshop is reset by loading it again
+	for n := 0; n < 2; n++ {
+		assert.Nil(t, testutil.LoadFixtures(ctx, fakeDbString, []string{"fixtures/workshop.yaml"}))
+	}
+
+	profile, err := testDbClient.UserProfile(ctx, io.Discard, alice)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", profile.Name)
+	assert.Equal(t, int64(2), profile.ItemCount)
+
+	items, err := testDbClient.UserItems(ctx, io.Discard, alice)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+}
+
+func TestUserActivity(t *testing.T) {
+	caching := &Caching{RedisClient: testRdb}
+	userId, _ := uuid.NewUUID()
+	userID := userId.String()
+
+	activities, err := caching.UserActivity(userID, "0")
+	assert.Nil(t, err)
+	assert.Empty(t, activities)
+
+	added, _ := domain.NewItemChanged(userID, 1, itemTestID, EventItemAdded)
+	removed, _ := domain.NewItemChanged(userID, 2, itemTestID, EventItemRemoved)
+	assert.Nil(t, caching.AppendActivity(added))
+	assert.Nil(t, caching.AppendActivity(removed))
+
+	// replayed from the oldest, and the later ones after the id
+	activities, err = caching.UserActivity(userID, "0")
+	assert.Nil(t, err)
+	if assert.Len(t, activities, 2) {
+		assert.Equal(t, added, activities[0].Change)
+		assert.Equal(t, removed, activities[1].Change)
+		later, err := caching.UserActivity(userID, activities[0].ID)
+		assert.Nil(t, err)
+		assert.Equal(t, activities[1:], later)
+	}
+
+	assert.True(t, ValidActivityID("1700000000000-0"))
+	assert.False(t, ValidActivityID("$"))
+	testRdb.Del(activityKey(userID))
+}
+
+func TestStandbyCache(t *testing.T) {
+	// the standby is another db of the same redis
+	standbyRdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1, DialTimeout: 1 * time.Second})
+	defer standbyRdb.Close()
+	primary := &Caching{RedisClient: testRdb}
+	standby := &Caching{RedisClient: standbyRdb}
+	cache := NewStandbyCache(primary, standby)
+	key := "UserItems_standby-" + uuid.NewString()
+
+	// written to both, read from the primary
+	assert.Nil(t, cache.Set(key, "v1"))
+	data, err := standby.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", data)
+	assert.Nil(t, primary.Set(key, "primary only"))
+	data, err = cache.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "primary only", data)
+
+	assert.Nil(t, cache.SwitchReads(true))
+	assert.True(t, cache.ReadingStandby())
+	data, err = cache.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", data)
+	assert.Nil(t, cache.Del(key))
+	_, err = primary.Get(key)
+	assert.Equal(t, redis.Nil, err)
+
+	// another instance follows the switch kept in the standby
+	other := NewStandbyCache(primary, standby)
+	ctx, cancel := context.WithCancel(context.Background())
+	go other.WatchStandby(ctx, 10*time.Millisecond)
+	assert.Eventually(t, other.ReadingStandby, time.Second, 10*time.Millisecond)
+	assert.Nil(t, cache.SwitchReads(false))
+	assert.Eventually(t, func() bool { return !other.ReadingStandby() }, time.Second, 10*time.Millisecond)
+	cancel()
+
+	// copies to an unreachable standby don't fail writes, but make it behind
+	broken := NewStandbyCache(primary, &Caching{RedisClient: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})})
+	assert.Nil(t, broken.Set(key, "v2"))
+	assert.Greater(t, broken.Lag(), time.Duration(0))
+	assert.Nil(t, cache.Set(key, "v3"))
+	assert.Equal(t, time.Duration(0), cache.Lag())
+	assert.Nil(t, cache.Del(key))
+}
+
+func TestAPIKey(t *testing.T) {
+	ctx := context.Background()
+	key, secret, err := testDbClient.CreateAPIKey(ctx, "attendee")
+	assert.Nil(t, err)
+	assert.False(t, key.Revoked())
+
+	name, err := testDbClient.VerifyAPIKey(ctx, secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "attendee", name)
+
+	_, err = testDbClient.VerifyAPIKey(ctx, key.ID+".wrong")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = testDbClient.VerifyAPIKey(ctx, "malformed")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	assert.Nil(t, testDbClient.RevokeAPIKey(ctx, key.ID))
+	_, err = testDbClient.VerifyAPIKey(ctx, secret)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	keys, err := testDbClient.ListAPIKeys(ctx)
+	assert.Nil(t, err)
+	for _, k := range keys {
+		if k.ID == key.ID {
+			assert.True(t, k.Revoked())
+		}
+	}
+
+	// commands, like revoke-api-key, run without a cache
+	key, _, err = testDbClient.CreateAPIKey(ctx, "attendee")
+	assert.Nil(t, err)
+	noCache := testDbClient
+	noCache.Cache = nil
+	assert.Nil(t, noCache.RevokeAPIKey(ctx, key.ID))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.NewString()
+
+	replay, err := testDbClient.ClaimIdempotencyKey(ctx, key, "create-user")
+	assert.Nil(t, err)
+	assert.Nil(t, replay)
+
+	// held by the first request
+	_, err = testDbClient.ClaimIdempotencyKey(ctx, key, "create-user")
+	assert.ErrorIs(t, err, ErrIdempotencyInFlight)
+
+	resp := IdempotentResponse{StatusCode: 200, ContentType: "application/json", Body: []byte(`{"id":"1"}`)}
+	assert.Nil(t, testDbClient.CompleteIdempotencyKey(ctx, key, resp))
+	replay, err = testDbClient.ClaimIdempotencyKey(ctx, key, "create-user")
+	assert.Nil(t, err)
+	assert.Equal(t, &resp, replay)
+
+	_, err = testDbClient.ClaimIdempotencyKey(ctx, key, "add-item")
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	// released keys are claimed again by retries
+	key = uuid.NewString()
+	_, err = testDbClient.ClaimIdempotencyKey(ctx, key, "create-user")
+	assert.Nil(t, err)
+	assert.Nil(t, testDbClient.ReleaseIdempotencyKey(ctx, key))
+	replay, err = testDbClient.ClaimIdempotencyKey(ctx, key, "create-user")
+	assert.Nil(t, err)
+	assert.Nil(t, replay)
+}
+
+func TestCounter(t *testing.T) {
+	ctx := context.Background()
+	name := "test_" + uuid.NewString()
+	for i := 0; i < CounterShards*2; i++ {
+		assert.Nil(t, testDbClient.AddCounter(ctx, name, 2))
+	}
+	total, err := testDbClient.Counter(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(CounterShards*4), total)
+
+	total, err = testDbClient.Counter(ctx, "test_never_added")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), total)
+
+	assert.ErrorIs(t, testDbClient.AddCounter(ctx, "", 1), domain.ErrInvalid)
+}
+
+func TestRetrier(t *testing.T) {
+	ctx := context.Background()
+	r, err := ParseRetrier("3/10ms/40ms, Once=1/0s/0s")
+	assert.Nil(t, err)
+	waits := []time.Duration{}
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	failing := func(code codes.Code, failures int) func() error {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= failures {
+				return status.Error(code, "failed")
+			}
+			return nil
+		}
+	}
+
+	// transient ones are retried with backoff up to the attempts
+	assert.Nil(t, r.Do(ctx, "Twice", failing(codes.Aborted, 2)))
+	assert.Len(t, waits, 2)
+	assert.Less(t, waits[0], 10*time.Millisecond)
+	assert.Less(t, waits[1], 20*time.Millisecond)
+	assert.Equal(t, codes.Unavailable, spanner.ErrCode(r.Do(ctx, "Always", failing(codes.Unavailable, 3))))
+	assert.Equal(t, codes.Unavailable, spanner.ErrCode(r.Do(ctx, "Once", failing(codes.Unavailable, 1))))
+
+	// others and permanent ones are not
+	calls := 0
+	err = r.Do(ctx, "NotFound", func() error { calls++; return status.Error(codes.NotFound, "not found") })
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+	err = r.Do(ctx, "Permanent", func() error { calls++; return permanent(status.Error(codes.Aborted, "aborted")) })
+	assert.Equal(t, codes.Aborted, spanner.ErrCode(err))
+	assert.Equal(t, 2, calls)
+
+	// retries stop when the budget runs out
+	r.tokens = 1
+	calls = 0
+	assert.NotNil(t, r.Do(ctx, "Budget", func() error { calls++; return status.Error(codes.Aborted, "aborted") }))
+	assert.Equal(t, 2, calls)
+
+	off, err := ParseRetrier("off")
+	assert.Nil(t, err)
+	assert.Nil(t, off.Do(ctx, "Off", failing(codes.Aborted, 0)))
+	_, err = ParseRetrier("3/50ms")
+	assert.NotNil(t, err)
+}
+
+// a remote cache in a map, which implements the optional interfaces as Caching does
+type mapCaching map[string]string
+
+func (c mapCaching) Get(key string) (string, error) {
+	data, ok := c[key]
+	if !ok {
+		return "", redis.Nil
+	}
+	return data, nil
+}
+
+func (c mapCaching) Set(key string, data string) error {
+	c[key] = data
+	return nil
+}
+
+func (c mapCaching) Del(key string) error {
+	delete(c, key)
+	return nil
+}
+
+func (c mapCaching) CompareAndSwap(key string, old string, new string) (bool, error) {
+	if c[key] != old {
+		return false, nil
+	}
+	c[key] = new
+	return true, nil
+}
+
+// a cache without the optional interfaces, so entries are invalidated instead of patched
+type plainCaching struct {
+	entries mapCaching
+}
+
+func (c plainCaching) Get(key string) (string, error) {
+	return c.entries.Get(key)
+}
 
+func (c plainCaching) Set(key string, data string) error {
+	return c.entries.Set(key, data)
+}
+
+func (c plainCaching) Del(key string) error {
+	return c.entries.Del(key)
+}
+
+// a remote cache where another instance patches the entry right before the first compare and swap
+type racingCaching struct {
+	mapCaching
+	race  func()
+	swaps []bool
+}
+
+func (c *racingCaching) CompareAndSwap(key string, old string, new string) (bool, error) {
+	if race := c.race; race != nil {
+		c.race = nil
+		race()
+	}
+	swapped, err := c.mapCaching.CompareAndSwap(key, old, new)
+	c.swaps = append(c.swaps, swapped)
+	return swapped, err
+}
+
+func TestCachePatchRace(t *testing.T) {
+	ctx := context.Background()
+	itemId, _ := uuid.NewUUID()
+	item, _ := domain.NewItem(itemId.String(), "raced item", 100)
+	assert.Nil(t, testDbClient.CreateItem(ctx, io.Discard, item))
+
+	d := testDbClient
+	d.Cache = plainCaching{entries: mapCaching{}}
+	u := UserParams{UserID: uuid.NewString(), UserName: "raced"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	for _, itemID := range []string{itemTestID, item.ID} {
+		assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemID}))
+	}
+
+	// the cached entry is of before both grants, and each of them patches it
+	cache := &racingCaching{mapCaching: mapCaching{}}
+	d.Cache = cache
+	key := "UserItems_" + u.UserID
+	empty, err := encodeUserItems(domain.Inventory{}, time.Time{})
+	assert.Nil(t, err)
+	cache.mapCaching[key] = string(empty)
+	committed := time.Now()
+	cache.race = func() {
+		d.patchUserItems(ctx, u.UserID, item.ID, true, committed)
+	}
+	d.patchUserItems(ctx, u.UserID, itemTestID, true, committed)
+
+	// both swapped from the same entry and only the other one won, then the loser patched again on top of it
+	assert.Equal(t, []bool{true, false, true}, cache.swaps)
+	items, _, err := decodeUserItems(cache.mapCaching[key])
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	assert.True(t, items.Has(itemTestID))
+	assert.True(t, items.Has(item.ID))
+
+	// the script on redis lets only one of the ones racing from the same entry win as well
+	caching := &Caching{RedisClient: testRdb}
+	key = "CachePatchRace_" + uuid.NewString()
+	assert.Nil(t, caching.Set(key, "v0"))
+	won := make([]bool, 2)
+	var wg sync.WaitGroup
+	for n := range won {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			swapped, err := caching.CompareAndSwap(key, "v0", fmt.Sprintf("v%d", n+1))
+			assert.Nil(t, err)
+			won[n] = swapped
+		}(n)
+	}
+	wg.Wait()
+	assert.NotEqual(t, won[0], won[1])
+	winner := "v1"
+	if won[1] {
+		winner = "v2"
+	}
+	data, err := caching.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, winner, data)
+	assert.Nil(t, caching.Del(key))
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	ctx := context.Background()
+	caches := map[string]Cacher{
+		"patched":     mapCaching{},
+		"invalidated": plainCaching{entries: mapCaching{}},
+	}
+	for name, cache := range caches {
+		d := testDbClient
+		d.Cache = cache
+		userId, _ := uuid.NewUUID()
+		u := UserParams{UserID: userId.String(), UserName: name}
+		i := ItemParams{ItemID: itemTestID}
+
+		// not found before the user is created
+		_, err := d.UserItems(ctx, io.Discard, u.UserID)
+		assert.Equal(t, codes.NotFound, spanner.ErrCode(err), name)
+
+		assert.Nil(t, d.CreateUser(ctx, io.Discard, u), name)
+		assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, i), name)
+		items, err := d.UserItems(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err, name)
+		assert.Len(t, items, 1, name)
+
+		assert.Nil(t, d.RemoveItemFromUser(ctx, io.Discard, u, i), name)
+		items, err = d.UserItems(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err, name)
+		assert.Empty(t, items, name)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	cache := mapCaching{}
+	d := testDbClient
+	d.Cache = cache
+	d.CacheStrategy = WriteThrough
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "written"}
+	key := "UserItems_" + u.UserID
+
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	// in cache without being read
+	assert.Contains(t, cache[key], itemTestID)
+
+	assert.Nil(t, d.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	assert.Equal(t, "[]", cache[key])
+
+	_, err := ParseCacheStrategy("write-back")
+	assert.NotNil(t, err)
+	s, err := ParseCacheStrategy("invalidate")
+	assert.Nil(t, err)
+	assert.Equal(t, Invalidate, s)
+}
+
+func TestCacheRollout(t *testing.T) {
+	ctx := context.Background()
+	cache := mapCaching{}
+	d := testDbClient
+	d.Cache = cache
+	written, invalidated := UserParams{UserID: uuid.NewString(), UserName: "written"}, UserParams{UserID: uuid.NewString(), UserName: "invalidated"}
+	d.CacheRollout = func(userID string) CacheStrategy {
+		if userID == written.UserID {
+			return WriteThrough
+		}
+		return ""
+	}
+	d.CacheStrategy = Invalidate
+	assert.Equal(t, WriteThrough, d.cacheStrategyOf(written.UserID))
+	assert.Equal(t, Invalidate, d.cacheStrategyOf(invalidated.UserID))
+
+	for _, u := range []UserParams{written, invalidated} {
+		assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+		_, err := d.UserItems(ctx, io.Discard, u.UserID)
+		assert.Nil(t, err)
+		assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	}
+	assert.Contains(t, cache["UserItems_"+written.UserID], itemTestID)
+	_, cached := cache["UserItems_"+invalidated.UserID]
+	assert.False(t, cached)
+}
+
+func TestWriteModes(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	var err error
+	d.WriteModes, err = ParseWriteModes("mutation")
+	assert.Nil(t, err)
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "mutated"}
+
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Equal(t, codes.AlreadyExists, spanner.ErrCode(d.CreateUser(ctx, io.Discard, u)))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID, Quantity: 2}))
+
+	// the same rows as DML writes
+	profile, err := d.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+	items, err := d.queryUserItems(ctx, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, int64(3), items[0].Quantity)
+	unknown := UserParams{UserID: uuid.NewString(), UserName: "unknown"}
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(d.AddItemToUser(ctx, io.Discard, unknown, ItemParams{ItemID: itemTestID})))
+
+	modes, err := ParseWriteModes("CreateUser=mutation, AddItemToUser=dml")
+	assert.Nil(t, err)
+	assert.Equal(t, WriteMutation, modes.of("CreateUser"))
+	assert.Equal(t, WriteDML, modes.of("AddItemToUser"))
+	assert.Equal(t, WriteDML, WriteModes{}.of("CreateUser"))
+	for _, config := range []string{"batch", "DeleteUser=mutation", "CreateUser=apply"} {
+		_, err := ParseWriteModes(config)
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestInvalidateUserItems(t *testing.T) {
+	caching := &Caching{RedisClient: testRdb, Epoch: CacheEpoch{Current: "test"}}
+	userID := uuid.NewString()
+	key := "UserItems_" + userID
+	change := func(seq int64) domain.ItemChanged {
+		e, err := domain.NewItemChanged(userID, seq, itemTestID, EventItemAdded)
+		assert.Nil(t, err)
+		return e
+	}
+
+	// the first one is applied, there is no sequence of the user yet
+	assert.Nil(t, caching.Set(key, "[]"))
+	applied, err := caching.InvalidateUserItems(change(5))
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	_, err = caching.Get(key)
+	assert.Equal(t, redis.Nil, err)
+
+	for _, c := range []struct {
+		name    string
+		seq     int64
+		applied bool
+	}{
+		{"replayed", 5, false},
+		{"older", 3, false},
+		{"newer", 6, true},
+		{"after newer", 6, false},
+		{"newer with a gap", 9, true},
+		{"older than the gap", 7, false},
+	} {
+		assert.Nil(t, caching.Set(key, "[]"), c.name)
+		applied, err := caching.InvalidateUserItems(change(c.seq))
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.applied, applied, c.name)
+		// the entry is kept by the ones ignored, which are of before it was filled
+		_, err = caching.Get(key)
+		assert.Equal(t, c.applied, err == redis.Nil, c.name)
+	}
+}
+
+func TestItemQuantity(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = mapCaching{}
+	u := UserParams{UserID: uuid.NewString(), UserName: "stacked"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), items[0].Quantity)
+
+	// stacked in place, and the cached items are patched with the new quantity
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID, Quantity: 5}))
+	items, err = d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, int64(6), items[0].Quantity)
+
+	profile, err := d.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+
+	for _, quantity := range []int64{-1, 1001} {
+		err := d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID, Quantity: quantity})
+		assert.True(t, errors.Is(err, domain.ErrInvalid), quantity)
+	}
+
+	// entries cached before quantities are of one each
+	items, _, err = decodeUserItems(`[{"user_name":"stacked","item_name":"sword","item_id":"i1"}]`)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), items[0].Quantity)
+}
+
+func TestStaleness(t *testing.T) {
+	ctx := context.Background()
+	for config, want := range map[string]string{
+		"":          "strong",
+		"strong":    "strong",
+		"exact:10s": "exact:10s",
+		"max:1m":    "max:1m0s",
+	} {
+		s, err := ParseStaleness(config)
+		assert.Nil(t, err, config)
+		assert.Equal(t, want, s.String())
+	}
+	assert.Equal(t, "strong", Staleness{}.String())
+	for _, config := range []string{"stale", "max", "max:0s", "exact:2h", "bounded:10s"} {
+		_, err := ParseStaleness(config)
+		assert.NotNil(t, err, config)
+	}
+
+	s, err := ParseStaleness("max:10s")
+	assert.Nil(t, err)
+	_, err = testDbClient.UserItems(WithStaleness(ctx, s), io.Discard, userTestID)
+	assert.Nil(t, err)
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	userID := uuid.NewString()
+	ndjson := fmt.Sprintf(`{"type":"user","user_id":%q,"name":"imported"}
+
+{"type":"user_item","user_id":%q,"item_id":%q}
+{"type":"user","user_id":%q,"name":"existing"}
+`, userID, userID, itemTestID, userTestID)
+	records, err := ReadImportRecords(strings.NewReader(ndjson))
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+
+	for _, broken := range []string{
+		`{"type":"item","user_id":"u1"}`,
+		`{"type":"user","user_id":"u1"}`,
+		`{"type":"user_item","user_id":"u1","item_id":"NOT AN ID"}`,
+		`{"type":"user_item","user_id":"u1","item_id":"i1"}` + "\n" + `{"type":"user_item","user_id":"u1","item_id":"i1"}`,
+		`not json`,
+	} {
+		_, err := ReadImportRecords(strings.NewReader(broken))
+		assert.ErrorIs(t, err, domain.ErrInvalid, broken)
+	}
+
+	var progress []ImportProgress
+	report, err := testDbClient.Import(ctx, records, func(p ImportProgress) { progress = append(progress, p) })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Groups)
+	assert.Equal(t, 1, report.Applied)
+	assert.Equal(t, 2, report.Records)
+	// the user exists, so none of its group is written
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, userTestID, report.Failures[0].UserID)
+	assert.Equal(t, []ImportProgress{report.ImportProgress}, progress)
+
+	profile, err := testDbClient.UserProfile(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+}
+
+func TestUserItemsPage(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = &Caching{RedisClient: testRdb}
+	d.ValidateCache = true
+	u := UserParams{UserID: uuid.NewString(), UserName: "paged"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	itemIDs := []string{"46f026ae-c6e9-4e41-82e5-240c7645a553", "7470b7c2-c4ef-449e-bd6a-0471a7d258e8", "6d027790-3e97-4e84-9131-98295b1ce2b3"}
+	_, err := d.AddItemsToUser(ctx, io.Discard, u, itemIDs)
+	assert.Nil(t, err)
+	sort.Strings(itemIDs)
+
+	var paged []string
+	cursor := ""
+	for pages := 0; pages < 2; pages++ {
+		items, next, err := d.UserItemsPage(ctx, io.Discard, u.UserID, 2, cursor)
+		assert.Nil(t, err)
+		for _, item := range items {
+			paged = append(paged, item.ItemID)
+		}
+		cursor = next
+	}
+	assert.Equal(t, itemIDs, paged)
+	assert.Equal(t, "", cursor)
+
+	// the first page is cached by its limit and cursor, and a write makes it stale
+	cacheCtx, status := WithCacheStatus(ctx)
+	_, _, err = d.UserItemsPage(cacheCtx, io.Discard, u.UserID, 2, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "hit", status.String())
+	assert.Nil(t, d.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemIDs[0]}))
+	items, next, err := d.UserItemsPage(cacheCtx, io.Discard, u.UserID, 2, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "stale", status.String())
+	assert.Len(t, items, 2)
+	assert.Equal(t, "", next)
+
+	_, _, err = d.UserItemsPage(ctx, io.Discard, uuid.NewString(), 2, "")
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+	_, _, err = d.UserItemsPage(ctx, io.Discard, u.UserID, 2, "%%%")
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestRowLimit(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = mapCaching{}
+	u := UserParams{UserID: uuid.NewString(), UserName: "limited"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	_, err := d.AddItemsToUser(ctx, io.Discard, u, []string{"46f026ae-c6e9-4e41-82e5-240c7645a553", "7470b7c2-c4ef-449e-bd6a-0471a7d258e8"})
+	assert.Nil(t, err)
+
+	_, err = d.UserItems(WithRowLimit(ctx, 1), io.Discard, u.UserID)
+	var tooMany *ErrTooManyRows
+	assert.ErrorAs(t, err, &tooMany)
+	assert.Equal(t, 1, tooMany.Limit)
+	// nothing is cached by the failed read
+	_, err = d.Cache.Get("UserItems_" + u.UserID)
+	assert.NotNil(t, err)
+
+	items, err := d.UserItems(WithRowLimit(ctx, 2), io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	// pages are within the limit
+	items, _, err = d.UserItemsPage(WithRowLimit(ctx, 2), io.Discard, u.UserID, 1, "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+// a cache which remembers the ttls of entries set with them
+type ttlCaching struct {
+	mapCaching
+	ttls map[string]time.Duration
+}
+
+func (c ttlCaching) SetWithTTL(key string, data string, ttl time.Duration) error {
+	c.ttls[key] = ttl
+	return c.mapCaching.Set(key, data)
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	cache := ttlCaching{mapCaching: mapCaching{}, ttls: map[string]time.Duration{}}
+	d := testDbClient
+	d.Cache = cache
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "unknown"}
+	key := "UserItems_" + u.UserID
+
+	_, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+	assert.Equal(t, userNotFoundEntry, cache.mapCaching[key])
+	assert.Equal(t, userNotFoundTTL, cache.ttls[key])
+
+	// answered by cache, Spanner would say the user has no items
+	d.Sc = nil
+	_, err = d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Equal(t, codes.NotFound, spanner.ErrCode(err))
+
+	// a user without items is not unknown
+	d.Sc = testDbClient.Sc
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.NotContains(t, cache.mapCaching, key)
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Empty(t, items)
+}
+
+func TestCorruptCache(t *testing.T) {
+	ctx := context.Background()
+	cache := mapCaching{}
+	d := testDbClient
+	d.Cache = cache
+	u := UserParams{UserID: uuid.NewString(), UserName: "corrupt"}
+	key := "UserItems_" + u.UserID
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	// read from Spanner instead of answering an empty inventory, and cached again
+	cache[key] = `[{"item_id":`
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	_, _, err = decodeUserItems(cache[key])
+	assert.Nil(t, err)
+}
+
+func TestValidateCache(t *testing.T) {
+	ctx := context.Background()
+	caching := &Caching{RedisClient: testRdb}
+	d := testDbClient
+	d.Cache = caching
+	d.ValidateCache = true
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "validated"}
+	key := "UserItems_" + u.UserID
+
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+	written, ok, err := caching.LastWrite(writeStampKey(u.UserID))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// filled by a read which raced with the write, it's stale however late it's cached
+	stale, err := encodeUserItems(domain.Inventory{}, written.Add(-time.Microsecond))
+	assert.Nil(t, err)
+	assert.Nil(t, caching.Set(key, string(stale)))
+	items, err := d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	// the entry filled by the miss has the write, it's served without Spanner
+	cached, err := caching.Get(key)
+	assert.Nil(t, err)
+	_, readAt, err := decodeUserItems(cached)
+	assert.Nil(t, err)
+	assert.False(t, readAt.Before(written))
+	d.Sc = nil
+	items, err = d.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+// a cache which always misses, as the entry of a hot user has just expired
+type missCaching struct{}
+
+func (c missCaching) Get(key string) (string, error) {
+	return "", redis.Nil
+}
+
+func (c missCaching) Set(key string, data string) error {
+	return nil
+}
+
+func (c missCaching) Del(key string) error {
+	return nil
+}
+
+func TestUserItemsStampede(t *testing.T) {
+	ctx := context.Background()
+	d := testDbClient
+	d.Cache = missCaching{}
+	userId, _ := uuid.NewUUID()
+	u := UserParams{UserID: userId.String(), UserName: "hot"}
+	assert.Nil(t, d.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, d.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemTestID}))
+
+	// whether they share a query or not, all of them see the same items
+	var wg sync.WaitGroup
+	results := make([]domain.Inventory, 10)
+	for n := range results {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			items, err := d.UserItems(ctx, io.Discard, u.UserID)
+			assert.Nil(t, err)
+			results[n] = items
+		}(n)
+	}
+	wg.Wait()
+	for _, items := range results {
+		assert.Len(t, items, 1)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	now := time.Now()
+	remote := mapCaching{}
+	tc := NewTieredCache(remote, 2, time.Second)
+	tc.local.now = func() time.Time { return now }
+
+	// hits in process don't see changes of other instances until the ttl
+	assert.Nil(t, tc.Set("a", "1"))
+	remote["a"] = "2"
+	data, err := tc.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", data)
+	now = now.Add(time.Second)
+	data, _ = tc.Get("a")
+	assert.Equal(t, "2", data)
+
+	// the least recently used one is evicted
+	remote["b"], remote["c"] = "b", "c"
+	tc.Get("b")
+	tc.Get("a")
+	tc.Get("c")
+	_, ok := tc.local.get("b")
+	assert.False(t, ok)
+	_, ok = tc.local.get("a")
+	assert.True(t, ok)
+
+	// a lost swap drops the stale entry, and a delete drops both
+	remote["a"] = "3"
+	swapped, err := tc.CompareAndSwap("a", "2", "4")
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	data, _ = tc.Get("a")
+	assert.Equal(t, "3", data)
+	assert.Nil(t, tc.Del("a"))
+	_, err = tc.Get("a")
+	assert.Equal(t, redis.Nil, err)
+
+	// the remote doesn't have ttls
+	assert.ErrorIs(t, tc.SetWithTTL("d", "d", time.Minute), errNotSupported)
+
+	size, ttl, err := ParseLocalCache("1000, 500ms")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, size)
+	assert.Equal(t, 500*time.Millisecond, ttl)
+	_, _, err = ParseLocalCache("1000")
+	assert.NotNil(t, err)
+}
+
+func TestMemcaching(t *testing.T) {
+	assert.Equal(t, int32(2), memcacheExpiration(cacheTTL))
+	assert.Equal(t, int32(2), memcacheExpiration(1500*time.Millisecond))
+	assert.Equal(t, int32(1), memcacheExpiration(time.Millisecond))
+
+	mc := NewMemcaching([]string{"127.0.0.1:11211"}, CacheEpoch{Current: "test"})
+	defer mc.Client.Close()
+	if err := mc.Client.Ping(); err != nil {
+		t.Skip("memcached is not running", err)
+	}
+	key := "Memcaching_" + uuid.NewString()
+	_, err := mc.Get(key)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, mc.Set(key, "a"))
+	data, err := mc.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", data)
+
+	swapped, err := mc.CompareAndSwap(key, "x", "b")
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	swapped, err = mc.CompareAndSwap(key, "a", "b")
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	data, _ = mc.Get(key)
+	assert.Equal(t, "b", data)
+
+	assert.Nil(t, mc.Del(key))
+	assert.Nil(t, mc.Del(key))
+	assert.Equal(t, CacheHealthy, mc.Health.State())
+}
+
+func TestCacheHealth(t *testing.T) {
+	failed := errors.New("redis is down")
+	// n calls of the same result
+	calls := func(n int, err error) []error {
+		errs := make([]error, n)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	seq := func(parts ...[]error) []error {
+		errs := []error{}
+		for _, p := range parts {
+			errs = append(errs, p...)
+		}
+		return errs
+	}
+	// over a fifth of the window are errors, but never four in a row
+	flaky := seq(calls(10, nil), calls(1, failed), calls(1, nil), calls(1, failed), calls(1, nil), calls(1, failed), calls(1, nil), calls(1, failed))
+
+	for _, c := range []struct {
+		name  string
+		calls []error
+		state CacheState
+	}{
+		{"no calls", nil, CacheHealthy},
+		{"successes", calls(30, nil), CacheHealthy},
+		{"an error in a clean window", seq(calls(10, nil), calls(1, failed)), CacheHealthy},
+		{"errors of a fifth of the window", seq(calls(16, nil), calls(4, failed)), CacheHealthy},
+		{"errors over a fifth of the window", flaky, CacheDegraded},
+		{"errors rolled out of the window", seq(flaky, calls(healthWindowSize, nil)), CacheHealthy},
+		{"errors still in the window", seq(flaky, calls(2, nil)), CacheDegraded},
+		{"consecutive errors under the limit", seq(calls(20, nil), calls(downConsecutiveErrs-1, failed)), CacheHealthy},
+		{"consecutive errors", calls(downConsecutiveErrs, failed), CacheDown},
+		{"consecutive errors while degraded", seq(flaky, calls(downConsecutiveErrs, failed)), CacheDown},
+		{"errors while down", calls(downConsecutiveErrs*3, failed), CacheDown},
+		{"a success while down", seq(calls(downConsecutiveErrs, failed), calls(1, nil)), CacheDegraded},
+		{"successes after down", seq(calls(downConsecutiveErrs, failed), calls(2, nil)), CacheHealthy},
+		{"an error after recovered", seq(calls(downConsecutiveErrs, failed), calls(1, nil), calls(1, failed)), CacheDegraded},
+		{"down again after recovered", seq(calls(downConsecutiveErrs, failed), calls(1, nil), calls(downConsecutiveErrs, failed)), CacheDown},
+	} {
+		h := NewCacheHealth()
+		for _, err := range c.calls {
+			h.Observe(err)
+		}
+		assert.Equal(t, c.state, h.State(), c.name)
+		assert.Equal(t, c.state != CacheDown, h.Usable(), c.name)
+	}
+
+	// without health, the cache is always tried
+	var h *CacheHealth
+	h.Observe(failed)
+	assert.Equal(t, CacheHealthy, h.State())
+	assert.True(t, h.Usable())
+	assert.False(t, h.Slow())
+
+	h = NewCacheHealth()
+	h.ObserveLatency(time.Millisecond)
+	assert.False(t, h.Slow())
+	for i := 0; i < 20; i++ {
+		h.ObserveLatency(100 * time.Millisecond)
+	}
+	assert.True(t, h.Slow())
+}
+
+func TestCacheMetrics(t *testing.T) {
+	assert.Equal(t, "UserItems", keyPrefix("UserItems_"+uuid.NewString()))
+	assert.Equal(t, "UserItems", keyPrefix("UserItems_x_page_10_"))
+	assert.Equal(t, "APIKey", keyPrefix(apiKeyCacheKey("k")))
+	assert.Equal(t, "other", keyPrefix("_x"))
+
+	count := func(c prometheus.Collector) float64 { return promtestutil.ToFloat64(c) }
+	hits, misses, down := cacheGets.WithLabelValues("Metrics", "hit"), cacheGets.WithLabelValues("Metrics", "miss"), cacheGets.WithLabelValues("Metrics", "down")
+	before := []float64{count(hits), count(misses), count(down)}
+	observeCacheGet("Metrics_a", time.Now(), nil, false)
+	observeCacheGet("Metrics_a", time.Now(), redis.Nil, true)
+	observeCacheGet("Metrics_a", time.Now(), errCacheDown, false)
+	assert.Equal(t, []float64{before[0] + 1, before[1] + 1, before[2] + 1}, []float64{count(hits), count(misses), count(down)})
+
+	failures := cacheSetFailures.WithLabelValues("Metrics", "error")
+	n := count(failures)
+	observeCacheSet("Metrics_a", time.Now(), nil)
+	observeCacheSet("Metrics_a", time.Now(), errors.New("connection refused"))
+	assert.Equal(t, n+1, count(failures))
+}
+
+func TestSpannerMetrics(t *testing.T) {
+	method, _ := tag.NewKey("grpc_client_method")
+	latency := &view.View{
+		Name:        "cloud.google.com/go/spanner/test_latency",
+		Description: "Latency",
+		Measure:     stats.Int64("test_latency", "", stats.UnitMilliseconds),
+		Aggregation: view.Distribution(1, 10),
+	}
+	acquired := &view.View{
+		Name:        "cloud.google.com/go/spanner/test_acquired_sessions",
+		Description: "Acquired",
+		Measure:     stats.Int64("test_acquired_sessions", "", stats.UnitDimensionless),
+		Aggregation: view.Count(),
+	}
+	views := &spannerViews{data: map[string]*view.Data{}}
+	views.ExportView(&view.Data{View: latency, Rows: []*view.Row{{
+		Tags: []tag.Tag{{Key: method, Value: "ExecuteSql"}},
+		Data: &view.DistributionData{Count: 4, Mean: 5, CountPerBucket: []int64{1, 2, 1}},
+	}}})
+	views.ExportView(&view.Data{View: acquired, Rows: []*view.Row{{Data: &view.CountData{Value: 3}}}})
+
+	expected := `
+# HELP game_spanner_test_acquired_sessions_total Acquired
+# TYPE game_spanner_test_acquired_sessions_total counter
+game_spanner_test_acquired_sessions_total 3
+# HELP game_spanner_test_latency_milliseconds Latency
+# TYPE game_spanner_test_latency_milliseconds histogram
+game_spanner_test_latency_milliseconds_bucket{grpc_client_method="ExecuteSql",le="1"} 1
+game_spanner_test_latency_milliseconds_bucket{grpc_client_method="ExecuteSql",le="10"} 3
+game_spanner_test_latency_milliseconds_bucket{grpc_client_method="ExecuteSql",le="+Inf"} 4
+game_spanner_test_latency_milliseconds_sum{grpc_client_method="ExecuteSql"} 20
+game_spanner_test_latency_milliseconds_count{grpc_client_method="ExecuteSql"} 4
+`
+	assert.Nil(t, promtestutil.CollectAndCompare(views, strings.NewReader(expected)))
+}
+
+func TestQuery(t *testing.T) {
+	type params struct {
+		UserID string `spanner:"userID"`
+		ItemID string `spanner:"itemID"`
+	}
+	q, err := parseQuery[params](`SELECT * FROM user_items@{FORCE_INDEX=_BASE_TABLE} WHERE user_id = @userID AND item_id = @itemID OR item_id = @itemID`)
+	assert.Nil(t, err)
+	stmt := q.Statement(params{UserID: "u", ItemID: "i"})
+	assert.Equal(t, map[string]interface{}{"userID": "u", "itemID": "i"}, stmt.Params)
+
+	// the mismatch AddItemToUser had
+	_, err = parseQuery[params](`INSERT user_items (user_id, item_id) VALUES (@userID, @itemId)`)
+	assert.ErrorContains(t, err, "missing [itemId], unused [itemID]")
+
+	type untagged struct {
+		UserID string
+	}
+	_, err = parseQuery[untagged](`SELECT * FROM users WHERE user_id = @UserID`)
+	assert.NotNil(t, err)
+	_, err = parseQuery[string](`SELECT 1`)
+	assert.NotNil(t, err)
+}
+
+func TestParseDependencies(t *testing.T) {
+	deps, err := ParseDependencies("")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultDependencies, deps)
+
+	deps, err = ParseDependencies(`{"spanner":{"timeout":"5s","retry":"off"},"redis":{"read_timeout":"200ms"}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(5*time.Second), deps.Spanner.Timeout)
+	assert.Equal(t, "off", deps.Spanner.Retry)
+	// the others are the defaults
+	assert.Equal(t, DefaultDependencies.Spanner.Breaker, deps.Spanner.Breaker)
+	assert.Equal(t, 200*time.Millisecond, deps.Redis.Options("localhost:6379", "").ReadTimeout)
+	assert.Equal(t, DefaultDependencies.Redis.PoolSize, deps.Redis.PoolSize)
+	assert.Equal(t, DefaultDependencies.PubSub, deps.PubSub)
+
+	for _, config := range []string{
+		`{"spanner":{"timeout":5}}`,
+		`{"spanner":{"retry":"3"}}`,
+		`{"redis":{"dial_timeout":"-1s"}}`,
+		`{"redis":{"pool_size":0}}`,
+		`{"pubsub":{"publish_timeout":"0s"}}`,
+	} {
+		_, err := ParseDependencies(config)
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestSpannerTimeout(t *testing.T) {
+	d := testDbClient
+	d.Retrier = NewRetrier(RetryPolicy{MaxAttempts: 2})
+	d.Timeout = time.Millisecond
+	var deadlines int
+	err := d.retry(context.Background(), "TestSpannerTimeout", func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.True(t, time.Until(deadline) <= time.Millisecond)
+		deadlines++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	// each attempt has its own deadline, and the hung one is tried again
+	assert.Equal(t, codes.Unavailable, spanner.ErrCode(err))
+	assert.Equal(t, 2, deadlines)
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(2, 10*time.Second, time.Second)
+	b.now = func() time.Time { return now }
+	d := dbClient{Breaker: b}
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	// errors of requests don't count, and a success resets the failures
+	assert.NotNil(t, d.guard(func() error { return status.Error(codes.NotFound, "not found") }))
+	assert.NotNil(t, d.guard(func() error { return unavailable }))
+	assert.Nil(t, d.guard(func() error { return nil }))
+	assert.NotNil(t, d.guard(func() error { return unavailable }))
+	assert.Equal(t, BreakerClosed, b.State())
+
+	called := false
+	assert.NotNil(t, d.guard(func() error { return unavailable }))
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, d.guard(func() error { called = true; return nil }), ErrCircuitOpen)
+	assert.False(t, called)
+
+	// a failed probe opens it again, and a successful one closes it
+	now = now.Add(10 * time.Second)
+	assert.NotNil(t, d.guard(func() error { return unavailable }))
+	assert.Equal(t, BreakerOpen, b.State())
+	now = now.Add(10 * time.Second)
+	done, err := b.Allow()
+	assert.Nil(t, err)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	done(nil, time.Millisecond)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// slow calls are failures
+	done, _ = b.Allow()
+	done(nil, 2*time.Second)
+	done, _ = b.Allow()
+	done(nil, 2*time.Second)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	off, err := ParseBreaker("off")
+	assert.Nil(t, err)
+	assert.Nil(t, off)
+	_, err = ParseBreaker("0,10s")
+	assert.NotNil(t, err)
 }
 
 func TestCleaning(t *testing.T) {
@@ -183,3 +1983,211 @@ func TestCleaning(t *testing.T) {
 		},
 	)
 }
+
+func TestValidation(t *testing.T) {
+	defer domain.SetNameRules(domain.NameRules{MaxLength: 64, Chars: domain.NameCharsAny})
+
+	assert.Nil(t, validate.Var(uuid.NewString(), "uuid4"))
+	assert.NotNil(t, validate.Var(strings.ToUpper(uuid.NewString()), "uuid4"))
+	assert.NotNil(t, validate.Var("not-a-uuid", "uuid4"))
+
+	assert.Nil(t, checkParams(ItemParams{ItemID: itemTestID}))
+	assert.True(t, errors.Is(checkParams(ItemParams{ItemID: "Sword 1"}), domain.ErrInvalid))
+
+	assert.Nil(t, ConfigureValidation(""))
+	assert.NotNil(t, ConfigureValidation(`{"name_chars":"emoji"}`))
+	assert.Nil(t, ConfigureValidation(`{"max_name_length":8,"name_chars":"ascii"}`))
+	assert.Nil(t, checkParams(UserParams{UserID: "a1b2", UserName: "alice"}))
+	assert.True(t, errors.Is(checkParams(UserParams{UserID: "a1b2", UserName: "アリス"}), domain.ErrInvalid))
+	name := "alice-and-bob"
+	assert.True(t, errors.Is(checkParams(UserPatch{Name: &name}), domain.ErrInvalid))
+}
+
+func TestIDHashing(t *testing.T) {
+	defer ConfigureIDHashing(string(idHashSalt), idHashRaw)
+
+	assert.ErrorIs(t, ConfigureIDHashing("", false), ErrNoIDHashSalt)
+	assert.Nil(t, ConfigureIDHashing("", true))
+	assert.Equal(t, "u1", HashID("u1"))
+
+	assert.Nil(t, ConfigureIDHashing("salt", false))
+	salted := HashID("u1")
+	assert.Len(t, salted, 24)
+	assert.Nil(t, ConfigureIDHashing("another", false))
+	assert.NotEqual(t, salted, HashID("u1"))
+}
+
+func TestParseRedisConfig(t *testing.T) {
+	config, err := ParseRedisConfig("", "", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, RedisStandalone, config.Mode)
+
+	config, err = ParseRedisConfig("cluster", "10.0.0.1:6379, 10.0.0.2:6379", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:6379", "10.0.0.2:6379"}, config.Addrs)
+
+	config, err = ParseRedisConfig("sentinel", "10.0.0.1:26379", "mymaster", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "mymaster", config.MasterName)
+
+	for _, c := range [][2]string{{"", "a:6379,b:6379"}, {"cluster", ""}, {"sentinel", "10.0.0.1:26379"}, {"replica", "a:6379"}} {
+		_, err := ParseRedisConfig(c[0], c[1], "", "")
+		assert.NotNil(t, err, c)
+	}
+
+	// a standalone one is a cluster of a master
+	caching := &Caching{RedisClient: testRdb}
+	key := "UserItems_" + uuid.NewString()
+	assert.Nil(t, testRdb.Set(key, "[]", time.Minute).Err())
+	deleted, err := caching.FlushGameKeys()
+	assert.Nil(t, err)
+	assert.True(t, deleted >= 1)
+	assert.Equal(t, int64(0), testRdb.Exists(key).Val())
+}
+
+func TestLiteClient(t *testing.T) {
+	ctx := context.Background()
+	cache := mapCaching{}
+	l, err := NewLiteClient(cache)
+	assert.Nil(t, err)
+	var changes []domain.ItemChanged
+	l.EmitChange = func(ctx context.Context, e domain.ItemChanged) error {
+		changes = append(changes, e)
+		return nil
+	}
+
+	// the catalog of the schemas
+	items, next, err := l.ListItems(ctx, io.Discard, 0, "")
+	assert.Nil(t, err)
+	assert.Len(t, items, DefaultPageSize)
+	assert.NotEmpty(t, next)
+	item, err := l.Item(ctx, io.Discard, "46f026ae-c6e9-4e41-82e5-240c7645a553")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), item.Price)
+
+	u := UserParams{UserID: uuid.NewString(), UserName: "lite"}
+	assert.Nil(t, l.CreateUser(ctx, io.Discard, u))
+	assert.Equal(t, codes.AlreadyExists, status.Code(l.CreateUser(ctx, io.Discard, u)))
+	_, err = l.UserItems(ctx, io.Discard, "no-such-user")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	since := time.Now()
+	assert.Nil(t, l.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: item.ID, Quantity: 2}))
+	assert.Len(t, changes, 1)
+	assert.Equal(t, int64(1), changes[0].Seq)
+	inventory, err := l.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, inventory, 1)
+	assert.Equal(t, int64(2), inventory[0].Quantity)
+	assert.Contains(t, cache, "UserItems_"+u.UserID)
+
+	// a write drops the cached items
+	_, err = l.CreditWallet(ctx, io.Discard, u.UserID, 150, domain.LedgerCredit, "")
+	assert.Nil(t, err)
+	_, err = l.PurchaseItem(ctx, io.Discard, u, ItemParams{ItemID: "7470b7c2-c4ef-449e-bd6a-0471a7d258e8"})
+	assert.True(t, errors.Is(err, ErrInsufficientBalance))
+	receipt, err := l.PurchaseItem(ctx, io.Discard, u, ItemParams{ItemID: item.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), receipt.Price)
+	assert.NotContains(t, cache, "UserItems_"+u.UserID)
+	wallet, err := l.WalletBalance(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50), wallet.Balance)
+	ledger, next, err := l.WalletLedger(ctx, io.Discard, u.UserID, 1, "")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.LedgerPurchase, ledger[0].Reason)
+	ledger, _, err = l.WalletLedger(ctx, io.Discard, u.UserID, 1, next)
+	assert.Nil(t, err)
+	assert.Equal(t, domain.LedgerCredit, ledger[0].Reason)
+
+	assert.Nil(t, l.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: item.ID}))
+	delta, err := l.SyncUserItems(ctx, io.Discard, u.UserID, since)
+	assert.Nil(t, err)
+	assert.Empty(t, delta.Items)
+	assert.Equal(t, []string{item.ID}, delta.Removed)
+
+	// all or nothing, the unknown item fails the others
+	grant, err := domain.NewGrant("quest-"+u.UserID, domain.GrantQuest, []string{item.ID, "no-such-item"}, 100, 50)
+	assert.Nil(t, err)
+	_, err = l.GrantToUser(ctx, io.Discard, u.UserID, grant)
+	assert.True(t, errors.Is(err, domain.ErrInvalid))
+	grant.ItemIDs = []string{item.ID}
+	result, err := l.GrantToUser(ctx, io.Discard, u.UserID, grant)
+	assert.Nil(t, err)
+	assert.True(t, result.Granted)
+	assert.Equal(t, int64(150), result.Wallet.Balance)
+	profile, err := l.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), profile.ItemCount)
+	assert.Equal(t, int64(50), profile.XP)
+
+	records, _, err := l.UserAudit(ctx, io.Discard, u.UserID, 0, "")
+	assert.Nil(t, err)
+	assert.Equal(t, AuditRemoveItem, records[0].Action)
+	assert.Equal(t, AuditCreateUser, records[len(records)-1].Action)
+
+	deleted, err := l.ResetGameData(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted["users"])
+	_, err = l.UserProfile(ctx, io.Discard, u.UserID)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLiteRecordPurchase(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLiteClient(mapCaching{})
+	assert.Nil(t, err)
+	itemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+	u := UserParams{UserID: uuid.NewString(), UserName: "lite"}
+	assert.Nil(t, l.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, l.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemID}))
+
+	p := VerifiedPurchase{ReceiptID: uuid.NewString(), Store: "stub", ItemID: itemID}
+	for _, want := range []bool{true, false} {
+		granted, err := l.RecordPurchase(ctx, io.Discard, u, p)
+		assert.Nil(t, err)
+		assert.Equal(t, want, granted)
+	}
+	inventory, err := l.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), inventory[0].Quantity)
+	records, _, err := l.UserAudit(ctx, io.Discard, u.UserID, 0, "")
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, AuditAddItem, records[0].Action)
+}
+
+func TestLitePurchaseCompensation(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLiteClient(mapCaching{})
+	assert.Nil(t, err)
+	l.EmitReceipt = func(context.Context, Receipt) error {
+		return errors.New("receipts are down")
+	}
+	itemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+
+	u := UserParams{UserID: uuid.NewString(), UserName: "lite"}
+	assert.Nil(t, l.CreateUser(ctx, io.Discard, u))
+	assert.Nil(t, l.AddItemToUser(ctx, io.Discard, u, ItemParams{ItemID: itemID, Quantity: 2}))
+	_, err = l.CreditWallet(ctx, io.Discard, u.UserID, 150, domain.LedgerCredit, "")
+	assert.Nil(t, err)
+
+	// the copies owned before are kept
+	_, err = l.PurchaseItem(ctx, io.Discard, u, ItemParams{ItemID: itemID})
+	assert.NotNil(t, err)
+	inventory, err := l.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, inventory, 1)
+	assert.Equal(t, int64(2), inventory[0].Quantity)
+	wallet, err := l.WalletBalance(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(150), wallet.Balance)
+
+	// and the item is gone when it's the only one
+	assert.Nil(t, l.RemoveItemFromUser(ctx, io.Discard, u, ItemParams{ItemID: itemID}))
+	_, err = l.PurchaseItem(ctx, io.Discard, u, ItemParams{ItemID: itemID})
+	assert.NotNil(t, err)
+	inventory, err = l.UserItems(ctx, io.Discard, u.UserID)
+	assert.Nil(t, err)
+	assert.Empty(t, inventory)
+}
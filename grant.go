@@ -0,0 +1,214 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+// the grant id was given to another user, ids have to be unique across users
+var ErrGrantIDReused = errors.New("grant id is used for another user")
+
+/*
+GrantResult is the grant and the wallet and XP of the user after it.
+Granted is false when the grant was given before, nothing is given again then.
+*/
+type GrantResult struct {
+	domain.Grant
+	Granted bool          `json:"granted"`
+	Wallet  domain.Wallet `json:"wallet"`
+	XP      int64         `json:"xp"`
+}
+
+/*
+GrantToUser gives the items, currency and XP of the grant in a single transaction, all or nothing.
+It fails without giving anything if an item is unknown (ErrInvalid) or already owned (AlreadyExists),
+and NotFound if the user doesn't exist.
+It's idempotent by the grant id, which is recorded in the same transaction, like RecordPurchase is by receipt id.
+*/
+func (d dbClient) GrantToUser(ctx context.Context, w io.Writer, userID string, g domain.Grant) (GrantResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "GrantToUser")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("grant.id", g.GrantID),
+		attribute.String("grant.source", g.Source),
+		attribute.Int("grant.items", len(g.ItemIDs)),
+	)
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return GrantResult{}, err
+	}
+
+	var result GrantResult
+	var lastSeq int64
+	resp, err := d.readWriteTransaction(ctx, "GrantToUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) (err error) {
+		result, lastSeq, err = d.grantIn(ctx, txn, userID, g)
+		return err
+	})
+	if err != nil {
+		return GrantResult{}, err
+	}
+
+	span.SetAttributes(attribute.Bool("grant.granted", result.Granted))
+	d.grantCommitted(ctx, userID, result, lastSeq, resp.CommitTs)
+	return result, nil
+}
+
+// give the grant in txn, all or nothing with the other writes of txn, it returns the sequence of the last item given
+func (d dbClient) grantIn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, g domain.Grant) (GrantResult, int64, error) {
+	result := GrantResult{Grant: g}
+	var lastSeq int64
+
+	// NotFound if the user doesn't exist
+	row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"xp", "version"})
+	if err != nil {
+		return result, 0, err
+	}
+	var version int64
+	if err := row.Columns(&result.XP, &version); err != nil {
+		return result, 0, err
+	}
+
+	given, err := grantedTo(ctx, txn, g.GrantID)
+	if err != nil {
+		return result, 0, err
+	}
+	if given != "" {
+		if given != userID {
+			return result, 0, ErrGrantIDReused
+		}
+		result.Wallet, _, err = readWallet(ctx, txn, userID)
+		return result, 0, err
+	}
+
+	mutations := []*spanner.Mutation{
+		spanner.InsertMap("grants", map[string]interface{}{
+			"grant_id":   g.GrantID,
+			"user_id":    userID,
+			"source":     g.Source,
+			"item_ids":   append([]string{}, g.ItemIDs...),
+			"currency":   g.Currency,
+			"xp":         g.XP,
+			"created_at": spanner.CommitTimestamp,
+		}),
+	}
+	if len(g.ItemIDs) > 0 {
+		if lastSeq, err = d.grantItems(ctx, txn, userID, g.ItemIDs); err != nil {
+			return result, 0, err
+		}
+		if err := d.stageChanges(txn, userID, lastSeq, g.ItemIDs, EventItemAdded); err != nil {
+			return result, 0, err
+		}
+	}
+	if g.Currency > 0 {
+		wallet, changes, err := changeWallet(ctx, txn, userID, g.Currency, domain.LedgerGrant, g.GrantID)
+		if err != nil {
+			return result, 0, err
+		}
+		result.Wallet = wallet
+		mutations = append(mutations, changes...)
+	} else if result.Wallet, _, err = readWallet(ctx, txn, userID); err != nil {
+		return result, 0, err
+	}
+	if g.XP > 0 {
+		result.XP += g.XP
+		// XP is of the profile, so it's a change of the version
+		mutations = append(mutations, spanner.UpdateMap("users", map[string]interface{}{
+			"user_id": userID,
+			"xp":      result.XP,
+			"version": version + 1,
+		}))
+	}
+
+	result.Granted = true
+	return result, lastSeq, txn.BufferWrite(mutations)
+}
+
+// after the grant is committed, the cached items are invalidated and the items given are told as changes
+func (d dbClient) grantCommitted(ctx context.Context, userID string, result GrantResult, lastSeq int64, commitTs time.Time) {
+	if !result.Granted || len(result.ItemIDs) == 0 || d.EventSourced {
+		return
+	}
+	d.invalidateUserItems(ctx, userID, commitTs)
+	for n, itemID := range result.ItemIDs {
+		d.emitChange(ctx, userID, lastSeq-int64(len(result.ItemIDs)-1-n), itemID, EventItemAdded)
+	}
+}
+
+// the user the grant was given to, empty if it's not given yet
+func grantedTo(ctx context.Context, txn *spanner.ReadWriteTransaction, grantID string) (string, error) {
+	row, err := txn.ReadRow(ctx, "grants", spanner.Key{grantID}, []string{"user_id"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var userID string
+	err = row.Columns(&userID)
+	return userID, err
+}
+
+// add all the items or none of them, it returns the sequence of the last one
+func (d dbClient) grantItems(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, itemIDs []string) (int64, error) {
+	known, owned, err := d.batchItemStates(ctx, txn, userID, itemIDs)
+	if err != nil {
+		return 0, err
+	}
+	stmts := make([]spanner.Statement, 0, len(itemIDs))
+	t := time.Now()
+	for _, itemID := range itemIDs {
+		switch {
+		case !known[itemID]:
+			return 0, fmt.Errorf("%w: item %s is not found", domain.ErrInvalid, itemID)
+		case owned[itemID]:
+			return 0, status.Errorf(codes.AlreadyExists, "user already has item %s", itemID)
+		}
+		stmt, err := d.addItemStatement(userID, itemID, t)
+		if err != nil {
+			return 0, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	if _, err := txn.BatchUpdateWithOptions(ctx, stmts, spanner.QueryOptions{RequestTag: "func=GrantToUser,env=dev,action=insert"}); err != nil {
+		return 0, err
+	}
+	if d.EventSourced {
+		// the projector maintains item_count and sequences
+		return 0, nil
+	}
+	n := int64(len(itemIDs))
+	if err := addItemCount(ctx, txn, userID, n); err != nil {
+		return 0, err
+	}
+	if err := addCounter(ctx, txn, CounterItemsGranted, n); err != nil {
+		return 0, err
+	}
+	return reserveUserSeqs(ctx, txn, userID, n)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	idHashSalt = []byte{}
+	idHashRaw  = false
+)
+
+// anyone can hash ids without a salt, and find them in telemetry
+var ErrNoIDHashSalt = errors.New("ID_HASH_SALT is empty, hashed ids can be told by hashing them")
+
+/*
+ConfigureIDHashing should be called once on startup, raw disables hashing for local debugging.
+An empty salt is still used, but ErrNoIDHashSalt is returned, for the caller to fail or warn.
+*/
+func ConfigureIDHashing(salt string, raw bool) error {
+	idHashSalt = []byte(salt)
+	idHashRaw = raw
+	if salt == "" && !raw {
+		return ErrNoIDHashSalt
+	}
+	return nil
+}
+
+// HashID pseudonymizes an id like user id before it lands in logs, spans and metrics
+func HashID(id string) string {
+	if idHashRaw {
+		return id
+	}
+	mac := hmac.New(sha256.New, idHashSalt)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+var (
+	ErrIdempotencyInFlight   = errors.New("the request of the idempotency key is still in progress")
+	ErrIdempotencyKeyReused  = errors.New("the idempotency key is used for another request")
+	errIdempotencyNotClaimed = errors.New("the idempotency key is not claimed")
+)
+
+/*
+a request holding a key longer than it is taken as lost, like its instance was killed in the middle,
+and the key is claimed again by its retry. It's longer than the timeout of requests.
+*/
+const idempotencyLease = 2 * time.Minute
+
+// IdempotentResponse is what is replayed to retries of a request with the same Idempotency-Key
+type IdempotentResponse struct {
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// completed keys are cached with the fingerprint, to tell a reused key without Spanner
+type cachedIdempotency struct {
+	Fingerprint string             `json:"fingerprint"`
+	Response    IdempotentResponse `json:"response"`
+}
+
+func idempotencyCacheKey(key string) string {
+	return fmt.Sprintf("Idempotency_%s", key)
+}
+
+/*
+ClaimIdempotencyKey claims key for the request of fingerprint, or returns the response of the request which completed it.
+Keys are stored in Spanner, so a retry is answered the same by any instance, even after redis loses the cached ones.
+It's ErrIdempotencyInFlight while another request holds it, and ErrIdempotencyKeyReused if the key was used by another request.
+The claimer has to complete it by CompleteIdempotencyKey, or release it by ReleaseIdempotencyKey for the retries to run again.
+*/
+func (d dbClient) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (*IdempotentResponse, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ClaimIdempotencyKey")
+	defer span.End()
+
+	if cached, ok := d.cachedIdempotency(ctx, key); ok {
+		span.SetAttributes(attribute.Bool("idempotency.cached", true))
+		if cached.Fingerprint != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		return &cached.Response, nil
+	}
+
+	var completed *IdempotentResponse
+	_, err := d.readWriteTransaction(ctx, "ClaimIdempotencyKey", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		completed = nil
+		row, err := txn.ReadRow(ctx, "idempotency_keys", spanner.Key{key}, []string{"fingerprint", "status_code", "content_type", "response", "created_at"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.InsertMap("idempotency_keys", map[string]interface{}{
+					"idempotency_key": key,
+					"fingerprint":     fingerprint,
+					"created_at":      spanner.CommitTimestamp,
+				}),
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		var stored string
+		var statusCode spanner.NullInt64
+		var contentType spanner.NullString
+		var body []byte
+		var createdAt time.Time
+		if err := row.Columns(&stored, &statusCode, &contentType, &body, &createdAt); err != nil {
+			return err
+		}
+		if stored != fingerprint {
+			return ErrIdempotencyKeyReused
+		}
+		if statusCode.Valid {
+			completed = &IdempotentResponse{StatusCode: int(statusCode.Int64), ContentType: contentType.StringVal, Body: body}
+			return nil
+		}
+		if time.Since(createdAt) < idempotencyLease {
+			return ErrIdempotencyInFlight
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.UpdateMap("idempotency_keys", map[string]interface{}{
+				"idempotency_key": key,
+				"created_at":      spanner.CommitTimestamp,
+			}),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Bool("idempotency.replayed", completed != nil))
+	if completed != nil {
+		d.setIdempotency(ctx, key, cachedIdempotency{Fingerprint: fingerprint, Response: *completed})
+	}
+	return completed, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request which claimed key, to be replayed to its retries
+func (d dbClient) CompleteIdempotencyKey(ctx context.Context, key string, resp IdempotentResponse) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CompleteIdempotencyKey")
+	defer span.End()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	var fingerprint string
+	_, err := d.readWriteTransaction(ctx, "CompleteIdempotencyKey", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "idempotency_keys", spanner.Key{key}, []string{"fingerprint", "status_code"})
+		if err != nil {
+			return err
+		}
+		var statusCode spanner.NullInt64
+		if err := row.Columns(&fingerprint, &statusCode); err != nil {
+			return err
+		}
+		// completed by a retry which took it over, the first response wins
+		if statusCode.Valid {
+			return errIdempotencyNotClaimed
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.UpdateMap("idempotency_keys", map[string]interface{}{
+				"idempotency_key": key,
+				"status_code":     int64(resp.StatusCode),
+				"content_type":    resp.ContentType,
+				"response":        resp.Body,
+			}),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	d.setIdempotency(ctx, key, cachedIdempotency{Fingerprint: fingerprint, Response: resp})
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the claim of a request which failed, so a retry with the key runs it again
+func (d dbClient) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ReleaseIdempotencyKey")
+	defer span.End()
+
+	_, err := d.readWriteTransaction(ctx, "ReleaseIdempotencyKey", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "idempotency_keys", spanner.Key{key}, []string{"status_code"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var statusCode spanner.NullInt64
+		if err := row.Columns(&statusCode); err != nil {
+			return err
+		}
+		if statusCode.Valid {
+			return nil
+		}
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("idempotency_keys", spanner.Key{key})})
+	})
+	return err
+}
+
+func (d dbClient) cachedIdempotency(ctx context.Context, key string) (cachedIdempotency, bool) {
+	var cached cachedIdempotency
+	done := budget.Track(ctx, budget.Redis)
+	data, err := d.Cache.Get(idempotencyCacheKey(key))
+	done()
+	if err != nil || json.Unmarshal([]byte(data), &cached) != nil {
+		return cached, false
+	}
+	return cached, true
+}
+
+// caching is best effort, Spanner has the completed ones anyway
+func (d dbClient) setIdempotency(ctx context.Context, key string, cached cachedIdempotency) {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	defer budget.Track(ctx, budget.Redis)()
+	if err := d.Cache.Set(idempotencyCacheKey(key), string(data)); err != nil {
+		log.Println("idempotency", key, err)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+ImportRecord is a line of newline delimited json to import, a user or an item owned by a user, like
+{"type":"user","user_id":"...","name":"alice"} or {"type":"user_item","user_id":"...","item_id":"..."}.
+*/
+type ImportRecord struct {
+	Type   string `json:"type"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+	ItemID string `json:"item_id,omitempty"`
+}
+
+const (
+	ImportUser     = "user"
+	ImportUserItem = "user_item"
+)
+
+// ImportProgress is how far an import has gone, a group is a user and its items
+type ImportProgress struct {
+	Groups  int `json:"groups"`
+	Applied int `json:"applied"`
+	Failed  int `json:"failed"`
+	// records of the applied groups
+	Records int `json:"records"`
+}
+
+// ImportFailure is a group which couldn't be written, none of its records are
+type ImportFailure struct {
+	UserID string `json:"user_id"`
+	Error  string `json:"error"`
+}
+
+type ImportReport struct {
+	ImportProgress
+	// up to maxImportFailures of them, Failed has the number of all of them
+	Failures []ImportFailure `json:"failures"`
+}
+
+const (
+	// lines longer than it are not records
+	maxImportLine = 64 << 10
+	// groups written at once
+	importParallel = 8
+	// progress is reported every this many groups, and at the end
+	importProgressEvery = 100
+	maxImportFailures   = 100
+)
+
+/*
+ReadImportRecords reads newline delimited json of ImportRecords, and checks them as CreateUser and AddItemToUser do.
+Any broken line fails the whole import before anything is written, the error tells the line.
+*/
+func ReadImportRecords(r io.Reader) ([]ImportRecord, error) {
+	var records []ImportRecord
+	seen := map[ImportRecord]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec ImportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %s", domain.ErrInvalid, line, err)
+		}
+		if err := checkImportRecord(rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		// a user is a record whatever its name is
+		key := rec
+		key.Name = ""
+		if seen[key] {
+			return nil, fmt.Errorf("%w: line %d: %s of %s is duplicated", domain.ErrInvalid, line, rec.Type, rec.UserID)
+		}
+		seen[key] = true
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", domain.ErrInvalid, err)
+	}
+	return records, nil
+}
+
+func checkImportRecord(rec ImportRecord) error {
+	switch rec.Type {
+	case ImportUser:
+		if rec.Name == "" {
+			return fmt.Errorf("%w: name of the user is required", domain.ErrInvalid)
+		}
+		return checkParams(UserParams{UserID: rec.UserID, UserName: rec.Name})
+	case ImportUserItem:
+		if err := checkParams(UserParams{UserID: rec.UserID}); err != nil {
+			return err
+		}
+		return checkParams(ItemParams{ItemID: rec.ItemID})
+	}
+	return fmt.Errorf("%w: type has to be %s or %s, not %q", domain.ErrInvalid, ImportUser, ImportUserItem, rec.Type)
+}
+
+// records of a user, which are written atomically
+type importGroup struct {
+	userID  string
+	user    *ImportRecord
+	itemIDs []string
+}
+
+// groups by user in the order they first appear
+func importGroups(records []ImportRecord) []*importGroup {
+	var groups []*importGroup
+	byUser := map[string]*importGroup{}
+	for n := range records {
+		rec := &records[n]
+		g, ok := byUser[rec.UserID]
+		if !ok {
+			g = &importGroup{userID: rec.UserID}
+			byUser[rec.UserID] = g
+			groups = append(groups, g)
+		}
+		if rec.Type == ImportUser {
+			g.user = rec
+		} else {
+			g.itemIDs = append(g.itemIDs, rec.ItemID)
+		}
+	}
+	return groups
+}
+
+/*
+the rows are inserted, not upserted, so a user or an item which already exists fails its group.
+item_count of an imported user is of its items in the import, the one of a user which exists is left as it is,
+run recount-items after importing items of users which are not in the import.
+*/
+func (g *importGroup) mutations(now time.Time) []*spanner.Mutation {
+	var ms []*spanner.Mutation
+	if g.user != nil {
+		ms = append(ms, spanner.InsertMap("users", map[string]interface{}{
+			"user_id":    g.userID,
+			"name":       g.user.Name,
+			"created_at": now,
+			"updated_at": now,
+			"item_count": int64(len(g.itemIDs)),
+		}))
+	}
+	for _, itemID := range g.itemIDs {
+		ms = append(ms, spanner.InsertMap("user_items", map[string]interface{}{
+			"user_id":    g.userID,
+			"item_id":    itemID,
+			"created_at": now,
+			"updated_at": spanner.CommitTimestamp,
+		}))
+	}
+	return ms
+}
+
+func (g *importGroup) records() int {
+	n := len(g.itemIDs)
+	if g.user != nil {
+		n++
+	}
+	return n
+}
+
+/*
+Import writes the records by mutation groups, a user with its items a group, so a group is written entirely or not at all,
+and a failed group, like of a user which exists or an unknown item, doesn't stop the others.
+Spanner's BatchWrite takes groups like them in a call, but the client in go.mod is older than it,
+so each group is applied by itself, importParallel of them at once.
+progress is called every importProgressEvery groups and at the end, the error is only of ctx.
+*/
+func (d dbClient) Import(ctx context.Context, records []ImportRecord, progress func(ImportProgress)) (ImportReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Import")
+	defer span.End()
+
+	groups := importGroups(records)
+	span.SetAttributes(attribute.Int("import.records", len(records)), attribute.Int("import.groups", len(groups)))
+
+	report := ImportReport{Failures: []ImportFailure{}}
+	var mu sync.Mutex
+	done := func(g *importGroup, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Groups++
+		if err != nil {
+			report.Failed++
+			if len(report.Failures) < maxImportFailures {
+				report.Failures = append(report.Failures, ImportFailure{UserID: g.userID, Error: err.Error()})
+			}
+		} else {
+			report.Applied++
+			report.Records += g.records()
+		}
+		if progress != nil && report.Groups%importProgressEvery == 0 {
+			progress(report.ImportProgress)
+		}
+	}
+
+	// failed groups don't cancel the others
+	var eg errgroup.Group
+	eg.SetLimit(importParallel)
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		g := g
+		eg.Go(func() error {
+			commitTs, err := d.applyMutations(ctx, "Import", g.mutations(time.Now()))
+			if err == nil {
+				// the user may have been cached as unknown
+				d.invalidateUserItems(ctx, g.userID, commitTs)
+			}
+			done(g, err)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	if progress != nil && report.Groups%importProgressEvery != 0 {
+		progress(report.ImportProgress)
+	}
+	span.SetAttributes(attribute.Int("import.applied", report.Applied), attribute.Int("import.failed", report.Failed))
+	return report, ctx.Err()
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+/*
+ApplyEventOnce runs apply in the same transaction as recording the event id to the inbox table,
+so the side effect of an event is applied exactly once even if the broker redelivers it.
+It returns false when the event has been applied already.
+*/
+func (d dbClient) ApplyEventOnce(ctx context.Context, eventID, eventType string, apply func(context.Context, *spanner.ReadWriteTransaction) error) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ApplyEventOnce")
+	defer span.End()
+	span.SetAttributes(attribute.String("event.id", eventID), attribute.String("event.type", eventType))
+
+	var applied bool
+	_, err := d.readWriteTransaction(ctx, "ApplyEventOnce", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		applied = false
+		_, err := txn.ReadRow(ctx, "inbox", spanner.Key{eventID}, []string{"event_id"})
+		if err == nil {
+			return nil
+		}
+		if spanner.ErrCode(err) != codes.NotFound {
+			return err
+		}
+
+		if err := apply(ctx, txn); err != nil {
+			return err
+		}
+		applied = true
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertMap("inbox", map[string]interface{}{
+				"event_id":     eventID,
+				"event_type":   eventType,
+				"processed_at": spanner.CommitTimestamp,
+			}),
+		})
+	})
+
+	span.SetAttributes(attribute.Bool("event.applied", applied))
+	return applied, err
+}
+
+// RecordEventAnalytics stores an event for analytics exactly once, and counts it by the type
+func (d dbClient) RecordEventAnalytics(ctx context.Context, eventID, eventType string, payload []byte) (bool, error) {
+	return d.ApplyEventOnce(ctx, eventID, eventType, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := addCounter(ctx, txn, EventCounter(eventType), 1); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertMap("event_analytics", map[string]interface{}{
+				"event_id":    eventID,
+				"event_type":  eventType,
+				"payload":     string(payload),
+				"received_at": time.Now(),
+			}),
+		})
+	})
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+users.item_count is a counter of user_items of the user,
+it's updated in the same transaction as every change of user_items,
+so the profile doesn't have to count a large inventory.
+*/
+
+type itemCountParams struct {
+	UserID string `spanner:"userID"`
+	Delta  int64  `spanner:"delta"`
+}
+
+var updateItemCount = newQuery[itemCountParams](`UPDATE users SET item_count = item_count + @delta WHERE user_id = @userID`)
+
+func addItemCount(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	stmt := updateItemCount.Statement(itemCountParams{UserID: userID, Delta: delta})
+	_, err := txn.UpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=addItemCount,env=dev,action=update"})
+	return err
+}
+
+// how many of the item the user has as of the transaction, 0 if the user doesn't have it
+func ownedQuantity(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, itemID string) (int64, error) {
+	row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"quantity"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var quantity int64
+	err = row.Columns(&quantity)
+	return quantity, err
+}
+
+// RecountItems sets item_count of all users from user_items, to backfill it or to fix drift
+func (d dbClient) RecountItems(ctx context.Context) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RecountItems")
+	defer span.End()
+
+	stmt := spanner.Statement{
+		SQL: `UPDATE users SET item_count = (SELECT COUNT(*) FROM user_items WHERE user_items.user_id = users.user_id) WHERE true`,
+	}
+	return d.Sc.PartitionedUpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=RecountItems,env=dev,action=update"})
+}
+
+// get the profile of the user, NotFound if the user doesn't exist
+func (d dbClient) UserProfile(ctx context.Context, w io.Writer, userID string) (domain.Profile, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserProfile")
+	defer span.End()
+
+	row, err := d.readRow(ctx, "users", spanner.Key{userID}, []string{"name", "item_count", "xp", "version"})
+	if err != nil {
+		return domain.Profile{}, err
+	}
+	var name string
+	var itemCount, xp, version int64
+	if err := row.Columns(&name, &itemCount, &xp, &version); err != nil {
+		return domain.Profile{}, err
+	}
+	return domain.NewProfile(userID, name, itemCount, xp, version)
+}
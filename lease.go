@@ -0,0 +1,102 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+/*
+Leases let one holder among instances and commands do work which must not overlap,
+like rebuilding user_items while projectors of every instance run.
+A lease is a row of leases held until leased_until, so one left by a holder which died is taken by another after it.
+A holder can lose the lease while it works, so work which must not overlap checks it in its own transaction by checkLease.
+*/
+
+var ErrLeaseHeld = errors.New("the lease is held by another one")
+
+// AcquireLease takes the lease of name for holder until ttl from now, or extends it if holder has it already
+func (d dbClient) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AcquireLease")
+	defer span.End()
+	span.SetAttributes(attribute.String("lease.name", name))
+
+	_, err := d.readWriteTransaction(ctx, "AcquireLease", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := checkLease(ctx, txn, name, holder); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertOrUpdateMap("leases", map[string]interface{}{
+				"name":         name,
+				"holder":       holder,
+				"leased_until": time.Now().Add(ttl),
+			}),
+		})
+	})
+	return err
+}
+
+// ReleaseLease gives the lease of name up if holder still has it, so the others don't wait for it to expire
+func (d dbClient) ReleaseLease(ctx context.Context, name, holder string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ReleaseLease")
+	defer span.End()
+	span.SetAttributes(attribute.String("lease.name", name))
+
+	_, err := d.readWriteTransaction(ctx, "ReleaseLease", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		err := checkLease(ctx, txn, name, holder)
+		if errors.Is(err, ErrLeaseHeld) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("leases", spanner.Key{name})})
+	})
+	return err
+}
+
+/*
+checkLease returns ErrLeaseHeld if anyone but holder has the lease of name, an empty holder is of no one.
+It's read in txn, so the lease can't be taken by another one until txn ends.
+*/
+func checkLease(ctx context.Context, txn *spanner.ReadWriteTransaction, name, holder string) error {
+	row, err := txn.ReadRow(ctx, "leases", spanner.Key{name}, []string{"holder", "leased_until"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var current string
+	var until time.Time
+	if err := row.Columns(&current, &until); err != nil {
+		return err
+	}
+	if current != holder && until.After(time.Now()) {
+		return fmt.Errorf("%w: %s has %s until %s", ErrLeaseHeld, current, name, until.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,965 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/envelope"
+	"github.com/shin5ok/go-architecting-workshop/fixtures"
+	"github.com/shin5ok/go-architecting-workshop/schemas"
+)
+
+/*
+liteClient keeps the game in memory instead of Spanner, for DB_DRIVER=lite of the API,
+so the API, the cache and change events run on a laptop without Google Cloud, like for the first module of the workshop.
+It fails as the Spanner one does, NotFound and AlreadyExists as grpc statuses and domain.ErrInvalid, so the handlers are the same.
+Nothing survives a restart and instances don't share it, so it's for a single instance.
+Options of the Spanner one, like write modes, staleness, the breaker and event sourcing, don't apply to it.
+*/
+type liteClient struct {
+	// UserItems are cached aside of the store, and dropped after writes of the user
+	Cache Cacher
+	// called as the last step of purchase, receipts are just logged if nil
+	EmitReceipt func(context.Context, Receipt) error
+	// called after items of a user are changed, nothing is emitted if nil
+	EmitChange func(context.Context, domain.ItemChanged) error
+	// encrypts sensitive fields, they can't be used if nil
+	Envelope *envelope.Envelope
+	store    *liteStore
+}
+
+// all the state is guarded by a lock, a write holds it as a transaction would
+type liteStore struct {
+	mu sync.Mutex
+	// the last commit timestamp, timestamps are unique as the ones of Spanner are to a user
+	last        time.Time
+	users       map[string]*liteUser
+	items       map[string]domain.Item
+	grants      map[string]string
+	purchases   map[string]string
+	apiKeys     map[string]*liteAPIKey
+	idempotency map[string]*liteIdempotency
+	// tombstones of users merged into others, the source to the target
+	merges map[string]string
+}
+
+type liteUser struct {
+	name       string
+	xp         int64
+	version    int64
+	seq        int64
+	items      map[string]*liteUserItem
+	tombstones map[string]time.Time
+	wallet     *domain.Wallet
+	// ledger, mails and audit are in the order of creation
+	ledger []domain.LedgerEntry
+	mails  []domain.Mail
+	audit  []AuditRecord
+	pii    *litePII
+}
+
+type liteUserItem struct {
+	quantity  int64
+	updatedAt time.Time
+}
+
+type litePII struct {
+	email, externalID []byte
+}
+
+type liteAPIKey struct {
+	APIKey
+	secretHash string
+}
+
+type liteIdempotency struct {
+	fingerprint string
+	response    *IdempotentResponse
+	claimedAt   time.Time
+}
+
+// a change of items of a user, emitted after the write
+type liteChange struct {
+	seq    int64
+	itemID string
+	kind   string
+}
+
+// NewLiteClient returns the in-memory repository with the catalog inserted by the schemas, see liteClient
+func NewLiteClient(c Cacher) (liteClient, error) {
+	items, err := schemas.Items()
+	if err != nil {
+		return liteClient{}, err
+	}
+	s := &liteStore{
+		users:       map[string]*liteUser{},
+		items:       map[string]domain.Item{},
+		grants:      map[string]string{},
+		purchases:   map[string]string{},
+		apiKeys:     map[string]*liteAPIKey{},
+		idempotency: map[string]*liteIdempotency{},
+		merges:      map[string]string{},
+	}
+	for _, i := range items {
+		item, err := domain.NewItem(i.ID, i.Name, i.Price)
+		if err != nil {
+			return liteClient{}, err
+		}
+		s.items[item.ID] = item
+	}
+	return liteClient{Cache: c, store: s}, nil
+}
+
+/*
+Load writes the fixture as fixtures.Load does to Spanner, rows of the same keys are overwritten,
+so the demo users of "make seed" are there in lite mode as well.
+*/
+func (l liteClient) Load(f fixtures.Fixture) error {
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at := s.now()
+	for _, i := range f.Items {
+		item, err := domain.NewItem(i.ItemID, i.ItemName, i.Price)
+		if err != nil {
+			return err
+		}
+		s.items[item.ID] = item
+	}
+	for _, u := range f.Users {
+		if user, ok := s.users[u.UserID]; ok {
+			user.name = u.Name
+			continue
+		}
+		s.users[u.UserID] = newLiteUser(u.Name)
+	}
+	for _, ui := range f.UserItems {
+		user, err := s.user(ui.UserID)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.items[ui.ItemID]; !ok {
+			return errItemNotInCatalog(ui.ItemID)
+		}
+		if _, ok := user.items[ui.ItemID]; !ok {
+			user.items[ui.ItemID] = &liteUserItem{quantity: 1, updatedAt: at}
+		}
+	}
+	for _, w := range f.Wallets {
+		user, err := s.user(w.UserID)
+		if err != nil {
+			return err
+		}
+		wallet, err := domain.NewWallet(w.UserID, w.Balance)
+		if err != nil {
+			return err
+		}
+		user.wallet = &wallet
+	}
+	return nil
+}
+
+func newLiteUser(name string) *liteUser {
+	return &liteUser{name: name, items: map[string]*liteUserItem{}, tombstones: map[string]time.Time{}}
+}
+
+// the timestamp of a write, later than any before it, the caller holds the lock
+func (s *liteStore) now() time.Time {
+	t := time.Now().UTC()
+	if !t.After(s.last) {
+		t = s.last.Add(time.Nanosecond)
+	}
+	s.last = t
+	return t
+}
+
+func (s *liteStore) user(userID string) (*liteUser, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return u, nil
+}
+
+// as a row of user_items refers to an unknown item by the foreign key
+func errItemNotInCatalog(itemID string) error {
+	return status.Errorf(codes.FailedPrecondition, "item %s is not in the catalog", itemID)
+}
+
+func (s *liteStore) inventory(u *liteUser) (domain.Inventory, error) {
+	ids := make([]string, 0, len(u.items))
+	for itemID := range u.items {
+		ids = append(ids, itemID)
+	}
+	sort.Strings(ids)
+	results := make(domain.Inventory, 0, len(ids))
+	for _, itemID := range ids {
+		item, err := domain.NewOwnedItem(u.name, s.items[itemID].Name, itemID, u.items[itemID].quantity)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, item)
+	}
+	return results, nil
+}
+
+func (s *liteStore) profile(userID string, u *liteUser) (domain.Profile, error) {
+	return domain.NewProfile(userID, u.name, int64(len(u.items)), u.xp, u.version)
+}
+
+// add quantity of the item to the user, stacked on the one the user has, and return the change of it
+func (s *liteStore) addItem(u *liteUser, itemID string, quantity int64, at time.Time) (before *auditedItem, after auditedItem, change liteChange) {
+	if owned, ok := u.items[itemID]; ok {
+		before = &auditedItem{ItemID: itemID, Quantity: owned.quantity}
+		owned.quantity += quantity
+		owned.updatedAt = at
+	} else {
+		u.items[itemID] = &liteUserItem{quantity: quantity, updatedAt: at}
+	}
+	u.seq++
+	return before, auditedItem{ItemID: itemID, Quantity: u.items[itemID].quantity}, liteChange{seq: u.seq, itemID: itemID, kind: EventItemAdded}
+}
+
+/*
+take quantity of the item back from the user as compensation, the stack is removed only when nothing is left of it,
+before is nil if the user doesn't have the item, and after is nil if the stack is gone
+*/
+func (s *liteStore) revokeItem(u *liteUser, itemID string, quantity int64, at time.Time) (before, after *auditedItem, change liteChange) {
+	owned, ok := u.items[itemID]
+	if !ok {
+		return nil, nil, liteChange{}
+	}
+	before = &auditedItem{ItemID: itemID, Quantity: owned.quantity}
+	if owned.quantity <= quantity {
+		return before, nil, s.removeItem(u, itemID, at)
+	}
+	owned.quantity -= quantity
+	owned.updatedAt = at
+	u.seq++
+	return before, &auditedItem{ItemID: itemID, Quantity: owned.quantity}, liteChange{seq: u.seq, itemID: itemID, kind: EventItemRemoved}
+}
+
+// remove the whole stack of the item from the user, with its tombstone for the sync
+func (s *liteStore) removeItem(u *liteUser, itemID string, at time.Time) liteChange {
+	delete(u.items, itemID)
+	u.tombstones[itemID] = at
+	u.seq++
+	return liteChange{seq: u.seq, itemID: itemID, kind: EventItemRemoved}
+}
+
+// record the mutation by the actor of ctx as auditMutation does, before or after is nil when there's nothing
+func (s *liteStore) audit(ctx context.Context, u *liteUser, action string, before, after interface{}, at time.Time) error {
+	payload := func(v interface{}) (json.RawMessage, error) {
+		if v == nil {
+			return json.RawMessage("null"), nil
+		}
+		return json.Marshal(v)
+	}
+	b, err := payload(before)
+	if err != nil {
+		return err
+	}
+	a, err := payload(after)
+	if err != nil {
+		return err
+	}
+	actor := actorFromContext(ctx)
+	u.audit = append(u.audit, AuditRecord{
+		AuditID:   uuid.NewString(),
+		Action:    action,
+		Caller:    actor.Caller,
+		ActingAs:  actor.ActingAs,
+		RequestID: actor.RequestID,
+		Before:    b,
+		After:     a,
+		CreatedAt: at,
+	})
+	return nil
+}
+
+// after a write of the user, cached items are dropped and the changes are emitted, both best effort
+func (l liteClient) committed(ctx context.Context, userID string, changes ...liteChange) {
+	if l.Cache != nil {
+		if err := l.Cache.Del(fmt.Sprintf("UserItems_%s", userID)); err != nil {
+			log.Println("UserItems", HashID(userID), err)
+		}
+	}
+	for _, c := range changes {
+		emitItemChanged(ctx, l.EmitChange, userID, c.seq, c.itemID, c.kind)
+	}
+}
+
+// keys after the cursor in order, paginated in the same way as ListUsers
+func liteKeysAfter(keys []string, limit int, cursor string) ([]string, string, error) {
+	limit = pageSize(limit)
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+	keys = keys[start:]
+	if len(keys) <= limit {
+		return keys, "", nil
+	}
+	keys = keys[:limit]
+	return keys, encodeCursor(keys[limit-1]), nil
+}
+
+/*
+entries from the newest, paginated in the same way as WalletLedger, entries are in the order of creation.
+key is the timestamp and the id of an entry, which are of the cursor.
+*/
+func liteNewestFirst[T any](entries []T, key func(T) (time.Time, string), limit int, cursor string) ([]T, string, error) {
+	limit = pageSize(limit)
+	at, id, err := decodeLedgerCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	page := make([]T, 0, limit+1)
+	for n := len(entries) - 1; n >= 0 && len(page) <= limit; n-- {
+		t, i := key(entries[n])
+		if t.Before(at) || (t.Equal(at) && i < id) {
+			page = append(page, entries[n])
+		}
+	}
+	if len(page) <= limit {
+		return page, "", nil
+	}
+	page = page[:limit]
+	t, i := key(page[limit-1])
+	return page, encodeCursor(t.Format(time.RFC3339Nano) + "/" + i), nil
+}
+
+func (l liteClient) CreateUser(ctx context.Context, w io.Writer, u UserParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreateUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+
+	s := l.store
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.users[u.UserID]; ok {
+			return status.Errorf(codes.AlreadyExists, "user %s already exists", u.UserID)
+		}
+		user := newLiteUser(u.UserName)
+		s.users[u.UserID] = user
+		return s.audit(ctx, user, AuditCreateUser, nil, domain.User{ID: u.UserID, Name: u.UserName}, s.now())
+	}()
+
+	// UserItems of the id may have been read and cached empty before it's created
+	if err == nil {
+		l.committed(ctx, u.UserID)
+	}
+	return err
+}
+
+func (l liteClient) ListUsers(ctx context.Context, w io.Writer, limit int, cursor string) ([]domain.User, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListUsers")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.users))
+	for userID := range s.users {
+		ids = append(ids, userID)
+	}
+	ids, next, err := liteKeysAfter(ids, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	users := make([]domain.User, 0, len(ids))
+	for _, userID := range ids {
+		u, err := domain.NewUser(userID, s.users[userID].name)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, u)
+	}
+	return users, next, nil
+}
+
+// delete a user and everything of the user, as the rows interleaved in users are
+func (l liteClient) DeleteUser(ctx context.Context, w io.Writer, u UserParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DeleteUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+
+	s := l.store
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, err := s.user(u.UserID); err != nil {
+			return err
+		}
+		delete(s.users, u.UserID)
+		return nil
+	}()
+
+	if err == nil {
+		l.committed(ctx, u.UserID)
+	}
+	return err
+}
+
+func (l liteClient) UpdateUser(ctx context.Context, w io.Writer, userID string, version int64, patch UserPatch) (domain.Profile, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UpdateUser")
+	defer span.End()
+
+	if err := checkParams(patch); err != nil {
+		return domain.Profile{}, err
+	}
+
+	s := l.store
+	profile, err := func() (domain.Profile, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u, err := s.user(userID)
+		if err != nil {
+			return domain.Profile{}, err
+		}
+		if version != AnyVersion && version != u.version {
+			return domain.Profile{}, ErrVersionConflict
+		}
+		before, err := s.profile(userID, u)
+		if err != nil {
+			return domain.Profile{}, err
+		}
+		name := u.name
+		if patch.Name != nil {
+			name = *patch.Name
+		}
+		profile, err := domain.NewProfile(userID, name, before.ItemCount, u.xp, u.version+1)
+		if err != nil {
+			return domain.Profile{}, err
+		}
+		if err := s.audit(ctx, u, AuditUpdateUser, before, profile, s.now()); err != nil {
+			return domain.Profile{}, err
+		}
+		u.name, u.version = profile.Name, profile.Version
+		return profile, nil
+	}()
+	if err != nil {
+		return domain.Profile{}, err
+	}
+
+	// cached UserItems have the user name in them
+	l.committed(ctx, userID)
+	return profile, nil
+}
+
+// add the item to the user, or add to the quantity of it if the user has it already
+func (l liteClient) AddItemToUser(ctx context.Context, w io.Writer, u UserParams, i ItemParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AddItemUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+	if err := checkParams(i); err != nil {
+		return err
+	}
+
+	s := l.store
+	var change liteChange
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		user, err := s.user(u.UserID)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.items[i.ItemID]; !ok {
+			return errItemNotInCatalog(i.ItemID)
+		}
+		var before *auditedItem
+		var after auditedItem
+		at := s.now()
+		before, after, change = s.addItem(user, i.ItemID, i.quantity(), at)
+		if before == nil {
+			return s.audit(ctx, user, AuditAddItem, nil, after, at)
+		}
+		return s.audit(ctx, user, AuditAddItem, *before, after, at)
+	}()
+
+	if err == nil {
+		l.committed(ctx, u.UserID, change)
+	}
+	return err
+}
+
+// remove the item from the user, NotFound if the user doesn't have it
+func (l liteClient) RemoveItemFromUser(ctx context.Context, w io.Writer, u UserParams, i ItemParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RemoveItemFromUser")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return err
+	}
+	if err := checkParams(i); err != nil {
+		return err
+	}
+
+	s := l.store
+	var change liteChange
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		user, err := s.user(u.UserID)
+		if err != nil {
+			return err
+		}
+		owned, ok := user.items[i.ItemID]
+		if !ok {
+			return status.Errorf(codes.NotFound, "user doesn't have item %s", i.ItemID)
+		}
+		at := s.now()
+		before := auditedItem{ItemID: i.ItemID, Quantity: owned.quantity}
+		change = s.removeItem(user, i.ItemID, at)
+		return s.audit(ctx, user, AuditRemoveItem, before, nil, at)
+	}()
+
+	if err == nil {
+		l.committed(ctx, u.UserID, change)
+	}
+	return err
+}
+
+/*
+add items to the user at once, items which can't be added, unknown, already owned or duplicated in the request,
+are reported in the results as AddItemsToUser of Spanner does, and the others are still added.
+*/
+func (l liteClient) AddItemsToUser(ctx context.Context, w io.Writer, u UserParams, itemIDs []string) ([]ItemResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AddItemsToUser")
+	defer span.End()
+	span.SetAttributes(attribute.Int("batch.size", len(itemIDs)))
+
+	if err := checkParams(u); err != nil {
+		return nil, err
+	}
+	if len(itemIDs) == 0 || len(itemIDs) > MaxBatchItems {
+		return nil, fmt.Errorf("%w: 1 to %d items can be added at once", domain.ErrInvalid, MaxBatchItems)
+	}
+	for _, itemID := range itemIDs {
+		if err := checkParams(ItemParams{ItemID: itemID}); err != nil {
+			return nil, err
+		}
+	}
+
+	s := l.store
+	results := make([]ItemResult, len(itemIDs))
+	var changes []liteChange
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		user, err := s.user(u.UserID)
+		if err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		var added []auditedItem
+		at := s.now()
+		for n, itemID := range itemIDs {
+			results[n].ItemID = itemID
+			_, known := s.items[itemID]
+			_, owned := user.items[itemID]
+			switch {
+			case seen[itemID]:
+				results[n].Error = "duplicated in the request"
+			case !known:
+				results[n].Error = "item is not found"
+			case owned:
+				results[n].Error = "user already has the item"
+			default:
+				_, after, change := s.addItem(user, itemID, 1, at)
+				added = append(added, after)
+				changes = append(changes, change)
+			}
+			seen[itemID] = true
+		}
+		if len(added) == 0 {
+			return nil
+		}
+		return s.audit(ctx, user, AuditAddItems, nil, added, at)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("batch.added", len(changes)))
+	if len(changes) > 0 {
+		l.committed(ctx, u.UserID, changes...)
+	}
+	return results, nil
+}
+
+// get items the user has, cache-aside as the Spanner client does by default
+func (l liteClient) UserItems(ctx context.Context, w io.Writer, userID string) (domain.Inventory, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserItems")
+	defer span.End()
+
+	key := fmt.Sprintf("UserItems_%s", userID)
+	if l.Cache != nil {
+		if data, err := l.Cache.Get(key); err == nil {
+			if results, _, err := decodeUserItems(data); err == nil {
+				recordLookup(ctx, "hit")
+				return results, nil
+			}
+		}
+		recordLookup(ctx, "miss")
+	}
+
+	s := l.store
+	results, err := func() (domain.Inventory, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u, err := s.user(userID)
+		if err != nil {
+			return nil, err
+		}
+		return s.inventory(u)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	// caching is best effort, errors are just logged
+	if l.Cache != nil {
+		data, err := encodeUserItems(results, time.Time{})
+		if err == nil {
+			err = l.Cache.Set(key, string(data))
+		}
+		if err != nil {
+			log.Println("UserItems", HashID(userID), err)
+		}
+	}
+	return results, nil
+}
+
+// items of the user in the order of item_id, paginated in the same way as ListItems, they are not cached
+func (l liteClient) UserItemsPage(ctx context.Context, w io.Writer, userID string, limit int, cursor string) (domain.Inventory, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserItemsPage")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := make([]string, 0, len(u.items))
+	for itemID := range u.items {
+		ids = append(ids, itemID)
+	}
+	ids, next, err := liteKeysAfter(ids, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	items := make(domain.Inventory, 0, len(ids))
+	for _, itemID := range ids {
+		item, err := domain.NewOwnedItem(u.name, s.items[itemID].Name, itemID, u.items[itemID].quantity)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+	}
+	return items, next, nil
+}
+
+// items of the user changed after since, and the ones removed by their tombstones, as SyncUserItems of Spanner
+func (l liteClient) SyncUserItems(ctx context.Context, w io.Writer, userID string, since time.Time) (SyncDelta, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "SyncUserItems")
+	defer span.End()
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return SyncDelta{}, err
+	}
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// an unknown user has nothing changed, as the queries of Spanner find nothing
+	delta := SyncDelta{Items: domain.Inventory{}, Removed: []string{}, SyncedAt: s.now()}
+	u, ok := s.users[userID]
+	if !ok {
+		return delta, nil
+	}
+	items, err := s.inventory(u)
+	if err != nil {
+		return SyncDelta{}, err
+	}
+	for _, item := range items {
+		if u.items[item.ItemID].updatedAt.After(since) {
+			delta.Items = append(delta.Items, item)
+		}
+	}
+	if !since.IsZero() {
+		for itemID, at := range u.tombstones {
+			if _, owned := u.items[itemID]; !owned && at.After(since) {
+				delta.Removed = append(delta.Removed, itemID)
+			}
+		}
+		sort.Strings(delta.Removed)
+	}
+	return delta, nil
+}
+
+// add an item to the catalog, AlreadyExists if the item_id is used
+func (l liteClient) CreateItem(ctx context.Context, w io.Writer, i domain.Item) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreateItem")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[i.ID]; ok {
+		return status.Errorf(codes.AlreadyExists, "item %s already exists", i.ID)
+	}
+	s.items[i.ID] = i
+	return nil
+}
+
+func (l liteClient) Item(ctx context.Context, w io.Writer, itemID string) (domain.Item, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Item")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.item(itemID)
+}
+
+func (s *liteStore) item(itemID string) (domain.Item, error) {
+	item, ok := s.items[itemID]
+	if !ok {
+		return domain.Item{}, status.Errorf(codes.NotFound, "item %s is not found", itemID)
+	}
+	return item, nil
+}
+
+func (l liteClient) ListItems(ctx context.Context, w io.Writer, limit int, cursor string) ([]domain.Item, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListItems")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.items))
+	for itemID := range s.items {
+		ids = append(ids, itemID)
+	}
+	ids, next, err := liteKeysAfter(ids, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]domain.Item, 0, len(ids))
+	for _, itemID := range ids {
+		items = append(items, s.items[itemID])
+	}
+	return items, next, nil
+}
+
+/*
+change name and price of an item, NotFound if it doesn't exist.
+Cached UserItems have item names in them, so a renamed item shows its old name until the entries expire.
+*/
+func (l liteClient) UpdateItem(ctx context.Context, w io.Writer, i domain.Item) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UpdateItem")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.item(i.ID); err != nil {
+		return err
+	}
+	s.items[i.ID] = i
+	return nil
+}
+
+// delete an item from the catalog, it fails with FailedPrecondition while any user has the item
+func (l liteClient) DeleteItem(ctx context.Context, w io.Writer, itemID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DeleteItem")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.item(itemID); err != nil {
+		return err
+	}
+	for _, u := range s.users {
+		if _, ok := u.items[itemID]; ok {
+			return status.Errorf(codes.FailedPrecondition, "item %s is owned by users", itemID)
+		}
+	}
+	delete(s.items, itemID)
+	return nil
+}
+
+// remove a recalled item from all users, NotFound if the item doesn't exist
+func (l liteClient) RevokeItem(ctx context.Context, w io.Writer, itemID string) (RevokeReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RevokeItem")
+	defer span.End()
+
+	report := RevokeReport{ItemID: itemID}
+	if err := checkParams(ItemParams{ItemID: itemID}); err != nil {
+		return report, err
+	}
+
+	s := l.store
+	changes := map[string]liteChange{}
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, err := s.item(itemID); err != nil {
+			return err
+		}
+		at := s.now()
+		for userID, u := range s.users {
+			if _, ok := u.items[itemID]; ok {
+				changes[userID] = s.removeItem(u, itemID, at)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return report, err
+	}
+
+	report.Users, report.Removed = len(changes), int64(len(changes))
+	span.SetAttributes(attribute.Int("revoke.users", report.Users))
+	for userID, change := range changes {
+		l.committed(ctx, userID, change)
+	}
+	return report, nil
+}
+
+// get the profile of the user, NotFound if the user doesn't exist
+func (l liteClient) UserProfile(ctx context.Context, w io.Writer, userID string) (domain.Profile, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserProfile")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return domain.Profile{}, err
+	}
+	return s.profile(userID, u)
+}
+
+/*
+ResetGameData forgets everything but the catalog and api keys, as ResetGameData of Spanner truncates ResetTables,
+and returns how many rows of them there were.
+*/
+func (l liteClient) ResetGameData(ctx context.Context) (map[string]int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ResetGameData")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := map[string]int64{}
+	for _, table := range ResetTables {
+		deleted[table] = 0
+	}
+	for _, u := range s.users {
+		deleted["users"]++
+		deleted["user_items"] += int64(len(u.items))
+		deleted["user_item_tombstones"] += int64(len(u.tombstones))
+		deleted["wallet_ledger"] += int64(len(u.ledger))
+		deleted["mailbox"] += int64(len(u.mails))
+		deleted["user_audit"] += int64(len(u.audit))
+		if u.seq > 0 {
+			deleted["user_sequences"]++
+		}
+		if u.wallet != nil {
+			deleted["wallets"]++
+		}
+		if u.pii != nil {
+			deleted["user_pii"]++
+		}
+	}
+	deleted["grants"] = int64(len(s.grants))
+	deleted["purchases"] = int64(len(s.purchases))
+	deleted["idempotency_keys"] = int64(len(s.idempotency))
+	deleted["user_merges"] = int64(len(s.merges))
+
+	s.users = map[string]*liteUser{}
+	s.grants = map[string]string{}
+	s.purchases = map[string]string{}
+	s.idempotency = map[string]*liteIdempotency{}
+	s.merges = map[string]string{}
+	return deleted, nil
+}
@@ -0,0 +1,910 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+wallets, purchases, grants, mailboxes, the audit, pii, api keys, idempotency keys and imports of liteClient,
+they behave as the ones of Spanner do, see the files of each.
+*/
+
+// a user who has never been credited has balance 0, an unknown user as well, as readWallet of Spanner
+func (l liteClient) WalletBalance(ctx context.Context, w io.Writer, userID string) (domain.Wallet, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "WalletBalance")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && u.wallet != nil {
+		return *u.wallet, nil
+	}
+	return domain.NewWallet(userID, 0)
+}
+
+// add amount to the user's wallet, negative amount means debit, every change is recorded to the ledger
+func (l liteClient) CreditWallet(ctx context.Context, w io.Writer, userID string, amount int64, reason, referenceID string) (domain.Wallet, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreditWallet")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return domain.Wallet{}, err
+	}
+	return s.changeWallet(userID, u, amount, reason, referenceID, s.now())
+}
+
+// the same as changeWallet of Spanner, the caller holds the lock
+func (s *liteStore) changeWallet(userID string, u *liteUser, amount int64, reason, referenceID string, at time.Time) (domain.Wallet, error) {
+	current, err := domain.NewWallet(userID, 0)
+	if err != nil {
+		return domain.Wallet{}, err
+	}
+	if u.wallet != nil {
+		current = *u.wallet
+	}
+	var wallet domain.Wallet
+	if amount < 0 {
+		wallet, err = current.Debit(-amount)
+	} else {
+		wallet, err = current.Credit(amount)
+	}
+	if err != nil {
+		return domain.Wallet{}, err
+	}
+	entry, err := domain.NewLedgerEntry(userID, uuid.NewString(), amount, wallet.Balance, reason, referenceID, at)
+	if err != nil {
+		return domain.Wallet{}, err
+	}
+	u.wallet = &wallet
+	u.ledger = append(u.ledger, entry)
+	return wallet, nil
+}
+
+// the newest entry at the top, the cursor is the last entry of the previous page
+func (l liteClient) WalletLedger(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]domain.LedgerEntry, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "WalletLedger")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ledger []domain.LedgerEntry
+	if u, ok := s.users[userID]; ok {
+		ledger = u.ledger
+	}
+	return liteNewestFirst(ledger, func(e domain.LedgerEntry) (time.Time, string) { return e.CreatedAt, e.EntryID }, limit, cursor)
+}
+
+/*
+purchase an item by the same steps as the saga of Spanner, debit wallet -> grant item -> emit receipt,
+the steps done are compensated in reverse order when one fails. Sagas are not recorded, they end with the request.
+*/
+func (l liteClient) PurchaseItem(ctx context.Context, w io.Writer, u UserParams, i ItemParams) (Receipt, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "PurchaseItem")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return Receipt{}, err
+	}
+	if err := checkParams(i); err != nil {
+		return Receipt{}, err
+	}
+
+	item, err := l.Item(ctx, w, i.ItemID)
+	if err != nil {
+		return Receipt{}, err
+	}
+	price := item.Price
+	receipt := Receipt{
+		ReceiptID: uuid.NewString(),
+		SagaID:    uuid.NewString(),
+		UserID:    u.UserID,
+		ItemID:    i.ItemID,
+		Price:     price,
+	}
+
+	steps := []SagaStep{
+		{
+			Name: "debitWallet",
+			Do: func(ctx context.Context) error {
+				// free items don't touch the wallet
+				if price == 0 {
+					return nil
+				}
+				_, err := l.CreditWallet(ctx, w, u.UserID, -price, domain.LedgerPurchase, receipt.ReceiptID)
+				return err
+			},
+			Compensate: func(ctx context.Context) error {
+				if price == 0 {
+					return nil
+				}
+				_, err := l.CreditWallet(ctx, w, u.UserID, price, domain.LedgerRefund, receipt.ReceiptID)
+				return err
+			},
+		},
+		{
+			Name: "grantItem",
+			Do: func(ctx context.Context) error {
+				return l.AddItemToUser(ctx, w, u, i)
+			},
+			Compensate: func(ctx context.Context) error {
+				return l.revokeItem(ctx, u.UserID, i.ItemID, i.quantity())
+			},
+		},
+		{
+			Name: "emitReceipt",
+			Do: func(ctx context.Context) error {
+				receipt.PurchasedAt = time.Now()
+				if l.EmitReceipt == nil {
+					log.Printf("receipt %s of %s\n", receipt.ReceiptID, HashID(receipt.UserID))
+					return nil
+				}
+				return l.EmitReceipt(ctx, receipt)
+			},
+		},
+	}
+
+	for n, step := range steps {
+		stepErr := step.Do(ctx)
+		if stepErr == nil {
+			continue
+		}
+		log.Printf("saga purchase(%s) failed at %s: %v\n", receipt.SagaID, step.Name, stepErr)
+		for i := n - 1; i >= 0; i-- {
+			if steps[i].Compensate == nil {
+				continue
+			}
+			if err := steps[i].Compensate(ctx); err != nil {
+				log.Printf("saga purchase(%s) failed to compensate %s: %v\n", receipt.SagaID, steps[i].Name, err)
+				break
+			}
+		}
+		return receipt, fmt.Errorf("%s: %w", step.Name, stepErr)
+	}
+	return receipt, nil
+}
+
+// undo of AddItemToUser as revokeItem of Spanner, copies the user owned before the grant are kept
+func (l liteClient) revokeItem(ctx context.Context, userID, itemID string, quantity int64) error {
+	s := l.store
+	var change liteChange
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		user, err := s.user(userID)
+		if err != nil {
+			return err
+		}
+		at := s.now()
+		var before, after *auditedItem
+		if before, after, change = s.revokeItem(user, itemID, quantity, at); before == nil {
+			// nothing is left to take back
+			return nil
+		}
+		if after == nil {
+			return s.audit(ctx, user, AuditRemoveItem, *before, nil, at)
+		}
+		return s.audit(ctx, user, AuditRemoveItem, *before, *after, at)
+	}()
+
+	if err == nil && change.seq > 0 {
+		l.committed(ctx, userID, change)
+	}
+	return err
+}
+
+// record a purchase verified by a store and grant the item as RecordPurchase of Spanner, it's idempotent by receipt id
+func (l liteClient) RecordPurchase(ctx context.Context, w io.Writer, u UserParams, p VerifiedPurchase) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RecordPurchase")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return false, err
+	}
+
+	s := l.store
+	var changes []liteChange
+	granted, err := func() (bool, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.purchases[p.ReceiptID]; ok {
+			return false, nil
+		}
+		user, err := s.user(u.UserID)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := s.items[p.ItemID]; !ok {
+			return false, errItemNotInCatalog(p.ItemID)
+		}
+		// stacked and audited as AddItemToUser does
+		at := s.now()
+		before, after, change := s.addItem(user, p.ItemID, 1, at)
+		changes = append(changes, change)
+		s.purchases[p.ReceiptID] = u.UserID
+		if before == nil {
+			return true, s.audit(ctx, user, AuditAddItem, nil, after, at)
+		}
+		return true, s.audit(ctx, user, AuditAddItem, *before, after, at)
+	}()
+
+	if len(changes) > 0 {
+		l.committed(ctx, u.UserID, changes...)
+	}
+	return granted, err
+}
+
+/*
+GrantToUser gives the items, currency and XP of the grant all or nothing, as GrantToUser of Spanner.
+It fails if an item is unknown (ErrInvalid) or already owned (AlreadyExists), and it's idempotent by the grant id.
+*/
+func (l liteClient) GrantToUser(ctx context.Context, w io.Writer, userID string, g domain.Grant) (GrantResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "GrantToUser")
+	defer span.End()
+	span.SetAttributes(attribute.String("grant.id", g.GrantID), attribute.String("grant.source", g.Source))
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return GrantResult{}, err
+	}
+
+	s := l.store
+	var changes []liteChange
+	result, err := func() (GrantResult, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		result, granted, err := s.grant(userID, g, s.now())
+		changes = granted
+		return result, err
+	}()
+	if err != nil {
+		return GrantResult{}, err
+	}
+
+	if len(changes) > 0 {
+		l.committed(ctx, userID, changes...)
+	}
+	return result, nil
+}
+
+// give the grant, nothing is changed if it fails, the caller holds the lock
+func (s *liteStore) grant(userID string, g domain.Grant, at time.Time) (GrantResult, []liteChange, error) {
+	result := GrantResult{Grant: g}
+	u, err := s.user(userID)
+	if err != nil {
+		return result, nil, err
+	}
+	result.XP = u.xp
+
+	wallet := func() (domain.Wallet, error) {
+		if u.wallet != nil {
+			return *u.wallet, nil
+		}
+		return domain.NewWallet(userID, 0)
+	}
+	if given, ok := s.grants[g.GrantID]; ok {
+		if given != userID {
+			return result, nil, ErrGrantIDReused
+		}
+		result.Wallet, err = wallet()
+		return result, nil, err
+	}
+
+	// checked before anything is changed, to give all or nothing
+	for _, itemID := range g.ItemIDs {
+		if _, ok := s.items[itemID]; !ok {
+			return result, nil, fmt.Errorf("%w: item %s is not found", domain.ErrInvalid, itemID)
+		}
+		if _, ok := u.items[itemID]; ok {
+			return result, nil, status.Errorf(codes.AlreadyExists, "user already has item %s", itemID)
+		}
+	}
+	if g.Currency > 0 {
+		if result.Wallet, err = s.changeWallet(userID, u, g.Currency, domain.LedgerGrant, g.GrantID, at); err != nil {
+			return result, nil, err
+		}
+	} else if result.Wallet, err = wallet(); err != nil {
+		return result, nil, err
+	}
+	var changes []liteChange
+	for _, itemID := range g.ItemIDs {
+		_, _, change := s.addItem(u, itemID, 1, at)
+		changes = append(changes, change)
+	}
+	if g.XP > 0 {
+		u.xp += g.XP
+		// XP is of the profile, so it's a change of the version
+		u.version++
+		result.XP = u.xp
+	}
+	s.grants[g.GrantID] = userID
+	result.Granted = true
+	return result, changes, nil
+}
+
+/*
+Mailbox lists mails of the user from the newest.
+Mails are deposited by the worker, which doesn't run in lite mode, so mailboxes stay empty unless DepositMail is called.
+*/
+func (l liteClient) Mailbox(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]domain.Mail, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Mailbox")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var mails []domain.Mail
+	if u, ok := s.users[userID]; ok {
+		mails = u.mails
+	}
+	return liteNewestFirst(mails, func(m domain.Mail) (time.Time, string) { return m.CreatedAt, m.MailID }, limit, cursor)
+}
+
+// DepositMail puts the mail into the mailbox of its user, false if it's there already, NotFound if the user doesn't exist
+func (l liteClient) DepositMail(ctx context.Context, m domain.Mail) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DepositMail")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(m.UserID)
+	if err != nil {
+		return false, err
+	}
+	for _, deposited := range u.mails {
+		if deposited.MailID == m.MailID {
+			return false, nil
+		}
+	}
+	m.CreatedAt = s.now()
+	u.mails = append(u.mails, m)
+	return true, nil
+}
+
+// AckMail marks the mail read, and claims it if it has attachments, a mail acknowledged before is returned as it is
+func (l liteClient) AckMail(ctx context.Context, w io.Writer, userID, mailID string) (MailAck, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AckMail")
+	defer span.End()
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return MailAck{}, err
+	}
+
+	s := l.store
+	var changes []liteChange
+	ack, err := func() (MailAck, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u, ok := s.users[userID]
+		if !ok {
+			return MailAck{}, errMailNotFound
+		}
+		for n := range u.mails {
+			m := &u.mails[n]
+			if m.MailID != mailID {
+				continue
+			}
+			if m.ReadAt != nil {
+				return MailAck{Mail: *m}, nil
+			}
+			at := s.now()
+			var ack MailAck
+			if g, ok := m.Grant(); ok {
+				result, granted, err := s.grant(userID, g, at)
+				if err != nil {
+					return MailAck{}, err
+				}
+				ack.Grant, changes = &result, granted
+				m.ClaimedAt = &at
+			}
+			m.ReadAt = &at
+			ack.Mail = *m
+			return ack, nil
+		}
+		return MailAck{}, errMailNotFound
+	}()
+	if err != nil {
+		return MailAck{}, err
+	}
+
+	if len(changes) > 0 {
+		l.committed(ctx, userID, changes...)
+	}
+	span.SetAttributes(attribute.Bool("mail.claimed", ack.Grant != nil))
+	return ack, nil
+}
+
+// UserAudit lists mutations of the user from the newest, paginated in the same way as WalletLedger
+func (l liteClient) UserAudit(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]AuditRecord, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserAudit")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []AuditRecord
+	if u, ok := s.users[userID]; ok {
+		records = u.audit
+	}
+	return liteNewestFirst(records, func(r AuditRecord) (time.Time, string) { return r.CreatedAt, r.AuditID }, limit, cursor)
+}
+
+/*
+MergeUsers merges the source user into the target one all or nothing, as MergeUsers of Spanner,
+and forgets the source but where it has gone.
+*/
+func (l liteClient) MergeUsers(ctx context.Context, w io.Writer, sourceID, targetID string, policy MergePolicy) (MergeReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "MergeUsers")
+	defer span.End()
+	span.SetAttributes(attribute.String("merge.policy", string(policy)))
+
+	if err := checkParams(UserParams{UserID: sourceID}); err != nil {
+		return MergeReport{}, err
+	}
+	if err := checkParams(UserParams{UserID: targetID}); err != nil {
+		return MergeReport{}, err
+	}
+	if sourceID == targetID {
+		return MergeReport{}, fmt.Errorf("%w: a user can't be merged into itself", domain.ErrInvalid)
+	}
+
+	s := l.store
+	var changes []liteChange
+	report, err := func() (MergeReport, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		report, merged, err := s.merge(ctx, sourceID, targetID, policy, s.now())
+		changes = merged
+		return report, err
+	}()
+	if err != nil {
+		return MergeReport{}, err
+	}
+
+	if report.Merged {
+		l.committed(ctx, sourceID)
+		l.committed(ctx, targetID, changes...)
+	}
+	return report, nil
+}
+
+// merge the source into the target, nothing is changed if it fails, the caller holds the lock
+func (s *liteStore) merge(ctx context.Context, sourceID, targetID string, policy MergePolicy, at time.Time) (MergeReport, []liteChange, error) {
+	report := MergeReport{SourceUserID: sourceID, TargetUserID: targetID, Policy: policy, Items: []auditedItem{}, Dropped: []string{}}
+	if merged, ok := s.merges[sourceID]; ok {
+		if merged != targetID {
+			return report, nil, status.Errorf(codes.NotFound, "user %s has been merged into another user", sourceID)
+		}
+		return report, nil, nil
+	}
+	source, err := s.user(sourceID)
+	if err != nil {
+		return report, nil, err
+	}
+	target, err := s.user(targetID)
+	if err != nil {
+		return report, nil, err
+	}
+
+	// what to give is decided before anything is changed, to merge all or nothing
+	itemIDs := make([]string, 0, len(source.items))
+	for itemID := range source.items {
+		itemIDs = append(itemIDs, itemID)
+	}
+	sort.Strings(itemIDs)
+	gives := map[string]int64{}
+	for _, itemID := range itemIDs {
+		quantity := source.items[itemID].quantity
+		owned, ok := target.items[itemID]
+		if !ok {
+			gives[itemID] = quantity
+			continue
+		}
+		var delta int64
+		switch policy {
+		case MergeFail:
+			return report, nil, status.Errorf(codes.AlreadyExists, "both users have item %s", itemID)
+		case MergeSum:
+			delta = quantity
+		case MergeMax:
+			delta = max(quantity-owned.quantity, 0)
+		}
+		if delta == 0 {
+			report.Dropped = append(report.Dropped, itemID)
+			continue
+		}
+		gives[itemID] = delta
+	}
+
+	report.XP = source.xp
+	if source.wallet != nil {
+		report.Currency = source.wallet.Balance
+	}
+	switch {
+	case report.Currency > 0:
+		report.Wallet, err = s.changeWallet(targetID, target, report.Currency, domain.LedgerMerge, sourceID, at)
+	case target.wallet != nil:
+		report.Wallet = *target.wallet
+	default:
+		report.Wallet, err = domain.NewWallet(targetID, 0)
+	}
+	if err != nil {
+		return report, nil, err
+	}
+
+	var changes []liteChange
+	for _, itemID := range itemIDs {
+		if quantity, ok := gives[itemID]; ok {
+			_, after, change := s.addItem(target, itemID, quantity, at)
+			report.Items = append(report.Items, after)
+			changes = append(changes, change)
+		}
+	}
+	// XP is of the profile, so it's a change of the version even without XP to add
+	target.xp += source.xp
+	target.version++
+	for _, m := range source.mails {
+		if m.ReadAt == nil {
+			m.UserID = targetID
+			target.mails = append(target.mails, m)
+			report.Mails++
+		}
+	}
+	sort.SliceStable(target.mails, func(i, j int) bool { return target.mails[i].CreatedAt.Before(target.mails[j].CreatedAt) })
+
+	report.Merged = true
+	if err := s.audit(ctx, target, AuditMergeUser, nil, report, at); err != nil {
+		return report, nil, err
+	}
+	delete(s.users, sourceID)
+	s.merges[sourceID] = targetID
+	return report, changes, nil
+}
+
+// set sensitive attributes of the user, they are kept encrypted as they are in Spanner
+func (l liteClient) SetUserPII(ctx context.Context, w io.Writer, userID string, pii UserPII) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "SetUserPII")
+	defer span.End()
+
+	if l.Envelope == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := pii.validate(); err != nil {
+		return err
+	}
+
+	// sealed before the lock, it may call KMS
+	email, err := sealField(ctx, l.Envelope, pii.Email)
+	if err != nil {
+		return err
+	}
+	externalID, err := sealField(ctx, l.Envelope, pii.ExternalID)
+	if err != nil {
+		return err
+	}
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	u.pii = &litePII{email: email, externalID: externalID}
+	return nil
+}
+
+func (l liteClient) UserPII(ctx context.Context, w io.Writer, userID string) (UserPII, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserPII")
+	defer span.End()
+
+	if l.Envelope == nil {
+		return UserPII{}, ErrEncryptionDisabled
+	}
+
+	s := l.store
+	s.mu.Lock()
+	var sealed *litePII
+	if u, ok := s.users[userID]; ok {
+		sealed = u.pii
+	}
+	s.mu.Unlock()
+	if sealed == nil {
+		return UserPII{}, status.Error(codes.NotFound, "pii of the user is not found")
+	}
+
+	var pii UserPII
+	var err error
+	if pii.Email, err = openField(ctx, l.Envelope, sealed.email); err != nil {
+		return UserPII{}, err
+	}
+	if pii.ExternalID, err = openField(ctx, l.Envelope, sealed.externalID); err != nil {
+		return UserPII{}, err
+	}
+	return pii, nil
+}
+
+// CreateAPIKey mints a key for the name, the returned key is the only place the secret is in plain
+func (l liteClient) CreateAPIKey(ctx context.Context, name string) (APIKey, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreateAPIKey")
+	defer span.End()
+
+	k := APIKey{ID: uuid.NewString(), Name: name}
+	if err := checkParams(k); err != nil {
+		return APIKey{}, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k.CreatedAt = s.now()
+	s.apiKeys[k.ID] = &liteAPIKey{APIKey: k, secretHash: hashSecret(encoded)}
+	return k, k.ID + "." + encoded, nil
+}
+
+// list keys in the order of creation, revoked ones are included
+func (l liteClient) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ListAPIKeys")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, k.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// RevokeAPIKey makes the key invalid, NotFound if it doesn't exist
+func (l liteClient) RevokeAPIKey(ctx context.Context, keyID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RevokeAPIKey")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[keyID]
+	if !ok {
+		return status.Errorf(codes.NotFound, "api key %s is not found", keyID)
+	}
+	if k.RevokedAt == nil {
+		at := s.now()
+		k.RevokedAt = &at
+	}
+	return nil
+}
+
+// VerifyAPIKey returns the name of the key, ErrInvalidAPIKey if it's malformed, unknown, revoked or the secret doesn't match
+func (l liteClient) VerifyAPIKey(ctx context.Context, key string) (string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "VerifyAPIKey")
+	defer span.End()
+
+	keyID, secret, ok := strings.Cut(key, ".")
+	if !ok || secret == "" {
+		return "", ErrInvalidAPIKey
+	}
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[keyID]
+	if !ok || k.Revoked() || subtle.ConstantTimeCompare([]byte(k.secretHash), []byte(hashSecret(secret))) != 1 {
+		return "", ErrInvalidAPIKey
+	}
+	return k.Name, nil
+}
+
+// ClaimIdempotencyKey claims key for the request of fingerprint, or returns the response of the request which completed it
+func (l liteClient) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (*IdempotentResponse, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ClaimIdempotencyKey")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claim, ok := s.idempotency[key]
+	switch {
+	case !ok:
+		s.idempotency[key] = &liteIdempotency{fingerprint: fingerprint, claimedAt: time.Now()}
+		return nil, nil
+	case claim.fingerprint != fingerprint:
+		return nil, ErrIdempotencyKeyReused
+	case claim.response != nil:
+		return claim.response, nil
+	case time.Since(claim.claimedAt) < idempotencyLease:
+		return nil, ErrIdempotencyInFlight
+	}
+	// the request holding it is taken as lost
+	claim.claimedAt = time.Now()
+	return nil, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request which claimed key, to be replayed to its retries
+func (l liteClient) CompleteIdempotencyKey(ctx context.Context, key string, resp IdempotentResponse) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CompleteIdempotencyKey")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claim, ok := s.idempotency[key]
+	if !ok {
+		return status.Errorf(codes.NotFound, "idempotency key %s is not claimed", key)
+	}
+	// completed by a retry which took it over, the first response wins
+	if claim.response != nil {
+		return errIdempotencyNotClaimed
+	}
+	claim.response = &resp
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the claim of a request which failed, so a retry with the key runs it again
+func (l liteClient) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ReleaseIdempotencyKey")
+	defer span.End()
+
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if claim, ok := s.idempotency[key]; ok && claim.response == nil {
+		delete(s.idempotency, key)
+	}
+	return nil
+}
+
+/*
+Import writes the records by groups, a user with its items a group, as Import of Spanner,
+so a user or an item which already exists, or an unknown item, fails only its group.
+*/
+func (l liteClient) Import(ctx context.Context, records []ImportRecord, progress func(ImportProgress)) (ImportReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Import")
+	defer span.End()
+
+	groups := importGroups(records)
+	span.SetAttributes(attribute.Int("import.records", len(records)), attribute.Int("import.groups", len(groups)))
+
+	report := ImportReport{Failures: []ImportFailure{}}
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		err := l.store.importGroup(g)
+		report.Groups++
+		if err != nil {
+			report.Failed++
+			if len(report.Failures) < maxImportFailures {
+				report.Failures = append(report.Failures, ImportFailure{UserID: g.userID, Error: err.Error()})
+			}
+		} else {
+			report.Applied++
+			report.Records += g.records()
+			// the user may have been cached as unknown
+			l.committed(ctx, g.userID)
+		}
+		if progress != nil && report.Groups%importProgressEvery == 0 {
+			progress(report.ImportProgress)
+		}
+	}
+
+	if progress != nil && report.Groups%importProgressEvery != 0 {
+		progress(report.ImportProgress)
+	}
+	span.SetAttributes(attribute.Int("import.applied", report.Applied), attribute.Int("import.failed", report.Failed))
+	return report, ctx.Err()
+}
+
+// the rows are inserted, not upserted, as the mutations of importGroup are
+func (s *liteStore) importGroup(g *importGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, exists := s.users[g.userID]
+	switch {
+	case g.user != nil && exists:
+		return status.Errorf(codes.AlreadyExists, "user %s already exists", g.userID)
+	case g.user == nil && !exists:
+		return errUserNotFound
+	}
+	for _, itemID := range g.itemIDs {
+		if _, ok := s.items[itemID]; !ok {
+			return errItemNotInCatalog(itemID)
+		}
+		if exists {
+			if _, ok := u.items[itemID]; ok {
+				return status.Errorf(codes.AlreadyExists, "user %s already has item %s", g.userID, itemID)
+			}
+		}
+	}
+
+	if !exists {
+		u = newLiteUser(g.user.Name)
+		s.users[g.userID] = u
+	}
+	at := s.now()
+	for _, itemID := range g.itemIDs {
+		u.items[itemID] = &liteUserItem{quantity: 1, updatedAt: at}
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+-- set KEYS[1] to ARGV[2] for ARGV[3] milliseconds, only if it's still ARGV[1]
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+end
+return false
@@ -0,0 +1,8 @@
+-- delete KEYS[1] only if ARGV[1] is newer than the seq in KEYS[2], and remember it for ARGV[2] seconds
+local current = tonumber(redis.call("GET", KEYS[2]) or "0")
+if tonumber(ARGV[1]) <= current then
+  return 0
+end
+redis.call("SET", KEYS[2], ARGV[1], "EX", ARGV[2])
+redis.call("DEL", KEYS[1])
+return 1
@@ -0,0 +1,59 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package luascript
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+)
+
+/*
+Lock is a lease of a key in redis among instances, it's held until it's released or its ttl passes.
+The key has a random token of the holder, so a holder whose lease has expired can't release or extend the one of the next holder.
+It's not fenced, work which must not overlap at all has to check it by itself, like by a transaction of Spanner.
+*/
+type Lock struct {
+	c     redis.Cmdable
+	key   string
+	token string
+}
+
+// AcquireLock takes key for ttl, it returns false without an error if another one holds it
+func AcquireLock(c redis.Cmdable, key string, ttl time.Duration) (*Lock, bool, error) {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err := c.SetNX(key, token.String(), ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return &Lock{c: c, key: key, token: token.String()}, true, nil
+}
+
+// Extend makes the lease ttl from now, false if it has been lost
+func (l *Lock) Extend(ttl time.Duration) (bool, error) {
+	n, err := ExtendLock.Run(l.c, []string{l.key}, l.token, ttl.Milliseconds()).Int64()
+	return n == 1, err
+}
+
+// Release gives the lease up, false if it has been lost already
+func (l *Lock) Release() (bool, error) {
+	n, err := ReleaseLock.Run(l.c, []string{l.key}, l.token).Int64()
+	return n == 1, err
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package luascript is the registry of Lua scripts of redis, they are embedded from *.lua in this directory.
+A script runs atomically in redis, so nothing of other clients comes between its reads and writes.
+They are loaded once at start by Load, and run by EVALSHA,
+which falls back to EVAL when redis doesn't have them, like after it's restarted or failed over.
+*/
+package luascript
+
+import (
+	"embed"
+	"fmt"
+	"sort"
+
+	"github.com/go-redis/redis"
+)
+
+//go:embed *.lua
+var sources embed.FS
+
+var registry = map[string]*redis.Script{}
+
+// mustScript registers the script of name.lua, it panics if it's not embedded, as it's meant for package level vars
+func mustScript(name string) *redis.Script {
+	src, err := sources.ReadFile(name + ".lua")
+	if err != nil {
+		panic(err)
+	}
+	s := redis.NewScript(string(src))
+	registry[name] = s
+	return s
+}
+
+// the scripts, see each .lua for its keys and args
+var (
+	CompareAndSwap  = mustScript("compare_and_swap")
+	InvalidateBySeq = mustScript("invalidate_by_seq")
+	TokenBucket     = mustScript("token_bucket")
+	TakeQuota       = mustScript("take_quota")
+	ReleaseLock     = mustScript("release_lock")
+	ExtendLock      = mustScript("extend_lock")
+	SetMax          = mustScript("set_max")
+)
+
+// Names of the registered scripts, in order
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Load loads all the scripts into redis, so their first runs don't send the whole source.
+It's not required, Run of a script loads it anyway, so errors of it are only worth a warning.
+They are loaded into every master of a cluster, as a script runs on the node of its keys.
+*/
+func Load(c redis.Cmdable) error {
+	if cluster, ok := c.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(node *redis.Client) error {
+			return Load(node)
+		})
+	}
+	for _, name := range Names() {
+		if err := registry[name].Load(c).Err(); err != nil {
+			return fmt.Errorf("script %s: %w", name, err)
+		}
+	}
+	return nil
+}
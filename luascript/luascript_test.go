@@ -0,0 +1,137 @@
+package luascript
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRdb = redis.NewClient(&redis.Options{
+	Addr:        "127.0.0.1:6379",
+	DialTimeout: 1 * time.Second,
+})
+
+// the tests run against a local redis, and are skipped without it
+func requireRedis(t *testing.T) {
+	t.Helper()
+	if err := testRdb.Ping().Err(); err != nil {
+		t.Skip("redis is not reachable:", err)
+	}
+}
+
+func testKey(name string) string {
+	id, _ := uuid.NewRandom()
+	return "luascript_test_" + name + "_" + id.String()
+}
+
+func TestLoad(t *testing.T) {
+	assert.Equal(t, []string{"compare_and_swap", "extend_lock", "invalidate_by_seq", "release_lock", "set_max", "take_quota", "token_bucket"}, Names())
+	requireRedis(t)
+
+	// scripts are not flushed to see EVAL of them, redis is shared with other clients
+	key := testKey("cas")
+	assert.Nil(t, testRdb.Set(key, "old", time.Minute).Err())
+	assert.Nil(t, CompareAndSwap.Run(testRdb, []string{key}, "old", "new", 60000).Err())
+
+	assert.Nil(t, Load(testRdb))
+	exists, err := testRdb.ScriptExists(CompareAndSwap.Hash(), TakeQuota.Hash()).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true}, exists)
+}
+
+func TestSetMax(t *testing.T) {
+	requireRedis(t)
+	key := testKey("max")
+	assert.Equal(t, int64(1), SetMax.Run(testRdb, []string{key}, 20, 60000).Val())
+	assert.Equal(t, int64(0), SetMax.Run(testRdb, []string{key}, 10, 60000).Val())
+	assert.Equal(t, "20", testRdb.Get(key).Val())
+}
+
+func TestInvalidateBySeq(t *testing.T) {
+	requireRedis(t)
+	for _, c := range []struct {
+		name    string
+		seq     int64
+		deleted bool
+		current string
+	}{
+		{"older", 4, false, "5"},
+		{"equal", 5, false, "5"},
+		{"newer", 6, true, "6"},
+	} {
+		key, seqKey := testKey("entry"), testKey("seq")
+		assert.Nil(t, testRdb.Set(key, "items", time.Minute).Err())
+		assert.Nil(t, testRdb.Set(seqKey, "5", time.Minute).Err())
+
+		result, err := InvalidateBySeq.Run(testRdb, []string{key, seqKey}, c.seq, 60).Int64()
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.deleted, result == 1, c.name)
+		assert.Equal(t, c.current, testRdb.Get(seqKey).Val(), c.name)
+		exists, _ := testRdb.Exists(key).Result()
+		assert.Equal(t, !c.deleted, exists == 1, c.name)
+	}
+
+	// the first one of the user is newer than none
+	key, seqKey := testKey("entry"), testKey("seq")
+	assert.Equal(t, int64(1), InvalidateBySeq.Run(testRdb, []string{key, seqKey}, 1, 60).Val())
+	ttl, err := testRdb.TTL(seqKey).Result()
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+}
+
+func TestLock(t *testing.T) {
+	requireRedis(t)
+	key := testKey("lock")
+	lock, ok, err := AcquireLock(testRdb, key, time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotNil(t, lock)
+
+	_, ok, err = AcquireLock(testRdb, key, time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = lock.Extend(time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// the next holder's lease is not released by the previous one
+	assert.Nil(t, testRdb.Del(key).Err())
+	next, ok, err := AcquireLock(testRdb, key, time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = lock.Release()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, _ = lock.Extend(time.Minute)
+	assert.False(t, ok)
+
+	ok, err = next.Release()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestUseQuota(t *testing.T) {
+	requireRedis(t)
+	key := testKey("quota")
+	ok, used, err := UseQuota(testRdb, key, 2, 3, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), used)
+
+	// nothing is taken when it would go over the limit
+	ok, used, _ = UseQuota(testRdb, key, 2, 3, time.Minute)
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), used)
+	ok, used, _ = UseQuota(testRdb, key, 1, 3, time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), used)
+
+	ttl, err := testRdb.PTTL(key).Result()
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package luascript
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+/*
+UseQuota takes n of limit per window from the counter of key, like items granted to a user a day.
+The window starts when the counter is created, not at fixed times.
+It returns whether n is taken and how many are used in the window, nothing is taken when it would go over limit.
+*/
+func UseQuota(c redis.Cmdable, key string, n, limit int64, window time.Duration) (bool, int64, error) {
+	result, err := TakeQuota.Run(c, []string{key}, n, limit, window.Milliseconds()).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected result of quota: %v", result)
+	}
+	taken, _ := values[0].(int64)
+	used, _ := values[1].(int64)
+	return taken == 1, used, nil
+}
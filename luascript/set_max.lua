@@ -0,0 +1,8 @@
+-- set KEYS[1] to ARGV[1] for ARGV[2] milliseconds, only if it's larger than the current one,
+-- as stamps of concurrent writers may arrive out of order. It returns 1 if it's set.
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tonumber(ARGV[1]) <= current then
+  return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
@@ -0,0 +1,13 @@
+-- add ARGV[1] to the counter of KEYS[1] unless it goes over ARGV[2],
+-- the counter starts a window of ARGV[3] milliseconds when it's created.
+-- It returns whether it's taken, and the counter after it.
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+local n = tonumber(ARGV[1])
+if used + n > tonumber(ARGV[2]) then
+  return {0, used}
+end
+used = redis.call("INCRBY", KEYS[1], n)
+if used == n then
+  redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return {1, used}
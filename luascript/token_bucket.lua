@@ -0,0 +1,26 @@
+-- refill tokens of KEYS[1] by ARGV[1] per second up to ARGV[2], and take one if there is.
+-- ARGV[3] is now in milliseconds, given by the caller, as TIME can't be followed by writes in scripts of older redis.
+-- It returns whether it's allowed, and milliseconds to wait for the next token if it's not.
+-- The bucket expires after it would be full again, so idle callers leave nothing behind.
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+  tokens = burst
+  ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+// MailEventType is the event_type of messages the worker deposits into mailboxes, their data is a domain.Mail
+const MailEventType = "user_mail"
+
+var errMailNotFound = status.Error(codes.NotFound, "mail is not found")
+
+/*
+MailAck is the mail after it's acknowledged, with what claiming it has given,
+Grant is nil for a mail without attachments or acknowledged before.
+*/
+type MailAck struct {
+	domain.Mail
+	Grant *GrantResult `json:"grant,omitempty"`
+}
+
+var mailColumns = []string{"mail_id", "kind", "subject", "body", "item_ids", "currency", "xp", "created_at", "read_at", "claimed_at"}
+
+/*
+DepositMail puts the mail into the mailbox of its user, it returns false if the mail is there already,
+as the event of it may be delivered more than once. NotFound if the user doesn't exist.
+*/
+func (d dbClient) DepositMail(ctx context.Context, m domain.Mail) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DepositMail")
+	defer span.End()
+	span.SetAttributes(attribute.String("user.id", HashID(m.UserID)), attribute.String("mail.kind", m.Kind))
+
+	_, err := d.applyMutations(ctx, "DepositMail", []*spanner.Mutation{
+		spanner.InsertMap("mailbox", map[string]interface{}{
+			"user_id":    m.UserID,
+			"mail_id":    m.MailID,
+			"kind":       m.Kind,
+			"subject":    m.Subject,
+			"body":       m.Body,
+			"item_ids":   append([]string{}, m.ItemIDs...),
+			"currency":   m.Currency,
+			"xp":         m.XP,
+			"created_at": spanner.CommitTimestamp,
+		}),
+	})
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Mailbox lists mails of the user from the newest, acknowledged ones as well, paginated in the same way as WalletLedger
+func (d dbClient) Mailbox(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]domain.Mail, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "Mailbox")
+	defer span.End()
+
+	limit = pageSize(limit)
+	// the same shape as the one of the ledger, a timestamp and an id
+	at, mailID, err := decodeLedgerCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT mail_id, kind, subject, body, item_ids, currency, xp, created_at, read_at, claimed_at FROM mailbox
+		  WHERE user_id = @userID AND (created_at < @at OR (created_at = @at AND mail_id < @mailID))
+		  ORDER BY created_at DESC, mail_id DESC LIMIT @limit`,
+		Params: map[string]interface{}{
+			"userID": userID,
+			"at":     at,
+			"mailID": mailID,
+			"limit":  limit + 1,
+		},
+	}
+	mails := make([]domain.Mail, 0, limit+1)
+	err = d.ForEachRow(ctx, "Mailbox", stmt, func(row *spanner.Row) error {
+		m, err := mailOfRow(userID, row)
+		if err != nil {
+			return err
+		}
+		mails = append(mails, m)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(mails) <= limit {
+		return mails, "", nil
+	}
+	mails = mails[:limit]
+	last := mails[limit-1]
+	return mails, encodeCursor(last.CreatedAt.Format(time.RFC3339Nano) + "/" + last.MailID), nil
+}
+
+/*
+AckMail marks the mail read, and claims it if it has attachments, in a single transaction,
+so the attachments are given once and a mail is never marked claimed without them.
+Claiming fails like GrantToUser, nothing is marked then. A mail acknowledged before is returned as it is.
+*/
+func (d dbClient) AckMail(ctx context.Context, w io.Writer, userID, mailID string) (MailAck, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "AckMail")
+	defer span.End()
+	span.SetAttributes(attribute.String("user.id", HashID(userID)))
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return MailAck{}, err
+	}
+
+	var ack MailAck
+	var lastSeq int64
+	resp, err := d.readWriteTransaction(ctx, "AckMail", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		ack, lastSeq = MailAck{}, 0
+		row, err := txn.ReadRow(ctx, "mailbox", spanner.Key{userID, mailID}, mailColumns)
+		if spanner.ErrCode(err) == codes.NotFound {
+			return errMailNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if ack.Mail, err = mailOfRow(userID, row); err != nil {
+			return err
+		}
+		if ack.ReadAt != nil {
+			return nil
+		}
+
+		values := map[string]interface{}{
+			"user_id": userID,
+			"mail_id": mailID,
+			"read_at": spanner.CommitTimestamp,
+		}
+		if g, ok := ack.Mail.Grant(); ok {
+			result, seq, err := d.grantIn(ctx, txn, userID, g)
+			if err != nil {
+				return err
+			}
+			ack.Grant, lastSeq = &result, seq
+			values["claimed_at"] = spanner.CommitTimestamp
+		}
+		return txn.BufferWrite([]*spanner.Mutation{spanner.UpdateMap("mailbox", values)})
+	})
+	if err != nil {
+		return MailAck{}, err
+	}
+
+	if ack.ReadAt == nil {
+		ack.ReadAt = &resp.CommitTs
+		if ack.Grant != nil {
+			ack.ClaimedAt = &resp.CommitTs
+			d.grantCommitted(ctx, userID, *ack.Grant, lastSeq, resp.CommitTs)
+		}
+	}
+	span.SetAttributes(attribute.Bool("mail.claimed", ack.Grant != nil))
+	return ack, nil
+}
+
+// a row of mailColumns
+func mailOfRow(userID string, row *spanner.Row) (domain.Mail, error) {
+	var mailID, kind, subject, body string
+	var itemIDs []string
+	var currency, xp int64
+	var createdAt time.Time
+	var readAt, claimedAt spanner.NullTime
+	if err := row.Columns(&mailID, &kind, &subject, &body, &itemIDs, &currency, &xp, &createdAt, &readAt, &claimedAt); err != nil {
+		return domain.Mail{}, err
+	}
+	m, err := domain.NewMail(userID, mailID, kind, subject, body, itemIDs, currency, xp)
+	if err != nil {
+		return domain.Mail{}, err
+	}
+	m.CreatedAt = createdAt
+	if readAt.Valid {
+		m.ReadAt = &readAt.Time
+	}
+	if claimedAt.Valid {
+		m.ClaimedAt = &claimedAt.Time
+	}
+	return m, nil
+}
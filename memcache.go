@@ -0,0 +1,143 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+/*
+Memcaching is a Cacher on Memcached, to compare it with Caching on Redis.
+It's the same as Caching for entries of the data layer, with the same ttl, health and epoch prefix,
+except that misses are not carried over from the previous epoch, and ttls are rounded up to seconds.
+Activity streams and rate limits stay on Redis, Memcached doesn't have their data structures.
+*/
+type Memcaching struct {
+	Client *memcache.Client
+	Health *CacheHealth
+	// prefix of keys, see CacheEpoch
+	Epoch CacheEpoch
+}
+
+func NewMemcaching(servers []string, epoch CacheEpoch) *Memcaching {
+	client := memcache.New(servers...)
+	client.Timeout = 1 * time.Second
+	client.MaxIdleConns = 10
+	return &Memcaching{Client: client, Health: NewCacheHealth(), Epoch: epoch}
+}
+
+// seconds of the ttl, at least 1 not to be 0, which means never expire
+func memcacheExpiration(ttl time.Duration) int32 {
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// a miss is not an error of memcached
+func (c *Memcaching) observe(err error) {
+	if errors.Is(err, memcache.ErrCacheMiss) || errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) {
+		err = nil
+	}
+	c.Health.Observe(err)
+}
+
+func (c *Memcaching) Get(key string) (result string, err error) {
+	start := time.Now()
+	defer func() { observeCacheGet(key, start, err, errors.Is(err, memcache.ErrCacheMiss)) }()
+	if !c.Health.Usable() {
+		return "", errCacheDown
+	}
+	item, err := c.Client.Get(c.Epoch.key(key))
+	c.Health.ObserveLatency(time.Since(start))
+	c.observe(err)
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
+}
+
+func (c *Memcaching) Slow() bool {
+	return c.Health.Slow()
+}
+
+func (c *Memcaching) Set(key string, data string) error {
+	return c.SetWithTTL(key, data, cacheTTL)
+}
+
+func (c *Memcaching) SetWithTTL(key string, data string, ttl time.Duration) (err error) {
+	start := time.Now()
+	defer func() { observeCacheSet(key, start, err) }()
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err = c.Client.Set(&memcache.Item{Key: c.Epoch.key(key), Value: []byte(data), Expiration: memcacheExpiration(ttl)})
+	c.observe(err)
+	return err
+}
+
+func (c *Memcaching) Del(key string) (err error) {
+	start := time.Now()
+	defer func() { observeCacheDel(key, start, err) }()
+	if !c.Health.Usable() {
+		return errCacheDown
+	}
+	err = c.Client.Delete(c.Epoch.key(key))
+	c.observe(err)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+// CompareAndSwap by the cas id of gets, a miss or a conflict is a lost race as the one of Caching
+func (c *Memcaching) CompareAndSwap(key string, old string, new string) (bool, error) {
+	if !c.Health.Usable() {
+		return false, errCacheDown
+	}
+	item, err := c.Client.Get(c.Epoch.key(key))
+	c.observe(err)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if string(item.Value) != old {
+		return false, nil
+	}
+	item.Value = []byte(new)
+	item.Expiration = memcacheExpiration(cacheTTL)
+	err = c.Client.CompareAndSwap(item)
+	c.observe(err)
+	if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) || errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WatchHealth pings memcached in background to feed Health
+func (c *Memcaching) WatchHealth(ctx context.Context, interval time.Duration) {
+	if c.Health == nil {
+		return
+	}
+	c.Health.Watch(ctx, c.Client.Ping, interval)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+Request scoped memo.
+Lookups in a request through memoize reach Spanner or redis only once per key,
+it matters for compound or batch endpoints which look up the same user or item many times.
+It lives only as long as the context, so it never serves data of another request.
+Writes in the same request have to forget keys they change.
+*/
+
+type memoKey struct{}
+
+type memo struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// WithMemo returns a context with an empty memo, it's set per request by the middleware
+func WithMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, memoKey{}, &memo{values: map[string]interface{}{}})
+}
+
+/*
+memoize returns the value of key in the memo, or calls fn and remembers its result.
+Errors are not remembered, so a failed lookup is tried again.
+Without a memo in ctx it just calls fn.
+*/
+func memoize[T any](ctx context.Context, key string, fn func() (T, error)) (T, error) {
+	m, ok := ctx.Value(memoKey{}).(*memo)
+	if !ok {
+		return fn()
+	}
+
+	m.mu.Lock()
+	v, found := m.values[key]
+	m.mu.Unlock()
+	if found {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("memo.hit", key))
+		return v.(T), nil
+	}
+
+	// not holding the lock while calling fn, concurrent lookups of the same key may both call it
+	result, err := fn()
+	if err != nil {
+		return result, err
+	}
+	m.mu.Lock()
+	m.values[key] = result
+	m.mu.Unlock()
+	return result, nil
+}
+
+// forget key in the memo, after it's changed in the request
+func forget(ctx context.Context, key string) {
+	m, ok := ctx.Value(memoKey{}).(*memo)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	delete(m.values, key)
+	m.mu.Unlock()
+}
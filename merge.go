@@ -0,0 +1,328 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+// MergePolicy is what MergeUsers does with an item both users have
+type MergePolicy string
+
+const (
+	// quantities of both are added up, as items stack
+	MergeSum MergePolicy = "sum"
+	// the larger quantity of the two is kept
+	MergeMax MergePolicy = "max"
+	// the quantity of the target is kept, the one of the source is dropped
+	MergeKeepTarget MergePolicy = "keep_target"
+	// nothing is merged, AlreadyExists
+	MergeFail MergePolicy = "fail"
+)
+
+// ParseMergePolicy reads the policy of a request, empty is sum
+func ParseMergePolicy(policy string) (MergePolicy, error) {
+	switch p := MergePolicy(policy); p {
+	case "":
+		return MergeSum, nil
+	case MergeSum, MergeMax, MergeKeepTarget, MergeFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown merge policy %q, it has to be %s, %s, %s or %s", domain.ErrInvalid, policy, MergeSum, MergeMax, MergeKeepTarget, MergeFail)
+}
+
+/*
+MergeReport is what the source has given to the target by MergeUsers.
+Merged is false when the source was merged into the target before, nothing else is set then.
+*/
+type MergeReport struct {
+	SourceUserID string      `json:"source_user_id"`
+	TargetUserID string      `json:"target_user_id"`
+	Policy       MergePolicy `json:"policy"`
+	Merged       bool        `json:"merged"`
+	// items of the target after the merge which the source had, and items of the source dropped by the policy
+	Items   []auditedItem `json:"items"`
+	Dropped []string      `json:"dropped"`
+	// currency moved from the wallet of the source, with the wallet of the target after it
+	Currency int64         `json:"currency"`
+	Wallet   domain.Wallet `json:"wallet"`
+	XP       int64         `json:"xp"`
+	// mails of the source not acknowledged yet, moved into the mailbox of the target
+	Mails int `json:"mails"`
+}
+
+/*
+MergeUsers merges the source user into the target one, like when a player links a guest account to their main one,
+in a single transaction of steps, all or nothing:
+items by the policy for items both have, the wallet with a ledger entry of domain.LedgerMerge, XP, and mails not acknowledged yet.
+The source is deleted with the rest of it, like its audit and PII, and its tombstone in user_merges tells where it has gone.
+It's recorded in the audit of the target, and the items given are told as changes of the target, so they are in its activity.
+NotFound if either doesn't exist, ErrInvalid to merge a user into itself, and merging the source again into the same target is not an error.
+*/
+func (d dbClient) MergeUsers(ctx context.Context, w io.Writer, sourceID, targetID string, policy MergePolicy) (MergeReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "MergeUsers")
+	defer span.End()
+	span.SetAttributes(attribute.String("merge.policy", string(policy)))
+
+	if err := checkParams(UserParams{UserID: sourceID}); err != nil {
+		return MergeReport{}, err
+	}
+	if err := checkParams(UserParams{UserID: targetID}); err != nil {
+		return MergeReport{}, err
+	}
+	if sourceID == targetID {
+		return MergeReport{}, fmt.Errorf("%w: a user can't be merged into itself", domain.ErrInvalid)
+	}
+	if d.EventSourced {
+		// items of the read model can lag behind events, the policy can't be applied to them
+		return MergeReport{}, fmt.Errorf("%w: merging users is not supported in event sourced mode", domain.ErrInvalid)
+	}
+
+	var report MergeReport
+	var lastSeq int64
+	resp, err := d.readWriteTransaction(ctx, "MergeUsers", func(ctx context.Context, txn *spanner.ReadWriteTransaction) (err error) {
+		if report, lastSeq, err = mergeIn(ctx, txn, sourceID, targetID, policy); err != nil || !report.Merged {
+			return err
+		}
+		itemIDs := make([]string, len(report.Items))
+		for n, item := range report.Items {
+			itemIDs[n] = item.ItemID
+		}
+		return d.stageChanges(txn, targetID, lastSeq, itemIDs, EventItemAdded)
+	})
+	if err != nil {
+		return MergeReport{}, err
+	}
+
+	span.SetAttributes(attribute.Bool("merge.merged", report.Merged), attribute.Int("merge.items", len(report.Items)))
+	if !report.Merged {
+		return report, nil
+	}
+	d.invalidateUserItems(ctx, sourceID, resp.CommitTs)
+	d.invalidateUserItems(ctx, targetID, resp.CommitTs)
+	for n, item := range report.Items {
+		d.emitChange(ctx, targetID, lastSeq-int64(len(report.Items)-1-n), item.ItemID, EventItemAdded)
+	}
+	return report, nil
+}
+
+// the steps of merging in txn, it returns the sequence of the last item given to the target
+func mergeIn(ctx context.Context, txn *spanner.ReadWriteTransaction, sourceID, targetID string, policy MergePolicy) (MergeReport, int64, error) {
+	report := MergeReport{SourceUserID: sourceID, TargetUserID: targetID, Policy: policy, Items: []auditedItem{}, Dropped: []string{}}
+
+	merged, err := mergedInto(ctx, txn, sourceID)
+	if err != nil {
+		return report, 0, err
+	}
+	if merged != "" {
+		if merged != targetID {
+			return report, 0, status.Errorf(codes.NotFound, "user %s has been merged into another user", sourceID)
+		}
+		return report, 0, nil
+	}
+
+	// NotFound if either doesn't exist
+	row, err := txn.ReadRow(ctx, "users", spanner.Key{sourceID}, []string{"xp"})
+	if err != nil {
+		return report, 0, err
+	}
+	if err := row.Columns(&report.XP); err != nil {
+		return report, 0, err
+	}
+	row, err = txn.ReadRow(ctx, "users", spanner.Key{targetID}, []string{"xp", "version"})
+	if err != nil {
+		return report, 0, err
+	}
+	var xp, version int64
+	if err := row.Columns(&xp, &version); err != nil {
+		return report, 0, err
+	}
+
+	lastSeq, err := mergeItems(ctx, txn, sourceID, targetID, policy, &report)
+	if err != nil {
+		return report, 0, err
+	}
+
+	var mutations []*spanner.Mutation
+	source, _, err := readWallet(ctx, txn, sourceID)
+	if err != nil {
+		return report, 0, err
+	}
+	report.Currency = source.Balance
+	if report.Currency > 0 {
+		wallet, changes, err := changeWallet(ctx, txn, targetID, report.Currency, domain.LedgerMerge, sourceID)
+		if err != nil {
+			return report, 0, err
+		}
+		report.Wallet = wallet
+		mutations = append(mutations, changes...)
+	} else if report.Wallet, _, err = readWallet(ctx, txn, targetID); err != nil {
+		return report, 0, err
+	}
+
+	// XP is of the profile, so it's a change of the version even without XP to add
+	mutations = append(mutations, spanner.UpdateMap("users", map[string]interface{}{
+		"user_id": targetID,
+		"xp":      xp + report.XP,
+		"version": version + 1,
+	}))
+
+	mails, err := moveMails(ctx, txn, sourceID, targetID)
+	if err != nil {
+		return report, 0, err
+	}
+	report.Mails = len(mails)
+	mutations = append(mutations, mails...)
+
+	report.Merged = true
+	audit, err := auditMutation(ctx, targetID, AuditMergeUser, nil, report)
+	if err != nil {
+		return report, 0, err
+	}
+	// the rows interleaved in the source are deleted with it
+	mutations = append(mutations, audit,
+		spanner.InsertMap("user_merges", map[string]interface{}{
+			"source_user_id": sourceID,
+			"target_user_id": targetID,
+			"policy":         string(policy),
+			"merged_at":      spanner.CommitTimestamp,
+		}),
+		spanner.Delete("users", spanner.Key{sourceID}),
+	)
+	return report, lastSeq, txn.BufferWrite(mutations)
+}
+
+// the user the source has been merged into, empty if it's not merged
+func mergedInto(ctx context.Context, txn *spanner.ReadWriteTransaction, sourceID string) (string, error) {
+	row, err := txn.ReadRow(ctx, "user_merges", spanner.Key{sourceID}, []string{"target_user_id"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var targetID string
+	err = row.Columns(&targetID)
+	return targetID, err
+}
+
+// give items of the source to the target by the policy, and return the sequence of the last one given
+func mergeItems(ctx context.Context, txn *spanner.ReadWriteTransaction, sourceID, targetID string, policy MergePolicy, report *MergeReport) (int64, error) {
+	owned := func(userID string) (map[string]int64, []string, error) {
+		quantities := map[string]int64{}
+		var ids []string
+		err := txn.Read(ctx, "user_items", spanner.Key{userID}.AsPrefix(), []string{"item_id", "quantity"}).Do(func(row *spanner.Row) error {
+			var itemID string
+			var quantity int64
+			if err := row.Columns(&itemID, &quantity); err != nil {
+				return err
+			}
+			quantities[itemID] = quantity
+			ids = append(ids, itemID)
+			return nil
+		})
+		return quantities, ids, err
+	}
+	source, itemIDs, err := owned(sourceID)
+	if err != nil {
+		return 0, err
+	}
+	target, _, err := owned(targetID)
+	if err != nil {
+		return 0, err
+	}
+
+	t := time.Now()
+	var stmts []spanner.Statement
+	var added int64
+	for _, itemID := range itemIDs {
+		quantity, has := target[itemID]
+		if !has {
+			stmts = append(stmts, insertUserItem.Statement(userItemParams{UserID: targetID, ItemID: itemID, Quantity: source[itemID], Timestamp: t}))
+			report.Items = append(report.Items, auditedItem{ItemID: itemID, Quantity: source[itemID]})
+			added++
+			continue
+		}
+		var delta int64
+		switch policy {
+		case MergeFail:
+			return 0, status.Errorf(codes.AlreadyExists, "both users have item %s", itemID)
+		case MergeSum:
+			delta = source[itemID]
+		case MergeMax:
+			delta = max(source[itemID]-quantity, 0)
+		}
+		if delta == 0 {
+			report.Dropped = append(report.Dropped, itemID)
+			continue
+		}
+		stmts = append(stmts, stackUserItem.Statement(stackParams{UserID: targetID, ItemID: itemID, Quantity: delta}))
+		report.Items = append(report.Items, auditedItem{ItemID: itemID, Quantity: quantity + delta})
+	}
+	if len(stmts) == 0 {
+		return 0, nil
+	}
+	if _, err := txn.BatchUpdateWithOptions(ctx, stmts, spanner.QueryOptions{RequestTag: "func=MergeUsers,env=dev,action=upsert"}); err != nil {
+		return 0, err
+	}
+	if err := addItemCount(ctx, txn, targetID, added); err != nil {
+		return 0, err
+	}
+	return reserveUserSeqs(ctx, txn, targetID, int64(len(report.Items)))
+}
+
+// mutations to move mails of the source not acknowledged yet to the target, mail ids are unique across users
+func moveMails(ctx context.Context, txn *spanner.ReadWriteTransaction, sourceID, targetID string) ([]*spanner.Mutation, error) {
+	stmt := spanner.Statement{
+		SQL:    `SELECT mail_id, kind, subject, body, item_ids, currency, xp, created_at FROM mailbox WHERE user_id = @userID AND read_at IS NULL`,
+		Params: map[string]interface{}{"userID": sourceID},
+	}
+	var mutations []*spanner.Mutation
+	err := txn.QueryWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=MergeUsers,env=dev,action=query"}).Do(func(row *spanner.Row) error {
+		var mailID, kind, subject, body string
+		var itemIDs []string
+		var currency, xp int64
+		var createdAt time.Time
+		if err := row.Columns(&mailID, &kind, &subject, &body, &itemIDs, &currency, &xp, &createdAt); err != nil {
+			return err
+		}
+		mutations = append(mutations, spanner.InsertMap("mailbox", map[string]interface{}{
+			"user_id":    targetID,
+			"mail_id":    mailID,
+			"kind":       kind,
+			"subject":    subject,
+			"body":       body,
+			"item_ids":   itemIDs,
+			"currency":   currency,
+			"xp":         xp,
+			"created_at": createdAt,
+		}))
+		return nil
+	})
+	return mutations, err
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// metrics of the data layer, they are exposed by promhttp.Handler() with the default registry
+var (
+	cachePayloadSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_cache_payload_size_bytes",
+			Help:    "Size of serialized payloads read from or written to cache, partitioned by operation.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		},
+		[]string{"op"},
+	)
+	localCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_local_cache_lookups_total",
+			Help: "How many reads looked up the cache in process before the remote one, partitioned by result, hit or miss.",
+		},
+		[]string{"result"},
+	)
+	cacheRaceWins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_race_wins_total",
+			Help: "How many reads raced between cache and Spanner, partitioned by the source which returned first.",
+		},
+		[]string{"source"},
+	)
+	cacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_lookups_total",
+			Help: "How many reads looked up user items in cache, partitioned by result, hit, miss, negative, which is of an unknown user, or stale, which is not provably fresh.",
+		},
+		[]string{"result"},
+	)
+	strategyLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_strategy_lookups_total",
+			Help: "The same as game_cache_lookups_total, partitioned by the cache strategy of the user as well, to compare strategies rolled out.",
+		},
+		[]string{"strategy", "result"},
+	)
+	cacheUpkeepDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_cache_upkeep_duration_milliseconds",
+			Help:    "How long keeping cached user items up with a mutation took, partitioned by the cache strategy of the user.",
+			Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 300},
+		},
+		[]string{"strategy"},
+	)
+	catalogLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_catalog_lookups_total",
+			Help: "How many queries of user items looked up item names in the catalog cache, partitioned by result, hit or miss.",
+		},
+		[]string{"result"},
+	)
+	spannerRowsPerQuery = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_spanner_rows_per_query",
+			Help:    "How many rows a query read from Spanner, partitioned by query.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"query"},
+	)
+	spannerRowLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_spanner_row_limit_exceeded_total",
+			Help: "How many queries were stopped by the row limit of the request, partitioned by query.",
+		},
+		[]string{"query"},
+	)
+	commitMutations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_spanner_commit_mutations",
+			Help:    "How many mutations a read-write transaction committed, from commit stats, partitioned by transaction.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"txn"},
+	)
+	commitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_spanner_commit_duration_milliseconds",
+			Help:    "How long a read-write transaction took until it was committed, partitioned by transaction.",
+			Buckets: []float64{5, 10, 25, 50, 100, 300, 1200, 5000},
+		},
+		[]string{"txn"},
+	)
+	writeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_spanner_write_duration_milliseconds",
+			Help:    "How long a successful write took including retries, partitioned by operation and write mode, dml or mutation.",
+			Buckets: []float64{5, 10, 25, 50, 100, 300, 1200, 5000},
+		},
+		[]string{"operation", "mode"},
+	)
+	userItemsQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_user_items_query_duration_milliseconds",
+			Help:    "How long a successful query of user items took from Spanner, partitioned by staleness, strong, exact or max.",
+			Buckets: []float64{5, 10, 25, 50, 100, 300, 1200, 5000},
+		},
+		[]string{"staleness"},
+	)
+	spannerAborts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_spanner_aborted_transactions_total",
+			Help: "How many attempts of read-write transactions were aborted and run again by the Spanner client, partitioned by transaction.",
+		},
+		[]string{"txn"},
+	)
+	spannerRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_spanner_retries_total",
+			Help: "How many transient errors of Spanner were retried, partitioned by operation and outcome, retried, recovered, exhausted or no_budget.",
+		},
+		[]string{"operation", "outcome"},
+	)
+	cacheEpochCarryovers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_cache_epoch_carryovers_total",
+			Help: "How many cache misses were filled from the previous epoch.",
+		},
+	)
+	cacheStampedesPrevented = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_cache_stampedes_prevented_total",
+			Help: "How many cache misses of user items shared the query of a concurrent miss of the same user instead of querying Spanner.",
+		},
+	)
+	standbyCopies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_standby_copies_total",
+			Help: "How many writes were copied to the cache which isn't read, the standby unless reads are switched over, partitioned by result, ok or error.",
+		},
+		[]string{"result"},
+	)
+	cacheKeys = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "game_cache_keys",
+			Help: "Keys of the primary and the standby redis, sampled while a standby is used, partitioned by cache.",
+		},
+		[]string{"cache"},
+	)
+	cacheGets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_gets_total",
+			Help: "How many reads of any key the cache was asked for, partitioned by key prefix and result, hit, miss, error or down, which was skipped while the cache was down.",
+		},
+		[]string{"prefix", "result"},
+	)
+	cacheSetFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_cache_set_failures_total",
+			Help: "How many writes to the cache failed, partitioned by key prefix and reason, error or down, which was skipped while the cache was down.",
+		},
+		[]string{"prefix", "reason"},
+	)
+	cacheDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "game_cache_duration_milliseconds",
+			Help:    "How long a call of redis, or memcached with CACHE_BACKEND, took, partitioned by operation, get, set or del, and key prefix.",
+			Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 25, 100},
+		},
+		[]string{"op", "prefix"},
+	)
+	outboxRelayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_outbox_relayed_total",
+			Help: "How many events of the outbox the relay published, partitioned by result, published or failed.",
+		},
+		[]string{"result"},
+	)
+	cacheReplicaFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_cache_replica_fallbacks_total",
+			Help: "How many cache reads fell back to the primary because a read replica failed.",
+		},
+	)
+)
+
+/*
+instruments of OpenTelemetry for some of the above, pushed by OTLP when the api runs with METRICS_EXPORTER=otlp.
+They're of the global meter provider, which is a no-op until it's set, and it doesn't fail to make them.
+*/
+var (
+	meter                      = otel.Meter("github.com/shin5ok/go-architecting-workshop")
+	cacheLookupsCounter, _     = meter.Int64Counter("game.cache.lookups", metric.WithDescription("How many reads looked up cache, by result."))
+	cacheDurationHistogram, _  = meter.Float64Histogram("game.cache.duration", metric.WithUnit("ms"), metric.WithDescription("How long calls of cache took, by operation and key prefix."))
+	commitDurationHistogram, _ = meter.Float64Histogram("game.spanner.commit.duration", metric.WithUnit("ms"), metric.WithDescription("How long read-write transactions took to commit, by transaction."))
+)
+
+// count a lookup of cache by its result, of both Prometheus and OpenTelemetry
+func countCacheLookup(ctx context.Context, result string) {
+	cacheLookups.WithLabelValues(result).Inc()
+	cacheLookupsCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+func init() {
+	prometheus.MustRegister(cachePayloadSize)
+	prometheus.MustRegister(cacheRaceWins)
+	prometheus.MustRegister(cacheLookups)
+	prometheus.MustRegister(strategyLookups)
+	prometheus.MustRegister(cacheUpkeepDuration)
+	prometheus.MustRegister(localCacheLookups)
+	prometheus.MustRegister(catalogLookups)
+	prometheus.MustRegister(cacheReplicaFallbacks)
+	prometheus.MustRegister(cacheGets)
+	prometheus.MustRegister(cacheSetFailures)
+	prometheus.MustRegister(cacheDuration)
+	prometheus.MustRegister(standbyCopies)
+	prometheus.MustRegister(cacheKeys)
+	prometheus.MustRegister(cacheStampedesPrevented)
+	prometheus.MustRegister(cacheEpochCarryovers)
+	prometheus.MustRegister(spannerRowsPerQuery)
+	prometheus.MustRegister(spannerRowLimitExceeded)
+	prometheus.MustRegister(commitMutations)
+	prometheus.MustRegister(commitDuration)
+	prometheus.MustRegister(writeDuration)
+	prometheus.MustRegister(userItemsQueryDuration)
+	prometheus.MustRegister(spannerRetries)
+	prometheus.MustRegister(spannerAborts)
+	prometheus.MustRegister(outboxRelayed)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+Transactional outbox.
+When dbClient.Outbox is true, changes of items are staged in event_outbox in the same transaction as the changes,
+and the relay publishes them after the commit, so a change is published at least once even if the broker is down when it's committed,
+instead of being lost like by EmitChange, which is called once after the commit.
+A change can be published more than once, when the relay stops between publishing and marking it,
+consumers dedupe it by its id as they do for redeliveries of the broker.
+*/
+
+const (
+	// the type of changes of items in the outbox, the same as the one published by EmitChange without it
+	OutboxItemChanged = "user_items_changed"
+
+	outboxBatchSize = 100
+	// events claimed by a relay are left to it for a while, any relay can claim them again after it if they are not published
+	outboxLease = 30 * time.Second
+)
+
+// OutboxEvent is an event staged in event_outbox, Payload is json of it
+type OutboxEvent struct {
+	ID       string
+	Type     string
+	Payload  json.RawMessage
+	Attempts int64
+}
+
+/*
+stage changes of the items in txn, with seqs up to lastSeq as emitChange is called after the commit.
+Nothing is staged without the outbox, or in event sourced mode, where changes are made by the projector after the transaction.
+*/
+func (d dbClient) stageChanges(txn *spanner.ReadWriteTransaction, userID string, lastSeq int64, itemIDs []string, changeType string) error {
+	if !d.Outbox || d.EventSourced || len(itemIDs) == 0 {
+		return nil
+	}
+	mutations := make([]*spanner.Mutation, 0, len(itemIDs))
+	for n, itemID := range itemIDs {
+		e, err := domain.NewItemChanged(userID, lastSeq-int64(len(itemIDs)-1-n), itemID, changeType)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		mutations = append(mutations, spanner.InsertMap("event_outbox", map[string]interface{}{
+			"event_id":   e.ID(),
+			"event_type": OutboxItemChanged,
+			"payload":    string(payload),
+			"attempts":   int64(0),
+			"created_at": spanner.CommitTimestamp,
+		}))
+	}
+	return txn.BufferWrite(mutations)
+}
+
+/*
+RelayOutbox publishes events of event_outbox not published yet in the order they were committed, up to outboxBatchSize of them,
+and returns how many were published.
+They are claimed for outboxLease first, so relays of other instances don't publish them at the same time,
+and marked published once publish returns, so publish has to return after the broker has accepted the event.
+It stops at the first failure, as the broker is likely down for the rest as well, and the events left are published again after the lease.
+*/
+func (d dbClient) RelayOutbox(ctx context.Context, publish func(context.Context, OutboxEvent) error) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RelayOutbox")
+	defer span.End()
+
+	var events []OutboxEvent
+	_, err := d.readWriteTransaction(ctx, "RelayOutbox", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		events = nil
+		stmt := spanner.Statement{
+			SQL: `SELECT event_id, event_type, payload, attempts
+			  FROM event_outbox@{FORCE_INDEX=event_outbox_by_published}
+			  WHERE published_at IS NULL AND (leased_until IS NULL OR leased_until < CURRENT_TIMESTAMP())
+			  ORDER BY created_at
+			  LIMIT @limit`,
+			Params: map[string]interface{}{
+				"limit": outboxBatchSize,
+			},
+		}
+		leasedUntil := time.Now().Add(outboxLease)
+		mutations := []*spanner.Mutation{}
+		err := forEachRow(ctx, txn, "RelayOutbox", stmt, func(row *spanner.Row) error {
+			var e OutboxEvent
+			var payload string
+			if err := row.Columns(&e.ID, &e.Type, &payload, &e.Attempts); err != nil {
+				return err
+			}
+			e.Payload = json.RawMessage(payload)
+			e.Attempts++
+			events = append(events, e)
+			mutations = append(mutations, spanner.UpdateMap("event_outbox", map[string]interface{}{
+				"event_id":     e.ID,
+				"attempts":     e.Attempts,
+				"leased_until": leasedUntil,
+			}))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var publishErr error
+	published := make([]*spanner.Mutation, 0, len(events))
+	for _, e := range events {
+		if err := publish(ctx, e); err != nil {
+			outboxRelayed.WithLabelValues("failed").Inc()
+			publishErr = fmt.Errorf("could not publish %s of the outbox, attempt %d: %w", e.ID, e.Attempts, err)
+			break
+		}
+		published = append(published, spanner.UpdateMap("event_outbox", map[string]interface{}{
+			"event_id":     e.ID,
+			"published_at": spanner.CommitTimestamp,
+		}))
+	}
+	span.SetAttributes(attribute.Int("outbox.claimed", len(events)), attribute.Int("outbox.published", len(published)))
+	if len(published) == 0 {
+		return 0, publishErr
+	}
+	// they are published again after the lease if they can't be marked
+	if err := d.apply(ctx, "RelayOutbox", published); err != nil {
+		return 0, errors.Join(publishErr, err)
+	}
+	outboxRelayed.WithLabelValues("published").Add(float64(len(published)))
+	return len(published), publishErr
+}
+
+// RelayPending relays all of pending events of the outbox by publish, it's run by the scheduler of the api every second
+func (d dbClient) RelayPending(ctx context.Context, publish func(context.Context, OutboxEvent) error) (int, error) {
+	total := 0
+	for {
+		n, err := d.RelayOutbox(ctx, publish)
+		total += n
+		if err != nil || n < outboxBatchSize {
+			return total, err
+		}
+	}
+}
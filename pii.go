@@ -0,0 +1,164 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/envelope"
+)
+
+var ErrEncryptionDisabled = errors.New("field encryption is not configured")
+
+// optional sensitive attributes of a user, they are encrypted before written to Spanner
+type UserPII struct {
+	Email      string `json:"email,omitempty" validate:"omitempty,email,max=254"`
+	ExternalID string `json:"external_id,omitempty" validate:"max=128"`
+}
+
+func (p UserPII) validate() error {
+	if err := validate.Struct(p); err != nil {
+		return fmt.Errorf("%w: %s", domain.ErrInvalid, err)
+	}
+	return nil
+}
+
+func sealField(ctx context.Context, e *envelope.Envelope, value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return e.Seal(ctx, []byte(value))
+}
+
+func openField(ctx context.Context, e *envelope.Envelope, sealed []byte) (string, error) {
+	if sealed == nil {
+		return "", nil
+	}
+	plain, err := e.Open(ctx, sealed)
+	return string(plain), err
+}
+
+// set sensitive attributes of the user
+func (d dbClient) SetUserPII(ctx context.Context, w io.Writer, userID string, pii UserPII) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "SetUserPII")
+	defer span.End()
+
+	if d.Envelope == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := pii.validate(); err != nil {
+		return err
+	}
+
+	email, err := sealField(ctx, d.Envelope, pii.Email)
+	if err != nil {
+		return err
+	}
+	externalID, err := sealField(ctx, d.Envelope, pii.ExternalID)
+	if err != nil {
+		return err
+	}
+
+	err = d.apply(ctx, "SetUserPII", []*spanner.Mutation{
+		spanner.InsertOrUpdateMap("user_pii", map[string]interface{}{
+			"user_id":     userID,
+			"email":       email,
+			"external_id": externalID,
+			"updated_at":  time.Now(),
+		}),
+	})
+	return err
+}
+
+// get sensitive attributes of the user, decrypted
+func (d dbClient) UserPII(ctx context.Context, w io.Writer, userID string) (UserPII, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserPII")
+	defer span.End()
+
+	if d.Envelope == nil {
+		return UserPII{}, ErrEncryptionDisabled
+	}
+
+	row, err := d.readRow(ctx, "user_pii", spanner.Key{userID}, []string{"email", "external_id"})
+	if err != nil {
+		return UserPII{}, err
+	}
+	var email, externalID []byte
+	if err := row.Columns(&email, &externalID); err != nil {
+		return UserPII{}, err
+	}
+
+	var pii UserPII
+	if pii.Email, err = openField(ctx, d.Envelope, email); err != nil {
+		return UserPII{}, err
+	}
+	if pii.ExternalID, err = openField(ctx, d.Envelope, externalID); err != nil {
+		return UserPII{}, err
+	}
+	return pii, nil
+}
+
+// RewrapUserPII wraps data keys of all the rows again with the current key, to be run after key rotation
+func (d dbClient) RewrapUserPII(ctx context.Context) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RewrapUserPII")
+	defer span.End()
+
+	if d.Envelope == nil {
+		return 0, ErrEncryptionDisabled
+	}
+
+	open := func(ctx context.Context) *spanner.RowIterator {
+		return d.Sc.Single().Read(ctx, "user_pii", spanner.AllKeys(), []string{"user_id", "email", "external_id"})
+	}
+	count := 0
+	err := eachRow(ctx, "RewrapUserPII", open, func(row *spanner.Row) error {
+		var userID string
+		var email, externalID []byte
+		if err := row.Columns(&userID, &email, &externalID); err != nil {
+			return err
+		}
+
+		values := map[string]interface{}{"user_id": userID}
+		for column, sealed := range map[string][]byte{"email": email, "external_id": externalID} {
+			if sealed == nil {
+				continue
+			}
+			rewrapped, err := d.Envelope.Rewrap(ctx, sealed)
+			if err != nil {
+				return err
+			}
+			values[column] = rewrapped
+		}
+		err := d.apply(ctx, "RewrapUserPII", []*spanner.Mutation{spanner.UpdateMap("user_pii", values)})
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+Event sourcing mode.
+When dbClient.EventSourced is true, item mutations are just appended to user_item_events,
+and the projector maintains user_items as the read model of them.
+The API surface is the same, but reads lag behind writes until the projector catches up.
+*/
+
+const (
+	EventItemAdded   = domain.ItemAdded
+	EventItemRemoved = domain.ItemRemoved
+	// one of the item is taken back by compensation, the rest of the stack is kept, it's only of user_item_events
+	EventItemRevoked = "item_revoked"
+
+	projectionBatchSize = 100
+
+	// the lease RebuildUserItems holds, projectors skip events while it's held
+	projectionLease = "projection"
+	rebuildLeaseTTL = 5 * time.Minute
+)
+
+// append an event of user item, it's called instead of writing to user_items directly
+func (d dbClient) appendItemEvent(ctx context.Context, userID, itemID, eventType string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "appendItemEvent")
+	defer span.End()
+
+	eventID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.readWriteTransaction(ctx, "appendItemEvent", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		sql := `INSERT user_item_events (user_id, event_id, item_id, event_type, projected, created_at)
+		  VALUES (@userID, @eventID, @itemID, @eventType, false, PENDING_COMMIT_TIMESTAMP())`
+		stmt := spanner.Statement{
+			SQL: sql,
+			Params: map[string]interface{}{
+				"userID":    userID,
+				"eventID":   eventID.String(),
+				"itemID":    itemID,
+				"eventType": eventType,
+			},
+		}
+		_, err := txn.UpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=appendItemEvent,env=dev,action=insert"})
+		return err
+	})
+
+	return err
+}
+
+/*
+ProjectEvents applies unprojected events to user_items in order, and returns how many events were applied.
+Items stack as AddItemToUser does in DML mode, an added event adds one to the quantity and keeps created_at of the row,
+a revoked one takes one back, and a removed one deletes the whole stack.
+ErrLeaseHeld is returned while RebuildUserItems runs.
+*/
+func (d dbClient) ProjectEvents(ctx context.Context) (int, error) {
+	return d.projectEvents(ctx, "")
+}
+
+// projectEvents as holder of the projection lease, the one of RebuildUserItems, or no one
+func (d dbClient) projectEvents(ctx context.Context, holder string) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ProjectEvents")
+	defer span.End()
+
+	var applied int
+	_, err := d.readWriteTransaction(ctx, "ProjectEvents", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		applied = 0
+		if err := checkLease(ctx, txn, projectionLease, holder); err != nil {
+			return err
+		}
+		stmt := spanner.Statement{
+			SQL: `SELECT user_id, event_id, item_id, event_type
+			  FROM user_item_events@{FORCE_INDEX=user_item_events_by_projected}
+			  WHERE projected = false
+			  ORDER BY created_at
+			  LIMIT @limit`,
+			Params: map[string]interface{}{
+				"limit": projectionBatchSize,
+			},
+		}
+		now := time.Now()
+		mutations := []*spanner.Mutation{}
+		// quantities as of the events applied so far in this batch
+		quantities := map[[2]string]int64{}
+		deltas := map[string]int64{}
+		var granted int64
+		err := forEachRow(ctx, txn, "ProjectEvents", stmt, func(row *spanner.Row) error {
+			var userID, eventID, itemID, eventType string
+			if err := row.Columns(&userID, &eventID, &itemID, &eventType); err != nil {
+				return err
+			}
+
+			key := [2]string{userID, itemID}
+			quantity, ok := quantities[key]
+			if !ok {
+				var err error
+				if quantity, err = ownedQuantity(ctx, txn, userID, itemID); err != nil {
+					return err
+				}
+			}
+
+			switch eventType {
+			case EventItemAdded:
+				if quantity == 0 {
+					mutations = append(mutations, spanner.InsertOrUpdateMap("user_items", map[string]interface{}{
+						"user_id":    userID,
+						"item_id":    itemID,
+						"quantity":   1,
+						"created_at": now,
+						"updated_at": spanner.CommitTimestamp,
+					}))
+					deltas[userID]++
+				} else {
+					mutations = append(mutations, spanner.UpdateMap("user_items", map[string]interface{}{
+						"user_id":    userID,
+						"item_id":    itemID,
+						"quantity":   quantity + 1,
+						"updated_at": spanner.CommitTimestamp,
+					}))
+				}
+				quantity++
+				granted++
+			case EventItemRevoked:
+				switch {
+				case quantity > 1:
+					mutations = append(mutations, spanner.UpdateMap("user_items", map[string]interface{}{
+						"user_id":    userID,
+						"item_id":    itemID,
+						"quantity":   quantity - 1,
+						"updated_at": spanner.CommitTimestamp,
+					}))
+					quantity--
+				case quantity == 1:
+					mutations = append(mutations, spanner.Delete("user_items", spanner.Key{userID, itemID}), tombstone(userID, itemID))
+					deltas[userID]--
+					quantity = 0
+				}
+			case EventItemRemoved:
+				mutations = append(mutations, spanner.Delete("user_items", spanner.Key{userID, itemID}), tombstone(userID, itemID))
+				if quantity > 0 {
+					deltas[userID]--
+				}
+				quantity = 0
+			default:
+				log.Printf("unknown event type %s of %s, skipped\n", eventType, eventID)
+			}
+			quantities[key] = quantity
+			mutations = append(mutations, spanner.UpdateMap("user_item_events", map[string]interface{}{
+				"user_id":   userID,
+				"event_id":  eventID,
+				"projected": true,
+			}))
+			applied++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for userID, delta := range deltas {
+			if err := addItemCount(ctx, txn, userID, delta); err != nil {
+				return err
+			}
+		}
+		if err := addCounter(ctx, txn, CounterItemsGranted, granted); err != nil {
+			return err
+		}
+		return txn.BufferWrite(mutations)
+	})
+
+	return applied, err
+}
+
+/*
+ProjectPending applies all of pending events batch by batch, it's run by the scheduler of the api every second.
+It's not an error that RebuildUserItems is running, then events are left to it.
+*/
+func (d dbClient) ProjectPending(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := d.ProjectEvents(ctx)
+		if errors.Is(err, ErrLeaseHeld) {
+			return total, nil
+		}
+		total += n
+		if err != nil || n < projectionBatchSize {
+			return total, err
+		}
+	}
+}
+
+/*
+RebuildUserItems throws away the read model and replays all of events from the beginning.
+It holds the projection lease while it runs, so projectors of the API don't apply events between the truncate and the replay,
+and it fails with ErrLeaseHeld if another rebuild is running.
+*/
+func (d dbClient) RebuildUserItems(ctx context.Context) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RebuildUserItems")
+	defer span.End()
+
+	holder := "rebuild-" + uuid.NewString()
+	if err := d.AcquireLease(ctx, projectionLease, holder, rebuildLeaseTTL); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := d.ReleaseLease(context.Background(), projectionLease, holder); err != nil {
+			log.Println("RebuildUserItems", err)
+		}
+	}()
+
+	for _, sql := range []string{
+		`DELETE FROM user_items WHERE true`,
+		`UPDATE users SET item_count = 0 WHERE true`,
+		`UPDATE user_item_events SET projected = false WHERE true`,
+	} {
+		count, err := d.Sc.PartitionedUpdate(ctx, spanner.Statement{SQL: sql})
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("%d records has been updated by %q\n", count, sql)
+		// extended as it goes, not to be taken over while it's slow
+		if err := d.AcquireLease(ctx, projectionLease, holder, rebuildLeaseTTL); err != nil {
+			return 0, err
+		}
+	}
+
+	total := 0
+	for {
+		n, err := d.projectEvents(ctx, holder)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < projectionBatchSize {
+			return total, nil
+		}
+		if err := d.AcquireLease(ctx, projectionLease, holder, rebuildLeaseTTL); err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+type Receipt struct {
+	ReceiptID   string    `json:"receipt_id"`
+	SagaID      string    `json:"saga_id"`
+	UserID      string    `json:"user_id"`
+	ItemID      string    `json:"item_id"`
+	Price       int64     `json:"price"`
+	PurchasedAt time.Time `json:"purchased_at"`
+}
+
+// an item of the catalog, it's memoized in the request
+func (d dbClient) item(ctx context.Context, itemID string) (domain.Item, error) {
+	return memoize(ctx, "item_"+itemID, func() (domain.Item, error) {
+		row, err := d.readRow(ctx, "items", spanner.Key{itemID}, []string{"item_name", "price"})
+		if err != nil {
+			return domain.Item{}, err
+		}
+		var name string
+		var price int64
+		if err := row.Columns(&name, &price); err != nil {
+			return domain.Item{}, err
+		}
+		return domain.NewItem(itemID, name, price)
+	})
+}
+
+/*
+undo of AddItemToUser, used by compensation.
+Only the quantity granted is taken back from the stack, and the row is deleted when nothing is left,
+so copies the user owned before the grant are kept.
+*/
+func (d dbClient) revokeItem(ctx context.Context, userID, itemID string, quantity int64) error {
+	if d.EventSourced {
+		// quantity is always 1 in event sourced mode
+		return d.appendItemEvent(ctx, userID, itemID, EventItemRevoked)
+	}
+	var seq, left int64
+	resp, err := d.readWriteTransaction(ctx, "revokeItem", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		seq = 0
+		row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"quantity"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			// nothing is left to take back
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var owned int64
+		if err := row.Columns(&owned); err != nil {
+			return err
+		}
+		before := auditedItem{ItemID: itemID, Quantity: owned}
+		// nil when the whole stack is gone
+		var after interface{}
+		var ms []*spanner.Mutation
+		if left = owned - quantity; left > 0 {
+			after = auditedItem{ItemID: itemID, Quantity: left}
+			ms = append(ms, spanner.UpdateMap("user_items", map[string]interface{}{
+				"user_id":    userID,
+				"item_id":    itemID,
+				"quantity":   left,
+				"updated_at": spanner.CommitTimestamp,
+			}))
+		} else {
+			ms = append(ms, spanner.Delete("user_items", spanner.Key{userID, itemID}), tombstone(userID, itemID))
+			if err := addItemCount(ctx, txn, userID, -1); err != nil {
+				return err
+			}
+		}
+		audit, err := auditMutation(ctx, userID, AuditRemoveItem, before, after)
+		if err != nil {
+			return err
+		}
+		if err := txn.BufferWrite(append(ms, audit)); err != nil {
+			return err
+		}
+		if seq, err = nextUserSeq(ctx, txn, userID); err != nil {
+			return err
+		}
+		return d.stageChanges(txn, userID, seq, []string{itemID}, EventItemRemoved)
+	})
+	if err == nil && seq > 0 {
+		d.patchUserItems(ctx, userID, itemID, left > 0, resp.CommitTs)
+		d.emitChange(ctx, userID, seq, itemID, EventItemRemoved)
+	}
+	return err
+}
+
+type userItemKey struct {
+	UserID string `spanner:"userID"`
+	ItemID string `spanner:"itemID"`
+}
+
+var deleteUserItem = newQuery[userItemKey](`DELETE FROM user_items WHERE user_id = @userID AND item_id = @itemID`)
+
+/*
+delete an item from the user, and keep item_count, the cache and change events along with it.
+When mustExist is true, NotFound is returned if the user doesn't have the item,
+in event sourcing mode it's checked against the read model, which can lag behind events.
+*/
+func (d dbClient) removeItem(ctx context.Context, userID, itemID string, mustExist bool) error {
+	if d.EventSourced {
+		if mustExist {
+			if _, err := d.readRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"item_id"}); err != nil {
+				return err
+			}
+		}
+		return d.appendItemEvent(ctx, userID, itemID, EventItemRemoved)
+	}
+	var seq int64
+	resp, err := d.readWriteTransaction(ctx, "removeItem", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// read for the audit too, the whole stack is removed
+		before := auditedItem{ItemID: itemID}
+		row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"quantity"})
+		switch {
+		case spanner.ErrCode(err) == codes.NotFound && !mustExist:
+		case err != nil:
+			return err
+		default:
+			if err := row.Columns(&before.Quantity); err != nil {
+				return err
+			}
+		}
+		stmt := deleteUserItem.Statement(userItemKey{UserID: userID, ItemID: itemID})
+		deleted, err := txn.UpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=removeItem,env=dev,action=delete"})
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			audit, err := auditMutation(ctx, userID, AuditRemoveItem, before, nil)
+			if err != nil {
+				return err
+			}
+			if err := txn.BufferWrite([]*spanner.Mutation{tombstone(userID, itemID), audit}); err != nil {
+				return err
+			}
+		}
+		if err := addItemCount(ctx, txn, userID, -deleted); err != nil {
+			return err
+		}
+		if seq, err = nextUserSeq(ctx, txn, userID); err != nil {
+			return err
+		}
+		return d.stageChanges(txn, userID, seq, []string{itemID}, EventItemRemoved)
+	})
+	if err == nil {
+		d.patchUserItems(ctx, userID, itemID, false, resp.CommitTs)
+		d.emitChange(ctx, userID, seq, itemID, EventItemRemoved)
+	}
+	return err
+}
+
+/*
+purchase an item as a saga across wallet and user_items,
+debit wallet -> grant item -> emit receipt
+*/
+func (d dbClient) PurchaseItem(ctx context.Context, w io.Writer, u UserParams, i ItemParams) (Receipt, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "PurchaseItem")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return Receipt{}, err
+	}
+	if err := checkParams(i); err != nil {
+		return Receipt{}, err
+	}
+
+	item, err := d.item(ctx, i.ItemID)
+	if err != nil {
+		return Receipt{}, err
+	}
+	receiptID, err := uuid.NewRandom()
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt := Receipt{
+		ReceiptID: receiptID.String(),
+		UserID:    u.UserID,
+		ItemID:    i.ItemID,
+		Price:     item.Price,
+	}
+
+	sagaID, err := d.RunSaga(ctx, "purchase", u.UserID, d.purchaseSteps(w, u, i, &receipt))
+	receipt.SagaID = sagaID
+	return receipt, err
+}
+
+// steps of PurchaseItem, debiting the price, granting the item and emitting the receipt, which is completed by the last one
+func (d dbClient) purchaseSteps(w io.Writer, u UserParams, i ItemParams, receipt *Receipt) []SagaStep {
+	price := receipt.Price
+	return []SagaStep{
+		{
+			Name: "debitWallet",
+			Do: func(ctx context.Context) error {
+				// free items don't touch the wallet
+				if price == 0 {
+					return nil
+				}
+				_, err := d.CreditWallet(ctx, w, u.UserID, -price, domain.LedgerPurchase, receipt.ReceiptID)
+				return err
+			},
+			Compensate: func(ctx context.Context) error {
+				if price == 0 {
+					return nil
+				}
+				_, err := d.CreditWallet(ctx, w, u.UserID, price, domain.LedgerRefund, receipt.ReceiptID)
+				return err
+			},
+		},
+		{
+			Name: "grantItem",
+			Do: func(ctx context.Context) error {
+				return d.AddItemToUser(ctx, w, u, i)
+			},
+			Compensate: func(ctx context.Context) error {
+				return d.revokeItem(ctx, u.UserID, i.ItemID, i.quantity())
+			},
+		},
+		{
+			Name: "emitReceipt",
+			Do: func(ctx context.Context) error {
+				receipt.PurchasedAt = time.Now()
+				if d.EmitReceipt == nil {
+					log.Printf("receipt %s of %s\n", receipt.ReceiptID, HashID(receipt.UserID))
+					return nil
+				}
+				return d.EmitReceipt(ctx, *receipt)
+			},
+		},
+	}
+}
+
+/*
+record a purchase verified by a store and grant the item, stacked on the one the user owns as AddItemToUser does,
+it's idempotent by receipt id, so a retried verification grants nothing and returns false
+*/
+func (d dbClient) RecordPurchase(ctx context.Context, w io.Writer, u UserParams, p VerifiedPurchase) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RecordPurchase")
+	defer span.End()
+
+	if err := checkParams(u); err != nil {
+		return false, err
+	}
+
+	var granted bool
+	var seq int64
+	resp, err := d.readWriteTransaction(ctx, "RecordPurchase", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		granted = false
+		seq = 0
+		_, err := txn.ReadRow(ctx, "purchases", spanner.Key{p.ReceiptID}, []string{"receipt_id"})
+		if err == nil {
+			return nil
+		}
+		if spanner.ErrCode(err) != codes.NotFound {
+			return err
+		}
+
+		t := time.Now()
+		mutations := []*spanner.Mutation{
+			spanner.InsertMap("purchases", map[string]interface{}{
+				"receipt_id": p.ReceiptID,
+				"user_id":    u.UserID,
+				"store":      p.Store,
+				"item_id":    p.ItemID,
+				"created_at": t,
+			}),
+		}
+		if d.EventSourced {
+			eventID, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+			mutations = append(mutations, spanner.InsertMap("user_item_events", map[string]interface{}{
+				"user_id":    u.UserID,
+				"event_id":   eventID.String(),
+				"item_id":    p.ItemID,
+				"event_type": EventItemAdded,
+				"projected":  false,
+				"created_at": spanner.CommitTimestamp,
+			}))
+		} else {
+			// stacked and audited as AddItemToUser does
+			if seq, err = d.stackItem(ctx, txn, u.UserID, p.ItemID, 1); err != nil {
+				return err
+			}
+		}
+
+		granted = true
+		return txn.BufferWrite(mutations)
+	})
+
+	if err == nil && granted && seq > 0 {
+		d.patchUserItems(ctx, u.UserID, p.ItemID, true, resp.CommitTs)
+		d.emitChange(ctx, u.UserID, seq, p.ItemID, EventItemAdded)
+	}
+	return granted, err
+}
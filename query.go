@@ -0,0 +1,96 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"cloud.google.com/go/spanner"
+)
+
+// @name in SQL, not @{hints}
+var sqlParam = regexp.MustCompile(`@(\w+)`)
+
+/*
+query is SQL whose params are the fields of P, named by their `spanner` tags like the columns of rows.
+It's checked when it's created that every @param of the SQL is a field and every field is used,
+so a mismatch like @itemID and "itemId" is found when the package is loaded, by any test or at the start of the server,
+not by a request which happens to run it.
+*/
+type query[P any] struct {
+	sql    string
+	fields map[string]int
+}
+
+// newQuery panics if sql and P don't match, it's meant for package level vars
+func newQuery[P any](sql string) query[P] {
+	q, err := parseQuery[P](sql)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+func parseQuery[P any](sql string) (query[P], error) {
+	var p P
+	t := reflect.TypeOf(p)
+	if t.Kind() != reflect.Struct {
+		return query[P]{}, fmt.Errorf("params of a query have to be a struct, not %s", t)
+	}
+
+	q := query[P]{sql: sql, fields: map[string]int{}}
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("spanner")
+		if name == "" {
+			return query[P]{}, fmt.Errorf("%s.%s doesn't have a spanner tag", t.Name(), t.Field(i).Name)
+		}
+		q.fields[name] = i
+	}
+
+	used := map[string]bool{}
+	var missing []string
+	for _, m := range sqlParam.FindAllStringSubmatch(sql, -1) {
+		name := m[1]
+		if _, ok := q.fields[name]; !ok && !used[name] {
+			missing = append(missing, name)
+		}
+		used[name] = true
+	}
+	var unused []string
+	for name := range q.fields {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	if len(missing) > 0 || len(unused) > 0 {
+		return query[P]{}, fmt.Errorf("params of %s don't match the SQL, missing %v, unused %v: %s", t.Name(), missing, unused, sql)
+	}
+	return q, nil
+}
+
+// Statement binds p to the SQL
+func (q query[P]) Statement(p P) spanner.Statement {
+	v := reflect.ValueOf(p)
+	params := make(map[string]interface{}, len(q.fields))
+	for name, i := range q.fields {
+		params[name] = v.Field(i).Interface()
+	}
+	return spanner.Statement{SQL: q.sql, Params: params}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"google.golang.org/api/androidpublisher/v3"
+)
+
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+type StoreReceipt struct {
+	Store     string `json:"store"`
+	ProductID string `json:"product_id" validate:"required,max=36"`
+	Token     string `json:"token" validate:"required"`
+}
+
+func (r StoreReceipt) validate() error {
+	if err := validate.Struct(r); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidReceipt, err)
+	}
+	return nil
+}
+
+// the result of verification, ReceiptID is unique per purchase in the store
+type VerifiedPurchase struct {
+	ReceiptID string
+	Store     string
+	ItemID    string
+}
+
+// StubVerifier accepts any receipt, just for local development
+type StubVerifier struct{}
+
+func (v StubVerifier) Verify(ctx context.Context, r StoreReceipt) (VerifiedPurchase, error) {
+	if err := r.validate(); err != nil {
+		return VerifiedPurchase{}, err
+	}
+	// hashed, since a token can be longer than receipt ids can be
+	sum := sha256.Sum256([]byte(r.Token))
+	return VerifiedPurchase{
+		ReceiptID: "stub-" + hex.EncodeToString(sum[:16]),
+		Store:     "stub",
+		ItemID:    r.ProductID,
+	}, nil
+}
+
+// GooglePlayVerifier asks Google Play Developer API whether the purchase token is valid
+type GooglePlayVerifier struct {
+	Service     *androidpublisher.Service
+	PackageName string
+}
+
+func NewGooglePlayVerifier(ctx context.Context, packageName string) (*GooglePlayVerifier, error) {
+	service, err := androidpublisher.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &GooglePlayVerifier{Service: service, PackageName: packageName}, nil
+}
+
+func (v *GooglePlayVerifier) Verify(ctx context.Context, r StoreReceipt) (VerifiedPurchase, error) {
+	if err := r.validate(); err != nil {
+		return VerifiedPurchase{}, err
+	}
+
+	purchase, err := v.Service.Purchases.Products.Get(v.PackageName, r.ProductID, r.Token).Context(ctx).Do()
+	if err != nil {
+		return VerifiedPurchase{}, err
+	}
+	// 0: purchased, 1: canceled, 2: pending
+	if purchase.PurchaseState != 0 {
+		return VerifiedPurchase{}, fmt.Errorf("%w: purchase state is %d", ErrInvalidReceipt, purchase.PurchaseState)
+	}
+
+	return VerifiedPurchase{
+		ReceiptID: purchase.OrderId,
+		Store:     "google_play",
+		ItemID:    r.ProductID,
+	}, nil
+}
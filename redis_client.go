@@ -0,0 +1,126 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisMode is how redis is deployed
+type RedisMode string
+
+const (
+	RedisStandalone RedisMode = "standalone"
+	RedisCluster    RedisMode = "cluster"
+	RedisSentinel   RedisMode = "sentinel"
+)
+
+/*
+RedisConfig is where redis is.
+Addrs is the host for standalone, some nodes of the cluster to discover the others, or the Sentinels,
+which tell the master of MasterName and the new one after a failover.
+*/
+type RedisConfig struct {
+	Mode       RedisMode
+	Addrs      []string
+	MasterName string
+	Password   string
+}
+
+// ParseRedisConfig reads config, hosts are comma separated, an empty mode is standalone on the default host if no host is given
+func ParseRedisConfig(mode, hosts, masterName, password string) (RedisConfig, error) {
+	config := RedisConfig{Mode: RedisMode(mode), MasterName: masterName, Password: password}
+	for _, addr := range strings.Split(hosts, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			config.Addrs = append(config.Addrs, addr)
+		}
+	}
+	switch config.Mode {
+	case "", RedisStandalone:
+		config.Mode = RedisStandalone
+		if len(config.Addrs) > 1 {
+			return RedisConfig{}, fmt.Errorf("standalone redis has one host, not %d", len(config.Addrs))
+		}
+		return config, nil
+	case RedisCluster, RedisSentinel:
+	default:
+		return RedisConfig{}, fmt.Errorf("unknown redis mode %q, it has to be %s, %s or %s", mode, RedisStandalone, RedisCluster, RedisSentinel)
+	}
+	if len(config.Addrs) == 0 {
+		return RedisConfig{}, fmt.Errorf("no host of redis %s", config.Mode)
+	}
+	if config.Mode == RedisSentinel && masterName == "" {
+		return RedisConfig{}, fmt.Errorf("master name is required for Sentinel")
+	}
+	return config, nil
+}
+
+/*
+NewRedisClient connects to redis as it's deployed, with the timeouts and retries of the policy.
+A client of Sentinel follows the master over failovers, and one of the cluster routes each key to the node of its slot,
+so scripts of more than one key need the keys in a slot, see InvalidateUserItems.
+*/
+func NewRedisClient(config RedisConfig, policy RedisPolicy) redis.UniversalClient {
+	switch config.Mode {
+	case RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           config.Addrs,
+			Password:        config.Password,
+			PoolSize:        policy.PoolSize,
+			PoolTimeout:     time.Duration(policy.PoolTimeout),
+			DialTimeout:     time.Duration(policy.DialTimeout),
+			ReadTimeout:     time.Duration(policy.ReadTimeout),
+			WriteTimeout:    time.Duration(policy.WriteTimeout),
+			MaxRetries:      policy.MaxRetries,
+			MinRetryBackoff: time.Duration(policy.MinRetryBackoff),
+			MaxRetryBackoff: time.Duration(policy.MaxRetryBackoff),
+		})
+	case RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:      config.MasterName,
+			SentinelAddrs:   config.Addrs,
+			Password:        config.Password,
+			PoolSize:        policy.PoolSize,
+			PoolTimeout:     time.Duration(policy.PoolTimeout),
+			DialTimeout:     time.Duration(policy.DialTimeout),
+			ReadTimeout:     time.Duration(policy.ReadTimeout),
+			WriteTimeout:    time.Duration(policy.WriteTimeout),
+			MaxRetries:      policy.MaxRetries,
+			MinRetryBackoff: time.Duration(policy.MinRetryBackoff),
+			MaxRetryBackoff: time.Duration(policy.MaxRetryBackoff),
+		})
+	}
+	addr := ""
+	if len(config.Addrs) > 0 {
+		addr = config.Addrs[0]
+	}
+	return redis.NewClient(policy.Options(addr, config.Password))
+}
+
+// run fn on each master, keys of a cluster are spread over them
+func forEachMaster(c redis.UniversalClient, fn func(*redis.Client) error) error {
+	switch c := c.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(fn)
+	case *redis.Client:
+		return fn(c)
+	}
+	return fmt.Errorf("unknown redis client %T", c)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+ResetTables are truncated by ResetGameData, interleaved children before their parents.
+items is not here, it's the catalog inserted with the schemas, and user_items referring to it are gone anyway.
+api_keys is not either, not to lock attendees and admins out of the next run.
+inbox and event_analytics are the state of consumers, they would skip or count events of the next run otherwise.
+idempotency_keys would replay responses about users who are gone, and event_outbox would publish changes of them.
+*/
+var ResetTables = []string{
+	"user_items",
+	"user_item_tombstones",
+	"user_item_events",
+	"user_sequences",
+	"user_pii",
+	"mailbox",
+	"user_audit",
+	"wallet_ledger",
+	"wallets",
+	"users",
+	"purchases",
+	"grants",
+	"user_merges",
+	"sagas",
+	"inbox",
+	"event_analytics",
+	"counters",
+	"idempotency_keys",
+	"event_outbox",
+}
+
+/*
+ResetGameData deletes all rows of ResetTables by partitioned DML, and returns how many rows are deleted from each of them.
+It's for workshop environments, to start each run clean. It's not atomic across tables, but running it again completes it.
+*/
+func (d dbClient) ResetGameData(ctx context.Context) (map[string]int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ResetGameData")
+	defer span.End()
+
+	deleted := map[string]int64{}
+	for _, table := range ResetTables {
+		stmt := spanner.Statement{SQL: fmt.Sprintf("DELETE FROM %s WHERE true", table)}
+		count, err := d.Sc.PartitionedUpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=ResetGameData,env=dev,action=delete"})
+		if err != nil {
+			return deleted, fmt.Errorf("%s: %w", table, err)
+		}
+		span.SetAttributes(attribute.Int64("reset."+table, count))
+		deleted[table] = count
+	}
+	return deleted, nil
+}
+
+// keys of this app in any epoch, redis may be shared with others, so it's never flushed as a whole
+var resetKeyPatterns = []string{
+	"*UserItems_*",
+	"UserItemsSeq_*",
+	"UserItemsWrite_*",
+	"UserActivity_*",
+	"*Idempotency_*",
+}
+
+/*
+FlushGameKeys deletes cache, sequences of invalidation and activity streams of all users, and returns how many keys are deleted.
+Each master of a cluster is scanned for its own keys, and they are deleted one by one, as keys of a DEL have to be in a slot.
+*/
+func (c *Caching) FlushGameKeys() (int64, error) {
+	var deleted int64
+	err := forEachMaster(c.RedisClient, func(node *redis.Client) error {
+		for _, pattern := range resetKeyPatterns {
+			iter := node.Scan(0, pattern, 1000).Iterator()
+			keys := []string{}
+			for iter.Next() {
+				keys = append(keys, iter.Val())
+			}
+			if err := iter.Err(); err != nil {
+				return err
+			}
+			// deleted in batches, not to block redis by a huge pipeline
+			for len(keys) > 0 {
+				n := len(keys)
+				if n > 1000 {
+					n = 1000
+				}
+				pipe := node.Pipeline()
+				dels := make([]*redis.IntCmd, n)
+				for i, key := range keys[:n] {
+					dels[i] = pipe.Del(key)
+				}
+				if _, err := pipe.Exec(); err != nil {
+					return err
+				}
+				for _, del := range dels {
+					atomic.AddInt64(&deleted, del.Val())
+				}
+				keys = keys[n:]
+			}
+		}
+		return nil
+	})
+	return atomic.LoadInt64(&deleted), err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+RetentionPolicy tells which rows of a table are expired.
+Rows older than the retention window by TimeColumn, and matching Filter if it's not empty, are archived then deleted.
+Filter must select only rows which never change anymore, otherwise a row could be changed to match
+between archiving and deleting, and be deleted without archived.
+*/
+type RetentionPolicy struct {
+	Table      string
+	TimeColumn string
+	Filter     string
+}
+
+// activity and audit tables, user_item_events is not here because it's the source of user_items
+var RetentionPolicies = []RetentionPolicy{
+	{Table: "event_analytics", TimeColumn: "received_at"},
+	{Table: "inbox", TimeColumn: "processed_at"},
+	{Table: "sagas", TimeColumn: "updated_at", Filter: fmt.Sprintf("state IN ('%s', '%s', '%s')", SagaCompleted, SagaCompensated, SagaFailed)},
+	// records are never changed once written, and the ones of a deleted user are gone with it
+	{Table: "user_audit", TimeColumn: "created_at"},
+}
+
+func (p RetentionPolicy) where() string {
+	where := fmt.Sprintf("%s < @before", p.TimeColumn)
+	if p.Filter != "" {
+		where += " AND " + p.Filter
+	}
+	return where
+}
+
+// ArchiveExpiredRows reads rows expired at before and calls fn with each of them as column name to value
+func (d dbClient) ArchiveExpiredRows(ctx context.Context, p RetentionPolicy, before time.Time, fn func(map[string]interface{}) error) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ArchiveExpiredRows")
+	defer span.End()
+	span.SetAttributes(attribute.String("retention.table", p.Table))
+
+	stmt := spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT * FROM %s WHERE %s", p.Table, p.where()),
+		Params: map[string]interface{}{"before": before},
+	}
+	var count int64
+	err := d.ForEachRow(ctx, "ArchiveExpiredRows", stmt, func(row *spanner.Row) error {
+		values := make(map[string]interface{}, row.Size())
+		for i, name := range row.ColumnNames() {
+			var v spanner.GenericColumnValue
+			if err := row.Column(i, &v); err != nil {
+				return err
+			}
+			values[name] = v.Value.AsInterface()
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	span.SetAttributes(attribute.Int64("retention.archived", count))
+	return count, err
+}
+
+// DeleteExpiredRows deletes rows expired at before with partitioned DML, call it after archived rows are stored safely
+func (d dbClient) DeleteExpiredRows(ctx context.Context, p RetentionPolicy, before time.Time) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "DeleteExpiredRows")
+	defer span.End()
+	span.SetAttributes(attribute.String("retention.table", p.Table))
+
+	stmt := spanner.Statement{
+		SQL:    fmt.Sprintf("DELETE FROM %s WHERE %s", p.Table, p.where()),
+		Params: map[string]interface{}{"before": before},
+	}
+	count, err := d.Sc.PartitionedUpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=DeleteExpiredRows,env=dev,action=delete"})
+	span.SetAttributes(attribute.Int64("retention.deleted", count))
+	return count, err
+}
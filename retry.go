@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is how many times an operation is tried, with exponential backoff and full jitter between them
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff << (attempt - 1)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+/*
+Retrier retries Spanner calls which failed by Aborted or Unavailable, the client library retries them only in some cases.
+Retries are limited by a budget shared by all operations, every call earns BudgetRatio of a retry up to BudgetMax,
+so an outage doesn't multiply the load on Spanner by MaxAttempts.
+An Unavailable commit may have been applied, inserts see AlreadyExists then, as they would when a client retries.
+*/
+type Retrier struct {
+	Default    RetryPolicy
+	Operations map[string]RetryPolicy
+
+	BudgetRatio float64
+	BudgetMax   float64
+
+	mu     sync.Mutex
+	tokens float64
+	// time.Sleep with ctx if nil, replaced by tests
+	sleep func(context.Context, time.Duration) error
+}
+
+func NewRetrier(policy RetryPolicy) *Retrier {
+	return &Retrier{Default: policy, Operations: map[string]RetryPolicy{}, BudgetRatio: 0.1, BudgetMax: 10, tokens: 10}
+}
+
+/*
+ParseRetrier reads policies like "3/50ms/1s,ProjectEvents=1/0s/0s",
+the one without the name is the default, others are of operations named as the ones of transactions and queries.
+It's nil for "off", to call Spanner just once.
+*/
+func ParseRetrier(config string) (*Retrier, error) {
+	if config == "off" {
+		return nil, nil
+	}
+	r := NewRetrier(RetryPolicy{MaxAttempts: 1})
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, spec, named := strings.Cut(entry, "=")
+		if !named {
+			spec = name
+		}
+		p, err := parseRetryPolicy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("retry %q: %w", entry, err)
+		}
+		if named {
+			r.Operations[strings.TrimSpace(name)] = p
+		} else {
+			r.Default = p
+		}
+	}
+	return r, nil
+}
+
+func parseRetryPolicy(spec string) (RetryPolicy, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 {
+		return RetryPolicy{}, errors.New(`has to be like "3/50ms/1s"`)
+	}
+	attempts, err := strconv.Atoi(parts[0])
+	if err != nil || attempts < 1 {
+		return RetryPolicy{}, errors.New("attempts has to be a positive number")
+	}
+	initial, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	max, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	return RetryPolicy{MaxAttempts: attempts, InitialBackoff: initial, MaxBackoff: max}, nil
+}
+
+func (r *Retrier) policy(name string) RetryPolicy {
+	if p, ok := r.Operations[name]; ok {
+		return p
+	}
+	return r.Default
+}
+
+func (r *Retrier) earn() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens += r.BudgetRatio
+	if r.tokens > r.BudgetMax {
+		r.tokens = r.BudgetMax
+	}
+}
+
+func (r *Retrier) spend() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+func (r *Retrier) wait(ctx context.Context, d time.Duration) error {
+	if r.sleep != nil {
+		return r.sleep(ctx, d)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Do calls f until it succeeds, fails by an error not to retry, or the attempts or the budget run out
+func (r *Retrier) Do(ctx context.Context, name string, f func() error) error {
+	if r == nil {
+		return unwrapPermanent(f())
+	}
+	r.earn()
+	p := r.policy(name)
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			if attempt > 1 {
+				spannerRetries.WithLabelValues(name, "recovered").Inc()
+			}
+			return nil
+		}
+		if !isTransient(err) {
+			return unwrapPermanent(err)
+		}
+		if attempt >= p.MaxAttempts {
+			if p.MaxAttempts > 1 {
+				spannerRetries.WithLabelValues(name, "exhausted").Inc()
+			}
+			return err
+		}
+		if !r.spend() {
+			spannerRetries.WithLabelValues(name, "no_budget").Inc()
+			return err
+		}
+		if r.wait(ctx, p.backoff(attempt)) != nil {
+			return err
+		}
+		spannerRetries.WithLabelValues(name, "retried").Inc()
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("spanner.retries", attempt))
+	}
+}
+
+// permanent wraps an error not to be retried even if it's transient, like the one after rows were delivered to the caller
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func unwrapPermanent(err error) error {
+	var p permanentError
+	if errors.As(err, &p) {
+		return p.error
+	}
+	return err
+}
+
+func isTransient(err error) bool {
+	var p permanentError
+	if errors.As(err, &p) {
+		return false
+	}
+	switch spanner.ErrCode(err) {
+	case codes.Aborted, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+/*
+retry runs f by the Retrier of the client, each attempt is guarded by the breaker,
+and has its own deadline of Timeout if it's set, so a hung call is tried again instead of taking the whole request.
+An attempt which ran out of its deadline is Unavailable, while the request still has time.
+*/
+func (d dbClient) retry(ctx context.Context, name string, f func(context.Context) error) error {
+	return d.Retrier.Do(ctx, name, func() error {
+		return d.guard(func() error {
+			if d.Timeout <= 0 {
+				return f(ctx)
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+			err := f(attemptCtx)
+			if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+				return status.Errorf(codes.Unavailable, "%s timed out after %s: %v", name, d.Timeout, err)
+			}
+			return err
+		})
+	})
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// RevokeReport is the result of revoking an item from all users
+type RevokeReport struct {
+	ItemID string `json:"item_id"`
+	// users who had the item when it was revoked
+	Users int `json:"users"`
+	// rows deleted from user_items by partitioned DML
+	Removed int64 `json:"removed"`
+}
+
+// users of a batch share a transaction for tombstones and sequences, and are invalidated in cache together
+const revokeBatchSize = 100
+
+type revokeParams struct {
+	ItemID string `spanner:"itemID"`
+}
+
+type recountParams struct {
+	UserIDs []string `spanner:"userIDs"`
+}
+
+var (
+	itemHolders      = newQuery[revokeParams](`SELECT user_id FROM user_items WHERE item_id = @itemID`)
+	deleteItemOfAll  = newQuery[revokeParams](`DELETE FROM user_items WHERE item_id = @itemID`)
+	recountItemsOfIn = newQuery[recountParams](`UPDATE users SET item_count = (SELECT COUNT(*) FROM user_items WHERE user_items.user_id = users.user_id)
+	  WHERE user_id IN UNNEST(@userIDs)`)
+)
+
+/*
+RevokeItem removes a recalled item from all users, NotFound if the item doesn't exist.
+user_items are deleted by partitioned DML, which is not in a transaction,
+so the users holding it are read before, and their tombstones, item_count and sequences are written after in batches.
+A user who is granted the item in between loses it without a change event, and the sync sees no tombstone for it.
+In event sourcing mode, a removal is appended for each of the users instead, and the projector applies them.
+*/
+func (d dbClient) RevokeItem(ctx context.Context, w io.Writer, itemID string) (RevokeReport, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RevokeItem")
+	defer span.End()
+
+	report := RevokeReport{ItemID: itemID}
+	if err := checkParams(ItemParams{ItemID: itemID}); err != nil {
+		return report, err
+	}
+	if _, err := d.readRow(ctx, "items", spanner.Key{itemID}, []string{"item_id"}); err != nil {
+		return report, err
+	}
+
+	var holders []string
+	err := d.ForEachRow(ctx, "RevokeItemHolders", itemHolders.Statement(revokeParams{ItemID: itemID}), func(row *spanner.Row) error {
+		var userID string
+		if err := row.Columns(&userID); err != nil {
+			return err
+		}
+		holders = append(holders, userID)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Users = len(holders)
+	span.SetAttributes(attribute.Int("revoke.users", len(holders)))
+
+	if d.EventSourced {
+		for _, userID := range holders {
+			if err := d.appendItemEvent(ctx, userID, itemID, EventItemRemoved); err != nil {
+				return report, err
+			}
+		}
+		return report, nil
+	}
+
+	report.Removed, err = d.Sc.PartitionedUpdateWithOptions(ctx, deleteItemOfAll.Statement(revokeParams{ItemID: itemID}),
+		spanner.QueryOptions{RequestTag: "func=RevokeItem,env=dev,action=delete"})
+	if err != nil {
+		return report, err
+	}
+	span.SetAttributes(attribute.Int64("revoke.removed", report.Removed))
+
+	for start := 0; start < len(holders); start += revokeBatchSize {
+		end := min(start+revokeBatchSize, len(holders))
+		if err := d.revokeBatch(ctx, holders[start:end], itemID); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// the rest of revoking for a batch of users, after their user_items have been deleted
+func (d dbClient) revokeBatch(ctx context.Context, userIDs []string, itemID string) error {
+	seqs := make(map[string]int64, len(userIDs))
+	resp, err := d.readWriteTransaction(ctx, "revokeBatch", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// counted again instead of decremented, so it's right even if the transaction is retried
+		stmt := recountItemsOfIn.Statement(recountParams{UserIDs: userIDs})
+		if _, err := txn.UpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=revokeBatch,env=dev,action=update"}); err != nil {
+			return err
+		}
+		mutations := make([]*spanner.Mutation, 0, len(userIDs))
+		for _, userID := range userIDs {
+			seq, err := nextUserSeq(ctx, txn, userID)
+			if err != nil {
+				return err
+			}
+			seqs[userID] = seq
+			if err := d.stageChanges(txn, userID, seq, []string{itemID}, EventItemRemoved); err != nil {
+				return err
+			}
+			mutations = append(mutations, tombstone(userID, itemID))
+		}
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		d.invalidateUserItems(ctx, userID, resp.CommitTs)
+		d.emitChange(ctx, userID, seqs[userID], itemID, EventItemRemoved)
+	}
+	log.Println("RevokeItem", itemID, "revoked from", len(userIDs), "users")
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+// return it from fn of ForEachRow to stop reading rows without an error
+var errStopRows = errors.New("stop rows")
+
+/*
+ErrTooManyRows is returned by a query which has more rows than the limit of the context, see WithRowLimit.
+Rows after the limit are not read, they have to be read by pages instead.
+*/
+type ErrTooManyRows struct {
+	Query string
+	Limit int
+}
+
+func (e *ErrTooManyRows) Error() string {
+	return fmt.Sprintf("query %s has more than %d rows, read them by pages with limit and cursor", e.Query, e.Limit)
+}
+
+type rowLimitKey struct{}
+
+/*
+WithRowLimit caps rows of every query in ctx, so a request never reads an unbounded result into memory,
+like UserItems of a user owning too many items. 0 is unlimited.
+It's set per request by the API, jobs and commands which scan tables run without it.
+*/
+func WithRowLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, rowLimitKey{}, limit)
+}
+
+func rowLimit(ctx context.Context) int {
+	limit, _ := ctx.Value(rowLimitKey{}).(int)
+	return limit
+}
+
+// Single(), ReadOnlyTransaction and ReadWriteTransaction can run a query
+type rowQuerier interface {
+	QueryWithOptions(ctx context.Context, statement spanner.Statement, opts spanner.QueryOptions) *spanner.RowIterator
+}
+
+/*
+ForEachRow runs stmt in a single use read-only transaction and calls fn with each row.
+name identifies the query, it's used for the span, the request tag and the row count metric.
+The iterator is stopped however it returns, so callers don't have to care about leaking it.
+*/
+func (d dbClient) ForEachRow(ctx context.Context, name string, stmt spanner.Statement, fn func(*spanner.Row) error) error {
+	delivered := false
+	return d.retry(ctx, name, func(ctx context.Context) error {
+		err := forEachRow(ctx, d.Sc.Single(), name, stmt, func(row *spanner.Row) error {
+			delivered = true
+			return fn(row)
+		})
+		// fn would see the rows twice if it's tried again
+		if delivered {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// the same as ForEachRow, in a transaction
+func forEachRow(ctx context.Context, q rowQuerier, name string, stmt spanner.Statement, fn func(*spanner.Row) error) error {
+	return eachRow(ctx, name, func(ctx context.Context) *spanner.RowIterator {
+		return q.QueryWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: fmt.Sprintf("func=%s,env=dev,action=query", name)})
+	}, fn)
+}
+
+// the same as Single().ReadRow, with the latency budget tracked
+func (d dbClient) readRow(ctx context.Context, table string, key spanner.Key, columns []string) (*spanner.Row, error) {
+	defer budget.Track(ctx, budget.Spanner)()
+	var row *spanner.Row
+	err := d.retry(ctx, "readRow."+table, func(ctx context.Context) (err error) {
+		row, err = d.Sc.Single().ReadRow(ctx, table, key, columns)
+		return err
+	})
+	return row, err
+}
+
+// for iterators which are not of a query, like Read or a partition of batch read
+func eachRow(ctx context.Context, name string, open func(context.Context) *spanner.RowIterator, fn func(*spanner.Row) error) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "rows."+name)
+	defer span.End()
+	defer budget.Track(ctx, budget.Spanner)()
+
+	iter := open(ctx)
+	defer iter.Stop()
+
+	limit := int64(rowLimit(ctx))
+	var rows int64
+	defer func() {
+		span.SetAttributes(attribute.Int64("spanner.rows", rows))
+		spannerRowsPerQuery.WithLabelValues(name).Observe(float64(rows))
+	}()
+
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+		rows++
+		if limit > 0 && rows > limit {
+			log.Println("query", fmt.Sprintf("func=%s", name), "has more rows than the limit", limit)
+			spannerRowLimitExceeded.WithLabelValues(name).Inc()
+			err := &ErrTooManyRows{Query: name, Limit: int(limit)}
+			span.RecordError(err)
+			return err
+		}
+		if err := fn(row); err != nil {
+			if err == errStopRows {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	SagaRunning      = "running"
+	SagaCompleted    = "completed"
+	SagaCompensating = "compensating"
+	SagaCompensated  = "compensated"
+	SagaFailed       = "failed"
+)
+
+// a step of saga, Compensate can be nil if the step has nothing to undo
+type SagaStep struct {
+	Name       string
+	Do         func(context.Context) error
+	Compensate func(context.Context) error
+}
+
+/*
+RunSaga runs steps in order, persisting the progress to the sagas table.
+When a step fails, steps already done are compensated in reverse order.
+The returned error is the one of the failed step, the saga state tells whether compensation worked.
+*/
+func (d dbClient) RunSaga(ctx context.Context, name, userID string, steps []SagaStep) (string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "RunSaga")
+	defer span.End()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	sagaID := id.String()
+	span.SetAttributes(attribute.String("saga.name", name), attribute.String("saga.id", sagaID))
+
+	now := time.Now()
+	err = d.apply(ctx, "RunSaga", []*spanner.Mutation{
+		spanner.InsertMap("sagas", map[string]interface{}{
+			"saga_id":    sagaID,
+			"saga_name":  name,
+			"user_id":    userID,
+			"state":      SagaRunning,
+			"step":       0,
+			"created_at": now,
+			"updated_at": now,
+		}),
+	})
+	if err != nil {
+		return sagaID, err
+	}
+
+	for n, step := range steps {
+		stepErr := step.Do(ctx)
+		if stepErr == nil {
+			d.updateSaga(ctx, sagaID, SagaRunning, n+1, nil)
+			continue
+		}
+
+		log.Printf("saga %s(%s) failed at %s: %v\n", name, sagaID, step.Name, stepErr)
+		d.updateSaga(ctx, sagaID, SagaCompensating, n, stepErr)
+
+		state := SagaCompensated
+		for i := n - 1; i >= 0; i-- {
+			if steps[i].Compensate == nil {
+				continue
+			}
+			if err := steps[i].Compensate(ctx); err != nil {
+				log.Printf("saga %s(%s) failed to compensate %s: %v\n", name, sagaID, steps[i].Name, err)
+				state = SagaFailed
+				break
+			}
+		}
+		d.updateSaga(ctx, sagaID, state, n, stepErr)
+		span.SetAttributes(attribute.String("saga.state", state))
+		return sagaID, fmt.Errorf("%s: %w", step.Name, stepErr)
+	}
+
+	d.updateSaga(ctx, sagaID, SagaCompleted, len(steps), nil)
+	span.SetAttributes(attribute.String("saga.state", SagaCompleted))
+	return sagaID, nil
+}
+
+/*
+SweepStaleSagas marks sagas which haven't progressed since before as failed.
+They are left by an instance which died in the middle of a saga, so nobody will compensate them.
+*/
+func (d dbClient) SweepStaleSagas(ctx context.Context, before time.Time) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "SweepStaleSagas")
+	defer span.End()
+
+	stmt := spanner.Statement{
+		SQL: `UPDATE sagas SET state = @failed, error = 'abandoned', updated_at = @now
+		  WHERE state IN (@running, @compensating) AND updated_at < @before`,
+		Params: map[string]interface{}{
+			"failed":       SagaFailed,
+			"running":      SagaRunning,
+			"compensating": SagaCompensating,
+			"before":       before,
+			"now":          time.Now(),
+		},
+	}
+	count, err := d.Sc.PartitionedUpdateWithOptions(ctx, stmt, spanner.QueryOptions{RequestTag: "func=SweepStaleSagas,env=dev,action=update"})
+	span.SetAttributes(attribute.Int64("saga.swept", count))
+	return count, err
+}
+
+// progress is recorded best effort, a failure here should not change the result of the saga
+func (d dbClient) updateSaga(ctx context.Context, sagaID, state string, step int, sagaErr error) {
+	values := map[string]interface{}{
+		"saga_id":    sagaID,
+		"state":      state,
+		"step":       step,
+		"updated_at": time.Now(),
+	}
+	if sagaErr != nil {
+		values["error"] = sagaErr.Error()
+	}
+	err := d.apply(ctx, "updateSaga", []*spanner.Mutation{spanner.UpdateMap("sagas", values)})
+	if err != nil {
+		log.Println("saga", sagaID, err)
+	}
+}
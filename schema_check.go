@@ -0,0 +1,103 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+
+	"github.com/shin5ok/go-architecting-workshop/schemas"
+)
+
+/*
+CheckSchema compares the live database with the ddl embedded in the binary,
+and returns what is different, empty means no drift.
+Extra tables or columns in the database are not treated as drift.
+*/
+func (d dbClient) CheckSchema(ctx context.Context) (string, []string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CheckSchema")
+	defer span.End()
+
+	expected, err := schemas.Expected()
+	if err != nil {
+		return "", nil, err
+	}
+
+	txn := d.Sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	live := map[string]map[string]string{}
+	err = forEachRow(ctx, txn, "CheckSchema", spanner.Statement{
+		SQL: `SELECT table_name, column_name, spanner_type FROM information_schema.columns WHERE table_schema = ''`,
+	}, func(row *spanner.Row) error {
+		var table, column, spannerType string
+		if err := row.Columns(&table, &column, &spannerType); err != nil {
+			return err
+		}
+		if live[table] == nil {
+			live[table] = map[string]string{}
+		}
+		live[table][column] = spannerType
+		return nil
+	})
+	if err != nil {
+		return expected.Version, nil, err
+	}
+
+	liveIndexes := map[string]bool{}
+	err = forEachRow(ctx, txn, "CheckSchemaIndexes", spanner.Statement{
+		SQL: `SELECT index_name FROM information_schema.indexes WHERE table_schema = '' AND index_type = 'INDEX'`,
+	}, func(row *spanner.Row) error {
+		var index string
+		if err := row.Columns(&index); err != nil {
+			return err
+		}
+		liveIndexes[index] = true
+		return nil
+	})
+	if err != nil {
+		return expected.Version, nil, err
+	}
+
+	drifts := []string{}
+	for name, table := range expected.Tables {
+		columns, ok := live[name]
+		if !ok {
+			drifts = append(drifts, fmt.Sprintf("table %s is missing", name))
+			continue
+		}
+		for column, spannerType := range table.Columns {
+			liveType, ok := columns[column]
+			switch {
+			case !ok:
+				drifts = append(drifts, fmt.Sprintf("column %s.%s is missing", name, column))
+			case liveType != spannerType:
+				drifts = append(drifts, fmt.Sprintf("column %s.%s is %s, expected %s", name, column, liveType, spannerType))
+			}
+		}
+	}
+	for _, index := range expected.Indexes {
+		if !liveIndexes[index] {
+			drifts = append(drifts, fmt.Sprintf("index %s is missing", index))
+		}
+	}
+
+	return expected.Version, drifts, nil
+}
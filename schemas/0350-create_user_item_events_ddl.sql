@@ -0,0 +1,9 @@
+CREATE TABLE user_item_events (
+  user_id STRING(36) NOT NULL,
+  event_id STRING(36) NOT NULL,
+  item_id STRING(36) NOT NULL,
+  event_type STRING(16) NOT NULL,
+  projected BOOL NOT NULL,
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(user_id, event_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
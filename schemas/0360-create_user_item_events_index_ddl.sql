@@ -0,0 +1 @@
+CREATE INDEX user_item_events_by_projected ON user_item_events (projected, created_at)
@@ -0,0 +1,7 @@
+CREATE TABLE wallets (
+  user_id STRING(36) NOT NULL,
+  balance INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
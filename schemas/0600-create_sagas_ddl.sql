@@ -0,0 +1,10 @@
+CREATE TABLE sagas (
+  saga_id STRING(36) NOT NULL,
+  saga_name STRING(64) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  state STRING(16) NOT NULL,
+  step INT64 NOT NULL,
+  error STRING(MAX),
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(saga_id)
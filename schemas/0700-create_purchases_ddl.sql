@@ -0,0 +1,7 @@
+CREATE TABLE purchases (
+  receipt_id STRING(128) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  store STRING(32) NOT NULL,
+  item_id STRING(36) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(receipt_id)
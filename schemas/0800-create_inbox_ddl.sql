@@ -0,0 +1,5 @@
+CREATE TABLE inbox (
+  event_id STRING(64) NOT NULL,
+  event_type STRING(64) NOT NULL,
+  processed_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(event_id)
@@ -0,0 +1,6 @@
+CREATE TABLE event_analytics (
+  event_id STRING(64) NOT NULL,
+  event_type STRING(64) NOT NULL,
+  payload STRING(MAX) NOT NULL,
+  received_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(event_id)
@@ -0,0 +1,6 @@
+CREATE TABLE user_sequences (
+  user_id STRING(36) NOT NULL,
+  seq INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
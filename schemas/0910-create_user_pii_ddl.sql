@@ -0,0 +1,7 @@
+CREATE TABLE user_pii (
+  user_id STRING(36) NOT NULL,
+  email BYTES(MAX),
+  external_id BYTES(MAX),
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN item_count INT64 NOT NULL DEFAULT (0)
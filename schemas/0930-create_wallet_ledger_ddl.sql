@@ -0,0 +1,10 @@
+CREATE TABLE wallet_ledger (
+  user_id STRING(36) NOT NULL,
+  entry_id STRING(36) NOT NULL,
+  amount INT64 NOT NULL,
+  balance INT64 NOT NULL,
+  reason STRING(32) NOT NULL,
+  reference_id STRING(64),
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(user_id, entry_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,7 @@
+CREATE TABLE api_keys (
+  key_id STRING(36) NOT NULL,
+  name STRING(64) NOT NULL,
+  secret_hash STRING(64) NOT NULL,
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+  revoked_at TIMESTAMP OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(key_id)
@@ -0,0 +1,6 @@
+CREATE TABLE counters (
+  name STRING(128) NOT NULL,
+  shard INT64 NOT NULL,
+  count INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(name, shard)
@@ -0,0 +1,6 @@
+CREATE TABLE user_item_tombstones (
+  user_id STRING(36) NOT NULL,
+  item_id STRING(36) NOT NULL,
+  deleted_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(user_id, item_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,9 @@
+CREATE TABLE idempotency_keys (
+  idempotency_key STRING(64) NOT NULL,
+  fingerprint STRING(64) NOT NULL,
+  status_code INT64,
+  content_type STRING(MAX),
+  response BYTES(MAX),
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(idempotency_key),
+  ROW DELETION POLICY (OLDER_THAN(created_at, INTERVAL 1 DAY))
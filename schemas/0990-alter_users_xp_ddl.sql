@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN xp INT64 NOT NULL DEFAULT (0)
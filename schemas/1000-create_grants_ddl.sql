@@ -0,0 +1,9 @@
+CREATE TABLE grants (
+  grant_id STRING(64) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  source STRING(32) NOT NULL,
+  item_ids ARRAY<STRING(36)> NOT NULL,
+  currency INT64 NOT NULL,
+  xp INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(grant_id)
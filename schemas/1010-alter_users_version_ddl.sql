@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN version INT64 NOT NULL DEFAULT (0)
@@ -0,0 +1 @@
+ALTER TABLE user_items ADD COLUMN quantity INT64 NOT NULL DEFAULT (1)
@@ -0,0 +1,14 @@
+CREATE TABLE mailbox (
+  user_id STRING(36) NOT NULL,
+  mail_id STRING(36) NOT NULL,
+  kind STRING(16) NOT NULL,
+  subject STRING(MAX) NOT NULL,
+  body STRING(MAX) NOT NULL,
+  item_ids ARRAY<STRING(36)> NOT NULL,
+  currency INT64 NOT NULL,
+  xp INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+  read_at TIMESTAMP OPTIONS (allow_commit_timestamp=true),
+  claimed_at TIMESTAMP OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(user_id, mail_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,12 @@
+CREATE TABLE user_audit (
+  user_id STRING(36) NOT NULL,
+  audit_id STRING(36) NOT NULL,
+  action STRING(32) NOT NULL,
+  caller STRING(MAX) NOT NULL,
+  acting_as STRING(36) NOT NULL,
+  request_id STRING(MAX) NOT NULL,
+  before STRING(MAX),
+  after STRING(MAX),
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(user_id, audit_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
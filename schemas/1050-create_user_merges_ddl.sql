@@ -0,0 +1,6 @@
+CREATE TABLE user_merges (
+  source_user_id STRING(36) NOT NULL,
+  target_user_id STRING(36) NOT NULL,
+  policy STRING(16) NOT NULL,
+  merged_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(source_user_id)
@@ -0,0 +1,10 @@
+CREATE TABLE event_outbox (
+  event_id STRING(64) NOT NULL,
+  event_type STRING(64) NOT NULL,
+  payload STRING(MAX) NOT NULL,
+  attempts INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+  leased_until TIMESTAMP,
+  published_at TIMESTAMP OPTIONS (allow_commit_timestamp=true),
+) PRIMARY KEY(event_id),
+  ROW DELETION POLICY (OLDER_THAN(published_at, INTERVAL 1 DAY))
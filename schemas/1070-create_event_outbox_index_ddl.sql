@@ -0,0 +1 @@
+CREATE INDEX event_outbox_by_published ON event_outbox (published_at, created_at)
@@ -0,0 +1,5 @@
+CREATE TABLE leases (
+  name STRING(64) NOT NULL,
+  holder STRING(64) NOT NULL,
+  leased_until TIMESTAMP NOT NULL,
+) PRIMARY KEY(name)
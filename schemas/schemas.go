@@ -0,0 +1,143 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package schemas
+
+import (
+	"embed"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Files are applied in the order of their names, which are prefixed by four digits in steps of ten,
+like 0100-create_users_ddl.sql, so a new one is named after the last one with room for one in between.
+*/
+//go:embed *_ddl.sql
+var ddlFiles embed.FS
+
+//go:embed *_dml.sql
+var dmlFiles embed.FS
+
+// Table is the expected shape of a table, Columns maps column name to its spanner type
+type Table struct {
+	Name    string
+	Columns map[string]string
+}
+
+type Schema struct {
+	// name of the latest ddl file, as the version of the schema
+	Version string
+	Tables  map[string]Table
+	Indexes []string
+}
+
+var (
+	createTableRe = regexp.MustCompile(`(?is)^\s*CREATE TABLE\s+(\w+)\s*\((.*)\)\s*PRIMARY KEY`)
+	createIndexRe = regexp.MustCompile(`(?i)^\s*CREATE\s+(?:UNIQUE\s+)?(?:NULL_FILTERED\s+)?INDEX\s+(\w+)`)
+	addColumnRe   = regexp.MustCompile(`(?i)^\s*ALTER TABLE\s+(\w+)\s+ADD COLUMN\s+(\w+)\s+([^\s,]+)`)
+	insertItemsRe = regexp.MustCompile(`(?i)^\s*INSERT INTO items\s*\(item_id, item_name, price\b`)
+	itemValuesRe  = regexp.MustCompile(`\(\s*'([^']*)'\s*,\s*'([^']*)'\s*,\s*(\d+)\s*,`)
+)
+
+// Expected parses the embedded ddl files, which are the same as applied by the Makefile
+func Expected() (Schema, error) {
+	files, err := fs.Glob(ddlFiles, "*_ddl.sql")
+	if err != nil {
+		return Schema{}, err
+	}
+	sort.Strings(files)
+
+	s := Schema{Tables: map[string]Table{}}
+	for _, file := range files {
+		data, err := ddlFiles.ReadFile(file)
+		if err != nil {
+			return Schema{}, err
+		}
+		parse(&s, string(data))
+		s.Version = file
+	}
+	return s, nil
+}
+
+func parse(s *Schema, ddl string) {
+	if m := createIndexRe.FindStringSubmatch(ddl); m != nil {
+		s.Indexes = append(s.Indexes, m[1])
+		return
+	}
+
+	// columns added to a table created by an earlier file
+	if m := addColumnRe.FindStringSubmatch(ddl); m != nil {
+		if t, ok := s.Tables[m[1]]; ok {
+			t.Columns[m[2]] = m[3]
+		}
+		return
+	}
+
+	m := createTableRe.FindStringSubmatch(ddl)
+	if m == nil {
+		return
+	}
+	t := Table{Name: m[1], Columns: map[string]string{}}
+	for _, line := range strings.Split(m[2], "\n") {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ","))
+		if len(fields) < 2 || strings.EqualFold(fields[0], "CONSTRAINT") {
+			continue
+		}
+		t.Columns[fields[0]] = strings.TrimSuffix(fields[1], ",")
+	}
+	s.Tables[t.Name] = t
+}
+
+// Item is a row of the catalog inserted by the dml files
+type Item struct {
+	ID    string
+	Name  string
+	Price int64
+}
+
+/*
+Items parses the embedded dml files inserting the catalog, which are the same as applied by the Makefile,
+for the repositories which don't run them, like the lite one of the API.
+*/
+func Items() ([]Item, error) {
+	files, err := fs.Glob(dmlFiles, "*_dml.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var items []Item
+	for _, file := range files {
+		data, err := dmlFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !insertItemsRe.Match(data) {
+			continue
+		}
+		for _, m := range itemValuesRe.FindAllStringSubmatch(string(data), -1) {
+			price, err := strconv.ParseInt(m[3], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, Item{ID: m[1], Name: m[2], Price: price})
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,62 @@
+package schemas
+
+import (
+	"io/fs"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpected(t *testing.T) {
+	s, err := Expected()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, ok := s.Tables["users"]
+	assert.True(t, ok)
+	assert.Equal(t, "STRING(36)", users.Columns["user_id"])
+	assert.Equal(t, "STRING(MAX)", users.Columns["name"])
+	assert.Equal(t, "TIMESTAMP", users.Columns["updated_at"])
+	assert.Equal(t, "INT64", users.Columns["item_count"])
+
+	userItems := s.Tables["user_items"]
+	assert.Len(t, userItems.Columns, 5)
+	assert.Equal(t, "INT64", userItems.Columns["quantity"])
+
+	assert.Contains(t, s.Indexes, "user_item_events_by_projected")
+	assert.Contains(t, s.Indexes, "event_outbox_by_published")
+	assert.NotEmpty(t, s.Version)
+}
+
+func TestItems(t *testing.T) {
+	items, err := Items()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, items, 100)
+	assert.Equal(t, Item{ID: "46f026ae-c6e9-4e41-82e5-240c7645a553", Name: "item1", Price: 100}, items[0])
+	assert.Equal(t, Item{ID: "2fc52be7-5c49-4442-946a-2426de9de96a", Name: "item100", Price: 10000}, items[99])
+}
+
+// names are of four digits, so they are applied in order by a glob as they are sorted
+func TestFileNames(t *testing.T) {
+	nameRe := regexp.MustCompile(`^\d{4}-\w+_(ddl|dml)\.sql$`)
+	prefixes := map[string]string{}
+	for _, files := range []fs.FS{ddlFiles, dmlFiles} {
+		names, err := fs.Glob(files, "*.sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			assert.Regexp(t, nameRe, name)
+			if other, ok := prefixes[name[:4]]; ok {
+				t.Errorf("%s has the same prefix as %s", name, other)
+			}
+			prefixes[name[:4]] = name
+		}
+	}
+	assert.NotEmpty(t, prefixes)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+	"github.com/shin5ok/go-architecting-workshop/luascript"
+)
+
+// increment the sequence of the user in txn, and return the new one
+func nextUserSeq(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string) (int64, error) {
+	return reserveUserSeqs(ctx, txn, userID, 1)
+}
+
+/*
+advance the sequence of the user by n in txn, and return the last one,
+changes in a transaction get seqs from last-n+1 to last, because the buffered sequence can't be read again.
+*/
+func reserveUserSeqs(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, n int64) (int64, error) {
+	var seq int64
+	row, err := txn.ReadRow(ctx, "user_sequences", spanner.Key{userID}, []string{"seq"})
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+	case err != nil:
+		return 0, err
+	default:
+		if err := row.Columns(&seq); err != nil {
+			return 0, err
+		}
+	}
+	seq += n
+	err = txn.BufferWrite([]*spanner.Mutation{
+		spanner.InsertOrUpdateMap("user_sequences", map[string]interface{}{
+			"user_id":    userID,
+			"seq":        seq,
+			"updated_at": time.Now(),
+		}),
+	})
+	return seq, err
+}
+
+// emitting is best effort, the change has been committed anyway
+func (d dbClient) emitChange(ctx context.Context, userID string, seq int64, itemID string, changeType string) {
+	emitItemChanged(ctx, d.EmitChange, userID, seq, itemID, changeType)
+}
+
+// the same as emitChange by emit, of any repository
+func emitItemChanged(ctx context.Context, emit func(context.Context, domain.ItemChanged) error, userID string, seq int64, itemID string, changeType string) {
+	if emit == nil {
+		return
+	}
+	e, err := domain.NewItemChanged(userID, seq, itemID, changeType)
+	if err != nil {
+		log.Println("emitChange", err)
+		return
+	}
+	if err := emit(ctx, e); err != nil {
+		log.Println("emitChange", e.ID(), err)
+	}
+}
+
+const seqKeyTTL = 24 * time.Hour
+
+// InvalidateUserItems applies a change event to cache, stale or replayed events are ignored
+func (c *Caching) InvalidateUserItems(e domain.ItemChanged) (bool, error) {
+	if !c.Health.Usable() {
+		return false, errCacheDown
+	}
+	key := fmt.Sprintf("UserItems_%s", e.UserID)
+	// the entry is the hash tag of the sequence, they are in a slot of a cluster as the script needs
+	seqKey := fmt.Sprintf("UserItemsSeq_{%s}", c.Epoch.key(key))
+	result, err := luascript.InvalidateBySeq.Run(c.RedisClient, []string{c.Epoch.key(key), seqKey}, e.Seq, int64(seqKeyTTL.Seconds())).Int64()
+	if err == nil && result == 1 {
+		err = c.delPrevious(key)
+	}
+	c.Health.Observe(err)
+	return result == 1, err
+}
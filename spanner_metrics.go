@@ -0,0 +1,129 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+// how often the views of the Spanner client are exported to /metrics, the session pool is maintained every few seconds anyway
+const spannerViewsPeriod = 5 * time.Second
+
+/*
+spannerViews bridges the views the Spanner client records its session pool and GFE latency by to the default registry,
+they are OpenCensus views in this version of the client, so they are exported to it and collected as metrics named after them,
+like game_spanner_num_sessions_in_pool{type="num_in_use_sessions"}.
+The client doesn't measure how long acquiring a session took, timeouts of it are game_spanner_get_session_timeouts_total.
+*/
+type spannerViews struct {
+	mu   sync.Mutex
+	data map[string]*view.Data
+}
+
+var spannerViewsOnce sync.Once
+
+/*
+EnableSpannerMetrics registers the views of the Spanner client, and exposes them on /metrics.
+Call it before NewClient, so the sessions created with the client are counted.
+*/
+func EnableSpannerMetrics() error {
+	var err error
+	spannerViewsOnce.Do(func() {
+		if err = spanner.EnableStatViews(); err != nil {
+			return
+		}
+		if err = spanner.EnableGfeLatencyAndHeaderMissingCountViews(); err != nil {
+			return
+		}
+		views := &spannerViews{data: map[string]*view.Data{}}
+		view.RegisterExporter(views)
+		view.SetReportingPeriod(spannerViewsPeriod)
+		err = prometheus.Register(views)
+	})
+	return err
+}
+
+// ExportView keeps the latest data of each view, which is cumulative
+func (s *spannerViews) ExportView(vd *view.Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[vd.View.Name] = vd
+}
+
+// nothing is described, as labels of views are known once they are recorded
+func (s *spannerViews) Describe(chan<- *prometheus.Desc) {}
+
+func (s *spannerViews) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vd := range s.data {
+		for _, row := range vd.Rows {
+			if m, err := spannerMetric(vd.View, row); err == nil {
+				ch <- m
+			}
+		}
+	}
+}
+
+// the metric of a row of the view, named game_spanner_<last element of the view name> with its tags as labels
+func spannerMetric(v *view.View, row *view.Row) (prometheus.Metric, error) {
+	name := "game_spanner_" + path.Base(v.Name)
+	if v.Measure.Unit() == stats.UnitMilliseconds {
+		name += "_milliseconds"
+	}
+	labels := prometheus.Labels{}
+	for _, t := range row.Tags {
+		labels[t.Key.Name()] = t.Value
+	}
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, label := range names {
+		values[i] = labels[label]
+	}
+
+	switch data := row.Data.(type) {
+	case *view.LastValueData:
+		return prometheus.NewConstMetric(prometheus.NewDesc(name, v.Description, names, nil), prometheus.GaugeValue, data.Value, values...)
+	case *view.CountData:
+		return prometheus.NewConstMetric(prometheus.NewDesc(name+"_total", v.Description, names, nil), prometheus.CounterValue, float64(data.Value), values...)
+	case *view.SumData:
+		return prometheus.NewConstMetric(prometheus.NewDesc(name+"_total", v.Description, names, nil), prometheus.CounterValue, data.Value, values...)
+	case *view.DistributionData:
+		// buckets of OpenCensus are not cumulative, and the last one is of the values above all the bounds
+		buckets := map[float64]uint64{}
+		var cumulative uint64
+		for i, bound := range v.Aggregation.Buckets {
+			cumulative += uint64(data.CountPerBucket[i])
+			buckets[bound] = cumulative
+		}
+		return prometheus.NewConstHistogram(prometheus.NewDesc(name, v.Description, names, nil),
+			uint64(data.Count), data.Mean*float64(data.Count), buckets, values...)
+	}
+	return nil, fmt.Errorf("unknown aggregation of view %s", v.Name)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+/*
+Staleness is the timestamp bound of queries of UserItems, it's a choice to compare in the workshop:
+a strong read sees every write committed before it, but the replica serving it may wait to catch up with the leader,
+an exact staleness read is at the time Bound ago, and a max staleness read is at any time within Bound,
+so they are served without waiting, at the cost of missing writes of the last Bound.
+Latencies of them are in game_user_items_query_duration_milliseconds by mode.
+*/
+type Staleness struct {
+	Mode  string
+	Bound time.Duration
+}
+
+const (
+	StalenessStrong = "strong"
+	StalenessExact  = "exact"
+	StalenessMax    = "max"
+)
+
+// older versions may have been garbage collected, they are kept for an hour by default
+const maxStalenessBound = time.Hour
+
+// ParseStaleness reads config like "exact:10s" or "max:10s", empty is strong
+func ParseStaleness(config string) (Staleness, error) {
+	if config == "" || config == StalenessStrong {
+		return Staleness{Mode: StalenessStrong}, nil
+	}
+	mode, bound, ok := strings.Cut(config, ":")
+	if !ok || (mode != StalenessExact && mode != StalenessMax) {
+		return Staleness{}, fmt.Errorf("staleness %q has to be %s, %s:<duration> or %s:<duration>", config, StalenessStrong, StalenessExact, StalenessMax)
+	}
+	d, err := time.ParseDuration(bound)
+	if err != nil {
+		return Staleness{}, fmt.Errorf("staleness %q: %w", config, err)
+	}
+	if d <= 0 || d > maxStalenessBound {
+		return Staleness{}, fmt.Errorf("staleness %q has to be more than 0 and up to %s", config, maxStalenessBound)
+	}
+	return Staleness{Mode: mode, Bound: d}, nil
+}
+
+// the mode, strong for the zero value
+func (s Staleness) mode() string {
+	if s.Mode == "" {
+		return StalenessStrong
+	}
+	return s.Mode
+}
+
+// String is the config which is parsed to it
+func (s Staleness) String() string {
+	if s.mode() == StalenessStrong {
+		return StalenessStrong
+	}
+	return fmt.Sprintf("%s:%s", s.Mode, s.Bound)
+}
+
+// max staleness is allowed only for single use read-only transactions
+func (s Staleness) timestampBound() spanner.TimestampBound {
+	switch s.mode() {
+	case StalenessExact:
+		return spanner.ExactStaleness(s.Bound)
+	case StalenessMax:
+		return spanner.MaxStaleness(s.Bound)
+	}
+	return spanner.StrongRead()
+}
+
+type stalenessKey struct{}
+
+/*
+WithStaleness makes UserItems in ctx query Spanner by s, without the cache, so the latencies of the bounds can be compared.
+Without it, misses of the cache are queried by Staleness of the client.
+*/
+func WithStaleness(ctx context.Context, s Staleness) context.Context {
+	return context.WithValue(ctx, stalenessKey{}, s)
+}
+
+func stalenessFromContext(ctx context.Context) (Staleness, bool) {
+	s, ok := ctx.Value(stalenessKey{}).(Staleness)
+	return s, ok
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+SyncDelta is what changed in the user's items since the last sync.
+SyncedAt is the timestamp of the snapshot it's read at, it's the since of the next sync.
+An item can be removed and added again after the last sync, then it's only in Items.
+*/
+type SyncDelta struct {
+	Items    domain.Inventory `json:"items"`
+	Removed  []string         `json:"removed"`
+	SyncedAt time.Time        `json:"synced_at"`
+}
+
+/*
+a row of user_item_tombstones tells the item was removed from the user at the commit timestamp.
+It's one row per user and item, so they don't grow more than user_items would, and they go with the user.
+*/
+func tombstone(userID, itemID string) *spanner.Mutation {
+	return spanner.InsertOrUpdateMap("user_item_tombstones", map[string]interface{}{
+		"user_id":    userID,
+		"item_id":    itemID,
+		"deleted_at": spanner.CommitTimestamp,
+	})
+}
+
+type syncParams struct {
+	UserID string    `spanner:"userID"`
+	Since  time.Time `spanner:"since"`
+}
+
+var (
+	syncedItems = newQuery[syncParams](`SELECT users.name, items.item_name, user_items.item_id, user_items.quantity
+	  FROM user_items JOIN items ON items.item_id = user_items.item_id JOIN users ON users.user_id = user_items.user_id
+	  WHERE user_items.user_id = @userID AND user_items.updated_at > @since`)
+	syncedRemovals = newQuery[syncParams](`SELECT t.item_id FROM user_item_tombstones t
+	  LEFT JOIN user_items ON user_items.user_id = t.user_id AND user_items.item_id = t.item_id
+	  WHERE t.user_id = @userID AND t.deleted_at > @since AND user_items.item_id IS NULL`)
+)
+
+/*
+SyncUserItems returns items of the user changed after since, by updated_at and tombstones which are commit timestamps.
+Both are read at the same snapshot, so a change committed after it has a later timestamp and comes in the next sync.
+The zero since returns all the items.
+*/
+func (d dbClient) SyncUserItems(ctx context.Context, w io.Writer, userID string, since time.Time) (SyncDelta, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "SyncUserItems")
+	defer span.End()
+	span.SetAttributes(attribute.String("user.id", HashID(userID)), attribute.String("sync.since", since.Format(time.RFC3339Nano)))
+
+	if err := checkParams(UserParams{UserID: userID}); err != nil {
+		return SyncDelta{}, err
+	}
+
+	delta := SyncDelta{Items: domain.Inventory{}, Removed: []string{}}
+	err := d.retry(ctx, "SyncUserItems", func(ctx context.Context) error {
+		delta.Items, delta.Removed = delta.Items[:0], delta.Removed[:0]
+		txn := d.Sc.ReadOnlyTransaction()
+		defer txn.Close()
+
+		params := syncParams{UserID: userID, Since: since}
+		err := forEachRow(ctx, txn, "SyncUserItems", syncedItems.Statement(params), func(row *spanner.Row) error {
+			var userName, itemName, itemID string
+			var quantity int64
+			if err := row.Columns(&userName, &itemName, &itemID, &quantity); err != nil {
+				return err
+			}
+			item, err := domain.NewOwnedItem(userName, itemName, itemID, quantity)
+			if err != nil {
+				return err
+			}
+			delta.Items = append(delta.Items, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !since.IsZero() {
+			err = forEachRow(ctx, txn, "SyncRemovedItems", syncedRemovals.Statement(params), func(row *spanner.Row) error {
+				var itemID string
+				if err := row.Columns(&itemID); err != nil {
+					return err
+				}
+				delta.Removed = append(delta.Removed, itemID)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		delta.SyncedAt, err = txn.Timestamp()
+		return err
+	})
+
+	span.SetAttributes(attribute.Int("sync.items", len(delta.Items)), attribute.Int("sync.removed", len(delta.Removed)))
+	return delta, err
+}
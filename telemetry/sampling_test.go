@@ -0,0 +1,24 @@
+package telemetry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSampler(t *testing.T) {
+	for name, description := range map[string]string{
+		"":                         "AlwaysOnSampler",
+		"always_off":               "AlwaysOffSampler",
+		"traceidratio":             "TraceIDRatioBased{0.25}",
+		"parentbased_traceidratio": "ParentBased{root:TraceIDRatioBased{0.25}",
+	} {
+		sampler, err := ParseSampler(name, "0.25")
+		assert.Nil(t, err)
+		assert.Contains(t, sampler.Description(), description, name)
+	}
+	_, err := ParseSampler("traceidratio", "2")
+	assert.NotNil(t, err)
+	_, err = ParseSampler("sometimes", "")
+	assert.NotNil(t, err)
+}
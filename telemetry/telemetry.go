@@ -0,0 +1,248 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package telemetry sets up exporting spans and metrics of the api and the worker by the same config,
+like TRACE_EXPORTER and OTEL_TRACES_SAMPLER, so they are traced alike.
+*/
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+
+	gcppropagator "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+)
+
+// exporters of Config
+const (
+	TraceCloudTrace = "cloudtrace"
+	TraceOTLP       = "otlp"
+	TraceNone       = "none"
+)
+
+// Config is where and as what telemetry of the service is exported
+type Config struct {
+	// TraceCloudTrace, TraceOTLP or TraceNone
+	TraceExporter string
+	// which requests are traced, see ParseSampler, always if nil
+	Sampler sdktrace.Sampler
+	// of Cloud Trace
+	ProjectID string
+	// base URL of the OTLP/HTTP receiver, like http://localhost:4318, and headers like "api-key=secret", see parseOTLPTarget
+	OTLPEndpoint string
+	OTLPHeaders  string
+	// resource attributes, OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override them
+	ServiceName    string
+	ServiceVersion string
+	// K_REVISION, which tells revisions apart during a rollout
+	Revision string
+}
+
+// ParseTraceExporter validates the exporter, cloudtrace if empty
+func ParseTraceExporter(exporter string) (string, error) {
+	switch exporter {
+	case "":
+		return TraceCloudTrace, nil
+	case TraceCloudTrace, TraceOTLP, TraceNone:
+		return exporter, nil
+	}
+	return "", fmt.Errorf("unknown trace exporter %q, it has to be %s, %s or %s", exporter, TraceCloudTrace, TraceOTLP, TraceNone)
+}
+
+// NewResource is the entity spans and metrics are of
+func NewResource(ctx context.Context, config Config) (*resource.Resource, error) {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(config.ServiceName),
+		semconv.ServiceVersionKey.String(config.ServiceVersion),
+		semconv.TelemetrySDKNameKey.String("opentelemetry"),
+		semconv.TelemetrySDKLanguageKey.String("go"),
+	}
+	if config.Revision != "" {
+		attrs = append(attrs, semconv.FaaSVersionKey.String(config.Revision))
+	}
+	// the environment is the last, so it wins over the defaults
+	return resource.New(ctx, resource.WithAttributes(attrs...), resource.WithFromEnv())
+}
+
+/*
+NewTracer sets up the global tracer provider to export spans by the exporter of the config, and the propagators.
+Spans are batched, so call Shutdown of the provider on exit to flush them.
+With TraceNone, spans are still created and propagated, so ids of traces are in logs, but they are not exported.
+Options are of the service, like span processors of its own.
+*/
+func NewTracer(ctx context.Context, config Config, options ...sdktrace.TracerProviderOption) (*sdktrace.TracerProvider, error) {
+	res, err := NewResource(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := config.Sampler
+	if sampler == nil {
+		sampler = sdktrace.AlwaysSample()
+	}
+	options = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	}, options...)
+	switch config.TraceExporter {
+	case TraceCloudTrace:
+		exporter, err := texporter.New(texporter.WithProjectID(config.ProjectID))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	case TraceOTLP:
+		target, err := parseOTLPTarget(config.OTLPEndpoint, config.OTLPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		otlpOptions := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(target.host),
+			otlptracehttp.WithURLPath(target.path("traces")),
+			otlptracehttp.WithHeaders(target.headers),
+		}
+		if target.insecure {
+			otlpOptions = append(otlpOptions, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, otlpOptions...)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	tp := sdktrace.NewTracerProvider(options...)
+
+	otel.SetTracerProvider(tp)
+
+	installPropagators()
+
+	return tp, nil
+}
+
+// how often metrics are pushed if OTEL_METRIC_EXPORT_INTERVAL is empty, the default of the spec
+const defaultExportInterval = time.Minute
+
+// ParseExportInterval reads OTEL_METRIC_EXPORT_INTERVAL, which is of milliseconds
+func ParseExportInterval(ms string) (time.Duration, error) {
+	if ms == "" {
+		return defaultExportInterval, nil
+	}
+	n, err := strconv.Atoi(ms)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid export interval %q, it has to be positive milliseconds", ms)
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+/*
+NewMeter sets up the global meter provider to push metrics to the receiver of the config by OTLP every interval,
+for environments which collect metrics instead of scraping /metrics.
+Instruments of requests, Spanner and cache are made of the global provider before it, and they are no-op until it's set.
+Sums and histograms are cumulative from the start of the process, as the ones of /metrics are,
+call Shutdown of the provider on exit to push the last of them.
+*/
+func NewMeter(ctx context.Context, config Config, interval time.Duration) (*sdkmetric.MeterProvider, error) {
+	target, err := parseOTLPTarget(config.OTLPEndpoint, config.OTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+	res, err := NewResource(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	otlpOptions := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(target.host),
+		otlpmetrichttp.WithURLPath(target.path("metrics")),
+		otlpmetrichttp.WithHeaders(target.headers),
+	}
+	if target.insecure {
+		otlpOptions = append(otlpOptions, otlpmetrichttp.WithInsecure())
+	}
+	exporter, err := otlpmetrichttp.New(ctx, otlpOptions...)
+	if err != nil {
+		return nil, err
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))),
+	)
+	otel.SetMeterProvider(mp)
+	return mp, nil
+}
+
+/*
+otlpTarget is the receiver of OTLP/HTTP, parsed from its base URL, like http://localhost:4318 or https://collector.example.com/otlp,
+and the headers of OTEL_EXPORTER_OTLP_HEADERS, like "api-key=secret,tenant=game".
+*/
+type otlpTarget struct {
+	host     string
+	insecure bool
+	basePath string
+	headers  map[string]string
+}
+
+func parseOTLPTarget(endpoint, headers string) (otlpTarget, error) {
+	if endpoint == "" {
+		return otlpTarget{}, fmt.Errorf("an endpoint of OTLP is required, like http://localhost:4318")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return otlpTarget{}, fmt.Errorf("invalid endpoint of OTLP %q, it has to be a base URL like http://localhost:4318", endpoint)
+	}
+	t := otlpTarget{host: u.Host, insecure: u.Scheme == "http", basePath: strings.TrimSuffix(u.Path, "/"), headers: map[string]string{}}
+	for _, header := range strings.Split(headers, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, "=")
+		if !ok {
+			return otlpTarget{}, fmt.Errorf("invalid header of OTLP %q, it has to be name=value", header)
+		}
+		t.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return t, nil
+}
+
+// signals are posted to /v1/<signal> of the base URL
+func (t otlpTarget) path(signal string) string {
+	return t.basePath + "/v1/" + signal
+}
+
+func installPropagators() {
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(
+			gcppropagator.CloudTraceOneWayPropagator{},
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		))
+}
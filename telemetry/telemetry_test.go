@@ -0,0 +1,126 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseTraceExporter(t *testing.T) {
+	exporter, err := ParseTraceExporter("")
+	assert.Nil(t, err)
+	assert.Equal(t, TraceCloudTrace, exporter)
+	exporter, err = ParseTraceExporter("otlp")
+	assert.Nil(t, err)
+	assert.Equal(t, TraceOTLP, exporter)
+	_, err = ParseTraceExporter("jaeger")
+	assert.NotNil(t, err)
+}
+
+func TestParseOTLPTarget(t *testing.T) {
+	target, err := parseOTLPTarget("http://localhost:4318/", "api-key=secret, tenant=game")
+	assert.Nil(t, err)
+	assert.Equal(t, otlpTarget{host: "localhost:4318", insecure: true, headers: map[string]string{"api-key": "secret", "tenant": "game"}}, target)
+	assert.Equal(t, "/v1/traces", target.path("traces"))
+
+	target, err = parseOTLPTarget("https://collector.example.com/otlp", "")
+	assert.Nil(t, err)
+	assert.False(t, target.insecure)
+	assert.Equal(t, "/otlp/v1/metrics", target.path("metrics"))
+
+	for _, endpoint := range []string{"", "localhost:4318", "grpc://localhost:4317"} {
+		_, err = parseOTLPTarget(endpoint, "")
+		assert.NotNil(t, err, endpoint)
+	}
+	_, err = parseOTLPTarget("http://localhost:4318", "api-key")
+	assert.NotNil(t, err)
+}
+
+func TestNewTracerOTLP(t *testing.T) {
+	var path, apiKey string
+	body := &coltracepb.ExportTraceServiceRequest{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, apiKey = r.URL.Path, r.Header.Get("Api-Key")
+		data, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, proto.Unmarshal(data, body))
+	}))
+	defer collector.Close()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	tp, err := NewTracer(context.Background(), Config{TraceExporter: TraceOTLP, OTLPEndpoint: collector.URL, OTLPHeaders: "api-key=secret", ServiceName: "game-api"})
+	assert.Nil(t, err)
+	ctx, parent := otel.Tracer("main").Start(context.Background(), "parent")
+	_, child := otel.Tracer("main").Start(ctx, "child")
+	child.End()
+	parent.End()
+	// spans are batched until the provider is shut down
+	assert.Nil(t, tp.Shutdown(context.Background()))
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "secret", apiKey)
+	assert.Len(t, body.ResourceSpans, 1)
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID().String(), hex.EncodeToString(spans[0].ParentSpanId))
+
+	_, err = NewTracer(context.Background(), Config{TraceExporter: TraceOTLP})
+	assert.NotNil(t, err)
+}
+
+func TestNewMeterOTLP(t *testing.T) {
+	var path string
+	body := &colmetricpb.ExportMetricsServiceRequest{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		data, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, proto.Unmarshal(data, body))
+	}))
+	defer collector.Close()
+	defer otel.SetMeterProvider(otel.GetMeterProvider())
+
+	// made before the provider is set, as the instruments of packages are
+	requests, err := otel.Meter("test").Int64Counter("requests")
+	assert.Nil(t, err)
+	mp, err := NewMeter(context.Background(), Config{OTLPEndpoint: collector.URL, ServiceName: "game-api"}, time.Hour)
+	assert.Nil(t, err)
+	requests.Add(context.Background(), 3, metric.WithAttributes(attribute.String("code", "200")))
+	// the last of metrics is pushed on shutdown
+	assert.Nil(t, mp.Shutdown(context.Background()))
+
+	assert.Equal(t, "/v1/metrics", path)
+	assert.Len(t, body.ResourceMetrics, 1)
+	m := body.ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "requests", m.Name)
+	point := m.GetSum().DataPoints[0]
+	assert.Equal(t, int64(3), point.GetAsInt())
+	assert.Equal(t, "200", point.Attributes[0].Value.GetStringValue())
+
+	_, err = NewMeter(context.Background(), Config{}, time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestParseExportInterval(t *testing.T) {
+	interval, err := ParseExportInterval("")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, interval)
+	interval, err = ParseExportInterval("5000")
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, interval)
+	_, err = ParseExportInterval("5s")
+	assert.NotNil(t, err)
+}
@@ -26,6 +26,8 @@ import (
 	database "cloud.google.com/go/spanner/admin/database/apiv1"
 	gonanoid "github.com/matoous/go-nanoid"
 	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+
+	"github.com/shin5ok/go-architecting-workshop/fixtures"
 )
 
 func InitData(ctx context.Context, db string, files []string) error {
@@ -102,6 +104,20 @@ func MakeData(ctx context.Context, db string, files []string) error {
 	return nil
 }
 
+// LoadFixtures is MakeData with yaml fixtures instead of dml files
+func LoadFixtures(ctx context.Context, db string, files []string) error {
+	f, err := fixtures.ReadFiles(files...)
+	if err != nil {
+		return err
+	}
+	dataClient, err := spanner.NewClient(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer dataClient.Close()
+	return fixtures.Load(ctx, dataClient, f)
+}
+
 func DropData(ctx context.Context, db string) error {
 
 	matches := regexp.MustCompile("^(.*)/databases/(.*)$").FindStringSubmatch(db)
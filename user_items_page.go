@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+// a page of UserItems as it's cached, the read timestamp validates it
+type userItemsPage struct {
+	ReadAt     time.Time        `json:"read_at"`
+	Items      domain.Inventory `json:"items"`
+	NextCursor string           `json:"next_cursor"`
+}
+
+/*
+UserItemsPage lists items of the user in the order of item_id, paginated in the same way as ListItems,
+for users who own too many items to answer them at once by UserItems.
+Pages are cached by the limit and the cursor, but writes drop only the entry of all the items of the user,
+so a page is served from the cache only if it's provably fresh, that is, with ValidateCache.
+*/
+func (d dbClient) UserItemsPage(ctx context.Context, w io.Writer, userID string, limit int, cursor string) (domain.Inventory, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "UserItemsPage")
+	defer span.End()
+
+	limit = pageSize(limit)
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := fmt.Sprintf("UserItems_%s_page_%d_%s", userID, limit, cursor)
+	page, err := memoize(ctx, key, func() (userItemsPage, error) {
+		if page, ok := d.cachedUserItemsPage(ctx, key, userID); ok {
+			return page, nil
+		}
+		page, err := d.queryUserItemsPage(ctx, userID, limit, after)
+		if err != nil {
+			return page, err
+		}
+		d.setUserItemsPage(ctx, key, page)
+		return page, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	span.SetAttributes(attribute.Int("result.item_count", len(page.Items)))
+	return page.Items, page.NextCursor, nil
+}
+
+func (d dbClient) cachedUserItemsPage(ctx context.Context, key, userID string) (userItemsPage, bool) {
+	if !d.ValidateCache {
+		return userItemsPage{}, false
+	}
+	done := budget.Track(ctx, budget.Redis)
+	data, err := d.Cache.Get(key)
+	done()
+	if err != nil {
+		d.lookedUp(ctx, userID, "miss")
+		return userItemsPage{}, false
+	}
+	var page userItemsPage
+	if err := json.Unmarshal([]byte(data), &page); err != nil {
+		log.Println(err)
+		d.lookedUp(ctx, userID, "miss")
+		return userItemsPage{}, false
+	}
+	if !d.provablyFresh(ctx, userID, page.ReadAt) {
+		d.lookedUp(ctx, userID, "stale")
+		return userItemsPage{}, false
+	}
+	d.lookedUp(ctx, userID, "hit")
+	return page, true
+}
+
+// caching is best effort as setUserItems is
+func (d dbClient) setUserItemsPage(ctx context.Context, key string, page userItemsPage) {
+	if !d.ValidateCache {
+		return
+	}
+	data, err := json.Marshal(page)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cachePayloadSize.WithLabelValues("set").Observe(float64(len(data)))
+	defer budget.Track(ctx, budget.Redis)()
+	if err := d.Cache.Set(key, string(data)); err != nil {
+		log.Println(err)
+	}
+}
+
+// the page after the item_id, by the staleness of the client, an empty first page tells whether the user exists
+func (d dbClient) queryUserItemsPage(ctx context.Context, userID string, limit int, after string) (userItemsPage, error) {
+
+	// one more than limit, to know whether the next page exists
+	stmt := spanner.Statement{
+		SQL: `SELECT users.name, items.item_name, user_items.item_id, user_items.quantity
+		  FROM user_items JOIN items ON items.item_id = user_items.item_id JOIN users ON users.user_id = user_items.user_id
+		  WHERE user_items.user_id = @user_id AND user_items.item_id > @after
+		  ORDER BY user_items.item_id LIMIT @limit`,
+		Params: map[string]interface{}{
+			"user_id": userID,
+			"after":   after,
+			"limit":   limit + 1,
+		},
+	}
+
+	page := userItemsPage{Items: make(domain.Inventory, 0, limit+1)}
+	err := d.retry(ctx, "UserItemsPage", func(ctx context.Context) error {
+		page.Items = page.Items[:0]
+		txn := d.Sc.Single().WithTimestampBound(d.Staleness.timestampBound())
+		defer txn.Close()
+		err := forEachRow(ctx, txn, "UserItemsPage", stmt, func(row *spanner.Row) error {
+			var userName, itemName, itemID string
+			var quantity int64
+			if err := row.Columns(&userName, &itemName, &itemID, &quantity); err != nil {
+				return err
+			}
+			item, err := domain.NewOwnedItem(userName, itemName, itemID, quantity)
+			if err != nil {
+				return err
+			}
+			page.Items = append(page.Items, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		page.ReadAt, err = txn.Timestamp()
+		return err
+	})
+	if err != nil {
+		return userItemsPage{}, err
+	}
+
+	if len(page.Items) == 0 && after == "" {
+		exists, err := d.userExists(ctx, userID)
+		if err != nil {
+			return userItemsPage{}, err
+		}
+		if !exists {
+			return userItemsPage{}, errUserNotFound
+		}
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = encodeCursor(page.Items[limit-1].ItemID)
+	}
+	return page, nil
+}
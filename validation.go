@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+/*
+validate checks params of the operations, so HTTP, gRPC and the commands take the same inputs.
+Tags of this app are registered in addition to the builtin ones:
+uuid4 is a random uuid in the canonical form, as ids minted by this app are,
+itemid is what routes of items accept, and safe_name is a user name by the rules of the deployment, see ConfigureValidation.
+*/
+var validate = newValidator()
+
+var itemIDPattern = regexp.MustCompile(`^[a-z0-9.-]{1,36}$`)
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterValidation("uuid4", func(fl validator.FieldLevel) bool {
+		id, err := uuid.Parse(fl.Field().String())
+		return err == nil && id.Version() == 4 && id.String() == fl.Field().String()
+	})
+	v.RegisterValidation("itemid", func(fl validator.FieldLevel) bool {
+		return itemIDPattern.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("safe_name", func(fl validator.FieldLevel) bool {
+		return domain.CheckUserName(fl.Field().String()) == nil
+	})
+	return v
+}
+
+// checkParams validates the params by their tags, errors are ErrInvalid to be answered as bad requests
+func checkParams(params interface{}) error {
+	if err := validate.Struct(params); err != nil {
+		return fmt.Errorf("%w: %s", domain.ErrInvalid, err)
+	}
+	return nil
+}
+
+/*
+ConfigureValidation sets the rules of the deployment from json like {"max_name_length":32,"name_chars":"alnum"},
+see domain.NameRules, the defaults are kept if it's empty.
+Names stored before the rules are changed are still read, the rules are of inputs.
+*/
+func ConfigureValidation(config string) error {
+	if config == "" {
+		return nil
+	}
+	rules := domain.NameRules{}
+	if err := json.Unmarshal([]byte(config), &rules); err != nil {
+		return fmt.Errorf("validation rules: %w", err)
+	}
+	return domain.SetNameRules(rules)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+	"github.com/shin5ok/go-architecting-workshop/domain"
+)
+
+var ErrInsufficientBalance = domain.ErrInsufficientBalance
+
+// the range of timestamps Spanner can store
+var (
+	minTimestamp = time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxTimestamp = time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC)
+)
+
+// a user without wallet row is treated as balance 0
+func readWallet(ctx context.Context, txn interface {
+	ReadRow(context.Context, string, spanner.Key, []string) (*spanner.Row, error)
+}, userID string) (domain.Wallet, bool, error) {
+	row, err := txn.ReadRow(ctx, "wallets", spanner.Key{userID}, []string{"balance"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		wallet, err := domain.NewWallet(userID, 0)
+		return wallet, false, err
+	}
+	if err != nil {
+		return domain.Wallet{}, false, err
+	}
+	var balance int64
+	if err := row.Columns(&balance); err != nil {
+		return domain.Wallet{}, false, err
+	}
+	wallet, err := domain.NewWallet(userID, balance)
+	return wallet, true, err
+}
+
+// get the user's wallet
+func (d dbClient) WalletBalance(ctx context.Context, w io.Writer, userID string) (domain.Wallet, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "WalletBalance")
+	defer span.End()
+	defer budget.Track(ctx, budget.Spanner)()
+
+	var wallet domain.Wallet
+	err := d.retry(ctx, "WalletBalance", func(ctx context.Context) (err error) {
+		wallet, _, err = readWallet(ctx, d.Sc.Single(), userID)
+		return err
+	})
+	return wallet, err
+}
+
+/*
+add amount to the user's wallet, negative amount means debit.
+Every change is recorded to wallet_ledger in the same transaction, with the reason and what caused it.
+*/
+func (d dbClient) CreditWallet(ctx context.Context, w io.Writer, userID string, amount int64, reason, referenceID string) (domain.Wallet, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "CreditWallet")
+	defer span.End()
+
+	var wallet domain.Wallet
+	_, err := d.readWriteTransaction(ctx, "CreditWallet", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		var mutations []*spanner.Mutation
+		var err error
+		wallet, mutations, err = changeWallet(ctx, txn, userID, amount, reason, referenceID)
+		if err != nil {
+			return err
+		}
+		return txn.BufferWrite(mutations)
+	})
+
+	return wallet, err
+}
+
+// the wallet after the change and the mutations of it and its ledger entry, to be buffered in the transaction
+func changeWallet(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, amount int64, reason, referenceID string) (domain.Wallet, []*spanner.Mutation, error) {
+	current, exists, err := readWallet(ctx, txn, userID)
+	if err != nil {
+		return domain.Wallet{}, nil, err
+	}
+	var wallet domain.Wallet
+	if amount < 0 {
+		wallet, err = current.Debit(-amount)
+	} else {
+		wallet, err = current.Credit(amount)
+	}
+	if err != nil {
+		return domain.Wallet{}, nil, err
+	}
+
+	entryID, err := uuid.NewRandom()
+	if err != nil {
+		return domain.Wallet{}, nil, err
+	}
+	entry, err := domain.NewLedgerEntry(userID, entryID.String(), amount, wallet.Balance, reason, referenceID, time.Now())
+	if err != nil {
+		return domain.Wallet{}, nil, err
+	}
+	ledger := spanner.InsertMap("wallet_ledger", map[string]interface{}{
+		"user_id":      entry.UserID,
+		"entry_id":     entry.EntryID,
+		"amount":       entry.Amount,
+		"balance":      entry.Balance,
+		"reason":       entry.Reason,
+		"reference_id": spanner.NullString{StringVal: entry.ReferenceID, Valid: entry.ReferenceID != ""},
+		"created_at":   spanner.CommitTimestamp,
+	})
+
+	t := time.Now()
+	values := map[string]interface{}{
+		"user_id":    wallet.UserID,
+		"balance":    wallet.Balance,
+		"updated_at": t,
+	}
+	if !exists {
+		values["created_at"] = t
+		return wallet, []*spanner.Mutation{spanner.InsertMap("wallets", values), ledger}, nil
+	}
+	return wallet, []*spanner.Mutation{spanner.UpdateMap("wallets", values), ledger}, nil
+}
+
+// the newest entry at the top, the cursor is the last entry of the previous page
+func (d dbClient) WalletLedger(ctx context.Context, w io.Writer, userID string, limit int, cursor string) ([]domain.LedgerEntry, string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "WalletLedger")
+	defer span.End()
+
+	limit = pageSize(limit)
+	at, entryID, err := decodeLedgerCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT entry_id, amount, balance, reason, reference_id, created_at FROM wallet_ledger
+		  WHERE user_id = @userID AND (created_at < @at OR (created_at = @at AND entry_id < @entryID))
+		  ORDER BY created_at DESC, entry_id DESC LIMIT @limit`,
+		Params: map[string]interface{}{
+			"userID":  userID,
+			"at":      at,
+			"entryID": entryID,
+			"limit":   limit + 1,
+		},
+	}
+	entries := make([]domain.LedgerEntry, 0, limit+1)
+	err = d.ForEachRow(ctx, "WalletLedger", stmt, func(row *spanner.Row) error {
+		var entryID, reason string
+		var amount, balance int64
+		var referenceID spanner.NullString
+		var createdAt time.Time
+		if err := row.Columns(&entryID, &amount, &balance, &reason, &referenceID, &createdAt); err != nil {
+			return err
+		}
+		e, err := domain.NewLedgerEntry(userID, entryID, amount, balance, reason, referenceID.StringVal, createdAt)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(entries) <= limit {
+		return entries, "", nil
+	}
+	entries = entries[:limit]
+	return entries, encodeLedgerCursor(entries[limit-1]), nil
+}
+
+// entries are ordered by created_at, then entry_id for entries committed at once
+func encodeLedgerCursor(last domain.LedgerEntry) string {
+	return encodeCursor(last.CreatedAt.Format(time.RFC3339Nano) + "/" + last.EntryID)
+}
+
+// the entry to list after, the first page is after the largest timestamp
+func decodeLedgerCursor(cursor string) (time.Time, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil || after == "" {
+		return maxTimestamp, "", err
+	}
+	ts, entryID, found := strings.Cut(after, "/")
+	if !found {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	at, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil || at.Before(minTimestamp) || at.After(maxTimestamp) {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return at, entryID, nil
+}
+
+// a wallet whose balance is not the sum of its ledger
+type WalletDrift struct {
+	UserID    string `json:"user_id"`
+	Balance   int64  `json:"balance"`
+	LedgerSum int64  `json:"ledger_sum"`
+}
+
+/*
+ReconcileWallets verifies balance of every wallet equals the sum of its ledger, and returns wallets which don't.
+Wallets credited before the ledger was introduced drift by the balance of then.
+*/
+func (d dbClient) ReconcileWallets(ctx context.Context) ([]WalletDrift, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ReconcileWallets")
+	defer span.End()
+
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id, balance, ledger_sum FROM (
+		    SELECT wallets.user_id, wallets.balance,
+		      IFNULL((SELECT SUM(amount) FROM wallet_ledger WHERE wallet_ledger.user_id = wallets.user_id), 0) AS ledger_sum
+		    FROM wallets
+		  ) WHERE balance != ledger_sum`,
+	}
+	drifts := []WalletDrift{}
+	err := d.ForEachRow(ctx, "ReconcileWallets", stmt, func(row *spanner.Row) error {
+		var drift WalletDrift
+		if err := row.Columns(&drift.UserID, &drift.Balance, &drift.LedgerSum); err != nil {
+			return err
+		}
+		drifts = append(drifts, drift)
+		return nil
+	})
+	span.SetAttributes(attribute.Int("wallet.drifts", len(drifts)))
+	return drifts, err
+}
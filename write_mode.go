@@ -0,0 +1,212 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package game
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+
+	"github.com/shin5ok/go-architecting-workshop/budget"
+)
+
+/*
+WriteMode is how CreateUser and AddItemToUser write to Spanner, it's a choice to compare in the workshop:
+DML statements are sent one by one in a transaction, each costs a round trip but it can be read in the same transaction,
+mutations are buffered in the client and sent with the commit, so a blind write like CreateUser is a single Apply.
+Their latencies are in game_spanner_write_duration_milliseconds by operation and mode.
+*/
+type WriteMode string
+
+const (
+	WriteDML      WriteMode = "dml"
+	WriteMutation WriteMode = "mutation"
+)
+
+// operations which can be written by either mode
+var writeModeOperations = []string{"CreateUser", "AddItemToUser"}
+
+// WriteModes are modes by operation, operations which are not in ByOperation are written by Default
+type WriteModes struct {
+	Default     WriteMode
+	ByOperation map[string]WriteMode
+}
+
+/*
+ParseWriteModes reads config like "mutation" for all the operations,
+or "CreateUser=mutation,AddItemToUser=dml" by operation, empty is DML.
+*/
+func ParseWriteModes(config string) (WriteModes, error) {
+	modes := WriteModes{Default: WriteDML, ByOperation: map[string]WriteMode{}}
+	if config == "" {
+		return modes, nil
+	}
+	for _, part := range strings.Split(config, ",") {
+		operation, value, byOperation := strings.Cut(strings.TrimSpace(part), "=")
+		if !byOperation {
+			value = operation
+		}
+		mode := WriteMode(value)
+		if mode != WriteDML && mode != WriteMutation {
+			return WriteModes{}, fmt.Errorf("unknown write mode %q, it has to be %s or %s", value, WriteDML, WriteMutation)
+		}
+		if !byOperation {
+			modes.Default = mode
+			continue
+		}
+		if !knownWriteOperation(operation) {
+			return WriteModes{}, fmt.Errorf("write mode of %s can't be set, only of %s", operation, strings.Join(writeModeOperations, " and "))
+		}
+		modes.ByOperation[operation] = mode
+	}
+	return modes, nil
+}
+
+func knownWriteOperation(operation string) bool {
+	for _, known := range writeModeOperations {
+		if operation == known {
+			return true
+		}
+	}
+	return false
+}
+
+// the mode of the operation, DML for the zero value
+func (m WriteModes) of(operation string) WriteMode {
+	if mode, ok := m.ByOperation[operation]; ok {
+		return mode
+	}
+	if m.Default == "" {
+		return WriteDML
+	}
+	return m.Default
+}
+
+// String is the config which is parsed to the same modes
+func (m WriteModes) String() string {
+	parts := []string{string(m.of(""))}
+	for _, operation := range writeModeOperations {
+		if mode, ok := m.ByOperation[operation]; ok {
+			parts = append(parts, operation+"="+string(mode))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// record the latency of a successful write, including retries, to compare the modes
+func observeWrite(ctx context.Context, operation string, mode WriteMode, start time.Time) {
+	elapsed := float64(time.Since(start).Nanoseconds()) / 1000000
+	writeDuration.WithLabelValues(operation, string(mode)).Observe(elapsed)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("spanner.write_mode", string(mode)),
+		attribute.Float64("spanner.write.duration_ms", elapsed),
+	)
+}
+
+// the same as Client.Apply, guarded and retried like readWriteTransaction, it returns the commit timestamp
+func (d dbClient) applyMutations(ctx context.Context, name string, ms []*spanner.Mutation) (time.Time, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "applyMutations")
+	defer span.End()
+	span.SetAttributes(attribute.Int("spanner.mutations", len(ms)))
+
+	defer budget.Track(ctx, budget.Spanner)()
+	var commitTs time.Time
+	err := d.retry(ctx, name, func(ctx context.Context) (err error) {
+		commitTs, err = d.Sc.Apply(ctx, ms, spanner.TransactionTag(fmt.Sprintf("func=%s,env=dev,mode=mutation", name)))
+		return err
+	})
+	return commitTs, err
+}
+
+/*
+add the item by mutations, they are buffered and sent with the commit instead of a DML statement each.
+Unlike CreateUser it's not a single Apply, as item_count, the quantity, the sequence and the counter are read and written in the same transaction.
+The user row is read for item_count, so an unknown user is NotFound as it is by DML,
+and the row of the item is read for its quantity, a mutation can't add to a column as the UPDATE does.
+*/
+func (d dbClient) addItemByMutations(ctx context.Context, userID, itemID string, quantity int64) (spanner.CommitResponse, int64, error) {
+	var seq int64
+	resp, err := d.readWriteTransaction(ctx, "AddItemToUser", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"item_count"})
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := row.Columns(&count); err != nil {
+			return err
+		}
+
+		var ms []*spanner.Mutation
+		// the item as it's owned before the add, nil if it isn't
+		var before interface{}
+		after := auditedItem{ItemID: itemID, Quantity: quantity}
+		row, err = txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"quantity"})
+		switch spanner.ErrCode(err) {
+		case codes.OK:
+			var owned int64
+			if err := row.Columns(&owned); err != nil {
+				return err
+			}
+			before = auditedItem{ItemID: itemID, Quantity: owned}
+			after.Quantity += owned
+			ms = append(ms, spanner.UpdateMap("user_items", map[string]interface{}{
+				"user_id":    userID,
+				"item_id":    itemID,
+				"quantity":   after.Quantity,
+				"updated_at": spanner.CommitTimestamp,
+			}))
+		case codes.NotFound:
+			ms = append(ms,
+				spanner.InsertMap("user_items", map[string]interface{}{
+					"user_id":    userID,
+					"item_id":    itemID,
+					"quantity":   quantity,
+					"created_at": time.Now(),
+					"updated_at": spanner.CommitTimestamp,
+				}),
+				spanner.UpdateMap("users", map[string]interface{}{
+					"user_id":    userID,
+					"item_count": count + 1,
+				}),
+			)
+		default:
+			return err
+		}
+		audit, err := auditMutation(ctx, userID, AuditAddItem, before, after)
+		if err != nil {
+			return err
+		}
+		if err := txn.BufferWrite(append(ms, audit)); err != nil {
+			return err
+		}
+		if err := addCounter(ctx, txn, CounterItemsGranted, quantity); err != nil {
+			return err
+		}
+		if seq, err = nextUserSeq(ctx, txn, userID); err != nil {
+			return err
+		}
+		return d.stageChanges(txn, userID, seq, []string{itemID}, EventItemAdded)
+	})
+	return resp, seq, err
+}